@@ -11,6 +11,12 @@
 
 package cbft
 
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
 // Cfg is the interface that configuration providers must implement.
 type Cfg interface {
 	// Get retrieves an entry from the Cfg.  A zero cas means don't do
@@ -51,3 +57,59 @@ type CfgEvent struct {
 	Key string
 	CAS uint64
 }
+
+// ------------------------------------------------------------------------
+
+// The max number of CAS mismatches that CfgUpdate() retries.
+var CfgUpdateMaxRetries = 100
+
+// The initial max backoff in millisecs between CfgUpdate() retries,
+// which doubles on each retry, up to 64x.  The actual backoff is
+// jittered, so that racing updaters, like nodes all registering
+// themselves after a datacenter power restart, spread out.
+var CfgUpdateBackoffMS = 10
+
+// CfgUpdate performs a read-modify-write of Cfg entries, retrying
+// the whole cycle on a CAS mismatch, so that mutate always sees the
+// freshest state from get.  The get func should retrieve the entries
+// (usually into variables that it shares with mutate and set) and
+// return their cas.  The mutate func should modify the retrieved
+// entries, returning false when no write is needed.  The set func
+// should write the entries with the cas, returning a *CfgCASError on
+// a CAS mismatch.
+func CfgUpdate(get func() (uint64, error),
+	mutate func() (bool, error),
+	set func(cas uint64) error) error {
+	for retries := 0; ; retries++ {
+		cas, err := get()
+		if err != nil {
+			return err
+		}
+
+		changed, err := mutate()
+		if err != nil || !changed {
+			return err
+		}
+
+		err = set(cas)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*CfgCASError); !ok {
+			return err
+		}
+
+		if retries >= CfgUpdateMaxRetries {
+			return fmt.Errorf("error: CfgUpdate, too many CAS mismatches,"+
+				" retries: %d, err: %v", retries, err)
+		}
+
+		shift := uint(retries)
+		if shift > 6 {
+			shift = 6
+		}
+		if backoffMS := CfgUpdateBackoffMS << shift; backoffMS > 0 {
+			time.Sleep(time.Duration(rand.Intn(backoffMS)) * time.Millisecond)
+		}
+	}
+}
@@ -15,7 +15,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"runtime"
+	"strconv"
 	"testing"
 )
 
@@ -355,3 +357,131 @@ func TestCfgCB(t *testing.T) {
 		t.Errorf("expected NewCfgCB to fail on bogus url")
 	}
 }
+
+// CASConflictCfg fails the next numConflicts Set()'s with a
+// CfgCASError, after first letting a racing writer change the Cfg.
+type CASConflictCfg struct {
+	Cfg
+	numConflicts int
+	race         func(cfg Cfg)
+}
+
+func (c *CASConflictCfg) Set(key string, val []byte, cas uint64) (
+	uint64, error) {
+	if c.numConflicts > 0 {
+		c.numConflicts--
+		c.race(c.Cfg)
+		return 0, &CfgCASError{}
+	}
+	return c.Cfg.Set(key, val, cas)
+}
+
+func TestCfgUpdate(t *testing.T) {
+	defer func(backoffMS int) { CfgUpdateBackoffMS = backoffMS }(CfgUpdateBackoffMS)
+	CfgUpdateBackoffMS = 1
+
+	inner := NewCfgMem()
+	inner.Set("counter", []byte("0"), 0)
+
+	cfg := &CASConflictCfg{
+		Cfg:          inner,
+		numConflicts: 3,
+		race: func(cfg Cfg) { // Another writer increments the counter.
+			val, cas, _ := cfg.Get("counter", 0)
+			n, _ := strconv.Atoi(string(val))
+			cfg.Set("counter", []byte(strconv.Itoa(n+1)), cas)
+		},
+	}
+
+	var n int
+	var seen []int
+	err := CfgUpdate(
+		func() (uint64, error) {
+			val, cas, err := cfg.Get("counter", 0)
+			if err == nil {
+				n, err = strconv.Atoi(string(val))
+			}
+			return cas, err
+		},
+		func() (bool, error) {
+			seen = append(seen, n)
+			n += 10
+			return true, nil
+		},
+		func(cas uint64) error {
+			_, err := cfg.Set("counter", []byte(strconv.Itoa(n)), cas)
+			return err
+		})
+	if err != nil {
+		t.Errorf("expected CfgUpdate to work, err: %v", err)
+	}
+	if !reflect.DeepEqual(seen, []int{0, 1, 2, 3}) {
+		t.Errorf("expected mutate to see fresh state, got: %v", seen)
+	}
+	val, _, _ := inner.Get("counter", 0)
+	if string(val) != "13" {
+		t.Errorf("expected counter 13, got: %s", val)
+	}
+
+	// A mutate that needs no write skips the set.
+	err = CfgUpdate(
+		func() (uint64, error) { return 0, nil },
+		func() (bool, error) { return false, nil },
+		func(cas uint64) error {
+			t.Errorf("expected no set")
+			return nil
+		})
+	if err != nil {
+		t.Errorf("expected no-op CfgUpdate to work, err: %v", err)
+	}
+
+	// The retries are bounded.
+	defer func(maxRetries int) { CfgUpdateMaxRetries = maxRetries }(CfgUpdateMaxRetries)
+	CfgUpdateMaxRetries = 2
+
+	sets := 0
+	err = CfgUpdate(
+		func() (uint64, error) { return 0, nil },
+		func() (bool, error) { return true, nil },
+		func(cas uint64) error {
+			sets++
+			return &CfgCASError{}
+		})
+	if err == nil || sets != 3 {
+		t.Errorf("expected bounded retries, sets: %d, err: %v", sets, err)
+	}
+}
+
+func TestSaveNodeDefCASRetry(t *testing.T) {
+	defer func(backoffMS int) { CfgUpdateBackoffMS = backoffMS }(CfgUpdateBackoffMS)
+	CfgUpdateBackoffMS = 1
+
+	cfg := &CASConflictCfg{
+		Cfg:          NewCfgMem(),
+		numConflicts: 2,
+		race: func(cfg Cfg) { // Another node registers itself.
+			nodeDefs, cas, _ := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+			if nodeDefs == nil {
+				nodeDefs = NewNodeDefs(VERSION)
+			}
+			nodeDefs.NodeDefs["other:1000"] = &NodeDef{
+				HostPort: "other:1000", UUID: "other",
+			}
+			CfgSetNodeDefs(cfg, NODE_DEFS_KNOWN, nodeDefs, cas)
+		},
+	}
+
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, "self:1000",
+		"", "some-datasource", nil)
+	err := mgr.SaveNodeDef(NODE_DEFS_KNOWN, false)
+	if err != nil {
+		t.Errorf("expected SaveNodeDef to work, err: %v", err)
+	}
+
+	nodeDefs, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if err != nil || nodeDefs == nil ||
+		nodeDefs.NodeDefs["self:1000"] == nil ||
+		nodeDefs.NodeDefs["other:1000"] == nil {
+		t.Errorf("expected both nodeDefs, got: %#v, err: %v", nodeDefs, err)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 
@@ -59,6 +60,9 @@ var register = flag.String("register", "wanted",
 	"register this node as wanted, wantedForce, known, knownForce or notRegistered")
 var cfgConnect = flag.String("cfgConnect", "simple",
 	"connection string/info to configuration provider")
+var options = flag.String("options", "",
+	"optional comma-separated key=value pairs for advanced configuration,"+
+		" like quarantineCorruptPIndexes=true or numVBuckets=64")
 
 var expvars = expvar.NewMap("stats")
 
@@ -102,8 +106,24 @@ func main() {
 		tagsArr = strings.Split(*tags, ",")
 	}
 
+	optionsMap, err := MainOptions(*options)
+	if err != nil {
+		log.Fatalf("error: could not parse options: %s, err: %v", *options, err)
+		return
+	}
+
+	if v, exists := optionsMap["numVBuckets"]; exists {
+		numVBuckets, err := strconv.Atoi(v)
+		if err != nil || numVBuckets <= 0 {
+			log.Fatalf("error: could not parse numVBuckets option: %s", v)
+			return
+		}
+		cbft.SetNumVBuckets(numVBuckets)
+	}
+
 	router, err := MainStart(cfg, uuid, tagsArr, *container, *weight,
-		*bindAddr, *dataDir, *staticDir, *staticETag, *server, *register, mr)
+		*bindAddr, *dataDir, *staticDir, *staticETag, *server, *register, mr,
+		optionsMap)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -144,9 +164,25 @@ func MainUUID(dataDir string) (string, error) {
 	return uuid, nil
 }
 
+// Parses a comma-separated list of key=value pairs.
+func MainOptions(s string) (map[string]string, error) {
+	rv := map[string]string{}
+	if s == "" {
+		return rv, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		a := strings.SplitN(kv, "=", 2)
+		if len(a) != 2 || a[0] == "" {
+			return nil, fmt.Errorf("error: options entry not key=value: %s", kv)
+		}
+		rv[a[0]] = a[1]
+	}
+	return rv, nil
+}
+
 func MainStart(cfg cbft.Cfg, uuid string, tags []string, container string,
 	weight int, bindAddr, dataDir, staticDir, staticETag, server string,
-	register string, mr *cbft.MsgRing) (
+	register string, mr *cbft.MsgRing, options map[string]string) (
 	*mux.Router, error) {
 	if server == "" {
 		return nil, fmt.Errorf("error: server URL required (-server)")
@@ -158,8 +194,8 @@ func MainStart(cfg cbft.Cfg, uuid string, tags []string, container string,
 			server, err)
 	}
 
-	mgr := cbft.NewManager(cbft.VERSION, cfg, uuid, tags, container, weight,
-		bindAddr, dataDir, server, &MainHandlers{})
+	mgr := cbft.NewManagerEx(cbft.VERSION, cfg, uuid, tags, container, weight,
+		bindAddr, dataDir, server, &MainHandlers{}, options)
 	err = mgr.Start(register)
 	if err != nil {
 		return nil, err
@@ -181,6 +217,11 @@ func (meh *MainHandlers) OnUnregisterPIndex(pindex *cbft.PIndex) {
 	bleveHttp.UnregisterIndexByName(pindex.Name)
 }
 
+func (meh *MainHandlers) OnFeedError(srcType string, r cbft.Feed, err error) {
+	log.Printf("main: feed error, srcType: %s, name: %s, err: %v",
+		srcType, r.Name(), err)
+}
+
 func dumpOnSignal(signals ...os.Signal) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, signals...)
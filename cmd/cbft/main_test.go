@@ -25,18 +25,35 @@ func TestMainStart(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	router, err := MainStart(nil, cbft.NewUUID(), nil, "", 1, ":1000",
-		"bad data dir", "./static", "etag", "", "", mr)
+		"bad data dir", "./static", "etag", "", "", mr, nil)
 	if router != nil || err == nil {
 		t.Errorf("expected empty server string to fail mainStart()")
 	}
 
 	router, err = MainStart(nil, cbft.NewUUID(), nil, "", 1, ":1000",
-		"bad data dir", "./static", "etag", "bad server", "", mr)
+		"bad data dir", "./static", "etag", "bad server", "", mr, nil)
 	if router != nil || err == nil {
 		t.Errorf("expected bad server string to fail mainStart()")
 	}
 }
 
+func TestMainOptions(t *testing.T) {
+	m, err := MainOptions("")
+	if err != nil || m == nil || len(m) != 0 {
+		t.Errorf("expected empty options to work, m: %#v, err: %v", m, err)
+	}
+
+	m, err = MainOptions("a=b,c=d=e")
+	if err != nil || len(m) != 2 || m["a"] != "b" || m["c"] != "d=e" {
+		t.Errorf("expected options to parse, m: %#v, err: %v", m, err)
+	}
+
+	m, err = MainOptions("a=b,not-a-key-value")
+	if err == nil || m != nil {
+		t.Errorf("expected err on bad options")
+	}
+}
+
 func TestMainUUID(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
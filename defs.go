@@ -73,6 +73,10 @@ type NodeDef struct {
 	Tags        []string `json:"tags"`
 	Container   string   `json:"container"`
 	Weight      int      `json:"weight"`
+
+	// Unix millisecs of the node's last heartbeat, only maintained in
+	// the known NodeDefs, where 0 means the node never heartbeated.
+	LastHeartbeat int64 `json:"lastHeartbeat,omitempty"`
 }
 
 // ------------------------------------------------------------------------
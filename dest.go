@@ -80,6 +80,135 @@ type Dest interface {
 		cancelCh chan struct{}) error
 }
 
+// DestSeqs is an optional interface that a Dest may implement to
+// report the progress of a partition, such as for readiness checks.
+type DestSeqs interface {
+	// Returns the max seq received for the partition and the end seq
+	// of the partition's current snapshot, which are both 0 for a
+	// partition that hasn't received any data.
+	PartitionSeqs(partition string) (seqMax, seqSnapEnd uint64, err error)
+}
+
+// DestManagerHandler is an optional interface that a Dest may
+// implement to share the resources of its owning Manager, like a
+// budget that spans all the Manager's dests.  The Manager is set
+// before the Dest receives any data.
+type DestManagerHandler interface {
+	SetManager(mgr *Manager)
+}
+
+// DestRollbackHandler is an optional interface that a Dest may
+// implement to let its owner, like the Manager, decide what happens
+// after the Dest has discarded its data due to a rollback, instead of
+// the Dest always invoking its restart callback.
+type DestRollbackHandler interface {
+	// The handler is invoked with the rolled back partition, the
+	// rollbackSeq requested by the data source, and the partition's
+	// max seq received before the rollback.
+	SetRollbackHandler(handler func(partition string,
+		rollbackSeq, seqMax uint64))
+}
+
+// DestConsistencyWaiters is an optional interface that a Dest may
+// implement to report its pending consistency waits, such as to
+// diagnose queries that never return due to a lagging partition.
+type DestConsistencyWaiters interface {
+	// Returns the partitions that have pending consistency waits,
+	// keyed by partition.
+	ConsistencyWaiters() map[string]*PartitionConsistencyWaiters
+}
+
+// DestIngestLag is an optional interface that a Dest may implement to
+// report the distribution of the time from when mutations are
+// received to when they're applied, which reveals indexing tail
+// latency that counters hide.
+type DestIngestLag interface {
+	IngestLag() *LatencyHistogramStats
+}
+
+// DestDocsTooLarge is an optional interface that a Dest may implement
+// to report how many documents it skipped rather than indexed as they
+// exceeded its max document size.
+type DestDocsTooLarge interface {
+	NumDocsTooLarge() uint64
+}
+
+// PartitionConsistencyWaiters is a snapshot of the consistency waits
+// that are pending on a partition.
+type PartitionConsistencyWaiters struct {
+	SeqMax      uint64               `json:"seqMax"`      // Max seq received.
+	SeqMaxBatch uint64               `json:"seqMaxBatch"` // Max seq applied.
+	Waiters     []*ConsistencyWaiter `json:"waiters"`
+}
+
+type ConsistencyWaiter struct {
+	ConsistencyLevel string `json:"consistencyLevel"`
+	ConsistencySeq   uint64 `json:"consistencySeq"`
+	WaitNS           int64  `json:"waitNS"`    // How long it's waited so far.
+	Cancelled        bool   `json:"cancelled"` // Its caller has given up.
+}
+
+// DestOpaqueApplied is an optional interface that a Dest may
+// implement when it receives mutations ahead of durably applying
+// them, such as by batching.
+type DestOpaqueApplied interface {
+	// Like GetOpaque(), but returns the max seq that's been applied,
+	// rather than merely received, which is where a restarted feed
+	// should resume so that it neither skips nor needlessly resends
+	// mutations.
+	GetOpaqueApplied(partition string) (
+		value []byte, lastSeqApplied uint64, err error)
+}
+
+// DestFlush is an optional interface that a Dest may implement when
+// it buffers mutations ahead of applying them, so that recently
+// received mutations can be made queryable right away, such as for
+// tests or for a consistent read after a burst of writes.
+type DestFlush interface {
+	// Synchronously applies the received mutations of all partitions.
+	Flush() error
+}
+
+// A DestMutation is a single data update or deletion, as delivered
+// in a batch to a DestBatch.
+type DestMutation struct {
+	Key    []byte
+	Seq    uint64
+	Val    []byte
+	Delete bool // When true, this is a deletion and Val is ignored.
+}
+
+// DestBatch is an optional interface that a Dest may implement to
+// receive many mutations of a partition in a single call, such as
+// all the mutations of a snapshot, to reduce per-mutation overhead
+// like locking.  The Dest implementation is responsible for making
+// its own copies of the key and val data.
+type DestBatch interface {
+	OnDataUpdateBatch(partition string, mutations []DestMutation) error
+}
+
+// DestOnDataUpdateBatch delivers mutations to a dest via DestBatch,
+// if the dest implements it, or else via one OnDataUpdate() or
+// OnDataDelete() call per mutation.
+func DestOnDataUpdateBatch(dest Dest, partition string,
+	mutations []DestMutation) error {
+	if db, ok := dest.(DestBatch); ok {
+		return db.OnDataUpdateBatch(partition, mutations)
+	}
+	for _, m := range mutations {
+		var err error
+		if m.Delete {
+			err = dest.OnDataDelete(partition, m.Key, m.Seq)
+		} else {
+			err = dest.OnDataUpdate(partition, m.Key, m.Seq, m.Val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type DestPartitionFunc func(partition string, key []byte,
 	dests map[string]Dest) (Dest, error)
 
@@ -118,6 +118,31 @@ func (t *DestFeed) OnDataDelete(partition string,
 	return dest.OnDataDelete(partition, key, seq)
 }
 
+func (t *DestFeed) OnDataUpdateBatch(partition string,
+	mutations []DestMutation) error {
+	// Forward runs of mutations that map to the same dest together.
+	var destCurr Dest
+	start := 0
+	for i, m := range mutations {
+		dest, err := t.pf(partition, m.Key, t.dests)
+		if err != nil {
+			return fmt.Errorf("error: DestFeed pf, err: %v", err)
+		}
+		if destCurr != nil && dest != destCurr {
+			err = DestOnDataUpdateBatch(destCurr, partition, mutations[start:i])
+			if err != nil {
+				return err
+			}
+			start = i
+		}
+		destCurr = dest
+	}
+	if destCurr != nil {
+		return DestOnDataUpdateBatch(destCurr, partition, mutations[start:])
+	}
+	return nil
+}
+
 func (t *DestFeed) OnSnapshotStart(partition string,
 	snapStart, snapEnd uint64) error {
 	dest, err := t.pf(partition, nil, t.dests)
@@ -145,6 +170,18 @@ func (t *DestFeed) GetOpaque(partition string) (
 	return dest.GetOpaque(partition)
 }
 
+func (t *DestFeed) GetOpaqueApplied(partition string) (
+	value []byte, lastSeqApplied uint64, err error) {
+	dest, err := t.pf(partition, nil, t.dests)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error: DestFeed pf, err: %v", err)
+	}
+	if destOpaqueApplied, ok := dest.(DestOpaqueApplied); ok {
+		return destOpaqueApplied.GetOpaqueApplied(partition)
+	}
+	return dest.GetOpaque(partition)
+}
+
 func (t *DestFeed) Rollback(partition string,
 	rollbackSeq uint64) error {
 	dest, err := t.pf(partition, nil, t.dests)
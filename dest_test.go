@@ -13,8 +13,21 @@ package cbft
 
 import (
 	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve"
 )
 
 type TestDest struct{}
@@ -137,3 +150,2132 @@ func TestDestFeed(t *testing.T) {
 		t.Errorf("expected err on querying a dest feed")
 	}
 }
+
+// A BatchDest records the batches it receives via DestBatch.
+type BatchDest struct {
+	TestDest
+
+	batches [][]DestMutation
+}
+
+func (s *BatchDest) OnDataUpdateBatch(partition string,
+	mutations []DestMutation) error {
+	s.batches = append(s.batches, mutations)
+	return nil
+}
+
+func TestDestOnDataUpdateBatch(t *testing.T) {
+	mutations := []DestMutation{
+		{Key: []byte("a"), Seq: 1, Val: []byte("x")},
+		{Key: []byte("b"), Seq: 2, Delete: true},
+		{Key: []byte("c"), Seq: 3, Val: []byte("y")},
+	}
+
+	od := &OrderingDest{}
+	if err := DestOnDataUpdateBatch(od, "0", mutations); err != nil {
+		t.Errorf("expected fallback to per-op methods to work, err: %v", err)
+	}
+	if fmt.Sprintf("%v", od.calls) != "[update-1 update-3]" {
+		t.Errorf("expected per-op updates, got: %v", od.calls)
+	}
+
+	bd := &BatchDest{}
+	if err := DestOnDataUpdateBatch(bd, "0", mutations); err != nil {
+		t.Errorf("expected batch to work, err: %v", err)
+	}
+	if len(bd.batches) != 1 || len(bd.batches[0]) != 3 {
+		t.Errorf("expected a single batch, got: %#v", bd.batches)
+	}
+
+	df := NewDestFeed("", BasicPartitionFunc, map[string]Dest{"0": bd})
+	if err := df.OnDataUpdateBatch("0", mutations); err != nil {
+		t.Errorf("expected DestFeed batch to work, err: %v", err)
+	}
+	if len(bd.batches) != 2 || len(bd.batches[1]) != 3 {
+		t.Errorf("expected DestFeed to forward a single batch, got: %#v",
+			bd.batches)
+	}
+	if df.OnDataUpdateBatch("unknown-partition", mutations) == nil {
+		t.Errorf("expected err on bad partition")
+	}
+}
+
+func benchmarkBleveDest(b *testing.B, batchSize int) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		b.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	// A far off snapshot end, so only buffer size triggers applies.
+	dest.OnSnapshotStart("0", 1, uint64(b.N)+1)
+
+	val := []byte(`{"x":"hello world"}`)
+	mutations := make([]DestMutation, 0, batchSize)
+
+	b.ResetTimer()
+
+	for i := 1; i <= b.N; i++ {
+		key := []byte(fmt.Sprintf("%d", i))
+		if batchSize <= 1 {
+			dest.OnDataUpdate("0", key, uint64(i), val)
+			continue
+		}
+		mutations = append(mutations,
+			DestMutation{Key: key, Seq: uint64(i), Val: val})
+		if len(mutations) >= batchSize || i == b.N {
+			DestOnDataUpdateBatch(dest, "0", mutations)
+			mutations = mutations[0:0]
+		}
+	}
+}
+
+func BenchmarkBleveDestOnDataUpdate(b *testing.B) {
+	benchmarkBleveDest(b, 1)
+}
+
+func BenchmarkBleveDestOnDataUpdateBatch100(b *testing.B) {
+	benchmarkBleveDest(b, 100)
+}
+
+// Compares the indexing throughput of the durability policies, where
+// every batch is its own snapshot, so that each batch is committed.
+func benchmarkBleveDestDurability(b *testing.B, durability string) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve",
+		`{"durability":"`+durability+`"}`,
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		b.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	val := []byte(`{"x":"hello world"}`)
+	mutations := make([]DestMutation, 0, 10)
+
+	b.ResetTimer()
+
+	for i := 1; i <= b.N; i++ {
+		mutations = append(mutations, DestMutation{
+			Key: []byte(fmt.Sprintf("%d", i)), Seq: uint64(i), Val: val})
+		if len(mutations) >= cap(mutations) || i == b.N {
+			dest.OnSnapshotStart("0", mutations[0].Seq, uint64(i))
+			DestOnDataUpdateBatch(dest, "0", mutations)
+			mutations = mutations[0:0]
+		}
+	}
+}
+
+func BenchmarkBleveDestDurabilitySafe(b *testing.B) {
+	benchmarkBleveDestDurability(b, BLEVE_DURABILITY_SAFE)
+}
+
+func BenchmarkBleveDestDurabilityFast(b *testing.B) {
+	benchmarkBleveDestDurability(b, BLEVE_DURABILITY_FAST)
+}
+
+func TestBleveDestForceFlush(t *testing.T) {
+	// Returns how long an at_plus consistency wait took for a seq
+	// that was received, but whose snapshot hasn't ended.
+	waitLatency := func(forceFlushMS int, numWaiters int) (
+		time.Duration, error) {
+		emptyDir, _ := ioutil.TempDir("./tmp", "test")
+		defer os.RemoveAll(emptyDir)
+
+		_, dest, err := NewBlevePIndexImpl("bleve",
+			fmt.Sprintf(`{"forceFlushMS":%d}`, forceFlushMS),
+			emptyDir+string(os.PathSeparator)+"bleve", func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		defer dest.Close()
+
+		dest.OnSnapshotStart("0", 1, 100)
+		dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"y"}`))
+
+		cancelCh := make(chan struct{})
+		time.AfterFunc(500*time.Millisecond, func() { close(cancelCh) })
+
+		start := time.Now()
+
+		errCh := make(chan error, numWaiters)
+		for i := 0; i < numWaiters; i++ {
+			go func() {
+				errCh <- dest.ConsistencyWait("0", "at_plus", 1, cancelCh)
+			}()
+		}
+		for i := 0; i < numWaiters; i++ {
+			if err = <-errCh; err != nil {
+				break
+			}
+		}
+
+		return time.Since(start), err
+	}
+
+	latency, err := waitLatency(0, 1)
+	if err == nil {
+		t.Errorf("expected wait without forced flush to block until"+
+			" cancelled, latency: %v", latency)
+	}
+
+	latency, err = waitLatency(10, 1)
+	if err != nil || latency >= 500*time.Millisecond {
+		t.Errorf("expected forced flush to bound wait latency,"+
+			" latency: %v, err: %v", latency, err)
+	}
+
+	latency, err = waitLatency(10, 10)
+	if err != nil || latency >= 500*time.Millisecond {
+		t.Errorf("expected forced flush to satisfy many waiters,"+
+			" latency: %v, err: %v", latency, err)
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, _, err = NewBlevePIndexImpl("bleve", `{"forceFlushMS":-1}`,
+		emptyDir+string(os.PathSeparator)+"bad", func() {})
+	if err == nil {
+		t.Errorf("expected a negative forceFlushMS to be invalid")
+	}
+}
+
+func TestBleveDestSnapshotAtomic(t *testing.T) {
+	bip, rest, err := ParseBleveIndexParams(`{"snapshotAtomic":true}`)
+	if err != nil || !bip.SnapshotAtomic || rest != "{}" {
+		t.Errorf("expected snapshotAtomic to be parsed and removed,"+
+			" bip: %#v, rest: %s, err: %v", bip, rest, err)
+	}
+
+	// Returns the doc count seen after 2 of the 3 mutations of a
+	// snapshot, and after the entire snapshot.
+	docCounts := func(indexParams string) (uint64, uint64) {
+		emptyDir, _ := ioutil.TempDir("./tmp", "test")
+		defer os.RemoveAll(emptyDir)
+
+		impl, dest, err := NewBlevePIndexImpl("bleve", indexParams,
+			emptyDir+string(os.PathSeparator)+"bleve", func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		defer dest.Close()
+		bindex := impl.(bleve.Index)
+
+		dest.OnSnapshotStart("0", 1, 3)
+		dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"y"}`))
+		dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"y"}`))
+
+		// Give any forced flush a chance to happen.
+		time.Sleep(50 * time.Millisecond)
+
+		mid, _ := bindex.DocCount()
+
+		dest.OnDataUpdate("0", []byte("c"), 3, []byte(`{"x":"y"}`))
+
+		end, _ := bindex.DocCount()
+
+		return mid, end
+	}
+
+	mid, end := docCounts(`{"snapshotAtomic":true,"forceFlushMS":1}`)
+	if mid != 0 || end != 3 {
+		t.Errorf("expected no mid-snapshot visibility with snapshotAtomic,"+
+			" mid: %d, end: %d", mid, end)
+	}
+
+	mid, end = docCounts(`{"forceFlushMS":1}`)
+	if end != 3 {
+		t.Errorf("expected all docs at snapshot end, mid: %d, end: %d",
+			mid, end)
+	}
+}
+
+func TestBleveDestDocIdTransform(t *testing.T) {
+	RegisterBleveDocIdTransform("testPrefix",
+		func(partition string, key []byte) string {
+			return "pre:" + string(key)
+		})
+
+	if ValidateBlevePIndexImpl("bleve", "idx",
+		`{"docIdTransform":"not-a-transform"}`) == nil {
+		t.Errorf("expected validation to fail on an unknown docIdTransform")
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, _, err := NewBlevePIndexImpl("bleve", `{"docIdTransform":"not-a-transform"}`,
+		emptyDir+string(os.PathSeparator)+"bad", func() {})
+	if err == nil {
+		t.Errorf("expected NewBlevePIndexImpl to fail on an unknown docIdTransform")
+	}
+
+	// Returns the sorted IDs of docs matching "y" after indexing a
+	// few docs and deleting one of them.
+	docIds := func(name, indexParams, partition string) []string {
+		impl, dest, err := NewBlevePIndexImpl("bleve", indexParams,
+			emptyDir+string(os.PathSeparator)+name, func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		defer dest.Close()
+
+		dest.OnSnapshotStart(partition, 1, 3)
+		dest.OnDataUpdate(partition, []byte("a"), 1, []byte(`{"x":"y"}`))
+		dest.OnDataUpdate(partition, []byte("b"), 2, []byte(`{"x":"y"}`))
+		dest.OnDataDelete(partition, []byte("a"), 3)
+
+		res, err := impl.(bleve.Index).Search(
+			bleve.NewSearchRequest(bleve.NewMatchQuery("y")))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		rv := []string{}
+		for _, hit := range res.Hits {
+			rv = append(rv, hit.ID)
+		}
+		sort.Strings(rv)
+		return rv
+	}
+
+	tests := []struct {
+		indexParams string
+		partition   string
+		expected    string
+	}{
+		{"", "0", "b"},
+		{`{"docIdTransform":"identity"}`, "0", "b"},
+		{`{"docIdTransform":"testPrefix"}`, "0", "pre:b"},
+		{`{"docIdTransform":"namespacePrefix"}`, "beer-sample/0", "beer-sample/b"},
+		{`{"docIdTransform":"namespacePrefix"}`, "0", "b"},
+	}
+	for i, test := range tests {
+		got := docIds(fmt.Sprintf("idx%d", i), test.indexParams, test.partition)
+		if strings.Join(got, ",") != test.expected {
+			t.Errorf("test %d, expected: %s, got: %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestBleveDestDocTransform(t *testing.T) {
+	RegisterBleveDocTransform("testExtractDoc",
+		func(partition string, key, val []byte) (interface{}, error) {
+			var v struct {
+				Doc map[string]interface{} `json:"doc"`
+			}
+			err := json.Unmarshal(val, &v)
+			if err != nil || v.Doc == nil {
+				return nil, err
+			}
+			return v.Doc, nil
+		})
+	RegisterBleveDocTransform("testSkipPrivate",
+		func(partition string, key, val []byte) (interface{}, error) {
+			if strings.HasPrefix(string(key), "private") {
+				return nil, nil
+			}
+			return val, nil
+		})
+
+	if ValidateBlevePIndexImpl("bleve", "idx",
+		`{"docTransform":"not-a-transform"}`) == nil {
+		t.Errorf("expected validation to fail on an unknown docTransform")
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	// Returns the sorted IDs of docs matching each of the terms.
+	docIds := func(name, indexParams string, terms ...string) []string {
+		impl, dest, err := NewBlevePIndexImpl("bleve", indexParams,
+			emptyDir+string(os.PathSeparator)+name, func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		defer dest.Close()
+
+		dest.OnSnapshotStart("0", 1, 2)
+		dest.OnDataUpdate("0", []byte("a"), 1,
+			[]byte(`{"doc":{"x":"yes"},"x":"zap"}`))
+		dest.OnDataUpdate("0", []byte("privateB"), 2,
+			[]byte(`{"x":"yes"}`))
+
+		rv := []string{}
+		for _, term := range terms {
+			res, err := impl.(bleve.Index).Search(
+				bleve.NewSearchRequest(bleve.NewMatchQuery(term)))
+			if err != nil {
+				t.Fatalf("expected Search to work, err: %v", err)
+			}
+			ids := []string{}
+			for _, hit := range res.Hits {
+				ids = append(ids, hit.ID)
+			}
+			sort.Strings(ids)
+			rv = append(rv, strings.Join(ids, ","))
+		}
+		return rv
+	}
+
+	tests := []struct {
+		indexParams string
+		expectYes   string
+		expectZap   string
+	}{
+		{"", "a,privateB", "a"},
+		{`{"docTransform":"passthrough"}`, "a,privateB", "a"},
+		{`{"docTransform":"testExtractDoc"}`, "a", ""},
+		{`{"docTransform":"testSkipPrivate"}`, "a", "a"},
+	}
+	for i, test := range tests {
+		got := docIds(fmt.Sprintf("idx%d", i), test.indexParams, "yes", "zap")
+		if got[0] != test.expectYes || got[1] != test.expectZap {
+			t.Errorf("test %d, expected yes: %s, zap: %s, got: %v",
+				i, test.expectYes, test.expectZap, got)
+		}
+	}
+}
+
+func TestBleveDestTombstones(t *testing.T) {
+	defer func(prev func() time.Time) { bleveDestTimeNow = prev }(bleveDestTimeNow)
+	now := time.Now()
+	bleveDestTimeNow = func() time.Time { return now }
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", `{"tombstoneTTL":1000}`,
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+	bindex := impl.(bleve.Index)
+	bdest := dest.(*BleveDest)
+
+	// Returns the sorted IDs of the tombstones.
+	tombstones := func() string {
+		min := 0.0
+		query := bleve.NewNumericRangeQuery(&min, nil)
+		query.SetField(BLEVE_DEST_TOMBSTONE_FIELD)
+		res, err := bindex.Search(bleve.NewSearchRequest(query))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+
+	dest.OnSnapshotStart("0", 1, 3)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"y"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"y"}`))
+	dest.OnDataDelete("0", []byte("a"), 3)
+
+	count, err := bindex.DocCount()
+	if err != nil || count != 2 || tombstones() != "a" {
+		t.Errorf("expected a tombstone for the deleted doc, count: %d,"+
+			" tombstones: %s, err: %v", count, tombstones(), err)
+	}
+
+	// Queries and counts exclude the tombstones, unless asked not to.
+	for _, includeTombstones := range []bool{false, true} {
+		qindex := &bleveDestIndex{Index: bindex, bdest: bdest,
+			includeTombstones: includeTombstones}
+		res, err := qindex.Search(
+			bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+		count, err2 := qindex.DocCount()
+		expTotal := uint64(1)
+		if includeTombstones {
+			expTotal = 2
+		}
+		if err != nil || err2 != nil ||
+			res.Total != expTotal || count != expTotal {
+			t.Errorf("includeTombstones: %t, expected total: %d,"+
+				" got: %v, count: %d, err: %v, err2: %v",
+				includeTombstones, expTotal, res, count, err, err2)
+		}
+	}
+
+	n, err := bdest.PurgeTombstones()
+	if err != nil || n != 0 || tombstones() != "a" {
+		t.Errorf("expected a young tombstone to be kept, n: %d, err: %v", n, err)
+	}
+
+	// A later tombstone, and a recreated doc that's no longer a tombstone.
+	now = now.Add(600 * time.Millisecond)
+	dest.OnSnapshotStart("0", 4, 5)
+	dest.OnDataDelete("0", []byte("b"), 4)
+	dest.OnDataUpdate("0", []byte("a"), 5, []byte(`{"x":"y"}`))
+	if tombstones() != "b" {
+		t.Errorf("expected only b to be a tombstone, got: %s", tombstones())
+	}
+
+	now = now.Add(600 * time.Millisecond)
+	dest.OnSnapshotStart("0", 6, 6)
+	dest.OnDataDelete("0", []byte("a"), 6)
+
+	// Only b's tombstone is now older than the TTL.
+	now = now.Add(500 * time.Millisecond)
+	n, err = bdest.PurgeTombstones()
+	if err != nil || n != 1 || tombstones() != "a" {
+		t.Errorf("expected the expired tombstone to be purged, n: %d,"+
+			" tombstones: %s, err: %v", n, tombstones(), err)
+	}
+
+	count, err = bindex.DocCount()
+	if err != nil || count != 1 {
+		t.Errorf("expected only the young tombstone, count: %d, err: %v",
+			count, err)
+	}
+
+	// A doc that's recreated while the purge searches isn't purged.
+	now = now.Add(2000 * time.Millisecond)
+	bindexes, q, err := bdest.startPurge()
+	if err != nil {
+		t.Fatalf("expected startPurge to work, err: %v", err)
+	}
+	res, err := bindexes[0].Search(bleve.NewSearchRequest(
+		newBleveTombstoneQuery(nil, nil)))
+	q.release()
+	if err != nil || len(res.Hits) != 1 {
+		t.Fatalf("expected the expired tombstone, res: %v, err: %v", res, err)
+	}
+
+	dest.OnSnapshotStart("0", 7, 7)
+	dest.OnDataUpdate("0", []byte("a"), 7, []byte(`{"x":"y"}`))
+
+	n, err = bdest.purge(bindexes, [][]string{{res.Hits[0].ID}})
+	if err != nil || n != 0 || tombstones() != "" {
+		t.Errorf("expected the recreated doc to be kept, n: %d, err: %v", n, err)
+	}
+	count, err = bindex.DocCount()
+	if err != nil || count != 1 {
+		t.Errorf("expected the recreated doc, count: %d, err: %v", count, err)
+	}
+}
+
+func TestBleveDestLanguageField(t *testing.T) {
+	mapping := `"types":{` +
+		`"english":{"default_analyzer":"en"},` +
+		`"french":{"default_analyzer":"fr"}}`
+	indexParams := `{"languageField":"lang",` +
+		`"languageMappings":{"en":"english","fr":"french"},` + mapping + `}`
+
+	if ValidateBlevePIndexImpl("bleve", "idx", indexParams) != nil {
+		t.Errorf("expected validation to work")
+	}
+	if ValidateBlevePIndexImpl("bleve", "idx", `{"languageField":"lang",`+
+		`"languageMappings":{"de":"german"},`+mapping+`}`) == nil {
+		t.Errorf("expected validation to fail on an unknown type mapping")
+	}
+	if ValidateBlevePIndexImpl("bleve", "idx",
+		`{"languageMappings":{"en":"english"},`+mapping+`}`) == nil {
+		t.Errorf("expected validation to fail without a languageField")
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", indexParams,
+		emptyDir+string(os.PathSeparator)+"foo", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 3)
+	dest.OnDataUpdate("0", []byte("en"), 1,
+		[]byte(`{"lang":"en","text":"running"}`))
+	dest.OnDataUpdate("0", []byte("fr"), 2,
+		[]byte(`{"lang":"fr","text":"chevaux"}`))
+	dest.OnDataUpdate("0", []byte("other"), 3,
+		[]byte(`{"lang":"de","text":"running chevaux"}`))
+
+	tests := []struct {
+		term string
+		exp  string
+	}{
+		// The english analyzer stems "running".
+		{"run", "en"},
+		// The french analyzer stems "chevaux", and an unknown
+		// language falls back to the default analyzer.
+		{"chevaux", "other"},
+		{"running", "other"},
+	}
+	for _, test := range tests {
+		res, err := impl.(bleve.Index).Search(bleve.NewSearchRequest(
+			bleve.NewTermQuery(test.term).SetField("text")))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		if strings.Join(ids, ",") != test.exp {
+			t.Errorf("expected term %q to match %q, got: %v",
+				test.term, test.exp, ids)
+		}
+	}
+}
+
+func TestBleveDestDocFilter(t *testing.T) {
+	indexParams := `{"docFilter":{"type":"product","meta.status":["new","sale"]}}`
+
+	if ValidateBlevePIndexImpl("bleve", "idx", indexParams) != nil {
+		t.Errorf("expected validation to work")
+	}
+	if ValidateBlevePIndexImpl("bleve", "idx",
+		`{"docFilter":{"type":{"nested":"object"}}}`) == nil {
+		t.Errorf("expected validation to fail on an object filter value")
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", indexParams,
+		emptyDir+string(os.PathSeparator)+"foo", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	ids := func() string {
+		res, err := impl.(bleve.Index).Search(bleve.NewSearchRequest(
+			bleve.NewTermQuery("hello").SetField("text")))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+
+	dest.OnSnapshotStart("0", 1, 5)
+	dest.OnDataUpdate("0", []byte("a"), 1,
+		[]byte(`{"type":"product","meta":{"status":"new"},"text":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2,
+		[]byte(`{"type":"product","meta":{"status":"sale"},"text":"hello"}`))
+	dest.OnDataUpdate("0", []byte("c"), 3,
+		[]byte(`{"type":"user","meta":{"status":"new"},"text":"hello"}`))
+	dest.OnDataUpdate("0", []byte("d"), 4,
+		[]byte(`{"type":"product","text":"hello"}`))
+	dest.OnDataUpdate("0", []byte("e"), 5, []byte(`not json hello`))
+
+	if got := ids(); got != "a,b" {
+		t.Errorf("expected only matching docs, got: %s", got)
+	}
+
+	// A doc that stops matching is removed, and one that starts
+	// matching is added.
+	dest.OnSnapshotStart("0", 6, 7)
+	dest.OnDataUpdate("0", []byte("a"), 6,
+		[]byte(`{"type":"user","meta":{"status":"new"},"text":"hello"}`))
+	dest.OnDataUpdate("0", []byte("c"), 7,
+		[]byte(`{"type":"product","meta":{"status":"new"},"text":"hello"}`))
+
+	if got := ids(); got != "b,c" {
+		t.Errorf("expected updated matching docs, got: %s", got)
+	}
+}
+
+func TestBleveDestRollbackHandler(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restarted := false
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve",
+		func() { restarted = true })
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+
+	var gotPartition string
+	var gotRollbackSeq, gotSeqMax uint64
+	dest.(DestRollbackHandler).SetRollbackHandler(func(partition string,
+		rollbackSeq, seqMax uint64) {
+		gotPartition, gotRollbackSeq, gotSeqMax = partition, rollbackSeq, seqMax
+	})
+
+	dest.OnSnapshotStart("0", 1, 3)
+	for i, k := range []string{"a", "b", "c"} {
+		dest.OnDataUpdate("0", []byte(k), uint64(i+1), []byte(`{"x":"y"}`))
+	}
+
+	err = dest.Rollback("0", 1)
+	if err != nil {
+		t.Errorf("expected Rollback to work, err: %v", err)
+	}
+	if restarted {
+		t.Errorf("expected rollback handler to be used instead of restart")
+	}
+	if gotPartition != "0" || gotRollbackSeq != 1 || gotSeqMax != 3 {
+		t.Errorf("expected rollback handler to get partition, rollbackSeq"+
+			" and seqMax, got: %s, %d, %d",
+			gotPartition, gotRollbackSeq, gotSeqMax)
+	}
+}
+
+func TestBleveDestPartitionIndexesRollback(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "bleve"
+	indexParams := `{"partitionIndexes":true}`
+
+	restarted := false
+	impl, dest, err := NewBlevePIndexImpl("bleve", indexParams, path,
+		func() { restarted = true })
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+
+	handled := false
+	dest.(DestRollbackHandler).SetRollbackHandler(func(partition string,
+		rollbackSeq, seqMax uint64) {
+		handled = true
+	})
+
+	ids := func(bindex bleve.Index) string {
+		res, err := bindex.Search(bleve.NewSearchRequest(
+			bleve.NewQueryStringQuery("hello")))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+
+	if got := ids(impl.(bleve.Index)); got != "" {
+		t.Errorf("expected no hits before any data, got: %s", got)
+	}
+
+	dest.OnSnapshotStart("0", 1, 2)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"hello"}`))
+	dest.OnSnapshotStart("1", 1, 1)
+	dest.OnDataUpdate("1", []byte("c"), 1, []byte(`{"x":"hello"}`))
+
+	if got := ids(impl.(bleve.Index)); got != "a,b,c" {
+		t.Errorf("expected hits across partitions, got: %s", got)
+	}
+
+	// The rollback waits for the queries that started before it, but
+	// without holding off the queries that start meanwhile.
+	bdest := dest.(*BleveDest)
+	_, q, err := bdest.acquireQuery()
+	if err != nil {
+		t.Fatalf("expected acquireQuery to work, err: %v", err)
+	}
+
+	rollbackErrCh := make(chan error, 1)
+	go func() {
+		rollbackErrCh <- dest.Rollback("0", 1)
+	}()
+
+	select {
+	case err = <-rollbackErrCh:
+		t.Errorf("expected rollback to wait for the inflight query,"+
+			" err: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, q2, err := bdest.acquireQuery()
+	if err != nil {
+		t.Errorf("expected a query to start during the rollback, err: %v", err)
+	} else {
+		q2.release()
+	}
+
+	q.release()
+
+	err = <-rollbackErrCh
+	if err != nil {
+		t.Errorf("expected Rollback to work, err: %v", err)
+	}
+	if restarted || handled {
+		t.Errorf("expected a partition rollback to not restart the pindex")
+	}
+
+	// Only the rolled back partition is affected.
+	if got := ids(impl.(bleve.Index)); got != "c" {
+		t.Errorf("expected only partition 1 hits, got: %s", got)
+	}
+	if _, seq, err := dest.GetOpaque("0"); err != nil || seq != 0 {
+		t.Errorf("expected rolled back partition seq 0, got: %d, err: %v",
+			seq, err)
+	}
+	if _, seq, err := dest.GetOpaque("1"); err != nil || seq != 1 {
+		t.Errorf("expected partition 1 seq 1, got: %d, err: %v", seq, err)
+	}
+
+	// The rolled back partition is restreamed from zero.
+	dest.OnSnapshotStart("0", 1, 1)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+
+	if got := ids(impl.(bleve.Index)); got != "a,c" {
+		t.Errorf("expected restreamed hits, got: %s", got)
+	}
+
+	err = dest.Close()
+	if err != nil {
+		t.Errorf("expected Close to work, err: %v", err)
+	}
+
+	// The partition indexes are reopened.
+	buf, _ := json.Marshal(&PIndex{IndexParams: indexParams})
+	err = ioutil.WriteFile(path+string(os.PathSeparator)+PINDEX_META_FILENAME,
+		buf, 0600)
+	if err != nil {
+		t.Fatalf("expected WriteFile to work, err: %v", err)
+	}
+
+	impl, dest, err = OpenBlevePIndexImpl("bleve", path, func() {})
+	if err != nil {
+		t.Fatalf("expected OpenBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	if got := ids(impl.(bleve.Index)); got != "a,c" {
+		t.Errorf("expected reopened hits, got: %s", got)
+	}
+	count, err := impl.(bleve.Index).DocCount()
+	if err != nil || count != 2 {
+		t.Errorf("expected reopened doc count 2, got: %d, err: %v", count, err)
+	}
+	if _, seq, err := dest.GetOpaque("1"); err != nil || seq != 1 {
+		t.Errorf("expected reopened partition 1 seq 1, got: %d, err: %v",
+			seq, err)
+	}
+}
+
+func TestBleveDestFlush(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+
+	// The snapshot doesn't end, so the batch stays buffered.
+	dest.OnSnapshotStart("0", 1, 100)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"hello"}`))
+
+	search := func() uint64 {
+		res, err := impl.(bleve.Index).Search(bleve.NewSearchRequest(
+			bleve.NewMatchQuery("hello").SetField("x")))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		return res.Total
+	}
+
+	if n := search(); n != 0 {
+		t.Errorf("expected buffered docs to not be queryable, got: %d", n)
+	}
+
+	if err = dest.(DestFlush).Flush(); err != nil {
+		t.Errorf("expected Flush to work, err: %v", err)
+	}
+	if n := search(); n != 2 {
+		t.Errorf("expected flushed docs to be queryable, got: %d", n)
+	}
+
+	_, lastSeq, err := dest.GetOpaque("0")
+	if err != nil || lastSeq != 2 {
+		t.Errorf("expected lastSeq 2, got: %d, err: %v", lastSeq, err)
+	}
+
+	dest.Close()
+
+	if dest.(DestFlush).Flush() == nil {
+		t.Errorf("expected Flush of a closed dest to fail")
+	}
+}
+
+func TestBleveDestExportImport(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 10)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("c"), 3, []byte(`{"x":"hello"}`))
+
+	// The export applies the pending batch of the incomplete snapshot.
+	exportPath := emptyDir + string(os.PathSeparator) + "export"
+	err = dest.(*BleveDest).Export(exportPath)
+	if err != nil {
+		t.Fatalf("expected Export to work, err: %v", err)
+	}
+	count, err := impl.(bleve.Index).DocCount()
+	if err != nil || count != 3 {
+		t.Errorf("expected doc count 3, got: %d, err: %v", count, err)
+	}
+	if dest.(*BleveDest).Export(exportPath) == nil {
+		t.Errorf("expected Export to an existing path to fail")
+	}
+
+	// While an export copies, the feed isn't held off, but its batch
+	// applies are left pending until the copy is done.
+	bdest := dest.(*BleveDest)
+	_, q, err := bdest.pauseApplies()
+	if err != nil {
+		t.Fatalf("expected pauseApplies to work, err: %v", err)
+	}
+	dest.OnSnapshotStart("0", 4, 4)
+	dest.OnDataUpdate("0", []byte("d"), 4, []byte(`{"x":"hello"}`))
+	_, seq, err := dest.(DestOpaqueApplied).GetOpaqueApplied("0")
+	if err != nil || seq != 3 {
+		t.Errorf("expected the apply to be paused, seq: %d, err: %v", seq, err)
+	}
+	q.release()
+	bdest.resumeApplies()
+	_, seq, err = dest.(DestOpaqueApplied).GetOpaqueApplied("0")
+	if err != nil || seq != 4 {
+		t.Errorf("expected the apply to resume, seq: %d, err: %v", seq, err)
+	}
+
+	path := emptyDir + string(os.PathSeparator) + "bar_0"
+	impl2, dest2, err := ImportBlevePIndexImpl("bleve", exportPath, path,
+		func() {})
+	if err != nil {
+		t.Fatalf("expected ImportBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest2.Close()
+
+	count2, err := impl2.(bleve.Index).DocCount()
+	if err != nil || count2 != count {
+		t.Errorf("expected imported doc count: %d, got: %d, err: %v",
+			count, count2, err)
+	}
+	if _, seq, err := dest2.GetOpaque("0"); err != nil || seq != 3 {
+		t.Errorf("expected imported partition 0 seq 3, got: %d, err: %v",
+			seq, err)
+	}
+
+	_, _, err = ImportBlevePIndexImpl("bleve", exportPath, path, func() {})
+	if err == nil {
+		t.Errorf("expected ImportBlevePIndexImpl to an existing path to fail")
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("expected a failed import to keep the existing path,"+
+			" err: %v", err)
+	}
+}
+
+func TestBleveEncodeKey(t *testing.T) {
+	for _, test := range []struct {
+		keyEncoding string
+		key         string
+		exp         string
+	}{
+		{"", "a", "a"},
+		{"", "\xff", "\xff"},
+		{"base64", "a", "a"},
+		{"base64", "\xff", "base64:/w=="},
+		{"base64", "base64:a", "base64:YmFzZTY0OmE="},
+		{"hex", "\xff\x00", "hex:ff00"},
+		{"hex", "base64:a", "base64:a"},
+	} {
+		docId := BleveEncodeKey(test.keyEncoding, []byte(test.key))
+		if docId != test.exp {
+			t.Errorf("expected key: %q, keyEncoding: %s, to encode to: %s,"+
+				" got: %s", test.key, test.keyEncoding, test.exp, docId)
+		}
+		key, err := BleveDecodeKey(test.keyEncoding, docId)
+		if err != nil || string(key) != test.key {
+			t.Errorf("expected docId: %s to decode to: %q, got: %q, err: %v",
+				docId, test.key, key, err)
+		}
+	}
+
+	if _, err := BleveDecodeKey("hex", "hex:zz"); err == nil {
+		t.Errorf("expected a bad hex docId to fail")
+	}
+	if ValidateBlevePIndexImpl("bleve", "foo",
+		`{"keyEncoding":"rot13"}`) == nil {
+		t.Errorf("expected an unknown keyEncoding to fail")
+	}
+}
+
+func TestBleveDestKeyEncoding(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", `{"keyEncoding":"base64"}`,
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	binaryKey := []byte{0xff, 0xfe, 0x00, 'k'}
+
+	dest.OnSnapshotStart("0", 1, 3)
+	dest.OnDataUpdate("0", binaryKey, 1, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("c"), 3, []byte(`{"x":"world"}`))
+
+	res, err := impl.(bleve.Index).Search(bleve.NewSearchRequest(
+		bleve.NewMatchQuery("hello").SetField("x")))
+	if err != nil {
+		t.Fatalf("expected Search to work, err: %v", err)
+	}
+	buf, err := json.Marshal(res)
+	if err != nil || !utf8.Valid(buf) {
+		t.Errorf("expected the hits to serialize as valid JSON, err: %v", err)
+	}
+
+	var keys []string
+	for _, hit := range res.Hits {
+		key, err := BleveDecodeKey("base64", hit.ID)
+		if err != nil {
+			t.Errorf("expected hit id: %s to decode, err: %v", hit.ID, err)
+		}
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != string(binaryKey) {
+		t.Errorf("expected the binary key to round-trip, got: %q", keys)
+	}
+
+	// A deletion of the binary key finds its doc.
+	dest.OnSnapshotStart("0", 4, 4)
+	dest.OnDataDelete("0", binaryKey, 4)
+	count, err := impl.(bleve.Index).DocCount()
+	if err != nil || count != 2 {
+		t.Errorf("expected doc count 2 after delete, got: %d, err: %v",
+			count, err)
+	}
+}
+
+func TestBleveDestMaxDocSize(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	if ValidateBlevePIndexImpl("bleve", "foo", `{"maxDocSize":-1}`) == nil {
+		t.Errorf("expected a negative maxDocSize to be invalid")
+	}
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", `{"maxDocSize":20}`,
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	big := []byte(`{"x":"hello","y":"` + strings.Repeat("z", 100) + `"}`)
+
+	dest.OnSnapshotStart("0", 1, 3)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, big)
+	dest.OnDataUpdate("0", []byte("c"), 3, []byte(`{"x":"hello"}`))
+
+	count, err := impl.(bleve.Index).DocCount()
+	if err != nil || count != 2 {
+		t.Errorf("expected the oversized doc to be skipped, count: %d, err: %v",
+			count, err)
+	}
+	if n := dest.(DestDocsTooLarge).NumDocsTooLarge(); n != 1 {
+		t.Errorf("expected 1 doc too large, got: %d", n)
+	}
+
+	// An indexed doc that grows too large is removed.
+	dest.OnSnapshotStart("0", 4, 4)
+	dest.OnDataUpdate("0", []byte("a"), 4, big)
+
+	count, err = impl.(bleve.Index).DocCount()
+	if err != nil || count != 1 {
+		t.Errorf("expected the grown doc to be removed, count: %d, err: %v",
+			count, err)
+	}
+	if n := dest.(DestDocsTooLarge).NumDocsTooLarge(); n != 2 {
+		t.Errorf("expected 2 docs too large, got: %d", n)
+	}
+
+	// Deletions still apply, and the seq still advances.
+	dest.OnSnapshotStart("0", 5, 6)
+	dest.OnDataDelete("0", []byte("b"), 5)
+	dest.OnDataDelete("0", []byte("c"), 6)
+
+	count, err = impl.(bleve.Index).DocCount()
+	if err != nil || count != 0 {
+		t.Errorf("expected no docs after deletes, count: %d, err: %v",
+			count, err)
+	}
+	_, lastSeq, err := dest.GetOpaque("0")
+	if err != nil || lastSeq != 6 {
+		t.Errorf("expected lastSeq 6, got: %d, err: %v", lastSeq, err)
+	}
+}
+
+func TestBleveDestCorruptSeqMax(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "foo_0"
+	impl, dest, err := NewBlevePIndexImpl("bleve", "", path, func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	dest.OnSnapshotStart("0", 1, 1)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+
+	// Write a malformed seqMax entry.
+	err = impl.(bleve.Index).SetInternal([]byte("0"), []byte("bad"))
+	if err != nil {
+		t.Fatalf("expected SetInternal to work, err: %v", err)
+	}
+	dest.Close()
+
+	impl, dest, err = OpenBlevePIndexImpl("bleve", path, func() {})
+	if err != nil {
+		t.Fatalf("expected OpenBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	// The corrupt seqMax reads as 0, so the feed restreams.
+	_, seq, err := dest.GetOpaque("0")
+	if err != nil || seq != 0 {
+		t.Errorf("expected a corrupt seqMax to read as 0, got: %d, err: %v",
+			seq, err)
+	}
+	count, err := impl.(bleve.Index).DocCount()
+	if err != nil || count != 1 {
+		t.Errorf("expected the docs to remain, got: %d, err: %v", count, err)
+	}
+
+	// The restream repairs the seqMax entry.
+	dest.OnSnapshotStart("0", 1, 1)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+
+	buf, err := impl.(bleve.Index).GetInternal([]byte("0"))
+	if err != nil || len(buf) != 8 || binary.BigEndian.Uint64(buf) != 1 {
+		t.Errorf("expected a repaired seqMax of 1, got: %v, err: %v", buf, err)
+	}
+	if _, seq, err = dest.GetOpaque("0"); err != nil || seq != 1 {
+		t.Errorf("expected seq 1, got: %d, err: %v", seq, err)
+	}
+}
+
+func TestBleveDestPartitionReset(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 100)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"y"}`))
+	dest.SetOpaque("0", []byte("opaque"))
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- dest.ConsistencyWait("0", "at_plus", 5, nil)
+	}()
+
+	bdp, _, err := dest.(*BleveDest).getPartition("0")
+	if err != nil {
+		t.Fatalf("expected getPartition to work, err: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		bdp.m.Lock()
+		n := bdp.cwrQueue.Len()
+		bdp.m.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bdp.Reset()
+
+	select {
+	case err = <-errCh:
+		if err == nil {
+			t.Errorf("expected waiter to be errored by Reset")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected waiter to be done after Reset")
+	}
+
+	bdp.m.Lock()
+	if bdp.seqMax != 0 || bdp.seqMaxBatch != 0 || bdp.seqSnapEnd != 0 ||
+		len(bdp.buf) != 0 || bdp.lastOpaque != nil ||
+		bdp.cwrQueue.Len() != 0 {
+		t.Errorf("expected partition state to be zeroed after Reset")
+	}
+	bdp.m.Unlock()
+
+	// The partition is reusable after a Reset.
+	dest.OnSnapshotStart("0", 1, 1)
+	dest.OnDataUpdate("0", []byte("b"), 1, []byte(`{"x":"y"}`))
+	err = dest.ConsistencyWait("0", "at_plus", 1, nil)
+	if err != nil {
+		t.Errorf("expected reuse after Reset to work, err: %v", err)
+	}
+}
+
+func TestBleveDestConcurrentConsistencyWait(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 2)
+
+	numWaiters := 500
+	errCh := make(chan error, numWaiters)
+	for i := 0; i < numWaiters; i++ {
+		go func() {
+			errCh <- dest.ConsistencyWait("0", "at_plus", 2, nil)
+		}()
+	}
+
+	// Other partitions and callers aren't blocked by the waiters.
+	err = dest.ConsistencyWait("1", "", 0, nil)
+	if err != nil {
+		t.Errorf("expected stale=ok wait to work, err: %v", err)
+	}
+
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"y"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"y"}`))
+
+	for i := 0; i < numWaiters; i++ {
+		select {
+		case err = <-errCh:
+			if err != nil {
+				t.Errorf("expected waiter to succeed, err: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected all waiters to be done")
+		}
+	}
+
+	// Fill up the queue, so that the next waiter is rejected.
+	bdp, _, _ := dest.(*BleveDest).getPartition("0")
+	bdp.m.Lock()
+	for i := 0; i < BLEVE_DEST_CWR_QUEUE_MAX; i++ {
+		heap.Push(&bdp.cwrQueue, &consistencyWaitReq{
+			consistencyLevel: "at_plus",
+			consistencySeq:   1000,
+			doneCh:           make(chan error, 1),
+		})
+	}
+	bdp.m.Unlock()
+
+	err = dest.ConsistencyWait("0", "at_plus", 1000, nil)
+	if err == nil {
+		t.Errorf("expected waiter to be rejected when queue is too deep")
+	}
+
+	bdp.Reset()
+}
+
+func BenchmarkBleveDestGetOpaque(b *testing.B) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		b.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	// Partitions with and without persisted opaque and seqMax.
+	dest.OnSnapshotStart("0", 1, 1)
+	dest.SetOpaque("0", []byte("opaque"))
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"y"}`))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dest.GetOpaque("0")
+		dest.GetOpaque("1")
+	}
+}
+
+func TestBleveDestPartitionSeqs(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+
+	destSeqs, ok := dest.(DestSeqs)
+	if !ok {
+		t.Fatalf("expected BleveDest to implement DestSeqs")
+	}
+
+	dest.OnSnapshotStart("0", 1, 10)
+	dest.OnDataUpdate("0", []byte("a"), 3, []byte(`{"x":"y"}`))
+
+	seqMax, seqSnapEnd, err := destSeqs.PartitionSeqs("0")
+	if err != nil || seqMax != 3 || seqSnapEnd != 10 {
+		t.Errorf("expected seqs 3 and 10, got: %d, %d, err: %v",
+			seqMax, seqSnapEnd, err)
+	}
+	seqMax, seqSnapEnd, err = destSeqs.PartitionSeqs("unknown")
+	if err != nil || seqMax != 0 || seqSnapEnd != 0 {
+		t.Errorf("expected zero seqs for unknown partition, got: %d, %d,"+
+			" err: %v", seqMax, seqSnapEnd, err)
+	}
+
+	dest.Close()
+
+	_, _, err = destSeqs.PartitionSeqs("0")
+	if err == nil {
+		t.Errorf("expected PartitionSeqs on closed dest to fail")
+	}
+}
+
+func TestBleveDestQueryMalformed(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	pindex := &PIndex{Name: "foo", IndexName: "foo", IndexType: "bleve",
+		Impl: impl, Dest: dest}
+
+	tests := []struct {
+		req string
+		exp string
+	}{
+		{`{}`, "missing query"},
+		{`{"consistency":{"level":"at_plus","vectors":{"foo":{"0":1}}}}`,
+			"missing query"},
+		{`{"query":{"query":{"query":"hello"},"size":-1}}`, "invalid size"},
+		{`not json`, "parsing bleveQueryParams"},
+	}
+	for _, test := range tests {
+		var res bytes.Buffer
+		err := dest.Query(pindex, []byte(test.req), &res, nil)
+		if err == nil || !strings.Contains(err.Error(), test.exp) {
+			t.Errorf("expected req: %s, to fail with: %s, got: %v",
+				test.req, test.exp, err)
+		}
+	}
+
+	var res bytes.Buffer
+	err = dest.Query(pindex, []byte(`{"query":{"query":{"query":"hello"}}}`),
+		&res, nil)
+	if err != nil {
+		t.Errorf("expected a well formed query to work, err: %v", err)
+	}
+}
+
+func TestBleveDestQueryConsistencyTimeout(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	pindex := &PIndex{Name: "foo", IndexName: "foo", IndexType: "bleve",
+		SourcePartitions: "0", sourcePartitionsArr: []string{"0"},
+		Impl: impl, Dest: dest}
+
+	dest.OnSnapshotStart("0", 1, 1)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+
+	// Waits for seq 10, which never arrives.
+	req := func(consistencyTimeout int) []byte {
+		return []byte(`{"query":{"query":{"query":"hello"}},` +
+			`"consistency":{"level":"at_plus","vectors":{"foo":{"0":10}},` +
+			`"timeout":` + fmt.Sprintf("%d", consistencyTimeout) + `}}`)
+	}
+
+	var res bytes.Buffer
+	err = dest.Query(pindex, req(10), &res, nil)
+	if _, ok := err.(*ConsistencyTimeoutError); !ok {
+		t.Errorf("expected a consistency timeout, got: %v", err)
+	}
+
+	// The query's own timeout isn't a consistency timeout.
+	cancelCh := make(chan struct{})
+	close(cancelCh)
+	err = dest.Query(pindex, req(100000), &res, cancelCh)
+	if err == nil {
+		t.Errorf("expected a cancelled query to fail")
+	}
+	if _, ok := err.(*ConsistencyTimeoutError); ok {
+		t.Errorf("expected a query timeout, got: %v", err)
+	}
+
+	// A satisfied consistency wait isn't affected by its timeout.
+	dest.OnSnapshotStart("0", 10, 10)
+	dest.OnDataUpdate("0", []byte("b"), 10, []byte(`{"x":"hello"}`))
+	err = dest.Query(pindex, req(10), &res, nil)
+	if err != nil {
+		t.Errorf("expected a satisfied consistency wait to work, err: %v", err)
+	}
+}
+
+func TestBleveDestQueryAsOf(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	pindex := &PIndex{Name: "foo", IndexName: "foo", IndexType: "bleve",
+		SourcePartitions: "0", sourcePartitionsArr: []string{"0"},
+		Impl: impl, Dest: dest}
+
+	dest.OnSnapshotStart("0", 1, 2)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"hello"}`))
+
+	req := func(seq int) []byte {
+		return []byte(`{"query":{"query":{"query":"hello"}},` +
+			`"consistency":{"level":"as_of","vectors":{"foo":{"0":` +
+			fmt.Sprintf("%d", seq) + `}},"timeout":1000}}`)
+	}
+
+	var res bytes.Buffer
+	err = dest.Query(pindex, req(2), &res, nil)
+	if err != nil {
+		t.Errorf("expected as_of the current snapshot to work, err: %v", err)
+	}
+	if !strings.Contains(res.String(), `"total_hits":2`) {
+		t.Errorf("expected 2 hits, got: %s", res.String())
+	}
+
+	// Older snapshots aren't retained.
+	res.Reset()
+	err = dest.Query(pindex, req(1), &res, nil)
+	if e, ok := err.(*SnapshotNotAvailableError); !ok ||
+		e.Seq != 1 || e.SeqAvailable != 2 {
+		t.Errorf("expected snapshot not available, got: %v", err)
+	}
+
+	dest.OnSnapshotStart("0", 3, 3)
+	dest.OnDataUpdate("0", []byte("c"), 3, []byte(`{"x":"hello"}`))
+
+	err = dest.Query(pindex, req(2), &res, nil)
+	if _, ok := err.(*SnapshotNotAvailableError); !ok {
+		t.Errorf("expected snapshot not available after new mutations,"+
+			" got: %v", err)
+	}
+
+	// A seq that's not applied yet is waited for.
+	errCh := make(chan error, 1)
+	go func() {
+		var res bytes.Buffer
+		err := dest.Query(pindex, req(4), &res, nil)
+		if err == nil && !strings.Contains(res.String(), `"total_hits":4`) {
+			err = fmt.Errorf("expected 4 hits, got: %s", res.String())
+		}
+		errCh <- err
+	}()
+
+	dest.OnSnapshotStart("0", 4, 4)
+	dest.OnDataUpdate("0", []byte("d"), 4, []byte(`{"x":"hello"}`))
+
+	if err = <-errCh; err != nil {
+		t.Errorf("expected as_of a later seq to wait, err: %v", err)
+	}
+
+	// A batch that's applied during a search fails the exact-seq
+	// check, even when the partition ends up at the same seq, such as
+	// after a rollback and a replay.
+	bdest := dest.(*BleveDest)
+	vector := ConsistencyVector{"0": 4}
+	batches := bdest.numBatches(vector)
+	if err = bdest.checkExactSeqs(vector, batches); err != nil {
+		t.Errorf("expected exact seqs, err: %v", err)
+	}
+	batches["0"]--
+	if _, ok := bdest.checkExactSeqs(vector,
+		batches).(*SnapshotNotAvailableError); !ok {
+		t.Errorf("expected snapshot not available after a batch")
+	}
+}
+
+func TestBleveDestDurability(t *testing.T) {
+	defer func(prev int) { BleveDestSyncMS = prev }(BleveDestSyncMS)
+	BleveDestSyncMS = 10
+
+	if ValidateBlevePIndexImpl("bleve", "idx", `{"durability":"fast"}`) != nil {
+		t.Errorf("expected fast durability to be valid")
+	}
+	if ValidateBlevePIndexImpl("bleve", "idx", `{"durability":"lazy"}`) == nil {
+		t.Errorf("expected unknown durability to be invalid")
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	for _, indexParams := range []string{
+		`{"durability":"fast"}`,
+		`{"durability":"fast","partitionIndexes":true}`,
+	} {
+		path, _ := ioutil.TempDir(emptyDir, "fast")
+
+		_, dest, err := NewBlevePIndexImpl("bleve", indexParams,
+			path+string(os.PathSeparator)+"bleve", func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		bdest := dest.(*BleveDest)
+
+		dest.OnSnapshotStart("0", 1, 1)
+		dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+
+		stats, err := bdest.StorageStats()
+		if err != nil || stats.DocCount != 1 ||
+			stats.Durability != BLEVE_DURABILITY_FAST {
+			t.Errorf("expected fast durability stats, got: %#v, err: %v",
+				stats, err)
+		}
+
+		bdest.m.Lock()
+		storePaths := bdest.storePathsUnlocked()
+		bdest.m.Unlock()
+
+		n, err := syncBleveStores(storePaths)
+		if err != nil || n != 1 {
+			t.Errorf("expected the store to be synced, indexParams: %s,"+
+				" got: %d, err: %v", indexParams, n, err)
+		}
+
+		// The background syncer stops once the dest is closed.
+		time.Sleep(3 * time.Duration(BleveDestSyncMS) * time.Millisecond)
+
+		err = dest.Close()
+		if err != nil {
+			t.Errorf("expected Close to work, err: %v", err)
+		}
+	}
+}
+
+func TestBleveDestIngestLag(t *testing.T) {
+	defer func(prev func() time.Time) { bleveDestTimeNow = prev }(bleveDestTimeNow)
+
+	now := time.Unix(1000, 0)
+	bleveDestTimeNow = func() time.Time { return now }
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	if stats := dest.(DestIngestLag).IngestLag(); stats.Count != 0 {
+		t.Errorf("expected no ingest lag yet, got: %#v", stats)
+	}
+
+	// Two mutations wait 2 secs for the snapshot end, while the
+	// other 98 are applied right when they're received.
+	dest.OnSnapshotStart("0", 1, 100)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnDataDelete("0", []byte("b"), 2)
+
+	now = now.Add(2 * time.Second)
+
+	mutations := []DestMutation{}
+	for seq := uint64(3); seq <= 100; seq++ {
+		mutations = append(mutations, DestMutation{
+			Key: []byte(fmt.Sprintf("%d", seq)), Seq: seq,
+			Val: []byte(`{"x":"hello"}`)})
+	}
+	DestOnDataUpdateBatch(dest, "0", mutations)
+
+	stats := dest.(DestIngestLag).IngestLag()
+	if stats.Count != 100 {
+		t.Errorf("expected 100 applied mutations, got: %#v", stats)
+	}
+	if stats.P50NS > int64(time.Millisecond) ||
+		stats.P90NS > int64(time.Millisecond) {
+		t.Errorf("expected small p50 and p90, got: %#v", stats)
+	}
+	if stats.P99NS != int64(2*time.Second) ||
+		stats.MaxNS != int64(2*time.Second) {
+		t.Errorf("expected the delayed mutations in the p99, got: %#v", stats)
+	}
+}
+
+func TestBleveDestGetOpaqueApplied(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "foo"
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "", path, func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+
+	dest.OnSnapshotStart("0", 1, 3)
+	for seq := uint64(1); seq <= 3; seq++ {
+		dest.OnDataUpdate("0", []byte(fmt.Sprintf("%d", seq)), seq, []byte(`{}`))
+	}
+
+	// Received, but not yet applied, as the snapshot is incomplete.
+	dest.OnSnapshotStart("0", 4, 10)
+	dest.OnDataUpdate("0", []byte("4"), 4, []byte(`{}`))
+	dest.OnDataUpdate("0", []byte("5"), 5, []byte(`{}`))
+
+	_, seq, err := dest.GetOpaque("0")
+	if err != nil || seq != 5 {
+		t.Errorf("expected received seq 5, got: %d, err: %v", seq, err)
+	}
+	_, seq, err = dest.(DestOpaqueApplied).GetOpaqueApplied("0")
+	if err != nil || seq != 3 {
+		t.Errorf("expected applied seq 3, got: %d, err: %v", seq, err)
+	}
+
+	// Simulates a crash, where the unapplied batch is lost.
+	dest.Close()
+
+	impl, dest, err := OpenBlevePIndexImpl("bleve", path, func() {})
+	if err != nil {
+		t.Fatalf("expected OpenBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	_, seq, err = dest.GetOpaque("0")
+	if err != nil || seq != 3 {
+		t.Errorf("expected reopened seq 3, got: %d, err: %v", seq, err)
+	}
+	_, seq, err = dest.(DestOpaqueApplied).GetOpaqueApplied("0")
+	if err != nil || seq != 3 {
+		t.Errorf("expected reopened applied seq 3, got: %d, err: %v", seq, err)
+	}
+	n, err := impl.(bleve.Index).DocCount()
+	if err != nil || n != 3 {
+		t.Errorf("expected only the applied docs, got: %d, err: %v", n, err)
+	}
+
+	// A consistency wait for an applied seq doesn't block.
+	err = dest.ConsistencyWait("0", "at_plus", 3, nil)
+	if err != nil {
+		t.Errorf("expected consistency wait on applied seq to work,"+
+			" err: %v", err)
+	}
+}
+
+func TestBleveDestCrashConsistency(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	type op struct {
+		kind    string // "snapshot", "opaque", "update" or "delete".
+		key     string
+		seq     uint64
+		snapEnd uint64 // For "snapshot", where seq is the snapStart.
+	}
+
+	ops := []op{
+		{kind: "snapshot", seq: 1, snapEnd: 3},
+		{kind: "opaque", key: "o1"},
+		{kind: "update", key: "a", seq: 1},
+		{kind: "update", key: "b", seq: 2},
+		{kind: "delete", key: "a", seq: 3},
+		{kind: "snapshot", seq: 4, snapEnd: 5},
+		{kind: "opaque", key: "o2"},
+		{kind: "update", key: "c", seq: 4},
+		{kind: "update", key: "d", seq: 5},
+	}
+
+	run := func(dest Dest, op op) {
+		switch op.kind {
+		case "snapshot":
+			dest.OnSnapshotStart("0", op.seq, op.snapEnd)
+		case "opaque":
+			dest.SetOpaque("0", []byte(op.key))
+		case "update":
+			dest.OnDataUpdate("0", []byte(op.key), op.seq, []byte(`{}`))
+		case "delete":
+			dest.OnDataDelete("0", []byte(op.key), op.seq)
+		}
+	}
+
+	// Returns the sorted doc IDs that are expected after the mutations
+	// up to and including seqMax.
+	expectedDocIds := func(seqMax uint64) string {
+		docs := map[string]bool{}
+		for _, op := range ops {
+			if op.kind == "update" && op.seq <= seqMax {
+				docs[op.key] = true
+			} else if op.kind == "delete" && op.seq <= seqMax {
+				delete(docs, op.key)
+			}
+		}
+		ids := []string{}
+		for id := range docs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+
+	docIds := func(impl PIndexImpl) string {
+		res, err := impl.(bleve.Index).Search(
+			bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+
+	expectedOpaques := map[uint64]string{0: "", 3: "o1", 5: "o2"}
+
+	for crashAt := 0; crashAt <= len(ops); crashAt++ {
+		path := emptyDir + string(os.PathSeparator) + fmt.Sprintf("%d", crashAt)
+
+		_, dest, err := NewBlevePIndexImpl("bleve", "", path, func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		for _, op := range ops[:crashAt] {
+			run(dest, op)
+		}
+		dest.Close() // Simulates a crash, losing any unapplied batch.
+
+		impl, dest, err := OpenBlevePIndexImpl("bleve", path, func() {})
+		if err != nil {
+			t.Fatalf("expected OpenBlevePIndexImpl to work, err: %v", err)
+		}
+
+		opaque, seqMax, err := dest.GetOpaque("0")
+		if err != nil {
+			t.Fatalf("expected GetOpaque to work, err: %v", err)
+		}
+		expectedOpaque, exists := expectedOpaques[seqMax]
+		if !exists || string(opaque) != expectedOpaque {
+			t.Errorf("crashAt: %d, expected seqMax at a snapshot end"+
+				" with its opaque, got seqMax: %d, opaque: %s",
+				crashAt, seqMax, opaque)
+		}
+		if docIds(impl) != expectedDocIds(seqMax) {
+			t.Errorf("crashAt: %d, expected docs: %s to match seqMax: %d,"+
+				" got: %s", crashAt, expectedDocIds(seqMax), seqMax, docIds(impl))
+		}
+
+		// Resumes from the persisted seqMax, like a feed would.
+		resumed := false
+		for _, op := range ops {
+			if op.kind == "snapshot" && op.snapEnd > seqMax {
+				resumed = true
+			}
+			if !resumed ||
+				((op.kind == "update" || op.kind == "delete") && op.seq <= seqMax) {
+				continue
+			}
+			run(dest, op)
+		}
+
+		opaque, seqMax, err = dest.GetOpaque("0")
+		if err != nil || seqMax != 5 || string(opaque) != "o2" {
+			t.Errorf("crashAt: %d, expected resumed seqMax 5 and opaque o2,"+
+				" got: %d, %s, err: %v", crashAt, seqMax, opaque, err)
+		}
+		if docIds(impl) != "b,c,d" {
+			t.Errorf("crashAt: %d, expected no skipped mutations, got: %s",
+				crashAt, docIds(impl))
+		}
+
+		dest.Close()
+	}
+}
+
+func TestBleveDestBufferedBytesMax(t *testing.T) {
+	bleveDestBuffered := newBleveDestBudget(1000)
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	var dests []Dest
+	for _, name := range []string{"a", "b"} {
+		_, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		dest.(*BleveDest).SetManager(&Manager{
+			bleveDestBuffered: bleveDestBuffered,
+		})
+		dests = append(dests, dest)
+	}
+
+	val := []byte(`{"x":"` + strings.Repeat("x", 90) + `"}`)
+
+	// A fast feed whose snapshots are far from complete, so that
+	// without the budget every batch would keep growing.
+	for _, dest := range dests {
+		dest.OnSnapshotStart("0", 1, 1000)
+		dest.OnSnapshotStart("1", 1, 1000)
+	}
+	for seq := uint64(1); seq <= 50; seq++ {
+		for _, dest := range dests {
+			for _, partition := range []string{"0", "1"} {
+				err := dest.OnDataUpdate(partition,
+					[]byte(fmt.Sprintf("%s-%d", partition, seq)), seq, val)
+				if err != nil {
+					t.Errorf("expected OnDataUpdate to work, err: %v", err)
+				}
+				if bleveDestBuffered.bytes() > 1000 {
+					t.Errorf("expected buffered bytes <= 1000, got: %d",
+						bleveDestBuffered.bytes())
+				}
+			}
+		}
+	}
+
+	if bleveDestBuffered.bytes() <= 0 {
+		t.Errorf("expected some buffered bytes")
+	}
+
+	// The budget forced early applies of the incomplete snapshots.
+	for _, dest := range dests {
+		_, seq, err := dest.(DestOpaqueApplied).GetOpaqueApplied("0")
+		if err != nil || seq <= 0 {
+			t.Errorf("expected early applies, seq: %d, err: %v", seq, err)
+		}
+	}
+
+	for _, dest := range dests {
+		dest.Close()
+	}
+	if bleveDestBuffered.bytes() != 0 {
+		t.Errorf("expected no buffered bytes after close, got: %d",
+			bleveDestBuffered.bytes())
+	}
+}
+
+func TestBleveDestBufferedBytesMaxSnapshotAtomic(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", `{"snapshotAtomic":true}`,
+		emptyDir+string(os.PathSeparator)+"a", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	bleveDestBuffered := newBleveDestBudget(1000)
+	dest.(*BleveDest).buffered = bleveDestBuffered
+
+	val := []byte(`{"x":"` + strings.Repeat("x", 90) + `"}`)
+
+	dest.OnSnapshotStart("0", 1, 50)
+	for seq := uint64(1); seq < 50; seq++ {
+		err = dest.OnDataUpdate("0", []byte(fmt.Sprintf("%d", seq)), seq, val)
+		if err != nil {
+			t.Errorf("expected OnDataUpdate to work, err: %v", err)
+		}
+	}
+
+	// The budget doesn't apply a partial snapshot.
+	_, seq, err := dest.(DestOpaqueApplied).GetOpaqueApplied("0")
+	if err != nil || seq != 0 {
+		t.Errorf("expected no partial snapshot apply, seq: %d, err: %v",
+			seq, err)
+	}
+	if bleveDestBuffered.bytes() <= 1000 {
+		t.Errorf("expected the snapshot to be buffered over budget, got: %d",
+			bleveDestBuffered.bytes())
+	}
+
+	err = dest.OnDataUpdate("0", []byte("50"), 50, val)
+	if err != nil {
+		t.Errorf("expected OnDataUpdate to work, err: %v", err)
+	}
+	_, seq, err = dest.(DestOpaqueApplied).GetOpaqueApplied("0")
+	if err != nil || seq != 50 {
+		t.Errorf("expected the whole snapshot to apply, seq: %d, err: %v",
+			seq, err)
+	}
+}
+
+func TestBleveDestStorageStats(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := emptyDir + string(os.PathSeparator) + "foo"
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "", path, func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+
+	dest.OnSnapshotStart("0", 1, 3)
+	for seq := uint64(1); seq <= 3; seq++ {
+		dest.OnDataUpdate("0", []byte(fmt.Sprintf("%d", seq)), seq,
+			[]byte(`{"x":"hello"}`))
+	}
+
+	pindex := &PIndex{Name: "foo", IndexType: "bleve", Path: path, Dest: dest}
+
+	stats, err := pindexImplTypes["bleve"].StorageStats(pindex)
+	if err != nil {
+		t.Fatalf("expected StorageStats to work, err: %v", err)
+	}
+	if stats.DocCount != 3 {
+		t.Errorf("expected 3 docs, got: %d", stats.DocCount)
+	}
+	if stats.DiskBytes <= 0 {
+		t.Errorf("expected non-zero disk bytes, got: %d", stats.DiskBytes)
+	}
+	if stats.Durability != BLEVE_DURABILITY_SAFE {
+		t.Errorf("expected default safe durability, got: %s", stats.Durability)
+	}
+
+	dest.Close()
+
+	_, err = dest.(*BleveDest).StorageStats()
+	if err == nil {
+		t.Errorf("expected StorageStats on a closed dest to fail")
+	}
+
+	// A path that's removed, such as during a rollback, has no size.
+	os.RemoveAll(path)
+	diskBytes, err := pindexDiskBytes(path)
+	if err != nil || diskBytes != 0 {
+		t.Errorf("expected 0 bytes for a removed path, got: %d, err: %v",
+			diskBytes, err)
+	}
+}
+
+func TestBleveDestConsistencyWaiters(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 2)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"y"}`))
+
+	dcw := dest.(DestConsistencyWaiters)
+	if len(dcw.ConsistencyWaiters()) != 0 {
+		t.Errorf("expected no waiters")
+	}
+
+	cancelCh := make(chan struct{})
+	for _, w := range []struct {
+		partition string
+		seq       uint64
+	}{{"0", 5}, {"0", 7}, {"1", 3}} {
+		go dest.ConsistencyWait(w.partition, "at_plus", w.seq, cancelCh)
+	}
+
+	var waiters map[string]*PartitionConsistencyWaiters
+	for i := 0; i < 100; i++ {
+		waiters = dcw.ConsistencyWaiters()
+		if len(waiters) == 2 && len(waiters["0"].Waiters) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(waiters) != 2 || waiters["0"] == nil || waiters["1"] == nil {
+		t.Fatalf("expected waiters on 2 partitions, got: %#v", waiters)
+	}
+	if waiters["0"].SeqMax != 1 || waiters["0"].SeqMaxBatch != 0 {
+		t.Errorf("expected seqMax 1 and seqMaxBatch 0, got: %#v",
+			waiters["0"])
+	}
+	seqs := map[uint64]bool{}
+	for _, w := range waiters["0"].Waiters {
+		seqs[w.ConsistencySeq] = true
+		if w.ConsistencyLevel != "at_plus" || w.WaitNS < 0 || w.Cancelled {
+			t.Errorf("unexpected waiter: %#v", w)
+		}
+	}
+	if len(seqs) != 2 || !seqs[5] || !seqs[7] {
+		t.Errorf("expected waiter seqs 5 and 7, got: %v", seqs)
+	}
+	if len(waiters["1"].Waiters) != 1 ||
+		waiters["1"].Waiters[0].ConsistencySeq != 3 {
+		t.Errorf("expected waiter seq 3, got: %#v", waiters["1"])
+	}
+
+	buf, err := json.Marshal(waiters)
+	if err != nil || !strings.Contains(string(buf), `"consistencySeq":7`) {
+		t.Errorf("expected serializable waiters, got: %s, err: %v", buf, err)
+	}
+
+	close(cancelCh)
+	for _, w := range dcw.ConsistencyWaiters()["0"].Waiters {
+		if !w.Cancelled {
+			t.Errorf("expected cancelled waiter, got: %#v", w)
+		}
+	}
+}
+
+// A bleve.Index whose Search blocks until released, and which records
+// whether it was closed while a search was inflight.
+type blockingBleveIndex struct {
+	bleve.Index
+	startedCh   chan struct{}
+	releaseCh   chan struct{}
+	inflight    int32
+	closedEarly int32
+}
+
+func (b *blockingBleveIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	atomic.AddInt32(&b.inflight, 1)
+	defer atomic.AddInt32(&b.inflight, -1)
+	b.startedCh <- struct{}{}
+	<-b.releaseCh
+	return &bleve.SearchResult{}, nil
+}
+
+func (b *blockingBleveIndex) Close() error {
+	if atomic.LoadInt32(&b.inflight) > 0 {
+		atomic.StoreInt32(&b.closedEarly, 1)
+	}
+	return nil
+}
+
+func TestBleveDestCloseWaitsForQueries(t *testing.T) {
+	defer func(prev int) { BleveDestCloseQueryWaitMS = prev }(BleveDestCloseQueryWaitMS)
+
+	for _, test := range []struct {
+		waitMS      int
+		closedEarly bool
+	}{
+		{10000, false},
+		{10, true}, // The close gives up waiting.
+	} {
+		BleveDestCloseQueryWaitMS = test.waitMS
+
+		bindex := &blockingBleveIndex{
+			startedCh: make(chan struct{}, 1),
+			releaseCh: make(chan struct{}),
+		}
+		bdest := NewBleveDest("", bindex, func() {}).(*BleveDest)
+		qindex := &bleveDestIndex{Index: bindex, bdest: bdest}
+
+		searchErrCh := make(chan error, 1)
+		go func() {
+			_, err := qindex.Search(bleve.NewSearchRequest(
+				bleve.NewMatchQuery("hello")))
+			searchErrCh <- err
+		}()
+		<-bindex.startedCh
+
+		closeErrCh := make(chan error, 1)
+		go func() {
+			closeErrCh <- bdest.Close()
+		}()
+
+		if !test.closedEarly {
+			select {
+			case <-closeErrCh:
+				t.Errorf("expected close to wait for the inflight query")
+			case <-time.After(50 * time.Millisecond):
+			}
+		} else {
+			err := <-closeErrCh
+			if err != nil {
+				t.Errorf("expected close to work, err: %v", err)
+			}
+		}
+
+		close(bindex.releaseCh)
+
+		err := <-searchErrCh
+		if err != nil {
+			t.Errorf("expected the inflight query to work, err: %v", err)
+		}
+		if !test.closedEarly {
+			err = <-closeErrCh
+			if err != nil {
+				t.Errorf("expected close to work, err: %v", err)
+			}
+		}
+		if (atomic.LoadInt32(&bindex.closedEarly) == 1) != test.closedEarly {
+			t.Errorf("waitMS: %d, expected closedEarly: %v",
+				test.waitMS, test.closedEarly)
+		}
+
+		// Queries after the close fail cleanly.
+		_, err = qindex.Search(bleve.NewSearchRequest(
+			bleve.NewMatchQuery("hello")))
+		if err != errBleveDestClosed {
+			t.Errorf("expected errBleveDestClosed, got: %v", err)
+		}
+		_, err = qindex.DocCount()
+		if err != errBleveDestClosed {
+			t.Errorf("expected errBleveDestClosed from DocCount, got: %v", err)
+		}
+	}
+}
@@ -26,6 +26,14 @@ type Feed interface {
 	Stats(io.Writer) error
 }
 
+// A Feed may optionally implement the FeedPauser interface, so that
+// it can be paused (such as for a maintenance window) and later
+// resumed without being closed.  See Manager.PauseFeed().
+type FeedPauser interface {
+	Pause() error
+	Resume() error
+}
+
 // Default values for feed parameters.
 const FEED_SLEEP_MAX_MS = 10000
 const FEED_SLEEP_INIT_MS = 100
@@ -36,6 +44,7 @@ var feedTypes = make(map[string]*FeedType) // Key is sourceType.
 type FeedType struct {
 	Start       FeedStartFunc
 	Partitions  FeedPartitionsFunc
+	Topology    FeedTopologyFunc // Optional, may be nil.
 	Public      bool
 	Description string
 	StartSample interface{}
@@ -48,10 +57,31 @@ type FeedStartFunc func(mgr *Manager, feedName, indexName, indexUUID string,
 type FeedPartitionsFunc func(sourceType, sourceName, sourceUUID, sourceParams,
 	server string) ([]string, error)
 
+// A FeedTopologyFunc returns an opaque signature of the data source's
+// current topology, such as which servers own which partitions, so
+// that the Manager can notice when a data source has been rebalanced.
+type FeedTopologyFunc func(sourceType, sourceName, sourceUUID, sourceParams,
+	server string) (string, error)
+
 func RegisterFeedType(sourceType string, f *FeedType) {
 	feedTypes[sourceType] = f
 }
 
+// ListFeedTypes returns the registered, public feed types, keyed by
+// sourceType.
+func ListFeedTypes() map[string]*MetaDesc {
+	rv := map[string]*MetaDesc{}
+	for sourceType, f := range feedTypes {
+		if f.Public {
+			rv[sourceType] = &MetaDesc{
+				Description: f.Description,
+				StartSample: f.StartSample,
+			}
+		}
+	}
+	return rv
+}
+
 func DataSourcePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 	server string) ([]string, error) {
 	feedType, exists := feedTypes[sourceType]
@@ -61,3 +91,18 @@ func DataSourcePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 
 	return feedType.Partitions(sourceType, sourceName, sourceUUID, sourceParams, server)
 }
+
+// DataSourceTopology returns the topology signature of a data source,
+// or "" if the sourceType doesn't support topology signatures.
+func DataSourceTopology(sourceType, sourceName, sourceUUID, sourceParams,
+	server string) (string, error) {
+	feedType, exists := feedTypes[sourceType]
+	if !exists || feedType == nil {
+		return "", fmt.Errorf("error: topology unknown sourceType: %s", sourceType)
+	}
+	if feedType.Topology == nil {
+		return "", nil
+	}
+
+	return feedType.Topology(sourceType, sourceName, sourceUUID, sourceParams, server)
+}
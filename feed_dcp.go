@@ -12,16 +12,21 @@
 package cbft
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/couchbase/gomemcached"
 	log "github.com/couchbaselabs/clog"
 	"github.com/couchbaselabs/go-couchbase"
+	"github.com/golang/snappy"
 
 	"github.com/steveyen/cbdatasource"
 )
@@ -30,6 +35,7 @@ func init() {
 	RegisterFeedType("couchbase", &FeedType{
 		Start:       StartDCPFeed,
 		Partitions:  CouchbasePartitions,
+		Topology:    CouchbaseTopology,
 		Public:      true,
 		Description: "couchbase - Couchbase Server/Cluster data source",
 		StartSample: &DCPFeedParams{},
@@ -37,6 +43,7 @@ func init() {
 	RegisterFeedType("couchbase-dcp", &FeedType{
 		Start:       StartDCPFeed,
 		Partitions:  CouchbasePartitions,
+		Topology:    CouchbaseTopology,
 		Public:      false, // Won't be listed in /api/managerMeta output.
 		Description: "couchbase-dcp - Couchbase Server/Cluster data source, via DCP protocol",
 		StartSample: &DCPFeedParams{},
@@ -45,8 +52,15 @@ func init() {
 
 func StartDCPFeed(mgr *Manager, feedName, indexName, indexUUID,
 	sourceType, bucketName, bucketUUID, params string, dests map[string]Dest) error {
-	feed, err := NewDCPFeed(feedName, mgr.server, "default",
-		bucketName, bucketUUID, params, BasicPartitionFunc, dests)
+	var feed Feed
+	var err error
+	if len(SourceBucketNames(bucketName)) > 1 {
+		feed, err = NewDCPMultiFeed(feedName, mgr.server, "default",
+			bucketName, bucketUUID, params, BasicPartitionFunc, dests, mgr)
+	} else {
+		feed, err = NewDCPFeed(feedName, mgr.server, "default",
+			bucketName, bucketUUID, params, BasicPartitionFunc, dests, mgr)
+	}
 	if err != nil {
 		return fmt.Errorf("error: could not prepare DCP feed to server: %s,"+
 			" bucketName: %s, indexName: %s, err: %v",
@@ -75,13 +89,36 @@ type DCPFeed struct {
 	params     *DCPFeedParams
 	pf         DestPartitionFunc
 	dests      map[string]Dest
-	bds        cbdatasource.BucketDataSource
+	namespace  string // Non-empty when dests are namespaced by bucketName.
+	vbParts    vbucketPartitions
+	vbucketIds []uint16
+	auth       couchbase.AuthHandler
+	options    *cbdatasource.BucketDataSourceOptions
+	mgr        *Manager // Might be nil for testing.
+
+	m        sync.Mutex
+	bds      cbdatasource.BucketDataSource // Replaced on Resume().
+	closed   bool
+	paused   bool
+	lastErr  error
+	fatalErr error // Non-nil when stopped on a non-recoverable error.
+
+	checkingBucket bool // True while dcpFeedCheckBucket() is inflight.
+
+	// Ring buffer of the most recent errors, where errHistoryNext is
+	// the slot for the next error once the ring buffer is full.
+	errHistory     []DCPFeedError
+	errHistoryNext int
 
-	m       sync.Mutex
-	closed  bool
-	lastErr error
+	retryStats DCPFeedRetryStats
+
+	// The partition workers when DispatchQueueSize > 0, keyed by
+	// partition, which stop when stopCh is closed.
+	dispatchers map[string]*dcpDispatcher
+	stopCh      chan struct{}
 
 	numError         uint64
+	numSkipped       uint64
 	numUpdate        uint64
 	numDelete        uint64
 	numSnapshotStart uint64
@@ -90,6 +127,38 @@ type DCPFeed struct {
 	numRollback      uint64
 }
 
+// DCPFeedRetryStats tracks the retry state of a DCPFeed's data
+// source, to help operators spot a flapping feed.
+type DCPFeedRetryStats struct {
+	// Number of errors since the last sustained healthy streaming.
+	NumRetries uint64 `json:"numRetries"`
+
+	// Number of times NumRetries was reset to 0.
+	NumResets uint64 `json:"numResets"`
+
+	LastErrorTime    time.Time `json:"lastErrorTime"`
+	LastProgressTime time.Time `json:"lastProgressTime"`
+}
+
+// A DCPFeed's NumRetries is reset when data streams successfully at
+// least this long after the last error.
+const DCP_FEED_HEALTHY_MS = 10000
+
+var dcpFeedTimeNow = time.Now // Overridable for testing.
+
+// A DCPFeedError is an error seen by a DCPFeed, as kept in its error
+// history.
+type DCPFeedError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// The number of recent errors that a DCPFeed keeps in its error
+// history, when DCPFeedParams.ErrorHistorySize is zero-valued.
+const DCP_FEED_ERROR_HISTORY_SIZE = 10
+
+var dcpNewBucketDataSource = cbdatasource.NewBucketDataSource // For testing.
+
 type DCPFeedParams struct {
 	AuthUser     string `json:"authUser"` // May be "" for no auth.
 	AuthPassword string `json:"authPassword"`
@@ -120,14 +189,123 @@ type DCPFeedParams struct {
 	// Used for UPR flow control and buffer-ack messages when this
 	// percentage of FeedBufferSizeBytes is reached.
 	FeedBufferAckThreshold float32 `json:"feedBufferAckThreshold"`
+
+	// Groups vbuckets into this many logical partitions, when > 0.
+	// See CouchbasePartitionNames().
+	NumPartitions int `json:"numPartitions"`
+
+	// When true, the extended attributes (XATTRs) of a mutation are
+	// merged into its JSON document as an object under the
+	// XAttrsNamespace field, so that index mappings can reference
+	// them.  Otherwise, XATTRs are stripped.  Of note, the server
+	// only sends XATTRs on DCP connections that enable them.
+	IncludeXAttrs bool `json:"includeXAttrs"`
+
+	// Defaults to DCP_FEED_XATTRS_NAMESPACE when "".
+	XAttrsNamespace string `json:"xattrsNamespace"`
+
+	// When true, the CAS, flags and expiry of a mutation are merged
+	// into its JSON document as the reserved DCP_FEED_META_CAS,
+	// DCP_FEED_META_FLAGS and DCP_FEED_META_EXPTIME number fields,
+	// so that queries can filter and sort on them.  A document's own
+	// field of the same name takes precedence, as it comes later.
+	IncludeMetadata bool `json:"includeMetadata"`
+
+	// The number of recent errors kept for the feed's stats.
+	// Defaults to DCP_FEED_ERROR_HISTORY_SIZE when 0, and a negative
+	// value disables the error history.
+	ErrorHistorySize int `json:"errorHistorySize"`
+
+	// When true, mutations for a vbucket that has no dest, such as a
+	// vbucket that moved away during a rebalance, are skipped and
+	// counted in the feed's numSkipped stat, instead of failing the
+	// vbucket's stream.
+	SkipUnassignedVBuckets bool `json:"skipUnassignedVBuckets"`
+
+	// When > 0, the mutations and snapshot markers of a partition are
+	// dispatched to its dest by a worker goroutine per partition, via
+	// a queue of up to this many entries, so that the data source's
+	// callbacks needn't wait for spiky dest applies.  A full queue
+	// blocks the callback, for backpressure.  The order within a
+	// partition is preserved, and the consecutive queued mutations
+	// of a dest that implements DestBatch are handed to it in a
+	// single call.  After a queued dispatch fails, the rest of the
+	// partition's queue is dropped and its callbacks fail, so that
+	// its seq doesn't advance past the failed mutation, until a
+	// metadata read returns the error and the data source restreams
+	// from the partition's last applied seq.  Metadata reads and
+	// rollbacks first wait for the partition's queue to drain.
+	DispatchQueueSize int `json:"dispatchQueueSize"`
 }
 
+// The default document field that holds a mutation's XATTRs.
+const DCP_FEED_XATTRS_NAMESPACE = "_xattrs"
+
+// The document fields that hold a mutation's metadata.  Of note, a
+// CAS beyond 2^53 loses precision as a JSON number, although it still
+// orders correctly enough for range queries.
+const DCP_FEED_META_CAS = "_cas"
+const DCP_FEED_META_FLAGS = "_flags"
+const DCP_FEED_META_EXPTIME = "_exptime"
+
 func (d *DCPFeedParams) GetCredentials() (string, string) {
 	return d.AuthUser, d.AuthPassword
 }
 
+// Default values for DCP feed flow control, used when the
+// corresponding DCPFeedParams are zero-valued.
+const DCP_FEED_BUFFER_SIZE_BYTES = uint32(20000000)
+const DCP_FEED_BUFFER_ACK_THRESHOLD = float32(0.2)
+
+// NewDCPFeedOptions returns the cbdatasource options for a DCP feed,
+// where any zero-valued backoff and flow control params are replaced
+// by defaults (see FEED_BACKOFF_FACTOR, FEED_SLEEP_INIT_MS,
+// FEED_SLEEP_MAX_MS, DCP_FEED_BUFFER_SIZE_BYTES and
+// DCP_FEED_BUFFER_ACK_THRESHOLD).
+func NewDCPFeedOptions(name string,
+	params *DCPFeedParams) *cbdatasource.BucketDataSourceOptions {
+	options := &cbdatasource.BucketDataSourceOptions{
+		Name:                        fmt.Sprintf("%s-%x", name, rand.Int31()),
+		ClusterManagerBackoffFactor: params.ClusterManagerBackoffFactor,
+		ClusterManagerSleepInitMS:   params.ClusterManagerSleepInitMS,
+		ClusterManagerSleepMaxMS:    params.ClusterManagerSleepMaxMS,
+		DataManagerBackoffFactor:    params.DataManagerBackoffFactor,
+		DataManagerSleepInitMS:      params.DataManagerSleepInitMS,
+		DataManagerSleepMaxMS:       params.DataManagerSleepMaxMS,
+		FeedBufferSizeBytes:         params.FeedBufferSizeBytes,
+		FeedBufferAckThreshold:      params.FeedBufferAckThreshold,
+	}
+
+	if options.ClusterManagerBackoffFactor <= 0.0 {
+		options.ClusterManagerBackoffFactor = FEED_BACKOFF_FACTOR
+	}
+	if options.ClusterManagerSleepInitMS <= 0 {
+		options.ClusterManagerSleepInitMS = FEED_SLEEP_INIT_MS
+	}
+	if options.ClusterManagerSleepMaxMS <= 0 {
+		options.ClusterManagerSleepMaxMS = FEED_SLEEP_MAX_MS
+	}
+	if options.DataManagerBackoffFactor <= 0.0 {
+		options.DataManagerBackoffFactor = FEED_BACKOFF_FACTOR
+	}
+	if options.DataManagerSleepInitMS <= 0 {
+		options.DataManagerSleepInitMS = FEED_SLEEP_INIT_MS
+	}
+	if options.DataManagerSleepMaxMS <= 0 {
+		options.DataManagerSleepMaxMS = FEED_SLEEP_MAX_MS
+	}
+	if options.FeedBufferSizeBytes <= 0 {
+		options.FeedBufferSizeBytes = DCP_FEED_BUFFER_SIZE_BYTES
+	}
+	if options.FeedBufferAckThreshold <= 0.0 {
+		options.FeedBufferAckThreshold = DCP_FEED_BUFFER_ACK_THRESHOLD
+	}
+
+	return options
+}
+
 func NewDCPFeed(name, url, poolName, bucketName, bucketUUID, paramsStr string,
-	pf DestPartitionFunc, dests map[string]Dest) (*DCPFeed, error) {
+	pf DestPartitionFunc, dests map[string]Dest, mgr *Manager) (*DCPFeed, error) {
 	params := &DCPFeedParams{}
 	if paramsStr != "" {
 		err := json.Unmarshal([]byte(paramsStr), params)
@@ -144,22 +322,20 @@ func NewDCPFeed(name, url, poolName, bucketName, bucketUUID, paramsStr string,
 		vbucketIds = nil
 	}
 
+	namespace := ""
+	for partition := range dests {
+		if strings.HasPrefix(partition, NamespacedPartition(bucketName, "")) {
+			namespace = bucketName
+			break
+		}
+	}
+
 	var auth couchbase.AuthHandler
 	if params.AuthUser != "" {
 		auth = params
 	}
 
-	options := &cbdatasource.BucketDataSourceOptions{
-		Name: fmt.Sprintf("%s-%x", name, rand.Int31()),
-		ClusterManagerBackoffFactor: params.ClusterManagerBackoffFactor,
-		ClusterManagerSleepInitMS:   params.ClusterManagerSleepInitMS,
-		ClusterManagerSleepMaxMS:    params.ClusterManagerSleepMaxMS,
-		DataManagerBackoffFactor:    params.DataManagerBackoffFactor,
-		DataManagerSleepInitMS:      params.DataManagerSleepInitMS,
-		DataManagerSleepMaxMS:       params.DataManagerSleepMaxMS,
-		FeedBufferSizeBytes:         params.FeedBufferSizeBytes,
-		FeedBufferAckThreshold:      params.FeedBufferAckThreshold,
-	}
+	options := NewDCPFeedOptions(name, params)
 
 	feed := &DCPFeed{
 		name:       name,
@@ -170,12 +346,16 @@ func NewDCPFeed(name, url, poolName, bucketName, bucketUUID, paramsStr string,
 		params:     params,
 		pf:         pf,
 		dests:      dests,
+		namespace:  namespace,
+		vbParts:    newVBucketPartitions(dests, namespace),
+		vbucketIds: vbucketIds,
+		auth:       auth,
+		options:    options,
+		mgr:        mgr,
+		stopCh:     make(chan struct{}),
 	}
 
-	feed.bds, err = cbdatasource.NewBucketDataSource(
-		strings.Split(url, ";"),
-		poolName, bucketName, bucketUUID,
-		vbucketIds, auth, feed, options)
+	feed.bds, err = feed.newBucketDataSource()
 	if err != nil {
 		return nil, err
 	}
@@ -183,13 +363,23 @@ func NewDCPFeed(name, url, poolName, bucketName, bucketUUID, paramsStr string,
 	return feed, nil
 }
 
+func (t *DCPFeed) newBucketDataSource() (cbdatasource.BucketDataSource, error) {
+	return dcpNewBucketDataSource(
+		strings.Split(t.url, ";"),
+		t.poolName, t.bucketName, t.bucketUUID,
+		t.vbucketIds, t.auth, t, t.options)
+}
+
 func (t *DCPFeed) Name() string {
 	return t.name
 }
 
 func (t *DCPFeed) Start() error {
 	log.Printf("DCPFeed.Start, name: %s", t.Name())
-	return t.bds.Start()
+	t.m.Lock()
+	bds := t.bds
+	t.m.Unlock()
+	return bds.Start()
 }
 
 func (t *DCPFeed) Close() error {
@@ -199,54 +389,545 @@ func (t *DCPFeed) Close() error {
 		return nil
 	}
 	t.closed = true
+	paused := t.paused
+	bds := t.bds
+	close(t.stopCh)
 	t.m.Unlock()
 
 	log.Printf("DCPFeed.Close, name: %s", t.Name())
-	return t.bds.Close()
+	if paused {
+		return nil // The bds was already closed by Pause().
+	}
+	return bds.Close()
+}
+
+// Pause stops the feed from consuming from its data source.  The
+// stream position is kept by the dests, as a later Resume() restarts
+// streaming from each partition's persisted opaque and seq (see
+// GetMetaData()).
+func (t *DCPFeed) Pause() error {
+	t.m.Lock()
+	if t.closed {
+		t.m.Unlock()
+		return fmt.Errorf("error: DCPFeed.Pause, feed closed, name: %s", t.name)
+	}
+	if t.paused {
+		t.m.Unlock()
+		return nil
+	}
+	t.paused = true
+	bds := t.bds
+	t.m.Unlock()
+
+	log.Printf("DCPFeed.Pause, name: %s", t.Name())
+	return bds.Close()
+}
+
+// Resume restarts streaming on a paused feed with a new data source.
+func (t *DCPFeed) Resume() error {
+	t.m.Lock()
+	if t.closed {
+		t.m.Unlock()
+		return fmt.Errorf("error: DCPFeed.Resume, feed closed, name: %s", t.name)
+	}
+	if !t.paused {
+		t.m.Unlock()
+		return nil
+	}
+	bds, err := t.newBucketDataSource()
+	if err != nil {
+		t.m.Unlock()
+		return err
+	}
+	t.bds = bds
+	t.paused = false
+	t.m.Unlock()
+
+	log.Printf("DCPFeed.Resume, name: %s", t.Name())
+	return bds.Start()
 }
 
 func (t *DCPFeed) Dests() map[string]Dest {
 	return t.dests
 }
 
+// DCPFeedStats are the counters of a DCPFeed's own callbacks.
+type DCPFeedStats struct {
+	NumError         uint64 `json:"numError"`
+	NumSkipped       uint64 `json:"numSkipped"` // See SkipUnassignedVBuckets.
+	NumUpdate        uint64 `json:"numUpdate"`
+	NumDelete        uint64 `json:"numDelete"`
+	NumSnapshotStart uint64 `json:"numSnapshotStart"`
+	NumSetMetaData   uint64 `json:"numSetMetaData"`
+	NumGetMetaData   uint64 `json:"numGetMetaData"`
+	NumRollback      uint64 `json:"numRollback"`
+}
+
+// Stats snapshots the feed's counters while only briefly holding t.m,
+// which the mutation path also uses, and then serializes and writes
+// outside of the lock, so that a slow stats consumer never stalls
+// the mutation path.
 func (t *DCPFeed) Stats(w io.Writer) error {
+	t.m.Lock()
+	bds := t.bds
+	retryStats := t.retryStats
+	errHistory := t.errorHistoryUnlocked()
+	feedStats := DCPFeedStats{
+		NumError:         t.numError,
+		NumSkipped:       t.numSkipped,
+		NumUpdate:        t.numUpdate,
+		NumDelete:        t.numDelete,
+		NumSnapshotStart: t.numSnapshotStart,
+		NumSetMetaData:   t.numSetMetaData,
+		NumGetMetaData:   t.numGetMetaData,
+		NumRollback:      t.numRollback,
+	}
+	t.m.Unlock()
+
 	bdss := cbdatasource.BucketDataSourceStats{}
-	err := t.bds.Stats(&bdss)
+	err := bds.Stats(&bdss)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(&struct {
+		cbdatasource.BucketDataSourceStats
+		RetryStats   DCPFeedRetryStats `json:"retryStats"`
+		FeedStats    DCPFeedStats      `json:"feedStats"`
+		ErrorHistory []DCPFeedError    `json:"errorHistory"`
+	}{bdss, retryStats, feedStats, errHistory})
 	if err != nil {
 		return err
 	}
-	return json.NewEncoder(w).Encode(&bdss)
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// RetryStats returns a snapshot of the feed's retry state.
+func (t *DCPFeed) RetryStats() DCPFeedRetryStats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.retryStats
+}
+
+// ErrorHistory returns a copy of the feed's most recent errors,
+// oldest first.
+func (t *DCPFeed) ErrorHistory() []DCPFeedError {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.errorHistoryUnlocked()
+}
+
+func (t *DCPFeed) errorHistoryUnlocked() []DCPFeedError {
+	rv := make([]DCPFeedError, 0, len(t.errHistory))
+	rv = append(rv, t.errHistory[t.errHistoryNext:]...)
+	return append(rv, t.errHistory[:t.errHistoryNext]...)
+}
+
+// Invoked with t.m locked to remember an error in the error history.
+func (t *DCPFeed) addErrorHistoryUnlocked(now time.Time, err error) {
+	size := t.params.ErrorHistorySize
+	if size == 0 {
+		size = DCP_FEED_ERROR_HISTORY_SIZE
+	}
+	if size < 0 {
+		return
+	}
+
+	e := DCPFeedError{Time: now, Error: err.Error()}
+	if len(t.errHistory) < size {
+		t.errHistory = append(t.errHistory, e)
+		return
+	}
+	t.errHistory[t.errHistoryNext] = e
+	t.errHistoryNext = (t.errHistoryNext + 1) % size
+}
+
+// Invoked with t.m locked when data was successfully streamed.
+func (t *DCPFeed) onProgressUnlocked() {
+	now := dcpFeedTimeNow()
+	t.retryStats.LastProgressTime = now
+	if t.retryStats.NumRetries > 0 &&
+		now.Sub(t.retryStats.LastErrorTime) >=
+			time.Duration(DCP_FEED_HEALTHY_MS)*time.Millisecond {
+		t.retryStats.NumRetries = 0
+		t.retryStats.NumResets += 1
+	}
 }
 
 // --------------------------------------------------------
 
+// The memcached response statuses that mean a DCPFeed can't make
+// progress by retrying, and that need user attention.
+var dcpFeedFatalStatuses = map[gomemcached.Status]bool{
+	gomemcached.AUTH_ERROR: true,
+}
+
+// A DCPFeedBucketError means that a DCPFeed's bucket is missing, or
+// was recreated, so that it no longer has the feed's bucketUUID.
+type DCPFeedBucketError struct {
+	BucketName string
+	BucketUUID string // The feed's bucketUUID, which may be "".
+	Missing    bool   // False when the bucket was recreated.
+}
+
+func (e *DCPFeedBucketError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("error: DCPFeed bucket not found,"+
+			" bucketName: %s", e.BucketName)
+	}
+	return fmt.Sprintf("error: DCPFeed mismatched bucket uuid,"+
+		" bucketName: %s, bucketUUID: %s", e.BucketName, e.BucketUUID)
+}
+
+// DCPFeedErrorIsFatal returns true when an error isn't recoverable,
+// which is a *DCPFeedBucketError, or a memcached response with an
+// auth failure status; as opposed to transient errors, like network
+// errors, which the data source retries.
+func DCPFeedErrorIsFatal(err error) bool {
+	switch e := err.(type) {
+	case *DCPFeedBucketError:
+		return true
+	case *gomemcached.MCResponse:
+		return dcpFeedFatalStatuses[e.Status]
+	}
+	return false
+}
+
+// dcpFeedCheckBucket returns a *DCPFeedBucketError when a DCPFeed's
+// bucket is missing from the cluster's pool or no longer has the
+// feed's bucketUUID, and is a variable so that tests can supply a
+// fake cluster.  The data source only reports those conditions as
+// messages, so a DCPFeed checks its bucket on the data source's
+// errors that aren't known to be fatal.
+var dcpFeedCheckBucket = func(url, poolName, bucketName,
+	bucketUUID string) error {
+	client, err := couchbase.Connect(strings.Split(url, ";")[0])
+	if err != nil {
+		return err
+	}
+	pool, err := client.GetPool(poolName)
+	if err != nil {
+		return err
+	}
+	bucket, exists := pool.BucketMap[bucketName]
+	if !exists {
+		return &DCPFeedBucketError{BucketName: bucketName,
+			BucketUUID: bucketUUID, Missing: true}
+	}
+	if bucketUUID != "" && bucketUUID != bucket.UUID {
+		return &DCPFeedBucketError{BucketName: bucketName,
+			BucketUUID: bucketUUID}
+	}
+	return nil
+}
+
+// OnError is invoked by the data source, whose errors are retried
+// unless they're fatal, or until dcpFeedCheckBucket() finds that the
+// bucket is gone.
 func (r *DCPFeed) OnError(err error) {
-	// TODO: Check the type of the error if it's something
-	// serious / not-recoverable / needs user attention.
 	log.Printf("DCPFeed.OnError: %s: %v\n", r.name, err)
 
+	fatal := DCPFeedErrorIsFatal(err)
+
+	now := dcpFeedTimeNow()
+
+	r.m.Lock()
+	r.numError += 1
+	r.lastErr = err
+	r.addErrorHistoryUnlocked(now, err)
+	r.retryStats.NumRetries += 1
+	r.retryStats.LastErrorTime = now
+	checkBucket := !fatal && !r.checkingBucket &&
+		r.fatalErr == nil && !r.closed
+	if checkBucket {
+		r.checkingBucket = true
+	}
+	r.m.Unlock()
+
+	if fatal {
+		r.onFatalError(err)
+	} else if checkBucket {
+		// Asynchronous, as we might be invoked from the data
+		// source's own goroutines.
+		go func() {
+			err := dcpFeedCheckBucket(r.url, r.poolName,
+				r.bucketName, r.bucketUUID)
+
+			r.m.Lock()
+			r.checkingBucket = false
+			r.m.Unlock()
+
+			if DCPFeedErrorIsFatal(err) {
+				r.onFatalError(err)
+			}
+		}()
+	}
+}
+
+// Stops the feed on its first non-recoverable error, which is then
+// surfaced to the manager.
+func (r *DCPFeed) onFatalError(err error) {
+	r.m.Lock()
+	firstFatal := r.fatalErr == nil
+	if firstFatal {
+		r.fatalErr = err
+		if r.lastErr != err {
+			r.lastErr = err
+			r.addErrorHistoryUnlocked(dcpFeedTimeNow(), err)
+		}
+	}
+	r.m.Unlock()
+
+	if firstFatal {
+		// Stop the data source from retrying, asynchronously as we
+		// might be invoked from the data source's own goroutines.
+		go r.Close()
+
+		if r.mgr != nil {
+			r.mgr.feedFatalError("couchbase", r, err)
+		}
+	}
+}
+
+// Invoked when a dest fails a dispatched callback, which is counted
+// as an error of the feed, but not as a data source retry, as the
+// data source didn't see it, nor checked for fatality.
+func (r *DCPFeed) onDestError(err error) {
 	r.m.Lock()
 	r.numError += 1
 	r.lastErr = err
+	r.addErrorHistoryUnlocked(dcpFeedTimeNow(), err)
 	r.m.Unlock()
 }
 
+// FatalErr returns the non-recoverable error that stopped the feed,
+// if any.
+func (r *DCPFeed) FatalErr() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.fatalErr
+}
+
+// Returns the partition and dest of a vbucket, where the dest is nil
+// without an error for a vbucket that has no dest when the feed's
+// SkipUnassignedVBuckets param is true, and a key, if any, is then
+// counted as a skipped mutation.
+func (r *DCPFeed) partitionDest(vbucketId uint16, key []byte) (
+	string, Dest, error) {
+	partition, dest, err := r.vbucketPartitionDest(vbucketId, key)
+	if err != nil &&
+		r.params.SkipUnassignedVBuckets &&
+		int(vbucketId) < len(vbucketIdStrings) {
+		if key != nil {
+			r.m.Lock()
+			r.numSkipped += 1
+			r.m.Unlock()
+		}
+		return "", nil, nil
+	}
+	return partition, dest, err
+}
+
 func (r *DCPFeed) DataUpdate(vbucketId uint16, key []byte, seq uint64,
 	req *gomemcached.MCRequest) error {
 	// log.Printf("DCPFeed.DataUpdate: %s: vbucketId: %d, key: %s, seq: %d, req: %v\n",
 	// r.name, vbucketId, key, seq, req)
 
-	partition, dest, err :=
-		VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, key)
-	if err != nil {
+	partition, dest, err := r.partitionDest(vbucketId, key)
+	if err != nil || dest == nil {
 		return err
 	}
 
+	if r.params.DispatchQueueSize > 0 {
+		// The data source may reuse its buffers once we return.
+		key = append([]byte(nil), key...)
+	}
+
 	r.m.Lock()
 	r.numUpdate += 1
+	r.onProgressUnlocked()
 	r.m.Unlock()
 
-	return dest.OnDataUpdate(partition, key, seq, req.Body)
+	xattrsNamespace := ""
+	if r.params.IncludeXAttrs {
+		xattrsNamespace = r.params.XAttrsNamespace
+		if xattrsNamespace == "" {
+			xattrsNamespace = DCP_FEED_XATTRS_NAMESPACE
+		}
+	}
+
+	val, err := DCPFeedRequestValue(req, xattrsNamespace)
+	if err != nil {
+		// Treat an undecodable doc like a deletion, so that the
+		// partition's seq still advances and no stale version of
+		// the doc stays indexed.
+		log.Printf("DCPFeed.DataUpdate: %s: skipping doc, vbucketId: %d,"+
+			" key: %s, seq: %d, err: %v", r.name, vbucketId, key, seq, err)
+		return r.dispatchMutation(partition, dest, DestMutation{
+			Key: key, Seq: seq, Delete: true,
+		})
+	}
+
+	if r.params.IncludeMetadata {
+		val, err = mergeDCPMetadata(val, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.params.DispatchQueueSize > 0 {
+		// The value may still alias the data source's buffers.
+		val = append([]byte(nil), val...)
+	}
+
+	return r.dispatchMutation(partition, dest, DestMutation{
+		Key: key, Seq: seq, Val: val,
+	})
+}
+
+// The DCP datatype bits that flag a Snappy compressed value and a
+// value that's prefixed by XATTRs.
+const DCP_DATATYPE_SNAPPY = 0x02
+const DCP_DATATYPE_XATTR = 0x04
+
+// DCPFeedRequestValue returns the document value of a DCP mutation,
+// decompressing it if its datatype flags it as Snappy compressed, and
+// otherwise passing it through as-is.  A value's XATTRs are stripped,
+// unless xattrsNamespace is non-empty, in which case they're merged
+// into the document as an object under the xattrsNamespace field.
+func DCPFeedRequestValue(req *gomemcached.MCRequest,
+	xattrsNamespace string) ([]byte, error) {
+	val := req.Body
+	if req.DataType&DCP_DATATYPE_SNAPPY != 0 {
+		var err error
+		val, err = snappy.Decode(nil, req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error: could not decompress snappy value,"+
+				" err: %v", err)
+		}
+	}
+	if req.DataType&DCP_DATATYPE_XATTR == 0 {
+		return val, nil
+	}
+
+	xattrs, body, err := ParseXAttrs(val)
+	if err != nil {
+		return nil, err
+	}
+	if xattrsNamespace == "" || len(xattrs) <= 0 {
+		return body, nil
+	}
+	return mergeXAttrs(body, xattrsNamespace, xattrs)
+}
+
+// ParseXAttrs splits a value that's prefixed by XATTRs into the
+// XATTRs, keyed by name, and the document body.  The framing is a
+// 4 byte, big endian length of all the XATTRs, followed by each XATTR
+// as a 4 byte, big endian length and then "name\x00value\x00", where
+// each value is JSON.
+func ParseXAttrs(val []byte) (map[string]json.RawMessage, []byte, error) {
+	if len(val) < 4 {
+		return nil, nil, fmt.Errorf("error: ParseXAttrs, value too short")
+	}
+	xattrsLen := int(binary.BigEndian.Uint32(val))
+	if xattrsLen > len(val)-4 {
+		return nil, nil, fmt.Errorf("error: ParseXAttrs, bad xattrs length")
+	}
+	xattrs := map[string]json.RawMessage{}
+	for pos := 4; pos < 4+xattrsLen; {
+		if pos+4 > 4+xattrsLen {
+			return nil, nil, fmt.Errorf("error: ParseXAttrs, bad xattr framing")
+		}
+		pairLen := int(binary.BigEndian.Uint32(val[pos:]))
+		pos += 4
+		if pos+pairLen > 4+xattrsLen {
+			return nil, nil, fmt.Errorf("error: ParseXAttrs, bad xattr length")
+		}
+		pair := bytes.Split(val[pos:pos+pairLen], []byte{0})
+		if len(pair) != 3 || len(pair[2]) != 0 {
+			return nil, nil, fmt.Errorf("error: ParseXAttrs, bad xattr pair")
+		}
+		xattrs[string(pair[0])] = json.RawMessage(pair[1])
+		pos += pairLen
+	}
+	return xattrs, val[4+xattrsLen:], nil
+}
+
+// Returns the JSON object body with the xattrs added as the value of
+// the namespace field.  A body that's not a JSON object is returned
+// unchanged, as there's nowhere to merge the xattrs.
+func mergeXAttrs(body []byte, namespace string,
+	xattrs map[string]json.RawMessage) ([]byte, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) < 2 || trimmed[0] != '{' {
+		return body, nil
+	}
+
+	v, err := json.Marshal(xattrs) // Also validates the xattr values.
+	if err != nil {
+		return nil, fmt.Errorf("error: mergeXAttrs, bad xattrs, err: %v", err)
+	}
+
+	return mergeJSONField(trimmed, namespace, v)
+}
+
+// Returns the JSON object body with the metadata fields of a DCP
+// mutation added.  The flags and expiry are only available when the
+// mutation's extras are complete.
+func mergeDCPMetadata(body []byte, req *gomemcached.MCRequest) ([]byte, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) < 2 || trimmed[0] != '{' {
+		return body, nil
+	}
+
+	// The extras of a DCP mutation are the by_seqno, rev_seqno,
+	// flags, expiration, lock_time, ...
+	meta := map[string]uint64{DCP_FEED_META_CAS: req.Cas}
+	if len(req.Extras) >= 24 {
+		meta[DCP_FEED_META_FLAGS] =
+			uint64(binary.BigEndian.Uint32(req.Extras[16:20]))
+		meta[DCP_FEED_META_EXPTIME] =
+			uint64(binary.BigEndian.Uint32(req.Extras[20:24]))
+	}
+
+	for _, name := range []string{
+		DCP_FEED_META_CAS, DCP_FEED_META_FLAGS, DCP_FEED_META_EXPTIME} {
+		v, exists := meta[name]
+		if !exists {
+			continue
+		}
+		var err error
+		trimmed, err = mergeJSONField(trimmed, name,
+			[]byte(strconv.FormatUint(v, 10)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trimmed, nil
+}
+
+// Returns the trimmed JSON object body with the JSON value v added
+// as the first field, named name.
+func mergeJSONField(trimmed []byte, name string, v []byte) ([]byte, error) {
+	k, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := bytes.TrimSpace(trimmed[1:])
+
+	rv := make([]byte, 0, len(k)+len(v)+len(rest)+3)
+	rv = append(rv, '{')
+	rv = append(rv, k...)
+	rv = append(rv, ':')
+	rv = append(rv, v...)
+	if len(rest) > 0 && rest[0] != '}' {
+		rv = append(rv, ',')
+	}
+	return append(rv, rest...), nil
 }
 
 func (r *DCPFeed) DataDelete(vbucketId uint16, key []byte, seq uint64,
@@ -254,17 +935,231 @@ func (r *DCPFeed) DataDelete(vbucketId uint16, key []byte, seq uint64,
 	// log.Printf("DCPFeed.DataDelete: %s: vbucketId: %d, key: %s, seq: %d, req: %#v",
 	// r.name, vbucketId, key, seq, req)
 
-	partition, dest, err :=
-		VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, key)
-	if err != nil {
+	partition, dest, err := r.partitionDest(vbucketId, key)
+	if err != nil || dest == nil {
 		return err
 	}
 
 	r.m.Lock()
 	r.numDelete += 1
+	r.onProgressUnlocked()
 	r.m.Unlock()
 
-	return dest.OnDataDelete(partition, key, seq)
+	if r.params.DispatchQueueSize > 0 {
+		// The data source may reuse its buffers once we return.
+		key = append([]byte(nil), key...)
+	}
+
+	return r.dispatchMutation(partition, dest, DestMutation{
+		Key: key, Seq: seq, Delete: true,
+	})
+}
+
+// ----------------------------------------------------------------
+
+// A dcpDispatcher is the queue of a partition's worker goroutine,
+// when the DispatchQueueSize param is > 0.
+type dcpDispatcher struct {
+	ch chan dcpDispatch
+
+	m sync.Mutex
+
+	// The first error of a queued dispatch, while the dispatches
+	// queued after it are dropped, until taken by dispatchWait().
+	err error
+}
+
+// A dcpDispatch is an entry of a dcpDispatcher's queue, where a
+// non-nil doneCh marks a barrier that's closed once the entries
+// queued before it are done or dropped, and a non-nil mutation is
+// applied to dest, batched with the mutations queued right after it
+// when the dest implements DestBatch.
+type dcpDispatch struct {
+	f      func() error
+	doneCh chan struct{}
+
+	dest     Dest
+	mutation *DestMutation
+}
+
+func (d *dcpDispatcher) getErr() error {
+	d.m.Lock()
+	err := d.err
+	d.m.Unlock()
+	return err
+}
+
+func (d *dcpDispatcher) takeErr() error {
+	d.m.Lock()
+	err := d.err
+	d.err = nil
+	d.m.Unlock()
+	return err
+}
+
+// Returns the dispatcher of a partition, starting its worker on
+// first use.
+func (r *DCPFeed) dispatcher(partition string) *dcpDispatcher {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	d := r.dispatchers[partition]
+	if d == nil {
+		d = &dcpDispatcher{
+			ch: make(chan dcpDispatch, r.params.DispatchQueueSize),
+		}
+		if r.dispatchers == nil {
+			r.dispatchers = map[string]*dcpDispatcher{}
+		}
+		r.dispatchers[partition] = d
+
+		go r.runDispatcher(partition, d)
+	}
+	return d
+}
+
+func (r *DCPFeed) runDispatcher(partition string, d *dcpDispatcher) {
+	var next *dcpDispatch // An entry taken off the queue, but not a batch's.
+
+	for {
+		var e dcpDispatch
+		if next != nil {
+			e, next = *next, nil
+		} else {
+			select {
+			case <-r.stopCh:
+				return
+			case e = <-d.ch:
+			}
+		}
+
+		if e.doneCh != nil {
+			close(e.doneCh)
+			continue
+		}
+		if d.getErr() != nil {
+			// Dropped, as applying it would advance the
+			// partition's seq past the failed mutation.
+			continue
+		}
+
+		var err error
+		if e.mutation != nil {
+			var mutations []DestMutation
+			mutations, next = r.batchMutations(d, e)
+			err = DestOnDataUpdateBatch(e.dest, partition, mutations)
+		} else {
+			err = e.f()
+		}
+		if err != nil {
+			log.Printf("DCPFeed.runDispatcher: %s: partition: %s, err: %v",
+				r.name, partition, err)
+			d.m.Lock()
+			d.err = err
+			d.m.Unlock()
+
+			// Also report it right away, as the partition might
+			// not see another callback for a while.
+			r.onDestError(err)
+		}
+	}
+}
+
+// Returns the mutation of e, along with the mutations for the same
+// dest that are already queued right after it, up to the queue's
+// size, when the dest implements DestBatch.  Also returns the entry
+// that ended the batch, if one was taken off the queue.
+func (r *DCPFeed) batchMutations(d *dcpDispatcher, e dcpDispatch) (
+	[]DestMutation, *dcpDispatch) {
+	mutations := []DestMutation{*e.mutation}
+
+	if _, ok := e.dest.(DestBatch); !ok {
+		return mutations, nil
+	}
+
+	for len(mutations) < r.params.DispatchQueueSize {
+		select {
+		case n := <-d.ch:
+			if n.mutation == nil || n.dest != e.dest {
+				return mutations, &n
+			}
+			mutations = append(mutations, *n.mutation)
+		default:
+			return mutations, nil
+		}
+	}
+
+	return mutations, nil
+}
+
+// Invokes f, which calls the dest of a partition, either right away
+// or, when the DispatchQueueSize param is > 0, via the partition's
+// queue, blocking while the queue is full.  A queued dispatch that
+// failed fails every later dispatch of the partition, until the
+// error's taken by dispatchWait().
+func (r *DCPFeed) dispatch(partition string, f func() error) error {
+	if r.params.DispatchQueueSize <= 0 {
+		return f()
+	}
+
+	return r.enqueue(partition, dcpDispatch{f: f})
+}
+
+// Applies a data update or deletion to the dest of a partition, like
+// dispatch(), except that queued mutations may reach a dest that
+// implements DestBatch in batches.
+func (r *DCPFeed) dispatchMutation(partition string, dest Dest,
+	m DestMutation) error {
+	if r.params.DispatchQueueSize <= 0 {
+		if m.Delete {
+			return dest.OnDataDelete(partition, m.Key, m.Seq)
+		}
+		return dest.OnDataUpdate(partition, m.Key, m.Seq, m.Val)
+	}
+
+	return r.enqueue(partition, dcpDispatch{dest: dest, mutation: &m})
+}
+
+func (r *DCPFeed) enqueue(partition string, e dcpDispatch) error {
+	d := r.dispatcher(partition)
+
+	err := d.getErr()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case d.ch <- e:
+		return nil
+	case <-r.stopCh:
+		return fmt.Errorf("error: DCPFeed closed, name: %s", r.name)
+	}
+}
+
+// Waits until the queued dispatches of a partition, if any, are
+// done or dropped, returning and clearing the error of a failed
+// dispatch, after which the partition's dispatches are applied again.
+func (r *DCPFeed) dispatchWait(partition string) error {
+	if r.params.DispatchQueueSize <= 0 {
+		return nil
+	}
+
+	d := r.dispatcher(partition)
+
+	doneCh := make(chan struct{})
+	select {
+	case d.ch <- dcpDispatch{doneCh: doneCh}:
+	case <-r.stopCh:
+		return fmt.Errorf("error: DCPFeed closed, name: %s", r.name)
+	}
+
+	select {
+	case <-doneCh:
+	case <-r.stopCh:
+		return fmt.Errorf("error: DCPFeed closed, name: %s", r.name)
+	}
+
+	return d.takeErr()
 }
 
 func (r *DCPFeed) SnapshotStart(vbucketId uint16,
@@ -273,26 +1168,27 @@ func (r *DCPFeed) SnapshotStart(vbucketId uint16,
 		" snapStart: %d, snapEnd: %d, snapType: %d",
 		r.name, vbucketId, snapStart, snapEnd, snapType)
 
-	partition, dest, err :=
-		VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, nil)
-	if err != nil {
+	partition, dest, err := r.partitionDest(vbucketId, nil)
+	if err != nil || dest == nil {
 		return err
 	}
 
 	r.m.Lock()
 	r.numSnapshotStart += 1
+	r.onProgressUnlocked()
 	r.m.Unlock()
 
-	return dest.OnSnapshotStart(partition, snapStart, snapEnd)
+	return r.dispatch(partition, func() error {
+		return dest.OnSnapshotStart(partition, snapStart, snapEnd)
+	})
 }
 
 func (r *DCPFeed) SetMetaData(vbucketId uint16, value []byte) error {
 	log.Printf("DCPFeed.SetMetaData: %s: vbucketId: %d,"+
 		" value: %s", r.name, vbucketId, value)
 
-	partition, dest, err :=
-		VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, nil)
-	if err != nil {
+	partition, dest, err := r.partitionDest(vbucketId, nil)
+	if err != nil || dest == nil {
 		return err
 	}
 
@@ -300,15 +1196,20 @@ func (r *DCPFeed) SetMetaData(vbucketId uint16, value []byte) error {
 	r.numSetMetaData += 1
 	r.m.Unlock()
 
-	return dest.SetOpaque(partition, value)
+	if r.params.DispatchQueueSize > 0 {
+		value = append([]byte(nil), value...)
+	}
+
+	return r.dispatch(partition, func() error {
+		return dest.SetOpaque(partition, value)
+	})
 }
 
 func (r *DCPFeed) GetMetaData(vbucketId uint16) (value []byte, lastSeq uint64, err error) {
 	log.Printf("DCPFeed.GetMetaData: %s: vbucketId: %d", r.name, vbucketId)
 
-	partition, dest, err :=
-		VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, nil)
-	if err != nil {
+	partition, dest, err := r.partitionDest(vbucketId, nil)
+	if err != nil || dest == nil {
 		return nil, 0, err
 	}
 
@@ -316,15 +1217,54 @@ func (r *DCPFeed) GetMetaData(vbucketId uint16) (value []byte, lastSeq uint64, e
 	r.numGetMetaData += 1
 	r.m.Unlock()
 
+	err = r.dispatchWait(partition)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if destOpaqueApplied, ok := dest.(DestOpaqueApplied); ok {
+		return destOpaqueApplied.GetOpaqueApplied(partition)
+	}
+
 	return dest.GetOpaque(partition)
 }
 
+// Returns whether a partition is a logical partition that groups
+// several vbuckets, like "0-63".
+func dcpFeedPartitionIsGroup(partition string) bool {
+	_, vbPartition := SplitNamespacedPartition(partition)
+	return strings.Index(vbPartition, "-") > 0
+}
+
+// Returns the partition and dest of a vbucket.  A dest tracks a single
+// opaque and seq per partition, but each vbucket in a logical
+// partition that groups several vbuckets has its own failover log and
+// seqs, so the partition of such a vbucket is its own partition, like
+// "12", within the logical partition's dest.  See VBucketPartitions().
+func (r *DCPFeed) vbucketPartitionDest(vbucketId uint16, key []byte) (
+	string, Dest, error) {
+	partition, dest, err :=
+		r.vbParts.partitionDest(r.pf, r.dests, vbucketId, key)
+	if err != nil {
+		return "", nil, err
+	}
+	if dcpFeedPartitionIsGroup(partition) {
+		partition = NamespacedPartition(r.namespace,
+			vbucketIdStrings[vbucketId])
+	}
+	return partition, dest, nil
+}
+
 func (r *DCPFeed) Rollback(vbucketId uint16, rollbackSeq uint64) error {
 	log.Printf("DCPFeed.Rollback: %s: vbucketId: %d,"+
 		" rollbackSeq: %d", r.name, vbucketId, rollbackSeq)
 
-	partition, dest, err :=
-		VBucketIdToPartitionDest(r.pf, r.dests, vbucketId, nil)
+	partition, dest, err := r.vbucketPartitionDest(vbucketId, nil)
+	if err != nil {
+		return err
+	}
+
+	err = r.dispatchWait(partition)
 	if err != nil {
 		return err
 	}
@@ -335,3 +1275,128 @@ func (r *DCPFeed) Rollback(vbucketId uint16, rollbackSeq uint64) error {
 
 	return dest.Rollback(partition, rollbackSeq)
 }
+
+// --------------------------------------------------------
+
+// A DCPMultiFeed feeds an index from several buckets, via a DCPFeed
+// per bucket that all share the index's dests, whose partitions are
+// namespaced by bucket name.  See SourceBucketNames().  Of note,
+// document keys aren't namespaced, so the same key in several
+// buckets is indexed as a single document.
+type DCPMultiFeed struct {
+	name  string
+	dests map[string]Dest
+	feeds []*DCPFeed // Ordered like the source's bucket names.
+}
+
+func NewDCPMultiFeed(name, url, poolName, bucketNames, bucketUUIDs,
+	paramsStr string, pf DestPartitionFunc, dests map[string]Dest,
+	mgr *Manager) (*DCPMultiFeed, error) {
+	names := SourceBucketNames(bucketNames)
+	uuids, err := sourceBucketUUIDs(names, bucketUUIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split the dests by bucket, keeping their namespaced partitions.
+	bucketDests := map[string]map[string]Dest{}
+	for _, bucketName := range names {
+		bucketDests[bucketName] = map[string]Dest{}
+	}
+	for partition, dest := range dests {
+		bucketName, _ := SplitNamespacedPartition(partition)
+		if bucketDests[bucketName] == nil {
+			return nil, fmt.Errorf("error: NewDCPMultiFeed, partition: %s"+
+				" isn't namespaced by any of the bucketNames: %s",
+				partition, bucketNames)
+		}
+		bucketDests[bucketName][partition] = dest
+	}
+
+	feeds := make([]*DCPFeed, 0, len(names))
+	for i, bucketName := range names {
+		if len(bucketDests[bucketName]) <= 0 {
+			continue // Another node handles this bucket's partitions.
+		}
+		feed, err := NewDCPFeed(name+"_"+bucketName, url, poolName,
+			bucketName, uuids[i], paramsStr, pf, bucketDests[bucketName], mgr)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, feed)
+	}
+
+	return &DCPMultiFeed{name: name, dests: dests, feeds: feeds}, nil
+}
+
+func (t *DCPMultiFeed) Name() string {
+	return t.name
+}
+
+func (t *DCPMultiFeed) Start() error {
+	for _, feed := range t.feeds {
+		err := feed.Start()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *DCPMultiFeed) Close() error {
+	var rv error
+	for _, feed := range t.feeds {
+		err := feed.Close()
+		if err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
+
+func (t *DCPMultiFeed) Pause() error {
+	for _, feed := range t.feeds {
+		err := feed.Pause()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *DCPMultiFeed) Resume() error {
+	for _, feed := range t.feeds {
+		err := feed.Resume()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *DCPMultiFeed) Dests() map[string]Dest {
+	return t.dests
+}
+
+// Stats writes a JSON object of the per-bucket DCPFeed stats, keyed by
+// bucket name.
+func (t *DCPMultiFeed) Stats(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.Write([]byte("{"))
+	for i, feed := range t.feeds {
+		if i > 0 {
+			buf.Write([]byte(","))
+		}
+		k, _ := json.Marshal(feed.bucketName)
+		buf.Write(k)
+		buf.Write([]byte(":"))
+		err := feed.Stats(&buf)
+		if err != nil {
+			return err
+		}
+	}
+	buf.Write([]byte("}"))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,154 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Kinds of scripted SimpleFeedEvent's.
+const (
+	SIMPLE_FEED_UPDATE         = "update"
+	SIMPLE_FEED_DELETE         = "delete"
+	SIMPLE_FEED_SNAPSHOT_START = "snapshotStart"
+	SIMPLE_FEED_SET_OPAQUE     = "setOpaque"
+	SIMPLE_FEED_ROLLBACK       = "rollback"
+)
+
+// A SimpleFeedEvent is a single scripted data source event that a
+// SimpleFeed will send to its dests.
+type SimpleFeedEvent struct {
+	Kind      string // See SIMPLE_FEED_XXX constants.
+	Partition string
+	Key       []byte
+	Seq       uint64 // Also used as rollbackSeq for a rollback.
+	Val       []byte // Also used as the opaque value for setOpaque.
+	SnapStart uint64
+	SnapEnd   uint64
+}
+
+// A SimpleFeed is an in-memory Feed that sends a script of events to
+// its dests, in order and synchronously, without needing a real data
+// source.  It's intended for deterministic testing of Dest
+// implementations, such as a BleveDest.
+type SimpleFeed struct {
+	name   string
+	pf     DestPartitionFunc
+	dests  map[string]Dest
+	events []SimpleFeedEvent
+
+	m       sync.Mutex
+	numSent int // Number of events sent so far.
+}
+
+func NewSimpleFeed(name string, pf DestPartitionFunc,
+	dests map[string]Dest, events []SimpleFeedEvent) *SimpleFeed {
+	return &SimpleFeed{
+		name:   name,
+		pf:     pf,
+		dests:  dests,
+		events: events,
+	}
+}
+
+func (t *SimpleFeed) Name() string {
+	return t.name
+}
+
+// Start sends any remaining scripted events to the dests, stopping
+// on the first error.  A later Start() resumes after the events that
+// had the error.  Each event's Dest callback must return before the
+// next event is sent, even across concurrent Start()'s, so a
+// snapshot start is always completed before the mutations that
+// follow it.  Consecutive updates and deletes of a partition are
+// sent together to a dest that implements DestBatch.
+func (t *SimpleFeed) Start() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for t.numSent < len(t.events) {
+		i := t.numSent
+
+		n, err := t.sendUnlocked(i)
+		t.numSent += n
+		if err != nil {
+			return fmt.Errorf("error: SimpleFeed, name: %s, event: %d,"+
+				" kind: %s, err: %v", t.name, i, t.events[i].Kind, err)
+		}
+	}
+
+	return nil
+}
+
+// Sends the event at index i, along with any following mutations
+// that can be batched with it, and returns the number of events sent.
+func (t *SimpleFeed) sendUnlocked(i int) (int, error) {
+	event := &t.events[i]
+
+	dest, err := t.pf(event.Partition, event.Key, t.dests)
+	if err != nil {
+		return 1, fmt.Errorf("pf, err: %v", err)
+	}
+
+	switch event.Kind {
+	case SIMPLE_FEED_UPDATE, SIMPLE_FEED_DELETE:
+		mutations := []DestMutation(nil)
+		j := i
+		for j < len(t.events) {
+			e := &t.events[j]
+			if (e.Kind != SIMPLE_FEED_UPDATE && e.Kind != SIMPLE_FEED_DELETE) ||
+				e.Partition != event.Partition {
+				break
+			}
+			d, err := t.pf(e.Partition, e.Key, t.dests)
+			if err != nil || d != dest {
+				break
+			}
+			mutations = append(mutations, DestMutation{
+				Key:    e.Key,
+				Seq:    e.Seq,
+				Val:    e.Val,
+				Delete: e.Kind == SIMPLE_FEED_DELETE,
+			})
+			j++
+		}
+		return j - i, DestOnDataUpdateBatch(dest, event.Partition, mutations)
+	case SIMPLE_FEED_SNAPSHOT_START:
+		return 1, dest.OnSnapshotStart(event.Partition, event.SnapStart, event.SnapEnd)
+	case SIMPLE_FEED_SET_OPAQUE:
+		return 1, dest.SetOpaque(event.Partition, event.Val)
+	case SIMPLE_FEED_ROLLBACK:
+		return 1, dest.Rollback(event.Partition, event.Seq)
+	}
+
+	return 1, fmt.Errorf("unknown event kind: %s", event.Kind)
+}
+
+func (t *SimpleFeed) Close() error {
+	return nil
+}
+
+func (t *SimpleFeed) Dests() map[string]Dest {
+	return t.dests
+}
+
+func (t *SimpleFeed) Stats(w io.Writer) error {
+	t.m.Lock()
+	numSent := t.numSent
+	t.m.Unlock()
+
+	_, err := w.Write([]byte(fmt.Sprintf(`{"numEvents":%d,"numSent":%d}`,
+		len(t.events), numSent)))
+	return err
+}
@@ -16,6 +16,8 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/couchbase/gomemcached/client"
 	log "github.com/couchbaselabs/clog"
@@ -27,6 +29,7 @@ func init() {
 		&FeedType{
 			Start:       StartTAPFeed,
 			Partitions:  CouchbasePartitions,
+			Topology:    CouchbaseTopology,
 			Public:      false,
 			Description: "couchbase-tap - Couchbase Server/Cluster data source, via TAP protocol",
 			StartSample: &TAPFeedParams{},
@@ -65,16 +68,23 @@ type TAPFeed struct {
 	params     *TAPFeedParams
 	pf         DestPartitionFunc
 	dests      map[string]Dest
+	vbParts    vbucketPartitions
 	closeCh    chan bool
 	doneCh     chan bool
 	doneErr    error
 	doneMsg    string
+
+	m        sync.Mutex
+	resumeCh chan struct{} // Non-nil while paused.
 }
 
 type TAPFeedParams struct {
 	BackoffFactor float32 `json:"backoffFactor"`
 	SleepInitMS   int     `json:"sleepInitMS"`
 	SleepMaxMS    int     `json:"sleepMaxMS"`
+
+	// Groups vbuckets into this many logical partitions, when > 0.
+	NumPartitions int `json:"numPartitions"`
 }
 
 func NewTAPFeed(name, url, poolName, bucketName, bucketUUID, paramsStr string,
@@ -96,6 +106,7 @@ func NewTAPFeed(name, url, poolName, bucketName, bucketUUID, paramsStr string,
 		params:     params,
 		pf:         pf,
 		dests:      dests,
+		vbParts:    newVBucketPartitions(dests, ""),
 		closeCh:    make(chan bool),
 		doneCh:     make(chan bool),
 		doneErr:    nil,
@@ -203,8 +214,23 @@ loop:
 				" poolName: %s, bucketName: %s, opcode: %s, req: %#v",
 				t.url, t.poolName, t.bucketName, req.Opcode, req)
 
+			t.m.Lock()
+			resumeCh := t.resumeCh
+			t.m.Unlock()
+
+			if resumeCh != nil {
+				select {
+				case <-t.closeCh:
+					t.doneErr = nil
+					t.doneMsg = "closeCh closed"
+					close(t.doneCh)
+					return -1, nil
+				case <-resumeCh:
+				}
+			}
+
 			partition, dest, err :=
-				VBucketIdToPartitionDest(t.pf, t.dests, req.VBucket, req.Key)
+				t.vbParts.partitionDest(t.pf, t.dests, req.VBucket, req.Key)
 			if err != nil {
 				return 1, err
 			}
@@ -235,6 +261,26 @@ func (t *TAPFeed) Close() error {
 	return t.doneErr
 }
 
+// Pause stops the feed from dispatching to its dests, until Resume().
+func (t *TAPFeed) Pause() error {
+	t.m.Lock()
+	if t.resumeCh == nil {
+		t.resumeCh = make(chan struct{})
+	}
+	t.m.Unlock()
+	return nil
+}
+
+func (t *TAPFeed) Resume() error {
+	t.m.Lock()
+	if t.resumeCh != nil {
+		close(t.resumeCh)
+		t.resumeCh = nil
+	}
+	t.m.Unlock()
+	return nil
+}
+
 func (t *TAPFeed) Dests() map[string]Dest {
 	return t.dests
 }
@@ -246,29 +292,151 @@ func (t *TAPFeed) Stats(w io.Writer) error {
 
 // ----------------------------------------------------------------
 
+// A couchbase partition is either a single vbucket id, like "12", or
+// an inclusive range of vbucket ids, like "0-63", when the
+// "numPartitions" source param groups vbuckets into fewer, coarser
+// logical partitions (see CouchbasePartitionNames).  The plan and
+// the feeds' dests use the logical partitions, but as each vbucket
+// has its own failover log and seqs, a DCP feed still addresses each
+// vbucket's seqs and metadata by the vbucket's own partition within
+// the logical partition's dest, which is also how consistency vectors
+// are keyed (see VBucketPartitions).
+//
+// When the sourceName is a comma-separated list of bucket names, the
+// partitions are also namespaced by bucket name, like "beer-sample/12"
+// or "beer-sample/0-63", to avoid vbucket id collisions across buckets.
+// Plain partitions, without a namespace, are still supported.
+
+// Separates the namespace, like a bucket name, from the rest of a
+// namespaced partition.  Bucket names can't contain it.
+const PARTITION_NAMESPACE_SEP = "/"
+
+// NamespacedPartition returns the partition namespaced by bucketName,
+// or just the partition when bucketName is "".
+func NamespacedPartition(bucketName, partition string) string {
+	if bucketName == "" {
+		return partition
+	}
+	return bucketName + PARTITION_NAMESPACE_SEP + partition
+}
+
+// SourceBucketNames splits a sourceName into its bucket names.
+func SourceBucketNames(sourceName string) []string {
+	rv := strings.Split(sourceName, ",")
+	for i, bucketName := range rv {
+		rv[i] = strings.TrimSpace(bucketName)
+	}
+	return rv
+}
+
+// SplitNamespacedPartition splits a partition into its bucket name,
+// which is "" for a partition that isn't namespaced, and the rest.
+func SplitNamespacedPartition(partition string) (bucketName, rest string) {
+	sep := strings.LastIndex(partition, PARTITION_NAMESPACE_SEP)
+	if sep < 0 {
+		return "", partition
+	}
+	return partition[:sep], partition[sep+len(PARTITION_NAMESPACE_SEP):]
+}
+
+// ParsePartitionsToVBucketIds returns the vbucket ids of the dests'
+// partitions, which must all be plain or all be in the same
+// namespace, as vbucket ids from different namespaces would collide.
 func ParsePartitionsToVBucketIds(dests map[string]Dest) ([]uint16, error) {
-	vbuckets := make([]uint16, 0, len(dests))
+	byNamespace, err := ParsePartitionsToVBucketIdsByNamespace(dests)
+	if err != nil {
+		return nil, err
+	}
+	if len(byNamespace) > 1 {
+		return nil, fmt.Errorf("error: ParsePartitionsToVBucketIds,"+
+			" partitions span %d namespaces", len(byNamespace))
+	}
+	for _, vbuckets := range byNamespace {
+		return vbuckets, nil
+	}
+	return []uint16{}, nil
+}
+
+// ParsePartitionsToVBucketIdsByNamespace returns the vbucket ids of
+// the dests' partitions, keyed by namespace, where plain partitions
+// have a namespace of "".
+func ParsePartitionsToVBucketIdsByNamespace(dests map[string]Dest) (
+	map[string][]uint16, error) {
+	rv := map[string][]uint16{}
 	for partition, _ := range dests {
 		if partition != "" {
-			vbId, err := strconv.Atoi(partition)
+			lo, hi, err := ParsePartitionToVBucketRange(partition)
 			if err != nil {
-				return nil, fmt.Errorf("error: could not parse partition: %s, err: %v",
-					partition, err)
+				return nil, err
+			}
+			namespace, _ := SplitNamespacedPartition(partition)
+			for vbId := lo; vbId <= hi; vbId++ {
+				rv[namespace] = append(rv[namespace], vbId)
 			}
-			vbuckets = append(vbuckets, uint16(vbId))
 		}
 	}
-	return vbuckets, nil
+	return rv, nil
+}
+
+// ParsePartitionToVBucketRange returns the inclusive range of vbucket
+// ids covered by a partition, ignoring any bucket name namespace.
+func ParsePartitionToVBucketRange(partition string) (lo, hi uint16, err error) {
+	_, vbPartition := SplitNamespacedPartition(partition)
+	loStr, hiStr := vbPartition, vbPartition
+	dash := strings.Index(vbPartition, "-")
+	if dash >= 0 {
+		loStr, hiStr = vbPartition[:dash], vbPartition[dash+1:]
+	}
+	loInt, err := strconv.Atoi(loStr)
+	if err == nil {
+		var hiInt int
+		hiInt, err = strconv.Atoi(hiStr)
+		if err == nil && (loInt < 0 || hiInt < loInt || hiInt > 0xffff) {
+			err = fmt.Errorf("bad vbucket range")
+		}
+		hi = uint16(hiInt)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("error: could not parse partition: %s, err: %v",
+			partition, err)
+	}
+	return uint16(loInt), hi, nil
 }
 
 func VBucketIdToPartitionDest(pf DestPartitionFunc,
 	dests map[string]Dest, vbucketId uint16, key []byte) (
 	partition string, dest Dest, err error) {
-	if vbucketId < uint16(len(vbucketIdStrings)) {
-		partition = vbucketIdStrings[vbucketId]
+	return VBucketIdToNamespacedPartitionDest(pf, dests, "",
+		vbucketId, key)
+}
+
+// VBucketIdToNamespacedPartitionDest is like VBucketIdToPartitionDest,
+// but for dests whose partitions are namespaced by the given bucket
+// name, unless the bucketName is "".
+func VBucketIdToNamespacedPartitionDest(pf DestPartitionFunc,
+	dests map[string]Dest, bucketName string, vbucketId uint16, key []byte) (
+	partition string, dest Dest, err error) {
+	if int(vbucketId) >= len(vbucketIdStrings) {
+		return "", nil, fmt.Errorf("error: VBucketIdToPartitionDest,"+
+			" vbucket out of configured range, vbucketId: %d, numVBuckets: %d",
+			vbucketId, len(vbucketIdStrings))
+	}
+	partition = vbucketIdStrings[vbucketId]
+	if bucketName != "" {
+		partition = NamespacedPartition(bucketName, partition)
 	}
-	if partition == "" {
-		partition = fmt.Sprintf("%d", vbucketId)
+	if _, exists := dests[partition]; !exists {
+		// Look for a logical partition that covers the vbucket.
+		for p := range dests {
+			ns, vbPartition := SplitNamespacedPartition(p)
+			if ns == bucketName && strings.Index(vbPartition, "-") > 0 {
+				lo, hi, err := ParsePartitionToVBucketRange(p)
+				if err == nil && lo <= vbucketId && vbucketId <= hi {
+					partition = p
+					break
+				}
+			}
+		}
 	}
 	dest, err = pf(partition, key, dests)
 	if err != nil {
@@ -278,22 +446,208 @@ func VBucketIdToPartitionDest(pf DestPartitionFunc,
 	return partition, dest, err
 }
 
-var vbucketIdStrings []string
+// A vbucketPartitions maps each vbucket id to the partition of a
+// feed's dests that covers it, which is precomputed when the feed is
+// built, so that a mutation needn't scan the dests for the logical
+// partition that groups its vbucket.
+type vbucketPartitions []string
+
+// Returns the vbucketPartitions of the dests, whose partitions are
+// namespaced by the bucketName unless it's "".  A vbucket that no
+// logical partition covers maps to its own partition, so that the
+// partition func still decides its dest, as with
+// VBucketIdToNamespacedPartitionDest().
+func newVBucketPartitions(dests map[string]Dest,
+	bucketName string) vbucketPartitions {
+	rv := make(vbucketPartitions, len(vbucketIdStrings))
+	for p := range dests {
+		if !dcpFeedPartitionIsGroup(p) {
+			continue
+		}
+		ns, _ := SplitNamespacedPartition(p)
+		lo, hi, err := ParsePartitionToVBucketRange(p)
+		if ns != bucketName || err != nil {
+			continue
+		}
+		for vbId := int(lo); vbId <= int(hi) && vbId < len(rv); vbId++ {
+			rv[vbId] = p
+		}
+	}
+	for vbId := range rv {
+		partition := NamespacedPartition(bucketName, vbucketIdStrings[vbId])
+		if _, exists := dests[partition]; exists || rv[vbId] == "" {
+			rv[vbId] = partition
+		}
+	}
+	return rv
+}
+
+// Like VBucketIdToNamespacedPartitionDest, but via the precomputed
+// vbucketPartitions.
+func (vp vbucketPartitions) partitionDest(pf DestPartitionFunc,
+	dests map[string]Dest, vbucketId uint16, key []byte) (
+	partition string, dest Dest, err error) {
+	if int(vbucketId) >= len(vp) {
+		return "", nil, fmt.Errorf("error: VBucketIdToPartitionDest,"+
+			" vbucket out of configured range, vbucketId: %d, numVBuckets: %d",
+			vbucketId, len(vp))
+	}
+	partition = vp[vbucketId]
+	dest, err = pf(partition, key, dests)
+	if err != nil {
+		return "", nil, fmt.Errorf("error: VBucketIdToPartitionDest,"+
+			" partition func, vbucketId: %d, err: %v", vbucketId, err)
+	}
+	return partition, dest, err
+}
+
+// VBucketPartitions returns the partitions that a dest tracks seqs and
+// metadata for, and that consistency vectors are keyed by, for one of
+// a pindex's source partitions.  That's the partition itself, except
+// for a logical partition that groups several vbuckets, where it's the
+// partition of each of its vbuckets, as each vbucket has its own
+// failover log and seqs.
+func VBucketPartitions(partition string) []string {
+	if !dcpFeedPartitionIsGroup(partition) {
+		return []string{partition}
+	}
+	lo, hi, err := ParsePartitionToVBucketRange(partition)
+	if err != nil {
+		return []string{partition}
+	}
+	ns, _ := SplitNamespacedPartition(partition)
+	rv := make([]string, 0, int(hi)-int(lo)+1)
+	for vbId := int(lo); vbId <= int(hi); vbId++ {
+		rv = append(rv, NamespacedPartition(ns, strconv.Itoa(vbId)))
+	}
+	return rv
+}
+
+// Default number of vbuckets, see SetNumVBuckets().
+const NUM_VBUCKETS = 1024
+
+var vbucketIdStrings []string // Index is vbucketId.
 
 func init() {
-	vbucketIdStrings = make([]string, 1024)
-	for i := 0; i < len(vbucketIdStrings); i++ {
-		vbucketIdStrings[i] = fmt.Sprintf("%d", i)
+	SetNumVBuckets(NUM_VBUCKETS)
+}
+
+// SetNumVBuckets configures the number of vbuckets that feeds
+// accept, for clusters that aren't configured with the default
+// NUM_VBUCKETS.  It should be invoked during process initialization,
+// before any feeds are started.
+func SetNumVBuckets(numVBuckets int) {
+	a := make([]string, numVBuckets)
+	for i := 0; i < len(a); i++ {
+		a[i] = strconv.Itoa(i)
 	}
+	vbucketIdStrings = a
+}
+
+// CouchbasePartitionNames returns the names of numPartitions logical
+// partitions that evenly group the vbuckets, or one partition per
+// vbucket when numPartitions is <= 0 or >= numVBuckets.
+func CouchbasePartitionNames(numVBuckets, numPartitions int) []string {
+	if numPartitions <= 0 || numPartitions >= numVBuckets {
+		rv := make([]string, numVBuckets)
+		for i := 0; i < numVBuckets; i++ {
+			rv[i] = strconv.Itoa(i)
+		}
+		return rv
+	}
+	rv := make([]string, numPartitions)
+	for i := 0; i < numPartitions; i++ {
+		lo := i * numVBuckets / numPartitions
+		hi := (i+1)*numVBuckets/numPartitions - 1
+		if lo == hi {
+			rv[i] = strconv.Itoa(lo)
+		} else {
+			rv[i] = fmt.Sprintf("%d-%d", lo, hi)
+		}
+	}
+	return rv
 }
 
 // ----------------------------------------------------------------
 
 func CouchbasePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 	server string) ([]string, error) {
+	bucketNames := SourceBucketNames(sourceName)
+	if len(bucketNames) > 1 {
+		bucketUUIDs, err := sourceBucketUUIDs(bucketNames, sourceUUID)
+		if err != nil {
+			return nil, err
+		}
+		rv := []string{}
+		for i, bucketName := range bucketNames {
+			partitions, err := CouchbasePartitions(sourceType, bucketName,
+				bucketUUIDs[i], sourceParams, server)
+			if err != nil {
+				return nil, err
+			}
+			for _, partition := range partitions {
+				rv = append(rv, NamespacedPartition(bucketName, partition))
+			}
+		}
+		return rv, nil
+	}
+
 	poolName := "default" // TODO: Parameterize poolName.
 	bucketName := sourceName
 
+	vbm, err := couchbaseVBServerMap(server, poolName, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	params := struct {
+		NumPartitions int `json:"numPartitions"`
+	}{}
+	if sourceParams != "" {
+		err := json.Unmarshal([]byte(sourceParams), &params)
+		if err != nil {
+			return nil, fmt.Errorf("error: DataSourcePartitions/couchbase"+
+				" could not parse sourceParams: %s, err: %v", sourceParams, err)
+		}
+	}
+
+	// NOTE: We assume that vbucket numbers are continuous
+	// integers starting from 0.
+	return CouchbasePartitionNames(len(vbm.VBucketMap), params.NumPartitions), nil
+}
+
+// CouchbaseTopology returns a signature of the bucket's server list
+// and vbucket map, which changes whenever vbuckets move between
+// servers, such as during a rebalance.
+func CouchbaseTopology(sourceType, sourceName, sourceUUID, sourceParams,
+	server string) (string, error) {
+	bucketNames := SourceBucketNames(sourceName)
+
+	sigs := make([]string, 0, len(bucketNames))
+	for _, bucketName := range bucketNames {
+		vbm, err := couchbaseVBServerMap(server, "default", bucketName)
+		if err != nil {
+			return "", err
+		}
+
+		sig, err := json.Marshal(struct {
+			ServerList []string `json:"serverList"`
+			VBucketMap [][]int  `json:"vbucketMap"`
+		}{vbm.ServerList, vbm.VBucketMap})
+		if err != nil {
+			return "", err
+		}
+
+		sigs = append(sigs, bucketName+":"+string(sig))
+	}
+
+	return strings.Join(sigs, ";"), nil
+}
+
+// couchbaseVBServerMap returns the current VBServerMap of a bucket,
+// and is a variable so that tests can supply a fake bucket.
+var couchbaseVBServerMap = func(server, poolName, bucketName string) (
+	*couchbase.VBucketServerMap, error) {
 	// TODO: how the halloween does GetBucket() api work without explicit auth?
 	bucket, err := couchbase.GetBucket(server, poolName, bucketName)
 	if err != nil {
@@ -306,16 +660,177 @@ func CouchbasePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 	vbm := bucket.VBServerMap()
 	if vbm == nil {
 		return nil, fmt.Errorf("error: DataSourcePartitions/couchbase"+
-			" no VBServerMap, server: %s, poolName: %s, bucketName: %s, err: %v",
+			" no VBServerMap, server: %s, poolName: %s, bucketName: %s",
+			server, poolName, bucketName)
+	}
+
+	return vbm, nil
+}
+
+// The max number of keys fetched per bulk get by CouchbaseSourceDocs.
+const COUCHBASE_SOURCE_DOCS_BATCH_SIZE = 100
+
+// CouchbaseSourceDocs returns the bodies of the docs of a couchbase
+// data source for the keys, which are keyed by the name of the bucket
+// that holds them, fetched with bulk gets of at most
+// COUCHBASE_SOURCE_DOCS_BATCH_SIZE keys.  The result is keyed the same
+// way.  The keys under "" are of an unknown bucket, so for a
+// multi-bucket source, each bucket is tried in turn for the keys not
+// yet found.  Keys without a doc are missing from the result.  The
+// bucket connections are reused from the buckets.
+func CouchbaseSourceDocs(buckets *CouchbaseBuckets, sourceName, server string,
+	keys map[string][]string) (map[string]map[string][]byte, error) {
+	bucketNames := SourceBucketNames(sourceName)
+
+	rv := map[string]map[string][]byte{}
+
+	for namespace, namespaceKeys := range keys {
+		candidates := bucketNames
+		if namespace != "" {
+			candidates = []string{namespace}
+			found := false
+			for _, bucketName := range bucketNames {
+				found = found || bucketName == namespace
+			}
+			if !found {
+				return nil, fmt.Errorf("error: CouchbaseSourceDocs"+
+					" bucket: %s not in sourceName: %s", namespace, sourceName)
+			}
+		}
+
+		docs := map[string][]byte{}
+		rv[namespace] = docs
+
+		for _, bucketName := range candidates {
+			var batches [][]string
+			var batch []string
+			for _, key := range namespaceKeys {
+				if _, exists := docs[key]; exists {
+					continue
+				}
+				batch = append(batch, key)
+				if len(batch) >= COUCHBASE_SOURCE_DOCS_BATCH_SIZE {
+					batches = append(batches, batch)
+					batch = nil
+				}
+			}
+			if len(batch) > 0 {
+				batches = append(batches, batch)
+			}
+			if len(batches) <= 0 {
+				break
+			}
+
+			got, err := couchbaseGetBulk(buckets, server, "default",
+				bucketName, batches)
+			if err != nil {
+				return nil, err
+			}
+			for key, body := range got {
+				docs[key] = body
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+// couchbaseGetBulk returns the bodies of a bucket's docs for batches
+// of keys, using a bulk get per batch on a bucket connection of the
+// buckets, and is a variable so that tests can supply a fake bucket.
+var couchbaseGetBulk = func(buckets *CouchbaseBuckets,
+	server, poolName, bucketName string,
+	batches [][]string) (map[string][]byte, error) {
+	bucket, err := buckets.Get(server, poolName, bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("error: CouchbaseSourceDocs"+
+			" failed GetBucket, server: %s, poolName: %s, bucketName: %s, err: %v",
 			server, poolName, bucketName, err)
 	}
 
-	// NOTE: We assume that vbucket numbers are continuous
-	// integers starting from 0.
-	numVBuckets := len(vbm.VBucketMap)
-	rv := make([]string, numVBuckets)
-	for i := 0; i < numVBuckets; i++ {
-		rv[i] = strconv.Itoa(i)
+	rv := map[string][]byte{}
+	for _, keys := range batches {
+		resps, err := bucket.GetBulk(keys)
+		if err != nil {
+			// The next Get() reconnects.
+			buckets.Drop(server, poolName, bucketName, bucket)
+			return nil, fmt.Errorf("error: CouchbaseSourceDocs"+
+				" failed GetBulk, bucketName: %s, err: %v", bucketName, err)
+		}
+		for key, resp := range resps {
+			rv[key] = resp.Body
+		}
 	}
+
 	return rv, nil
 }
+
+// CouchbaseBuckets caches bucket connections, keyed by server, pool
+// and bucket name, so that repeated fetches of source docs, such as
+// for queries with includeSource, reuse their connections.
+type CouchbaseBuckets struct {
+	m       sync.Mutex
+	buckets map[string]*couchbase.Bucket
+}
+
+func NewCouchbaseBuckets() *CouchbaseBuckets {
+	return &CouchbaseBuckets{buckets: map[string]*couchbase.Bucket{}}
+}
+
+func couchbaseBucketsKey(server, poolName, bucketName string) string {
+	return server + "/" + poolName + "/" + bucketName
+}
+
+// Get returns the cached connection to a bucket, connecting first if
+// there's none.
+func (c *CouchbaseBuckets) Get(server, poolName, bucketName string) (
+	*couchbase.Bucket, error) {
+	k := couchbaseBucketsKey(server, poolName, bucketName)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if bucket := c.buckets[k]; bucket != nil {
+		return bucket, nil
+	}
+
+	// TODO: how the halloween does GetBucket() api work without explicit auth?
+	bucket, err := couchbase.GetBucket(server, poolName, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	c.buckets[k] = bucket
+
+	return bucket, nil
+}
+
+// Drop closes and forgets a bucket connection that failed, unless
+// it was already replaced.
+func (c *CouchbaseBuckets) Drop(server, poolName, bucketName string,
+	bucket *couchbase.Bucket) {
+	k := couchbaseBucketsKey(server, poolName, bucketName)
+
+	c.m.Lock()
+	if c.buckets[k] == bucket {
+		delete(c.buckets, k)
+	}
+	c.m.Unlock()
+
+	bucket.Close()
+}
+
+// Returns the bucket UUIDs for a multi-bucket source, where the
+// sourceUUID is either "" or a comma-separated list of bucket UUIDs
+// that's parallel to the bucketNames.
+func sourceBucketUUIDs(bucketNames []string, sourceUUID string) (
+	[]string, error) {
+	if sourceUUID == "" {
+		return make([]string, len(bucketNames)), nil
+	}
+	bucketUUIDs := SourceBucketNames(sourceUUID)
+	if len(bucketUUIDs) != len(bucketNames) {
+		return nil, fmt.Errorf("error: sourceUUID: %s doesn't match"+
+			" the bucket names: %v", sourceUUID, bucketNames)
+	}
+	return bucketUUIDs, nil
+}
@@ -12,9 +12,26 @@
 package cbft
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/go-couchbase"
+	"github.com/golang/snappy"
+
+	"github.com/steveyen/cbdatasource"
 )
 
 type ErrorOnlyFeed struct {
@@ -63,6 +80,175 @@ func TestParsePartitionsToVBucketIds(t *testing.T) {
 	}
 }
 
+func TestCouchbasePartitionNames(t *testing.T) {
+	for _, numPartitions := range []int{16, 1024} {
+		names := CouchbasePartitionNames(1024, numPartitions)
+		if len(names) != numPartitions {
+			t.Errorf("expected %d partitions, got: %d",
+				numPartitions, len(names))
+		}
+
+		dests := map[string]Dest{}
+		for _, name := range names {
+			dests[name] = &TestDest{}
+		}
+
+		vbuckets, err := ParsePartitionsToVBucketIds(dests)
+		if err != nil || len(vbuckets) != 1024 {
+			t.Errorf("expected partitions to cover 1024 vbuckets,"+
+				" got: %d, err: %v", len(vbuckets), err)
+		}
+		seen := map[uint16]bool{}
+		for _, vbId := range vbuckets {
+			if seen[vbId] {
+				t.Errorf("expected vbucket %d in only one partition", vbId)
+			}
+			seen[vbId] = true
+		}
+
+		for vbId := 0; vbId < 1024; vbId++ {
+			partition, dest, err := VBucketIdToPartitionDest(BasicPartitionFunc,
+				dests, uint16(vbId), nil)
+			if err != nil || dest != dests[partition] {
+				t.Errorf("expected dest for vbucket: %d, err: %v", vbId, err)
+			}
+			lo, hi, err := ParsePartitionToVBucketRange(partition)
+			if err != nil || int(lo) > vbId || vbId > int(hi) {
+				t.Errorf("expected partition: %s to cover vbucket: %d,"+
+					" err: %v", partition, vbId, err)
+			}
+		}
+	}
+
+	names := CouchbasePartitionNames(1024, 16)
+	if names[0] != "0-63" || names[15] != "960-1023" {
+		t.Errorf("expected contiguous vbucket ranges, got: %v", names)
+	}
+	names = CouchbasePartitionNames(1024, 1024)
+	if names[0] != "0" || names[1023] != "1023" {
+		t.Errorf("expected a partition per vbucket, got: %v", names)
+	}
+	if len(CouchbasePartitionNames(64, 0)) != 64 ||
+		len(CouchbasePartitionNames(64, 100)) != 64 {
+		t.Errorf("expected a partition per vbucket by default")
+	}
+}
+
+func TestParsePartitionToVBucketRange(t *testing.T) {
+	tests := []struct {
+		partition string
+		lo, hi    uint16
+		expectErr bool
+	}{
+		{"12", 12, 12, false},
+		{"0-63", 0, 63, false},
+		{"5-5", 5, 5, false},
+		{"", 0, 0, true},
+		{"a-b", 0, 0, true},
+		{"10-5", 0, 0, true},
+		{"-1", 0, 0, true},
+		{"0-70000", 0, 0, true},
+	}
+	for i, test := range tests {
+		lo, hi, err := ParsePartitionToVBucketRange(test.partition)
+		if (err != nil) != test.expectErr ||
+			lo != test.lo || hi != test.hi {
+			t.Errorf("test %d, partition: %q, got: %d-%d, err: %v",
+				i, test.partition, lo, hi, err)
+		}
+	}
+}
+
+func TestDCPFeedGroupedPartitionMetaData(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	_, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"0-63": dest}, nil)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	// Each vbucket in a grouped partition has its own metadata.
+	for _, vbucketId := range []uint16{10, 20} {
+		value, lastSeq, err := feed.GetMetaData(vbucketId)
+		if err != nil || value != nil || lastSeq != 0 {
+			t.Errorf("expected no metadata for a new vbucket,"+
+				" got: %s, %d, err: %v", value, lastSeq, err)
+		}
+	}
+
+	req := &gomemcached.MCRequest{Body: []byte(`{}`)}
+
+	feed.SnapshotStart(10, 1, 5, 0)
+	feed.DataUpdate(10, []byte("a"), 5, req)
+	feed.SetMetaData(10, []byte("opaque10"))
+	feed.SnapshotStart(20, 1, 2, 0)
+	feed.DataUpdate(20, []byte("b"), 2, req)
+	feed.SetMetaData(20, []byte("opaque20"))
+
+	for vbucketId, expected := range map[uint16]struct {
+		value   string
+		lastSeq uint64
+	}{10: {"opaque10", 5}, 20: {"opaque20", 2}, 30: {"", 0}} {
+		value, lastSeq, err := feed.GetMetaData(vbucketId)
+		if err != nil || string(value) != expected.value ||
+			lastSeq != expected.lastSeq {
+			t.Errorf("vbucketId: %d, expected: %+v, got: %s, %d, err: %v",
+				vbucketId, expected, value, lastSeq, err)
+		}
+	}
+
+	count, err := dest.(*BleveDest).bindex.DocCount()
+	if err != nil || count != 2 {
+		t.Errorf("expected both vbuckets' docs, got: %d, err: %v", count, err)
+	}
+}
+
+func TestVBucketPartitions(t *testing.T) {
+	if !reflect.DeepEqual(VBucketPartitions("12"), []string{"12"}) ||
+		!reflect.DeepEqual(VBucketPartitions("a/2-4"),
+			[]string{"a/2", "a/3", "a/4"}) {
+		t.Errorf("expected the vbucket partitions")
+	}
+
+	pindex := &PIndex{sourcePartitionsArr: []string{"0", "1-2"}}
+	if !reflect.DeepEqual(pindex.seqPartitions(), []string{"0", "1", "2"}) {
+		t.Errorf("expected expanded seq partitions, got: %v",
+			pindex.seqPartitions())
+	}
+
+	dests := map[string]Dest{"0-1": &TestDest{}, "3": &TestDest{},
+		"b/0-3": &TestDest{}}
+	vp := newVBucketPartitions(dests, "")
+	for vbucketId, expected := range map[uint16]string{
+		0: "0-1", 1: "0-1", 2: "2", 3: "3"} {
+		if vp[vbucketId] != expected {
+			t.Errorf("vbucketId: %d, expected: %s, got: %s",
+				vbucketId, expected, vp[vbucketId])
+		}
+	}
+	partition, dest, err := vp.partitionDest(BasicPartitionFunc, dests, 1, nil)
+	if err != nil || partition != "0-1" || dest != dests["0-1"] {
+		t.Errorf("expected 0-1, got: %s, err: %v", partition, err)
+	}
+	if _, _, err = vp.partitionDest(BasicPartitionFunc, dests, 2, nil); err == nil {
+		t.Errorf("expected a vbucket without a dest to fail")
+	}
+	if _, _, err = vp.partitionDest(BasicPartitionFunc, dests,
+		uint16(len(vp)), nil); err == nil {
+		t.Errorf("expected an out of range vbucket to fail")
+	}
+}
+
 func TestDataSourcePartitions(t *testing.T) {
 	a, err := DataSourcePartitions("a fake source type",
 		"sourceName", "sourceUUID", "sourceParams", "serverURL")
@@ -118,3 +304,1656 @@ func TestNilFeedStart(t *testing.T) {
 		t.Errorf("expected NILFeed.Start() to work")
 	}
 }
+
+func TestSimpleFeedBleveDest(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restart := func() {
+		t.Errorf("not expecting a restart")
+	}
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", restart)
+	if err != nil || impl == nil || dest == nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	bindex, ok := impl.(bleve.Index)
+	if !ok {
+		t.Fatalf("expected a bleve.Index impl")
+	}
+
+	feed := NewSimpleFeed("simple", BasicPartitionFunc,
+		map[string]Dest{"": dest}, []SimpleFeedEvent{
+			{Kind: SIMPLE_FEED_SNAPSHOT_START, Partition: "0",
+				SnapStart: 1, SnapEnd: 2},
+			{Kind: SIMPLE_FEED_UPDATE, Partition: "0",
+				Key: []byte("a"), Seq: 1, Val: []byte(`{"x":"hello"}`)},
+			{Kind: SIMPLE_FEED_UPDATE, Partition: "0",
+				Key: []byte("b"), Seq: 2, Val: []byte(`{"x":"world"}`)},
+			{Kind: SIMPLE_FEED_SET_OPAQUE, Partition: "0",
+				Val: []byte("opaque0")},
+			{Kind: SIMPLE_FEED_SNAPSHOT_START, Partition: "0",
+				SnapStart: 3, SnapEnd: 3},
+			{Kind: SIMPLE_FEED_DELETE, Partition: "0",
+				Key: []byte("a"), Seq: 3},
+		})
+	if feed.Name() != "simple" || len(feed.Dests()) != 1 {
+		t.Errorf("expected name and dests to match")
+	}
+	if err = feed.Start(); err != nil {
+		t.Errorf("expected SimpleFeed.Start() to work, err: %v", err)
+	}
+
+	count, err := bindex.DocCount()
+	if err != nil || count != 1 {
+		t.Errorf("expected 1 doc, got: %d, err: %v", count, err)
+	}
+	doc, err := bindex.Document("b")
+	if err != nil || doc == nil {
+		t.Errorf("expected doc b, err: %v", err)
+	}
+
+	opaque, lastSeq, err := dest.GetOpaque("0")
+	if err != nil || string(opaque) != "opaque0" || lastSeq != 3 {
+		t.Errorf("expected opaque0 and lastSeq 3, got: %s, %d, err: %v",
+			opaque, lastSeq, err)
+	}
+
+	err = dest.ConsistencyWait("0", "at_plus", 3, nil)
+	if err != nil {
+		t.Errorf("expected consistency wait to be satisfied, err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err = feed.Stats(&buf); err != nil ||
+		buf.String() != `{"numEvents":6,"numSent":6}` {
+		t.Errorf("expected stats to work, got: %s, err: %v", buf.String(), err)
+	}
+
+	if feed.Close() != nil {
+		t.Errorf("expected SimpleFeed.Close() to work")
+	}
+}
+
+func TestSimpleFeedErrors(t *testing.T) {
+	feed := NewSimpleFeed("simple", BasicPartitionFunc,
+		map[string]Dest{}, []SimpleFeedEvent{
+			{Kind: SIMPLE_FEED_UPDATE, Partition: "no-dest"},
+		})
+	if feed.Start() == nil {
+		t.Errorf("expected err on partition with no dest")
+	}
+	if feed.Start() != nil {
+		t.Errorf("expected restart to resume after the failed event")
+	}
+
+	feed = NewSimpleFeed("simple", BasicPartitionFunc,
+		map[string]Dest{"": &TestDest{}}, []SimpleFeedEvent{
+			{Kind: "not-a-kind", Partition: "0"},
+		})
+	if feed.Start() == nil {
+		t.Errorf("expected err on unknown event kind")
+	}
+}
+
+// An OrderingDest records the order in which its callbacks complete,
+// where OnSnapshotStart() is slow.
+type OrderingDest struct {
+	TestDest
+
+	m     sync.Mutex
+	calls []string
+}
+
+func (s *OrderingDest) OnSnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	time.Sleep(20 * time.Millisecond)
+	s.m.Lock()
+	s.calls = append(s.calls, fmt.Sprintf("snapshot-%d", snapStart))
+	s.m.Unlock()
+	return nil
+}
+
+func (s *OrderingDest) OnDataUpdate(partition string,
+	key []byte, seq uint64, val []byte) error {
+	s.m.Lock()
+	s.calls = append(s.calls, fmt.Sprintf("update-%d", seq))
+	s.m.Unlock()
+	return nil
+}
+
+func TestSimpleFeedSnapshotOrdering(t *testing.T) {
+	dest := &OrderingDest{}
+	feed := NewSimpleFeed("simple", BasicPartitionFunc,
+		map[string]Dest{"": dest}, []SimpleFeedEvent{
+			{Kind: SIMPLE_FEED_SNAPSHOT_START, Partition: "0",
+				SnapStart: 1, SnapEnd: 1},
+			{Kind: SIMPLE_FEED_UPDATE, Partition: "0", Seq: 1},
+			{Kind: SIMPLE_FEED_SNAPSHOT_START, Partition: "0",
+				SnapStart: 2, SnapEnd: 2},
+			{Kind: SIMPLE_FEED_UPDATE, Partition: "0", Seq: 2},
+		})
+
+	// Concurrent Start()'s must not interleave events.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := feed.Start(); err != nil {
+				t.Errorf("expected SimpleFeed.Start() to work, err: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	expected := []string{"snapshot-1", "update-1", "snapshot-2", "update-2"}
+	if fmt.Sprintf("%v", dest.calls) != fmt.Sprintf("%v", expected) {
+		t.Errorf("expected snapshot completion before updates, got: %v",
+			dest.calls)
+	}
+}
+
+func TestNewDCPFeedOptions(t *testing.T) {
+	options := NewDCPFeedOptions("feedName", &DCPFeedParams{})
+	if !strings.HasPrefix(options.Name, "feedName-") {
+		t.Errorf("expected options.Name prefixed by feed name, got: %s",
+			options.Name)
+	}
+	if options.ClusterManagerBackoffFactor != FEED_BACKOFF_FACTOR ||
+		options.ClusterManagerSleepInitMS != FEED_SLEEP_INIT_MS ||
+		options.ClusterManagerSleepMaxMS != FEED_SLEEP_MAX_MS ||
+		options.DataManagerBackoffFactor != FEED_BACKOFF_FACTOR ||
+		options.DataManagerSleepInitMS != FEED_SLEEP_INIT_MS ||
+		options.DataManagerSleepMaxMS != FEED_SLEEP_MAX_MS ||
+		options.FeedBufferSizeBytes != DCP_FEED_BUFFER_SIZE_BYTES ||
+		options.FeedBufferAckThreshold != DCP_FEED_BUFFER_ACK_THRESHOLD {
+		t.Errorf("expected defaults on empty params, got: %#v", options)
+	}
+
+	params := &DCPFeedParams{
+		ClusterManagerBackoffFactor: 2.0,
+		ClusterManagerSleepInitMS:   1,
+		ClusterManagerSleepMaxMS:    2,
+		DataManagerBackoffFactor:    3.0,
+		DataManagerSleepInitMS:      3,
+		DataManagerSleepMaxMS:       4,
+		FeedBufferSizeBytes:         1000,
+		FeedBufferAckThreshold:      0.5,
+	}
+	options = NewDCPFeedOptions("feedName", params)
+	if options.ClusterManagerBackoffFactor != 2.0 ||
+		options.ClusterManagerSleepInitMS != 1 ||
+		options.ClusterManagerSleepMaxMS != 2 ||
+		options.DataManagerBackoffFactor != 3.0 ||
+		options.DataManagerSleepInitMS != 3 ||
+		options.DataManagerSleepMaxMS != 4 ||
+		options.FeedBufferSizeBytes != 1000 ||
+		options.FeedBufferAckThreshold != 0.5 {
+		t.Errorf("expected params to be used when set, got: %#v", options)
+	}
+}
+
+func TestDCPFeedErrorIsFatal(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{fmt.Errorf("dial tcp 127.0.0.1:11210: connection refused"), false},
+		{fmt.Errorf("EOF"), false},
+		{fmt.Errorf("refresh cluster error: bucket not found"), false},
+		{&gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}, false},
+		{&gomemcached.MCResponse{Status: gomemcached.AUTH_ERROR}, true},
+		{&DCPFeedBucketError{BucketName: "default", Missing: true}, true},
+		{&DCPFeedBucketError{BucketName: "default", BucketUUID: "x"}, true},
+	}
+	for i, test := range tests {
+		actual := DCPFeedErrorIsFatal(test.err)
+		if actual != test.expected {
+			t.Errorf("test: %d, expected: %v, got: %v, err: %v",
+				i, test.expected, actual, test.err)
+		}
+	}
+}
+
+func TestDCPFeedOnError(t *testing.T) {
+	defer func(prev func(string, string, string, string) error) {
+		dcpFeedCheckBucket = prev
+	}(dcpFeedCheckBucket)
+	var m sync.Mutex
+	var bucketErr error
+	checkedCh := make(chan struct{}, 10)
+	dcpFeedCheckBucket = func(url, poolName, bucketName,
+		bucketUUID string) error {
+		defer func() { checkedCh <- struct{}{} }()
+		m.Lock()
+		defer m.Unlock()
+		return bucketErr
+	}
+
+	// Waits for the stopped feed to be unregistered by the manager,
+	// as the bucket check is asynchronous.
+	waitUnregistered := func(mgr *Manager) {
+		for i := 0; i < 100; i++ {
+			feeds, _ := mgr.CurrentMaps()
+			if feeds["feedName"] == nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("expected the stopped feed to be unregistered")
+	}
+
+	meh := &TestMEH{}
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "dir", "some-datasource", meh)
+
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{}, mgr)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+	if err = mgr.registerFeed(feed); err != nil {
+		t.Fatalf("expected registerFeed to work, err: %v", err)
+	}
+
+	// A transient error, whose bucket check finds the bucket.
+	feed.OnError(fmt.Errorf("connection refused"))
+	<-checkedCh
+	time.Sleep(20 * time.Millisecond)
+	if feed.FatalErr() != nil || meh.lastCall != "" ||
+		mgr.Stats().TotFeedFatalError != 0 {
+		t.Errorf("expected transient error to not be fatal")
+	}
+
+	// The bucket check finds that the bucket is gone.
+	m.Lock()
+	bucketErr = &DCPFeedBucketError{BucketName: "bucketName", Missing: true}
+	m.Unlock()
+
+	feed.OnError(fmt.Errorf("bucket not found"))
+	waitUnregistered(mgr)
+	if feed.FatalErr() != bucketErr || meh.lastCall != "OnFeedError" ||
+		mgr.Stats().TotFeedFatalError != 1 {
+		t.Errorf("expected the bucket error to be surfaced to the manager,"+
+			" err: %v", feed.FatalErr())
+	}
+
+	feed.OnError(&gomemcached.MCResponse{Status: gomemcached.AUTH_ERROR})
+	if feed.FatalErr() != bucketErr || mgr.Stats().TotFeedFatalError != 1 {
+		t.Errorf("expected only the first fatal error to be surfaced")
+	}
+
+	// A handler without OnFeedError still sees the feed stop, here on
+	// an auth failure status, which doesn't need a bucket check.
+	mgr = NewManager(VERSION, NewCfgMem(), NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "dir", "some-datasource", &TestBaseMEH{})
+
+	feed, err = NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{}, mgr)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	feed.OnError(&gomemcached.MCResponse{Status: gomemcached.AUTH_ERROR})
+	if feed.FatalErr() == nil || mgr.Stats().TotFeedFatalError != 1 {
+		t.Errorf("expected fatal error without OnFeedError to work")
+	}
+}
+
+func TestDCPFeedErrorHistory(t *testing.T) {
+	defer func(prev func([]string, string, string, string, []uint16,
+		couchbase.AuthHandler, cbdatasource.Receiver,
+		*cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error)) {
+		dcpNewBucketDataSource = prev
+	}(dcpNewBucketDataSource)
+	defer func(prev func() time.Time) { dcpFeedTimeNow = prev }(dcpFeedTimeNow)
+
+	mutations := []string{}
+
+	dcpNewBucketDataSource = func(serverURLs []string,
+		poolName, bucketName, bucketUUID string, vbucketIds []uint16,
+		auth couchbase.AuthHandler, receiver cbdatasource.Receiver,
+		options *cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error) {
+		return &FakeBucketDataSource{receiver: receiver, mutations: &mutations}, nil
+	}
+
+	defer func(prev func(string, string, string, string) error) {
+		dcpFeedCheckBucket = prev
+	}(dcpFeedCheckBucket)
+	dcpFeedCheckBucket = func(string, string, string, string) error {
+		return nil
+	}
+
+	now := time.Unix(1000, 0)
+	dcpFeedTimeNow = func() time.Time { return now }
+
+	feed, err := NewDCPFeed("feedName", "http://fake:8091",
+		"default", "bucketName", "bucketUUID", `{"errorHistorySize":3}`,
+		BasicPartitionFunc, map[string]Dest{}, nil)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	if len(feed.ErrorHistory()) != 0 {
+		t.Errorf("expected an empty error history")
+	}
+
+	for i := 0; i < 5; i++ {
+		now = time.Unix(int64(1000+i), 0)
+		feed.OnError(fmt.Errorf("err%d", i))
+	}
+
+	errHistory := feed.ErrorHistory()
+	if len(errHistory) != 3 {
+		t.Fatalf("expected only the latest 3 errors, got: %#v", errHistory)
+	}
+	for i, e := range errHistory {
+		if e.Error != fmt.Sprintf("err%d", i+2) ||
+			!e.Time.Equal(time.Unix(int64(1002+i), 0)) {
+			t.Errorf("expected latest errors in order, got: %#v", errHistory)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = feed.Stats(&buf); err != nil {
+		t.Errorf("expected Stats to work, err: %v", err)
+	}
+	var stats struct {
+		ErrorHistory []DCPFeedError `json:"errorHistory"`
+	}
+	if err = json.Unmarshal(buf.Bytes(), &stats); err != nil {
+		t.Errorf("expected stats json, err: %v", err)
+	}
+	if len(stats.ErrorHistory) != len(errHistory) {
+		t.Fatalf("expected stats error history, got: %s", buf.String())
+	}
+	for i, e := range stats.ErrorHistory {
+		if e.Error != errHistory[i].Error || !e.Time.Equal(errHistory[i].Time) {
+			t.Errorf("expected stats error history, got: %s", buf.String())
+		}
+	}
+
+	disabled, err := NewDCPFeed("feedName", "http://fake:8091",
+		"default", "bucketName", "bucketUUID", `{"errorHistorySize":-1}`,
+		BasicPartitionFunc, map[string]Dest{}, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+	disabled.OnError(fmt.Errorf("err"))
+	if len(disabled.ErrorHistory()) != 0 {
+		t.Errorf("expected a disabled error history")
+	}
+}
+
+func TestDCPFeedSkipUnassignedVBuckets(t *testing.T) {
+	defer func(prev func([]string, string, string, string, []uint16,
+		couchbase.AuthHandler, cbdatasource.Receiver,
+		*cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error)) {
+		dcpNewBucketDataSource = prev
+	}(dcpNewBucketDataSource)
+
+	mutations := []string{}
+
+	dcpNewBucketDataSource = func(serverURLs []string,
+		poolName, bucketName, bucketUUID string, vbucketIds []uint16,
+		auth couchbase.AuthHandler, receiver cbdatasource.Receiver,
+		options *cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error) {
+		return &FakeBucketDataSource{receiver: receiver, mutations: &mutations}, nil
+	}
+
+	req := &gomemcached.MCRequest{Body: []byte(`{"x":"hello"}`)}
+
+	dest := &SeqDest{}
+	feed, err := NewDCPFeed("feedName", "http://fake:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"0": dest}, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+	if feed.DataUpdate(5, []byte("a"), 1, req) == nil {
+		t.Errorf("expected a mutation for an unassigned vbucket to fail")
+	}
+
+	dest = &SeqDest{}
+	feed, err = NewDCPFeed("feedName", "http://fake:8091",
+		"default", "bucketName", "bucketUUID",
+		`{"skipUnassignedVBuckets":true}`,
+		BasicPartitionFunc, map[string]Dest{"0": dest}, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	if err = feed.SnapshotStart(5, 1, 2, 0); err != nil {
+		t.Errorf("expected a skipped snapshot start, err: %v", err)
+	}
+	if err = feed.DataUpdate(5, []byte("a"), 1, req); err != nil {
+		t.Errorf("expected a skipped update, err: %v", err)
+	}
+	if err = feed.DataDelete(5, []byte("b"), 2, req); err != nil {
+		t.Errorf("expected a skipped delete, err: %v", err)
+	}
+	if err = feed.DataUpdate(0, []byte("c"), 1, req); err != nil {
+		t.Errorf("expected an assigned vbucket's update to work, err: %v", err)
+	}
+	if dest.Keys() != "c" {
+		t.Errorf("expected only the assigned vbucket's key, got: %s",
+			dest.Keys())
+	}
+	if feed.DataUpdate(uint16(len(vbucketIdStrings)), []byte("d"), 1, req) == nil {
+		t.Errorf("expected an out of range vbucket to still fail")
+	}
+
+	var buf bytes.Buffer
+	if err = feed.Stats(&buf); err != nil {
+		t.Errorf("expected Stats to work, err: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"numSkipped":2`) ||
+		!strings.Contains(buf.String(), `"numUpdate":1`) {
+		t.Errorf("expected 2 skipped mutations, got: %s", buf.String())
+	}
+}
+
+func TestListFeedTypes(t *testing.T) {
+	feedTypes := ListFeedTypes()
+	if feedTypes["couchbase"] == nil || feedTypes["nil"] == nil {
+		t.Errorf("expected public feed types to be listed, got: %#v", feedTypes)
+	}
+	if feedTypes["couchbase"].Description == "" ||
+		feedTypes["couchbase"].StartSample == nil {
+		t.Errorf("expected feed type metadata, got: %#v", feedTypes["couchbase"])
+	}
+	if _, exists := feedTypes["couchbase-dcp"]; exists {
+		t.Errorf("expected non-public couchbase-dcp to not be listed")
+	}
+	if _, exists := feedTypes["dest"]; exists {
+		t.Errorf("expected non-public dest to not be listed")
+	}
+}
+
+func TestDCPFeedRetryStats(t *testing.T) {
+	defer func(prev func() time.Time) { dcpFeedTimeNow = prev }(dcpFeedTimeNow)
+	defer func(prev func(string, string, string, string) error) {
+		dcpFeedCheckBucket = prev
+	}(dcpFeedCheckBucket)
+	dcpFeedCheckBucket = func(string, string, string, string) error {
+		return nil
+	}
+
+	now := time.Now()
+	dcpFeedTimeNow = func() time.Time { return now }
+	advance := func(ms int) {
+		now = now.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"": &TestDest{}}, nil)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	// A flapping source, with errors between short bursts of data.
+	for i := 0; i < 3; i++ {
+		feed.OnError(fmt.Errorf("connection refused"))
+		advance(100)
+		feed.SnapshotStart(0, 1, 1, 0)
+		feed.DataUpdate(0, []byte("k"), 1, &gomemcached.MCRequest{})
+		advance(100)
+	}
+	rs := feed.RetryStats()
+	if rs.NumRetries != 3 || rs.NumResets != 0 ||
+		rs.LastProgressTime.IsZero() || rs.LastErrorTime.IsZero() {
+		t.Errorf("expected retries to accumulate while flapping, got: %#v", rs)
+	}
+
+	// Sustained healthy streaming resets the retries.
+	advance(DCP_FEED_HEALTHY_MS)
+	feed.DataDelete(0, []byte("k"), 2, &gomemcached.MCRequest{})
+	rs = feed.RetryStats()
+	if rs.NumRetries != 0 || rs.NumResets != 1 || !rs.LastProgressTime.Equal(now) {
+		t.Errorf("expected retries to reset after healthy streaming, got: %#v", rs)
+	}
+
+	feed.OnError(fmt.Errorf("connection refused"))
+	rs = feed.RetryStats()
+	if rs.NumRetries != 1 || rs.NumResets != 1 {
+		t.Errorf("expected retries to count again, got: %#v", rs)
+	}
+}
+
+// A FakeBucketDataSource synchronously streams, from its Start(),
+// the mutations of a fake vbucket 0 that are past the receiver's
+// lastSeq from GetMetaData().
+type FakeBucketDataSource struct {
+	receiver  cbdatasource.Receiver
+	mutations *[]string // Key of mutation i has seq i+1.
+
+	m      sync.Mutex
+	closed bool
+}
+
+func (t *FakeBucketDataSource) Start() error {
+	_, lastSeq, err := t.receiver.GetMetaData(0)
+	if err != nil {
+		return err
+	}
+	for i := lastSeq; i < uint64(len(*t.mutations)); i++ {
+		seq := i + 1
+		t.receiver.SnapshotStart(0, seq, seq, 0)
+		key := (*t.mutations)[i]
+		t.receiver.DataUpdate(0, []byte(key), seq,
+			&gomemcached.MCRequest{Body: []byte(`{"x":"hello from ` + key + `"}`)})
+	}
+	return nil
+}
+
+func (t *FakeBucketDataSource) Stats(dest *cbdatasource.BucketDataSourceStats) error {
+	return nil
+}
+
+func (t *FakeBucketDataSource) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.closed {
+		return fmt.Errorf("already closed")
+	}
+	t.closed = true
+	return nil
+}
+
+func (t *FakeBucketDataSource) Kick(reason string) error {
+	return nil
+}
+
+// A SeqDest records the keys of its updates and their last seq.
+type SeqDest struct {
+	TestDest
+
+	m       sync.Mutex
+	keys    []string
+	lastSeq uint64
+}
+
+func (t *SeqDest) OnDataUpdate(partition string,
+	key []byte, seq uint64, val []byte) error {
+	t.m.Lock()
+	t.keys = append(t.keys, string(key))
+	t.lastSeq = seq
+	t.m.Unlock()
+	return nil
+}
+
+func (t *SeqDest) GetOpaque(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return nil, t.lastSeq, nil
+}
+
+func (t *SeqDest) Keys() string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return strings.Join(t.keys, ",")
+}
+
+func TestDCPFeedPauseResume(t *testing.T) {
+	mutations := []string{"a", "b"}
+
+	var bdss []*FakeBucketDataSource
+
+	defer func(prev func([]string, string, string, string, []uint16,
+		couchbase.AuthHandler, cbdatasource.Receiver,
+		*cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error)) {
+		dcpNewBucketDataSource = prev
+	}(dcpNewBucketDataSource)
+
+	dcpNewBucketDataSource = func(serverURLs []string,
+		poolName, bucketName, bucketUUID string, vbucketIds []uint16,
+		auth couchbase.AuthHandler, receiver cbdatasource.Receiver,
+		options *cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error) {
+		bds := &FakeBucketDataSource{receiver: receiver, mutations: &mutations}
+		bdss = append(bdss, bds)
+		return bds, nil
+	}
+
+	mgr := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1,
+		":1000", "dir", "some-datasource", nil)
+
+	dest := &SeqDest{}
+	feed, err := NewDCPFeed("feedName", "http://fake:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"0": dest}, mgr)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+	if err = feed.Start(); err != nil {
+		t.Errorf("expected Start to work, err: %v", err)
+	}
+	if err = mgr.registerFeed(feed); err != nil {
+		t.Errorf("expected registerFeed to work, err: %v", err)
+	}
+	if dest.Keys() != "a,b" {
+		t.Errorf("expected a,b indexed, got: %s", dest.Keys())
+	}
+
+	if err = mgr.PauseFeed("feedName"); err != nil {
+		t.Errorf("expected PauseFeed to work, err: %v", err)
+	}
+	if err = mgr.PauseFeed("feedName"); err != nil {
+		t.Errorf("expected PauseFeed to be idempotent, err: %v", err)
+	}
+	if len(bdss) != 1 || !bdss[0].closed {
+		t.Errorf("expected the data source to be closed while paused")
+	}
+
+	// Mutations produced during the pause.
+	mutations = append(mutations, "c", "d")
+
+	if dest.Keys() != "a,b" {
+		t.Errorf("expected no indexing while paused, got: %s", dest.Keys())
+	}
+
+	if err = mgr.ResumeFeed("feedName"); err != nil {
+		t.Errorf("expected ResumeFeed to work, err: %v", err)
+	}
+	if len(bdss) != 2 || bdss[1].closed {
+		t.Errorf("expected a new data source on resume")
+	}
+	if dest.Keys() != "a,b,c,d" {
+		t.Errorf("expected resume to continue from lastSeq, got: %s",
+			dest.Keys())
+	}
+
+	if err = mgr.PauseFeed("feedName"); err != nil {
+		t.Errorf("expected PauseFeed to work, err: %v", err)
+	}
+	if err = feed.Close(); err != nil {
+		t.Errorf("expected Close while paused to work, err: %v", err)
+	}
+	if mgr.ResumeFeed("feedName") == nil {
+		t.Errorf("expected ResumeFeed on a closed feed to fail")
+	}
+
+	if mgr.PauseFeed("not-a-feed") == nil {
+		t.Errorf("expected PauseFeed on an unknown feed to fail")
+	}
+	mgr.registerFeed(&ErrorOnlyFeed{name: "not-pausable"})
+	if mgr.PauseFeed("not-pausable") == nil {
+		t.Errorf("expected PauseFeed on a non-FeedPauser to fail")
+	}
+}
+
+func TestVBucketIdToPartitionDestOutOfRange(t *testing.T) {
+	dests := map[string]Dest{"": &TestDest{}}
+
+	_, _, err := VBucketIdToPartitionDest(BasicPartitionFunc,
+		dests, 1024, nil)
+	if err == nil || !strings.Contains(err.Error(), "out of configured range") {
+		t.Errorf("expected out of range error, got: %v", err)
+	}
+
+	defer SetNumVBuckets(NUM_VBUCKETS)
+	SetNumVBuckets(2048)
+
+	partition, dest, err := VBucketIdToPartitionDest(BasicPartitionFunc,
+		dests, 1024, nil)
+	if err != nil || partition != "1024" || dest != dests[""] {
+		t.Errorf("expected vbucket in configured range to work,"+
+			" partition: %s, err: %v", partition, err)
+	}
+
+	SetNumVBuckets(64)
+
+	_, _, err = VBucketIdToPartitionDest(BasicPartitionFunc,
+		dests, 64, nil)
+	if err == nil {
+		t.Errorf("expected out of range error for fewer vbuckets")
+	}
+}
+
+// Measures the per-mutation cost of a DCPFeed without any indexing.
+func BenchmarkDCPFeedBlackHole(b *testing.B) {
+	dests := map[string]Dest{}
+	for i := 0; i < 64; i++ {
+		dests[fmt.Sprintf("%d", i)] = NewBlackHole("")
+	}
+
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, dests, nil)
+	if err != nil {
+		b.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	req := &gomemcached.MCRequest{Body: []byte(`{"x":"hello"}`)}
+	key := []byte("key")
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vbucketId := uint16(i % 64)
+		seq := uint64(i/64) + 1
+		err = feed.DataUpdate(vbucketId, key, seq, req)
+		if err != nil {
+			b.Fatalf("expected DataUpdate to work, err: %v", err)
+		}
+	}
+
+	b.StopTimer()
+
+	var numUpdate uint64
+	for _, dest := range dests {
+		numUpdate += dest.(*BlackHole).Stats().NumUpdate
+	}
+	if numUpdate != uint64(b.N) {
+		b.Errorf("expected %d updates, got: %d", b.N, numUpdate)
+	}
+}
+
+func TestDCPFeedDispatchQueue(t *testing.T) {
+	dests := map[string]Dest{}
+	for i := 0; i < 4; i++ {
+		dests[fmt.Sprintf("%d", i)] = &SeqDest{}
+	}
+
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID",
+		`{"dispatchQueueSize":2}`,
+		BasicPartitionFunc, dests, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+	defer feed.Close()
+
+	req := &gomemcached.MCRequest{Body: []byte(`{"x":"hello"}`)}
+
+	for seq := uint64(1); seq <= 50; seq++ {
+		for vbucketId := uint16(0); vbucketId < 4; vbucketId++ {
+			key := []byte(fmt.Sprintf("%d", seq))
+			err = feed.DataUpdate(vbucketId, key, seq, req)
+			if err != nil {
+				t.Fatalf("expected DataUpdate to work, err: %v", err)
+			}
+		}
+	}
+
+	for vbucketId := uint16(0); vbucketId < 4; vbucketId++ {
+		_, lastSeq, err := feed.GetMetaData(vbucketId)
+		if err != nil || lastSeq != 50 {
+			t.Errorf("expected GetMetaData to wait for the queue,"+
+				" lastSeq: %d, err: %v", lastSeq, err)
+		}
+
+		keys := strings.Split(dests[fmt.Sprintf("%d", vbucketId)].(*SeqDest).Keys(), ",")
+		for i, key := range keys {
+			if key != fmt.Sprintf("%d", i+1) {
+				t.Errorf("expected in order updates, vbucketId: %d, keys: %v",
+					vbucketId, keys)
+				break
+			}
+		}
+	}
+}
+
+// A FailDest fails its updates.
+type FailDest struct {
+	TestDest
+}
+
+func (t *FailDest) OnDataUpdate(partition string,
+	key []byte, seq uint64, val []byte) error {
+	return fmt.Errorf("error: FailDest")
+}
+
+func TestDCPFeedDispatchQueueError(t *testing.T) {
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID",
+		`{"dispatchQueueSize":10}`,
+		BasicPartitionFunc, map[string]Dest{"0": &FailDest{}}, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	req := &gomemcached.MCRequest{Body: []byte(`{"x":"hello"}`)}
+
+	if err = feed.DataUpdate(0, []byte("a"), 1, req); err != nil {
+		t.Errorf("expected a queued DataUpdate to work, err: %v", err)
+	}
+	if err = feed.dispatchWait("0"); err == nil {
+		t.Errorf("expected the queued error")
+	}
+	if err = feed.dispatchWait("0"); err != nil {
+		t.Errorf("expected the queued error to be returned once, err: %v", err)
+	}
+
+	feed.Close()
+
+	if err = feed.DataUpdate(0, []byte("b"), 2, req); err == nil {
+		t.Errorf("expected DataUpdate to fail after Close")
+	}
+}
+
+// A FailKeyDest is like a SeqDest that fails the updates of a key.
+type FailKeyDest struct {
+	SeqDest
+	failKey string
+}
+
+func (t *FailKeyDest) OnDataUpdate(partition string,
+	key []byte, seq uint64, val []byte) error {
+	if string(key) == t.failKey {
+		return fmt.Errorf("error: FailKeyDest, key: %s", key)
+	}
+	return t.SeqDest.OnDataUpdate(partition, key, seq, val)
+}
+
+func TestDCPFeedDispatchQueueErrorDropsLater(t *testing.T) {
+	dest := &FailKeyDest{failKey: "b"}
+
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID",
+		`{"dispatchQueueSize":10}`,
+		BasicPartitionFunc, map[string]Dest{"0": dest}, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+	defer feed.Close()
+
+	req := &gomemcached.MCRequest{Body: []byte(`{"x":"hello"}`)}
+
+	for i, key := range []string{"a", "b", "c"} {
+		err = feed.DataUpdate(0, []byte(key), uint64(i+1), req)
+		if err != nil {
+			t.Fatalf("expected a queued DataUpdate to work, err: %v", err)
+		}
+	}
+
+	// The error's reported without waiting for another callback.
+	for i := 0; len(feed.ErrorHistory()) <= 0; i++ {
+		if i > 1000 {
+			t.Fatalf("expected the queued error to be reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err = feed.DataUpdate(0, []byte("d"), 4, req); err == nil {
+		t.Errorf("expected DataUpdate to fail after a queued error")
+	}
+
+	if _, _, err = feed.GetMetaData(0); err == nil {
+		t.Errorf("expected GetMetaData to return the queued error")
+	}
+
+	_, lastSeq, err := feed.GetMetaData(0)
+	if err != nil || lastSeq != 1 {
+		t.Errorf("expected the seq to stop before the failed update,"+
+			" lastSeq: %d, err: %v", lastSeq, err)
+	}
+	if dest.Keys() != "a" {
+		t.Errorf("expected the updates after the failed one to be dropped,"+
+			" keys: %s", dest.Keys())
+	}
+
+	// Once the error's taken, the restreamed updates apply again.
+	dest.failKey = ""
+	for i, key := range []string{"b", "c"} {
+		err = feed.DataUpdate(0, []byte(key), uint64(i+2), req)
+		if err != nil {
+			t.Fatalf("expected DataUpdate to work, err: %v", err)
+		}
+	}
+	_, lastSeq, err = feed.GetMetaData(0)
+	if err != nil || lastSeq != 3 || dest.Keys() != "a,b,c" {
+		t.Errorf("expected the restreamed updates, lastSeq: %d,"+
+			" keys: %s, err: %v", lastSeq, dest.Keys(), err)
+	}
+}
+
+// A StallBatchDest is a BatchDest whose first batch waits for the
+// stallCh to close, so that later mutations pile up in a queue.
+type StallBatchDest struct {
+	BatchDest
+	stallCh chan struct{}
+}
+
+func (s *StallBatchDest) OnDataUpdateBatch(partition string,
+	mutations []DestMutation) error {
+	if len(s.batches) <= 0 {
+		<-s.stallCh
+	}
+	return s.BatchDest.OnDataUpdateBatch(partition, mutations)
+}
+
+func TestDCPFeedDispatchQueueBatch(t *testing.T) {
+	dest := &StallBatchDest{stallCh: make(chan struct{})}
+
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID",
+		`{"dispatchQueueSize":10}`,
+		BasicPartitionFunc, map[string]Dest{"0": dest}, nil)
+	if err != nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+	defer feed.Close()
+
+	req := &gomemcached.MCRequest{Body: []byte(`{"x":"hello"}`)}
+
+	if err = feed.DataUpdate(0, []byte("a"), 1, req); err != nil {
+		t.Fatalf("expected DataUpdate to work, err: %v", err)
+	}
+	for i, key := range []string{"b", "c", "d"} {
+		if err = feed.DataUpdate(0, []byte(key), uint64(i+2), req); err != nil {
+			t.Fatalf("expected DataUpdate to work, err: %v", err)
+		}
+	}
+	if err = feed.DataDelete(0, []byte("b"), 5, req); err != nil {
+		t.Fatalf("expected DataDelete to work, err: %v", err)
+	}
+	if err = feed.SnapshotStart(0, 6, 7, 0); err != nil {
+		t.Fatalf("expected SnapshotStart to work, err: %v", err)
+	}
+	for i, key := range []string{"e", "f"} {
+		if err = feed.DataUpdate(0, []byte(key), uint64(i+6), req); err != nil {
+			t.Fatalf("expected DataUpdate to work, err: %v", err)
+		}
+	}
+
+	close(dest.stallCh)
+
+	if err = feed.dispatchWait("0"); err != nil {
+		t.Fatalf("expected dispatchWait to work, err: %v", err)
+	}
+
+	// The worker might have taken "a" off the queue, stalling, before
+	// or after some of the mutations that follow it were queued, but
+	// the mutations that queued up behind the stall arrive together.
+	batches := dest.batches
+	if len(batches) < 2 || len(batches) > 3 {
+		t.Fatalf("expected the queued mutations to be batched,"+
+			" split by the snapshot start, got: %v", batches)
+	}
+
+	keys := func(mutations []DestMutation) string {
+		rv := []string{}
+		for _, m := range mutations {
+			key := string(m.Key)
+			if m.Delete {
+				key = "-" + key
+			}
+			rv = append(rv, fmt.Sprintf("%s:%d", key, m.Seq))
+		}
+		return strings.Join(rv, ",")
+	}
+
+	var first []DestMutation
+	for _, batch := range batches[:len(batches)-1] {
+		first = append(first, batch...)
+	}
+	if keys(first) != "a:1,b:2,c:3,d:4,-b:5" {
+		t.Errorf("expected the mutations before the snapshot start,"+
+			" in order, got: %s", keys(first))
+	}
+	if keys(batches[len(batches)-1]) != "e:6,f:7" {
+		t.Errorf("expected the mutations after the snapshot start"+
+			" in one batch, got: %s", keys(batches[len(batches)-1]))
+	}
+}
+
+// A SpikyDest is like a SeqDest whose every 100th update stalls,
+// like a dest flushing a batch.
+type SpikyDest struct {
+	SeqDest
+	numUpdate int
+}
+
+func (t *SpikyDest) OnDataUpdate(partition string,
+	key []byte, seq uint64, val []byte) error {
+	t.numUpdate++
+	if t.numUpdate%100 == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return t.SeqDest.OnDataUpdate(partition, key, seq, val)
+}
+
+func benchmarkDCPFeedDispatch(b *testing.B, params string) {
+	dests := map[string]Dest{}
+	for i := 0; i < 16; i++ {
+		dests[fmt.Sprintf("%d", i)] = &SpikyDest{}
+	}
+
+	feed, err := NewDCPFeed("feedName", "http://not-a-server:8091",
+		"default", "bucketName", "bucketUUID", params,
+		BasicPartitionFunc, dests, nil)
+	if err != nil {
+		b.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+	defer feed.Close()
+
+	req := &gomemcached.MCRequest{Body: []byte(`{"x":"hello"}`)}
+	key := []byte("key")
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vbucketId := uint16(i % 16)
+		seq := uint64(i/16) + 1
+		err = feed.DataUpdate(vbucketId, key, seq, req)
+		if err != nil {
+			b.Fatalf("expected DataUpdate to work, err: %v", err)
+		}
+	}
+
+	for partition := range dests {
+		if err = feed.dispatchWait(partition); err != nil {
+			b.Fatalf("expected dispatchWait to work, err: %v", err)
+		}
+	}
+}
+
+// Measures a DCPFeed applying mutations to spiky dests inline.
+func BenchmarkDCPFeedDispatchSync(b *testing.B) {
+	benchmarkDCPFeedDispatch(b, "")
+}
+
+// Measures a DCPFeed applying mutations to spiky dests via
+// per-partition workers.
+func BenchmarkDCPFeedDispatchAsync(b *testing.B) {
+	benchmarkDCPFeedDispatch(b, `{"dispatchQueueSize":100}`)
+}
+
+// A BlockingWriter blocks writes until its releaseCh is closed,
+// like a stalled stats consumer.
+type BlockingWriter struct {
+	enteredCh chan struct{}
+	releaseCh chan struct{}
+}
+
+func (w *BlockingWriter) Write(p []byte) (int, error) {
+	close(w.enteredCh)
+	<-w.releaseCh
+	return len(p), nil
+}
+
+func TestDCPFeedStatsSlowWriter(t *testing.T) {
+	defer func(prev func([]string, string, string, string, []uint16,
+		couchbase.AuthHandler, cbdatasource.Receiver,
+		*cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error)) {
+		dcpNewBucketDataSource = prev
+	}(dcpNewBucketDataSource)
+
+	mutations := []string{}
+
+	dcpNewBucketDataSource = func(serverURLs []string,
+		poolName, bucketName, bucketUUID string, vbucketIds []uint16,
+		auth couchbase.AuthHandler, receiver cbdatasource.Receiver,
+		options *cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error) {
+		return &FakeBucketDataSource{receiver: receiver, mutations: &mutations}, nil
+	}
+
+	dest := &SeqDest{}
+	feed, err := NewDCPFeed("feedName", "http://fake:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"0": dest}, nil)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	req := &gomemcached.MCRequest{Body: []byte(`{"x":"hello"}`)}
+
+	feed.DataUpdate(0, []byte("a"), 1, req)
+
+	w := &BlockingWriter{
+		enteredCh: make(chan struct{}),
+		releaseCh: make(chan struct{}),
+	}
+	statsErrCh := make(chan error)
+	go func() {
+		statsErrCh <- feed.Stats(w)
+	}()
+	<-w.enteredCh
+
+	updateErrCh := make(chan error)
+	go func() {
+		updateErrCh <- feed.DataUpdate(0, []byte("b"), 2, req)
+	}()
+	select {
+	case err = <-updateErrCh:
+		if err != nil {
+			t.Errorf("expected DataUpdate to work, err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected DataUpdate not to be blocked by a slow stats writer")
+	}
+
+	close(w.releaseCh)
+	if err = <-statsErrCh; err != nil {
+		t.Errorf("expected Stats to work, err: %v", err)
+	}
+	if dest.Keys() != "a,b" {
+		t.Errorf("expected a,b indexed, got: %s", dest.Keys())
+	}
+
+	var buf bytes.Buffer
+	if err = feed.Stats(&buf); err != nil {
+		t.Errorf("expected Stats to work, err: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"numUpdate":2`) {
+		t.Errorf("expected stats to snapshot counters, got: %s", buf.String())
+	}
+}
+
+func TestDCPMultiFeed(t *testing.T) {
+	defer func(prev func([]string, string, string, string, []uint16,
+		couchbase.AuthHandler, cbdatasource.Receiver,
+		*cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error)) {
+		dcpNewBucketDataSource = prev
+	}(dcpNewBucketDataSource)
+
+	bucketMutations := map[string][]string{
+		"beer-sample": {"b1", "b2"},
+		"wine":        {"w1"},
+	}
+
+	dcpNewBucketDataSource = func(serverURLs []string,
+		poolName, bucketName, bucketUUID string, vbucketIds []uint16,
+		auth couchbase.AuthHandler, receiver cbdatasource.Receiver,
+		options *cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error) {
+		mutations := bucketMutations[bucketName]
+		if len(vbucketIds) != 1 || vbucketIds[0] != 0 {
+			t.Errorf("expected only vbucket 0, got: %v", vbucketIds)
+		}
+		return &FakeBucketDataSource{receiver: receiver, mutations: &mutations}, nil
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+	bindex := impl.(bleve.Index)
+
+	dests := map[string]Dest{"beer-sample/0": dest, "wine/0": dest}
+
+	_, err = NewDCPMultiFeed("feedName", "http://fake:8091", "default",
+		"beer-sample,wine", "uuid0", "", BasicPartitionFunc, dests, nil)
+	if err == nil {
+		t.Errorf("expected NewDCPMultiFeed to fail on mismatched bucketUUIDs")
+	}
+	_, err = NewDCPMultiFeed("feedName", "http://fake:8091", "default",
+		"beer-sample,wine", "", "", BasicPartitionFunc,
+		map[string]Dest{"0": dest}, nil)
+	if err == nil {
+		t.Errorf("expected NewDCPMultiFeed to fail on a non-namespaced partition")
+	}
+
+	feed, err := NewDCPMultiFeed("feedName", "http://fake:8091", "default",
+		"beer-sample, wine", "", "", BasicPartitionFunc, dests, nil)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPMultiFeed to work, err: %v", err)
+	}
+	if err = feed.Start(); err != nil {
+		t.Errorf("expected Start to work, err: %v", err)
+	}
+	defer feed.Close()
+
+	count, err := bindex.DocCount()
+	if err != nil || count != 3 {
+		t.Errorf("expected 3 docs from both buckets, got: %d, err: %v",
+			count, err)
+	}
+
+	res, err := bindex.Search(bleve.NewSearchRequest(bleve.NewMatchQuery("hello")))
+	if err != nil {
+		t.Fatalf("expected Search to work, err: %v", err)
+	}
+	ids := []string{}
+	for _, hit := range res.Hits {
+		ids = append(ids, hit.ID)
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "b1,b2,w1" {
+		t.Errorf("expected hits across both buckets, got: %v", ids)
+	}
+
+	// Each bucket's partition keeps its own seq.
+	for partition, lastSeq := range map[string]uint64{
+		"beer-sample/0": 2, "wine/0": 1} {
+		_, seq, err := dest.GetOpaque(partition)
+		if err != nil || seq != lastSeq {
+			t.Errorf("expected partition: %s, seq: %d, got: %d, err: %v",
+				partition, lastSeq, seq, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = feed.Stats(&buf); err != nil {
+		t.Errorf("expected Stats to work, err: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"beer-sample":{`) ||
+		!strings.Contains(buf.String(), `,"wine":{`) {
+		t.Errorf("expected per-bucket stats, got: %s", buf.String())
+	}
+}
+
+func TestNamespacedPartitions(t *testing.T) {
+	bucketName, rest := SplitNamespacedPartition("beer-sample/0-63")
+	if bucketName != "beer-sample" || rest != "0-63" {
+		t.Errorf("expected split, got: %s, %s", bucketName, rest)
+	}
+	lo, hi, err := ParsePartitionToVBucketRange("beer-sample/0-63")
+	if err != nil || lo != 0 || hi != 63 {
+		t.Errorf("expected 0-63, got: %d-%d, err: %v", lo, hi, err)
+	}
+	if dcpFeedPartitionIsGroup("beer-sample/12") ||
+		!dcpFeedPartitionIsGroup("beer-sample/0-63") {
+		t.Errorf("expected grouping to ignore the bucket name")
+	}
+
+	vbucketIds, err := ParsePartitionsToVBucketIds(map[string]Dest{
+		"beer-sample/3": nil, "beer-sample/4-5": nil})
+	sort.Sort(uint16s(vbucketIds))
+	if err != nil || !reflect.DeepEqual(vbucketIds, []uint16{3, 4, 5}) {
+		t.Errorf("expected namespaced vbuckets, got: %v, err: %v",
+			vbucketIds, err)
+	}
+
+	dests := map[string]Dest{
+		"beer-sample/0-1": &TestDest{},
+		"wine/0-1":        &TestDest{},
+	}
+	partition, _, err := VBucketIdToNamespacedPartitionDest(BasicPartitionFunc,
+		dests, "wine", 1, nil)
+	if err != nil || partition != "wine/0-1" {
+		t.Errorf("expected wine/0-1, got: %s, err: %v", partition, err)
+	}
+}
+
+func TestParsePartitionsToVBucketIdsByNamespace(t *testing.T) {
+	if NamespacedPartition("", "12") != "12" ||
+		NamespacedPartition("beer-sample", "12") != "beer-sample/12" {
+		t.Errorf("expected plain and namespaced partition names")
+	}
+
+	tests := []struct {
+		dests    map[string]Dest
+		expected map[string][]uint16
+	}{
+		{map[string]Dest{"3": nil, "4-5": nil},
+			map[string][]uint16{"": {3, 4, 5}}},
+		{map[string]Dest{"a/3": nil, "b/3-4": nil, "5": nil},
+			map[string][]uint16{"a": {3}, "b": {3, 4}, "": {5}}},
+	}
+	for i, test := range tests {
+		byNamespace, err := ParsePartitionsToVBucketIdsByNamespace(test.dests)
+		for _, vbucketIds := range byNamespace {
+			sort.Sort(uint16s(vbucketIds))
+		}
+		if err != nil || !reflect.DeepEqual(byNamespace, test.expected) {
+			t.Errorf("test %d, expected: %v, got: %v, err: %v",
+				i, test.expected, byNamespace, err)
+		}
+	}
+
+	_, err := ParsePartitionsToVBucketIds(map[string]Dest{"a/3": nil, "b/3": nil})
+	if err == nil {
+		t.Errorf("expected colliding vbucket ids across namespaces to fail")
+	}
+	_, err = ParsePartitionsToVBucketIds(map[string]Dest{"a/x": nil})
+	if err == nil {
+		t.Errorf("expected a bad namespaced partition to fail")
+	}
+
+	dests := map[string]Dest{"3": &TestDest{}, "a/3": &TestDest{}}
+	for bucketName, expected := range map[string]string{"": "3", "a": "a/3"} {
+		partition, dest, err := VBucketIdToNamespacedPartitionDest(
+			BasicPartitionFunc, dests, bucketName, 3, nil)
+		if err != nil || partition != expected || dest != dests[expected] {
+			t.Errorf("expected partition: %s, got: %s, err: %v",
+				expected, partition, err)
+		}
+	}
+}
+
+func TestDCPFeedSnappyValues(t *testing.T) {
+	defer func(prev func([]string, string, string, string, []uint16,
+		couchbase.AuthHandler, cbdatasource.Receiver,
+		*cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error)) {
+		dcpNewBucketDataSource = prev
+	}(dcpNewBucketDataSource)
+
+	dcpNewBucketDataSource = func(serverURLs []string,
+		poolName, bucketName, bucketUUID string, vbucketIds []uint16,
+		auth couchbase.AuthHandler, receiver cbdatasource.Receiver,
+		options *cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error) {
+		return &FakeBucketDataSource{receiver: receiver, mutations: &[]string{}}, nil
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"bleve", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+	bindex := impl.(bleve.Index)
+
+	feed, err := NewDCPFeed("feedName", "http://fake:8091",
+		"default", "bucketName", "bucketUUID", "",
+		BasicPartitionFunc, map[string]Dest{"0": dest}, nil)
+	if err != nil || feed == nil {
+		t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+	}
+
+	feed.SnapshotStart(0, 1, 3, 0)
+	err = feed.DataUpdate(0, []byte("plain"), 1, &gomemcached.MCRequest{
+		Body: []byte(`{"x":"plain hello"}`),
+	})
+	if err != nil {
+		t.Errorf("expected uncompressed DataUpdate to work, err: %v", err)
+	}
+	err = feed.DataUpdate(0, []byte("compressed"), 2, &gomemcached.MCRequest{
+		Body:     snappy.Encode(nil, []byte(`{"x":"compressed hello"}`)),
+		DataType: DCP_DATATYPE_SNAPPY,
+	})
+	if err != nil {
+		t.Errorf("expected compressed DataUpdate to work, err: %v", err)
+	}
+	err = feed.DataUpdate(0, []byte("corrupt"), 3, &gomemcached.MCRequest{
+		Body:     []byte(`{"x":"corrupt hello"}`),
+		DataType: DCP_DATATYPE_SNAPPY,
+	})
+	if err != nil {
+		t.Errorf("expected corrupt DataUpdate to be skipped, err: %v", err)
+	}
+
+	for term, expected := range map[string]string{
+		"hello":      "compressed,plain",
+		"compressed": "compressed",
+		"corrupt":    "",
+	} {
+		res, err := bindex.Search(bleve.NewSearchRequest(bleve.NewMatchQuery(term)))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		if strings.Join(ids, ",") != expected {
+			t.Errorf("expected term: %s to match: %s, got: %v",
+				term, expected, ids)
+		}
+	}
+
+	_, lastSeq, err := dest.GetOpaque("0")
+	if err != nil || lastSeq != 3 {
+		t.Errorf("expected the skipped doc to advance the seq, got: %d,"+
+			" err: %v", lastSeq, err)
+	}
+}
+
+// Returns a value framed with the given xattrs, as DCP sends it.
+func xattrsValue(body string, xattrs ...string) []byte {
+	var pairs []byte
+	for i := 0; i+1 < len(xattrs); i += 2 {
+		pair := xattrs[i] + "\x00" + xattrs[i+1] + "\x00"
+		pairLen := make([]byte, 4)
+		binary.BigEndian.PutUint32(pairLen, uint32(len(pair)))
+		pairs = append(append(pairs, pairLen...), pair...)
+	}
+	rv := make([]byte, 4)
+	binary.BigEndian.PutUint32(rv, uint32(len(pairs)))
+	return append(append(rv, pairs...), body...)
+}
+
+func TestParseXAttrs(t *testing.T) {
+	xattrs, body, err := ParseXAttrs(
+		xattrsValue(`{"x":1}`, "a", `{"b":2}`, "c", `"d"`))
+	if err != nil || string(body) != `{"x":1}` || len(xattrs) != 2 ||
+		string(xattrs["a"]) != `{"b":2}` || string(xattrs["c"]) != `"d"` {
+		t.Errorf("expected xattrs and body, got: %v, %s, err: %v",
+			xattrs, body, err)
+	}
+
+	for i, val := range [][]byte{
+		nil,
+		[]byte{0, 0, 0, 9, 'x'},
+		[]byte{0, 0, 0, 4, 0, 0, 0, 9},
+		[]byte{0, 0, 0, 5, 0, 0, 0, 1, 'x'},
+	} {
+		if _, _, err = ParseXAttrs(val); err == nil {
+			t.Errorf("test %d, expected ParseXAttrs to fail on: %v", i, val)
+		}
+	}
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{`{"x":1}`, `{"_xattrs":{"a":true},"x":1}`},
+		{` { } `, `{"_xattrs":{"a":true}}`},
+		{`[1]`, `[1]`},
+	}
+	for i, test := range tests {
+		merged, err := mergeXAttrs([]byte(test.body), "_xattrs",
+			map[string]json.RawMessage{"a": json.RawMessage("true")})
+		if err != nil || string(merged) != test.expected {
+			t.Errorf("test %d, expected: %s, got: %s, err: %v",
+				i, test.expected, merged, err)
+		}
+	}
+}
+
+func TestDCPFeedXAttrs(t *testing.T) {
+	defer func(prev func([]string, string, string, string, []uint16,
+		couchbase.AuthHandler, cbdatasource.Receiver,
+		*cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error)) {
+		dcpNewBucketDataSource = prev
+	}(dcpNewBucketDataSource)
+
+	dcpNewBucketDataSource = func(serverURLs []string,
+		poolName, bucketName, bucketUUID string, vbucketIds []uint16,
+		auth couchbase.AuthHandler, receiver cbdatasource.Receiver,
+		options *cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error) {
+		return &FakeBucketDataSource{receiver: receiver, mutations: &[]string{}}, nil
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	// Returns the IDs of docs that match the query string after
+	// indexing a doc with an xattr, for the given feed params.
+	search := func(name, params, queryString string) string {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		defer dest.Close()
+
+		feed, err := NewDCPFeed("feedName", "http://fake:8091",
+			"default", "bucketName", "bucketUUID", params,
+			BasicPartitionFunc, map[string]Dest{"0": dest}, nil)
+		if err != nil || feed == nil {
+			t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+		}
+
+		feed.SnapshotStart(0, 1, 1, 0)
+		err = feed.DataUpdate(0, []byte("a"), 1, &gomemcached.MCRequest{
+			Body: snappy.Encode(nil, xattrsValue(`{"x":"hello"}`,
+				"meta", `{"author":"marty"}`)),
+			DataType: DCP_DATATYPE_SNAPPY | DCP_DATATYPE_XATTR,
+		})
+		if err != nil {
+			t.Errorf("expected DataUpdate to work, err: %v", err)
+		}
+
+		res, err := impl.(bleve.Index).Search(bleve.NewSearchRequest(
+			bleve.NewQueryStringQuery(queryString)))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	tests := []struct {
+		params      string
+		queryString string
+		expected    string
+	}{
+		{"", "x:hello", "a"},
+		{"", "marty", ""},
+		{`{"includeXAttrs":true}`, "x:hello", "a"},
+		{`{"includeXAttrs":true}`, "_xattrs.meta.author:marty", "a"},
+		{`{"includeXAttrs":true,"xattrsNamespace":"xa"}`, "xa.meta.author:marty", "a"},
+	}
+	for i, test := range tests {
+		got := search(fmt.Sprintf("idx%d", i), test.params, test.queryString)
+		if got != test.expected {
+			t.Errorf("test %d, expected: %s, got: %s", i, test.expected, got)
+		}
+	}
+}
+
+func TestDCPFeedMetadata(t *testing.T) {
+	defer func(prev func([]string, string, string, string, []uint16,
+		couchbase.AuthHandler, cbdatasource.Receiver,
+		*cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error)) {
+		dcpNewBucketDataSource = prev
+	}(dcpNewBucketDataSource)
+
+	dcpNewBucketDataSource = func(serverURLs []string,
+		poolName, bucketName, bucketUUID string, vbucketIds []uint16,
+		auth couchbase.AuthHandler, receiver cbdatasource.Receiver,
+		options *cbdatasource.BucketDataSourceOptions) (
+		cbdatasource.BucketDataSource, error) {
+		return &FakeBucketDataSource{receiver: receiver, mutations: &[]string{}}, nil
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	// The extras of a mutation with flags 7 and expiry 1000.
+	extras := make([]byte, 31)
+	binary.BigEndian.PutUint32(extras[16:20], 7)
+	binary.BigEndian.PutUint32(extras[20:24], 1000)
+
+	// Returns the IDs of docs whose field is in [min, max] after
+	// indexing a mutation with metadata, for the given feed params.
+	search := func(name, params, field string, min, max float64) string {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		defer dest.Close()
+
+		feed, err := NewDCPFeed("feedName", "http://fake:8091",
+			"default", "bucketName", "bucketUUID", params,
+			BasicPartitionFunc, map[string]Dest{"0": dest}, nil)
+		if err != nil || feed == nil {
+			t.Fatalf("expected NewDCPFeed to work, err: %v", err)
+		}
+
+		feed.SnapshotStart(0, 1, 1, 0)
+		err = feed.DataUpdate(0, []byte("a"), 1, &gomemcached.MCRequest{
+			Body:   []byte(`{"x":"hello"}`),
+			Cas:    123456,
+			Extras: extras,
+		})
+		if err != nil {
+			t.Errorf("expected DataUpdate to work, err: %v", err)
+		}
+
+		res, err := impl.(bleve.Index).Search(bleve.NewSearchRequest(
+			bleve.NewNumericRangeQuery(&min, &max).SetField(field)))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		ids := []string{}
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	tests := []struct {
+		params   string
+		field    string
+		min, max float64
+		expected string
+	}{
+		{"", "_cas", 0, 1000000, ""},
+		{`{"includeMetadata":true}`, "_cas", 100000, 200000, "a"},
+		{`{"includeMetadata":true}`, "_cas", 200000, 300000, ""},
+		{`{"includeMetadata":true}`, "_flags", 7, 7, "a"},
+		{`{"includeMetadata":true}`, "_flags", 8, 9, ""},
+		{`{"includeMetadata":true}`, "_exptime", 999, 1001, "a"},
+	}
+	for i, test := range tests {
+		got := search(fmt.Sprintf("idx%d", i), test.params,
+			test.field, test.min, test.max)
+		if got != test.expected {
+			t.Errorf("test %d, expected: %s, got: %s", i, test.expected, got)
+		}
+	}
+}
+
+func TestMergeDCPMetadata(t *testing.T) {
+	tests := []struct {
+		body     string
+		extras   []byte
+		expected string
+	}{
+		{`{"x":1}`, nil, `{"_cas":5,"x":1}`},
+		{`{}`, make([]byte, 24), `{"_exptime":0,"_flags":0,"_cas":5}`},
+		{`"not an object"`, nil, `"not an object"`},
+	}
+	for i, test := range tests {
+		merged, err := mergeDCPMetadata([]byte(test.body),
+			&gomemcached.MCRequest{Cas: 5, Extras: test.extras})
+		if err != nil || string(merged) != test.expected {
+			t.Errorf("test %d, expected: %s, got: %s, err: %v",
+				i, test.expected, merged, err)
+		}
+	}
+}
+
+type uint16s []uint16
+
+func (a uint16s) Len() int           { return len(a) }
+func (a uint16s) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint16s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,120 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of buckets of a LatencyHistogram, whose upper bounds
+// double from 1ms, so the last bucket is for everything beyond
+// about 4 minutes.
+const LATENCY_HISTOGRAM_BUCKETS = 20
+
+// A LatencyHistogram counts durations into fixed buckets, which keeps
+// recording cheap enough for hot paths, at the cost of percentiles
+// that are only as precise as the bucket bounds.
+type LatencyHistogram struct {
+	m      sync.Mutex
+	counts [LATENCY_HISTOGRAM_BUCKETS]uint64
+	total  uint64
+	max    time.Duration
+}
+
+// LatencyHistogramStats is a snapshot of a LatencyHistogram, where
+// each percentile is the upper bound of the bucket that holds it,
+// capped by the max.
+type LatencyHistogramStats struct {
+	Count uint64 `json:"count"`
+	P50NS int64  `json:"p50NS"`
+	P90NS int64  `json:"p90NS"`
+	P99NS int64  `json:"p99NS"`
+	MaxNS int64  `json:"maxNS"`
+}
+
+// Returns the upper bound of a bucket.
+func latencyHistogramBound(bucket int) time.Duration {
+	return time.Millisecond << uint(bucket)
+}
+
+func latencyHistogramBucket(d time.Duration) int {
+	for i := 0; i < LATENCY_HISTOGRAM_BUCKETS-1; i++ {
+		if d <= latencyHistogramBound(i) {
+			return i
+		}
+	}
+	return LATENCY_HISTOGRAM_BUCKETS - 1
+}
+
+func (h *LatencyHistogram) Add(d time.Duration) {
+	h.m.Lock()
+	h.addUnlocked(d)
+	h.m.Unlock()
+}
+
+// AddSince records the durations from each of the starts, in unix
+// nanosecs, to now, under a single lock acquisition.
+func (h *LatencyHistogram) AddSince(now time.Time, starts []int64) {
+	nowNS := now.UnixNano()
+
+	h.m.Lock()
+	for _, start := range starts {
+		h.addUnlocked(time.Duration(nowNS - start))
+	}
+	h.m.Unlock()
+}
+
+func (h *LatencyHistogram) addUnlocked(d time.Duration) {
+	h.counts[latencyHistogramBucket(d)] += 1
+	h.total += 1
+	if h.max < d {
+		h.max = d
+	}
+}
+
+func (h *LatencyHistogram) Stats() *LatencyHistogramStats {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	return &LatencyHistogramStats{
+		Count: h.total,
+		P50NS: int64(h.percentileUnlocked(0.50)),
+		P90NS: int64(h.percentileUnlocked(0.90)),
+		P99NS: int64(h.percentileUnlocked(0.99)),
+		MaxNS: int64(h.max),
+	}
+}
+
+func (h *LatencyHistogram) percentileUnlocked(p float64) time.Duration {
+	if h.total <= 0 {
+		return 0
+	}
+
+	rank := uint64(p * float64(h.total))
+	if float64(rank) < p*float64(h.total) {
+		rank += 1 // Rounds up, so the rank is at least 1.
+	}
+
+	var seen uint64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			if i < LATENCY_HISTOGRAM_BUCKETS-1 &&
+				latencyHistogramBound(i) < h.max {
+				return latencyHistogramBound(i)
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
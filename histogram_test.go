@@ -0,0 +1,57 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := &LatencyHistogram{}
+
+	stats := h.Stats()
+	if stats.Count != 0 || stats.P50NS != 0 || stats.MaxNS != 0 {
+		t.Errorf("expected empty stats, got: %#v", stats)
+	}
+
+	for i := 0; i < 90; i++ {
+		h.Add(500 * time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.Add(3 * time.Millisecond)
+	}
+	h.Add(time.Hour)
+
+	stats = h.Stats()
+	if stats.Count != 100 {
+		t.Errorf("expected 100 count, got: %d", stats.Count)
+	}
+	if stats.P50NS != int64(time.Millisecond) ||
+		stats.P90NS != int64(time.Millisecond) {
+		t.Errorf("expected p50 and p90 in the 1ms bucket, got: %#v", stats)
+	}
+	if stats.P99NS != int64(4*time.Millisecond) {
+		t.Errorf("expected p99 in the 4ms bucket, got: %#v", stats)
+	}
+	if stats.MaxNS != int64(time.Hour) {
+		t.Errorf("expected max of 1h, got: %#v", stats)
+	}
+
+	// A percentile is capped by the max.
+	h = &LatencyHistogram{}
+	h.AddSince(time.Unix(0, int64(3*time.Millisecond)), []int64{0, 0})
+	stats = h.Stats()
+	if stats.Count != 2 || stats.P50NS != int64(3*time.Millisecond) {
+		t.Errorf("expected p50 capped by the max, got: %#v", stats)
+	}
+}
@@ -10,7 +10,12 @@
 package cbft
 
 import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -60,3 +65,90 @@ func showError(w http.ResponseWriter, r *http.Request,
 	log.Printf("error: http: %v/%v", code, msg)
 	http.Error(w, msg, code)
 }
+
+// ------------------------------------------------------------------
+
+// Returns whether the client accepts a gzip encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+// Wraps w so that the response is gzip encoded when the client
+// accepts it.  The returned func must be invoked after the response
+// is written, to flush the encoding.
+func maybeGzipResponse(w http.ResponseWriter, r *http.Request) (
+	http.ResponseWriter, func()) {
+	if !acceptsGzip(r) {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	gz := gzip.NewWriter(w)
+	return &gzipResponseWriter{ResponseWriter: w, gz: gz}, func() { gz.Close() }
+}
+
+// Reads a request's body, decoding it if it's gzip encoded.  An
+// encoded body that can't be decoded returns a
+// RequestEncodingError.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	enc := r.Header.Get("Content-Encoding")
+	if enc == "" || enc == "identity" {
+		return ioutil.ReadAll(r.Body)
+	}
+	if enc != "gzip" {
+		return nil, &RequestEncodingError{
+			Err: fmt.Errorf("unsupported Content-Encoding: %s", enc),
+		}
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, &RequestEncodingError{Err: err}
+	}
+	defer gz.Close()
+	buf, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, &RequestEncodingError{Err: err}
+	}
+	return buf, nil
+}
+
+// A RequestEncodingError is the error of a request body whose
+// Content-Encoding isn't supported or can't be decoded, which is
+// reported with a 415 status, so that a client can retry with an
+// unencoded body.
+type RequestEncodingError struct {
+	Err error
+}
+
+func (e *RequestEncodingError) Error() string {
+	return e.Err.Error()
+}
+
+// Reads a response's body, decoding it if it's gzip encoded.  The
+// body is read to its end, so that its connection can be reused.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.ReadAll(resp.Body)
+	}
+	defer io.Copy(ioutil.Discard, resp.Body)
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
@@ -12,11 +12,18 @@
 package cbft
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/couchbaselabs/clog"
@@ -32,8 +39,15 @@ type Manager struct {
 	container string          // Slash ('/') separated containment path (optional).
 	weight    int
 	bindAddr  string
+	hostPort  string // The bindAddr as reachable by remote nodes, see HostPort().
 	dataDir   string
 	server    string // The datasource that cbft will index.
+	options   map[string]string
+	register  string // The register mode at Manager start.
+
+	stats ManagerStats // Only access via the sync/atomic functions.
+
+	hostPortOnce sync.Once // Lazily resolves the hostPort.
 
 	m         sync.Mutex
 	feeds     map[string]Feed    // Key is Feed.Name().
@@ -42,10 +56,28 @@ type Manager struct {
 	janitorCh chan *WorkReq      // Used to kick the janitor that there's more work.
 	meh       ManagerEventHandlers
 
+	rollbackPolicy RollbackPolicy // When nil, rollbacks always rebuild.
+
 	lastIndexDefs          *IndexDefs
 	lastIndexDefsByName    map[string]*IndexDef
 	lastPlanPIndexes       *PlanPIndexes
 	lastPlanPIndexesByName map[string][]*PlanPIndex
+
+	topologies map[string]string // Last seen data source topologies.
+
+	indexOps map[string]*indexOp // Async index operations, keyed by opID.
+
+	queryLimiters map[string]*queryLimiter // Keyed by index name.
+
+	// The budget of bytes buffered by the BleveDests of our pindexes.
+	bleveDestBuffered *bleveDestBudget
+
+	// Shared by our remote calls, so that connections are reused.
+	remoteHTTPClient *http.Client
+
+	// The connections to the buckets of the data sources, such as
+	// for queries with includeSource.
+	sourceBuckets *CouchbaseBuckets
 }
 
 type ManagerEventHandlers interface {
@@ -53,9 +85,73 @@ type ManagerEventHandlers interface {
 	OnUnregisterPIndex(pindex *PIndex)
 }
 
+// ManagerFeedEventHandlers is an optional extension of
+// ManagerEventHandlers, for handlers that also want to be notified
+// of feeds that have stopped, such as to alert an operator.
+type ManagerFeedEventHandlers interface {
+	// Invoked when a feed hits an error that it can't recover from,
+	// such as a deleted data source, after which the feed stops.
+	OnFeedError(srcType string, r Feed, err error)
+}
+
+// ManagerPlanEventHandlers is an optional extension of
+// ManagerEventHandlers, for handlers that also want to observe the
+// plans that are written by this node's planner, such as to update a
+// dashboard or to warm up the newly assigned pindexes.
+type ManagerPlanEventHandlers interface {
+	// Invoked after the planner saved a new plan, where the old plan
+	// is an empty plan when there was none.
+	OnPlanChanged(old, new *PlanPIndexes)
+}
+
+// ManagerStats holds counters of interesting Manager events, which
+// operators can monitor.  The fields are updated via sync/atomic.
+type ManagerStats struct {
+	TotLoadDataDirQuarantinedPIndex uint64 `json:"totLoadDataDirQuarantinedPIndex"`
+	TotFeedFatalError               uint64 `json:"totFeedFatalError"`
+	TotTopologyChange               uint64 `json:"totTopologyChange"`
+
+	// Kicks received by the planner and janitor, versus the work
+	// cycles they ran, where the difference is the coalesced kicks.
+	TotPlannerKick  uint64 `json:"totPlannerKick"`
+	TotPlannerCycle uint64 `json:"totPlannerCycle"`
+	TotJanitorKick  uint64 `json:"totJanitorKick"`
+	TotJanitorCycle uint64 `json:"totJanitorCycle"`
+
+	// Duplicate hits merged away by queries with the dedupe param.
+	TotQueryDuplicateHit uint64 `json:"totQueryDuplicateHit"`
+
+	// Queries rejected by query admission (see QueryBegin), and the
+	// current in-flight queries, keyed by index name.
+	TotQueryRejected uint64           `json:"totQueryRejected"`
+	CurQueryInFlight map[string]int64 `json:"curQueryInFlight"`
+
+	// Bytes currently buffered in the unapplied batches of the
+	// Manager's pindexes.
+	CurBufferedBytes uint64 `json:"curBufferedBytes"`
+}
+
+// The suffix appended to the path of a pindex directory that's
+// corrupt, when the "quarantineCorruptPIndexes" option is on.  See
+// PIndexCorruptError.
+const pindexQuarantineSuffix string = ".corrupt"
+
 func NewManager(version string, cfg Cfg, uuid string, tags []string,
 	container string, weight int, bindAddr, dataDir string, server string,
 	meh ManagerEventHandlers) *Manager {
+	return NewManagerEx(version, cfg, uuid, tags, container, weight,
+		bindAddr, dataDir, server, meh, nil)
+}
+
+// NewManagerEx is like NewManager, but also takes optional, advanced
+// configuration options, like "quarantineCorruptPIndexes": "true" or
+// "advertiseAddr": "host:port".
+func NewManagerEx(version string, cfg Cfg, uuid string, tags []string,
+	container string, weight int, bindAddr, dataDir string, server string,
+	meh ManagerEventHandlers, options map[string]string) *Manager {
+	if options == nil {
+		options = map[string]string{}
+	}
 	return &Manager{
 		startTime: time.Now(),
 		version:   version,
@@ -65,18 +161,27 @@ func NewManager(version string, cfg Cfg, uuid string, tags []string,
 		tagsMap:   StringsToMap(tags),
 		container: container,
 		weight:    weight,
-		bindAddr:  bindAddr, // TODO: need FQDN:port instead of ":8095".
+		bindAddr:  bindAddr,
 		dataDir:   dataDir,
 		server:    server,
+		options:   options,
 		feeds:     make(map[string]Feed),
 		pindexes:  make(map[string]*PIndex),
 		plannerCh: make(chan *WorkReq),
 		janitorCh: make(chan *WorkReq),
 		meh:       meh,
+
+		bleveDestBuffered: newBleveDestBudget(
+			bleveDestBufferedBytesMax(options)),
+		remoteHTTPClient: newRemoteHTTPClient(options),
+		sourceBuckets:    NewCouchbaseBuckets(),
 	}
 }
 
 func (mgr *Manager) Start(register string) error {
+
+	mgr.register = register
+
 	if register != "notRegistered" {
 		if register == "known" ||
 			register == "knownForce" ||
@@ -115,81 +220,168 @@ func (mgr *Manager) Start(register string) error {
 		go mgr.JanitorKick("start")
 	}
 
-	if mgr.cfg != nil { // TODO: err handling for Cfg subscriptions.
-		go func() {
-			ei := make(chan CfgEvent)
-			mgr.cfg.Subscribe(INDEX_DEFS_KEY, ei)
-			for _ = range ei {
-				mgr.GetIndexDefs(true)
-			}
-		}()
-		go func() {
-			ep := make(chan CfgEvent)
-			mgr.cfg.Subscribe(PLAN_PINDEXES_KEY, ep)
-			for _ = range ep {
-				mgr.GetPlanPIndexes(true)
-			}
-		}()
+	if pollMS := mgr.TopologyPollMS(); pollMS > 0 {
+		go mgr.TopologyLoop(pollMS)
+	}
+
+	if heartbeatMS := mgr.optionMS("heartbeatMS"); heartbeatMS > 0 {
+		go mgr.HeartbeatLoop(heartbeatMS, mgr.optionMS("nodeTTLMS"))
+	}
+
+	if mgr.cfg != nil {
+		go mgr.subscribeCfgKey(INDEX_DEFS_KEY, func() {
+			mgr.GetIndexDefs(true)
+		})
+		go mgr.subscribeCfgKey(PLAN_PINDEXES_KEY, func() {
+			mgr.GetPlanPIndexes(true)
+		})
 	}
 
 	return nil
 }
 
-// ---------------------------------------------------------------
+// subscribeCfgKey subscribes to changes of a Cfg key, invoking
+// refresh on every (coalesced) burst of changes.  If the Subscribe()
+// fails or if the Cfg unexpectedly closes the event channel, it
+// re-subscribes with an exponential backoff, so that the Manager
+// doesn't permanently stop seeing config changes.
+func (mgr *Manager) subscribeCfgKey(key string, refresh func()) {
+	attempts := 0
 
-func (mgr *Manager) SaveNodeDef(kind string, force bool) error {
-	if mgr.cfg == nil {
-		return nil // Occurs during testing.
+	ExponentialBackoffLoop("manager cfg subscribe, key: "+key,
+		func() int {
+			attempts += 1
+
+			ch := make(chan CfgEvent)
+			err := mgr.cfg.Subscribe(key, ch)
+			if err != nil {
+				log.Printf("error: manager could not subscribe to cfg,"+
+					" key: %s, attempts: %d, err: %v", key, attempts, err)
+				return 0
+			}
+			if attempts > 1 {
+				// Catch up on changes we missed while unsubscribed.
+				refresh()
+			}
+
+			numEvents := coalesceCfgEvents(ch, MANAGER_CFG_COALESCE_MS, refresh)
+
+			log.Printf("warning: manager cfg subscription closed,"+
+				" key: %s, numEvents: %d, will re-subscribe", key, numEvents)
+
+			return numEvents
+		},
+		FEED_SLEEP_INIT_MS, FEED_BACKOFF_FACTOR, FEED_SLEEP_MAX_MS)
+}
+
+// The time window (millisecs) during which a burst of Cfg events is
+// collapsed into a single refresh of the Manager's cached config.
+const MANAGER_CFG_COALESCE_MS = 50
+
+// coalesceCfgEvents invokes f once per burst of events received on
+// ch.  The first event of a burst starts a timer of windowMS, and f is
+// invoked when that timer fires, so f always runs at some point after
+// the last event of a burst and the latest config is never missed.
+// Returns the number of events received, when ch is closed.
+func coalesceCfgEvents(ch chan CfgEvent, windowMS int, f func()) int {
+	numEvents := 0
+
+	var timerCh <-chan time.Time
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				if timerCh != nil {
+					f() // Don't drop the final, pending refresh.
+				}
+				return numEvents
+			}
+			numEvents += 1
+			if timerCh == nil {
+				timerCh = time.After(time.Duration(windowMS) * time.Millisecond)
+			}
+		case <-timerCh:
+			timerCh = nil
+			f()
+		}
 	}
+}
 
-	nodeDef := &NodeDef{
-		HostPort:    mgr.bindAddr,
+// ---------------------------------------------------------------
+
+// Returns a NodeDef that describes this node.
+func (mgr *Manager) newNodeDef() *NodeDef {
+	return &NodeDef{
+		HostPort:    mgr.HostPort(),
 		UUID:        mgr.uuid,
 		ImplVersion: mgr.version,
 		Tags:        mgr.tags,
 		Container:   mgr.container,
 		Weight:      mgr.weight,
 	}
+}
 
-	for {
-		nodeDefs, cas, err := CfgGetNodeDefs(mgr.cfg, kind)
-		if err != nil {
-			return err
-		}
-		if nodeDefs == nil {
-			nodeDefs = NewNodeDefs(mgr.version)
-		}
-		nodeDefPrev, exists := nodeDefs.NodeDefs[mgr.bindAddr]
-		if exists && !force {
-			// If a previous entry exists, do some double-checking
-			// before we overwrite the entry with our entry.
-			if nodeDefPrev.UUID != mgr.uuid {
-				return fmt.Errorf("some other node is running at our bindAddr: %s,"+
-					" with a different uuid: %s, than our uuid: %s",
-					mgr.bindAddr, nodeDefPrev.UUID, mgr.uuid)
-			}
-			if reflect.DeepEqual(nodeDefPrev, nodeDef) {
-				return nil // No changes, so leave the existing nodeDef.
+func (mgr *Manager) SaveNodeDef(kind string, force bool) error {
+	if mgr.cfg == nil {
+		return nil // Occurs during testing.
+	}
+
+	nodeDef := mgr.newNodeDef()
+
+	// Retries on CAS mismatch, as perhaps multiple nodes are all
+	// racing to register themselves, such as in a full datacenter
+	// power restart.
+	var nodeDefs *NodeDefs
+	return CfgUpdate(
+		func() (cas uint64, err error) {
+			nodeDefs, cas, err = CfgGetNodeDefs(mgr.cfg, kind)
+			if err == nil && nodeDefs == nil {
+				nodeDefs = NewNodeDefs(mgr.version)
 			}
-		}
+			return cas, err
+		},
+		func() (bool, error) {
+			hostPort := mgr.HostPort()
 
-		nodeDefs.UUID = NewUUID()
-		nodeDefs.NodeDefs[mgr.bindAddr] = nodeDef
-		nodeDefs.ImplVersion = mgr.version // TODO: ImplVersion bump?
+			// Our entries under other keys, such as the bindAddr keys
+			// like ":8095" of earlier versions, are migrated away.
+			stale := false
+			for k, v := range nodeDefs.NodeDefs {
+				if k != hostPort && v.UUID == mgr.uuid {
+					delete(nodeDefs.NodeDefs, k)
+					stale = true
+				}
+			}
 
-		_, err = CfgSetNodeDefs(mgr.cfg, kind, nodeDefs, cas)
-		if err != nil {
-			if _, ok := err.(*CfgCASError); ok {
-				// Retry if it was a CAS mismatch, as perhaps
-				// multiple nodes are all racing to register themselves,
-				// such as in a full datacenter power restart.
-				continue
+			nodeDefPrev, exists := nodeDefs.NodeDefs[hostPort]
+			if exists && nodeDefPrev.UUID == mgr.uuid {
+				// Keep our heartbeat, which is maintained separately.
+				nodeDef.LastHeartbeat = nodeDefPrev.LastHeartbeat
 			}
+			if exists && !force {
+				// If a previous entry exists, do some double-checking
+				// before we overwrite the entry with our entry.
+				if nodeDefPrev.UUID != mgr.uuid {
+					return false, fmt.Errorf("some other node is running"+
+						" at our hostPort: %s, with a different uuid: %s,"+
+						" than our uuid: %s",
+						hostPort, nodeDefPrev.UUID, mgr.uuid)
+				}
+				if reflect.DeepEqual(nodeDefPrev, nodeDef) && !stale {
+					return false, nil // No changes, so leave the existing nodeDef.
+				}
+			}
+
+			nodeDefs.UUID = NewUUID()
+			nodeDefs.NodeDefs[hostPort] = nodeDef
+			nodeDefs.ImplVersion = mgr.version // TODO: ImplVersion bump?
+
+			return true, nil
+		},
+		func(cas uint64) error {
+			_, err := CfgSetNodeDefs(mgr.cfg, kind, nodeDefs, cas)
 			return err
-		}
-		break
-	}
-	return nil
+		})
 }
 
 // ---------------------------------------------------------------
@@ -216,6 +408,12 @@ func (mgr *Manager) LoadDataDir() error {
 		if err != nil {
 			log.Printf("error: could not open pindex: %s, err: %v",
 				path, err)
+			// Only quarantine the pindexes that won't open on a retry
+			// nor after an upgrade.
+			_, corrupt := err.(*PIndexCorruptError)
+			if corrupt && mgr.options["quarantineCorruptPIndexes"] == "true" {
+				mgr.quarantinePIndexPath(path)
+			}
 			continue
 		}
 
@@ -226,6 +424,24 @@ func (mgr *Manager) LoadDataDir() error {
 	return nil
 }
 
+// Renames a corrupt pindex directory, so that it no longer matches
+// the pindex naming pattern and is skipped by future LoadDataDir()'s,
+// leaving it around for an operator to inspect.
+func (mgr *Manager) quarantinePIndexPath(path string) {
+	quarantinePath := path + pindexQuarantineSuffix
+	err := os.Rename(path, quarantinePath)
+	if err != nil {
+		log.Printf("error: could not quarantine pindex: %s, err: %v",
+			path, err)
+		return
+	}
+
+	atomic.AddUint64(&mgr.stats.TotLoadDataDirQuarantinedPIndex, 1)
+
+	log.Printf("warning: quarantined pindex: %s, to: %s,"+
+		" an operator should inspect and remove it", path, quarantinePath)
+}
+
 // ---------------------------------------------------------------
 
 func (mgr *Manager) Kick(msg string) {
@@ -233,6 +449,43 @@ func (mgr *Manager) Kick(msg string) {
 	mgr.JanitorKick(msg)
 }
 
+// Returns the "kickCoalesceMS" manager option, which is how long the
+// planner and janitor wait to coalesce more kicks after receiving a
+// kick.  The default of 0 coalesces just the already pending kicks.
+func (mgr *Manager) kickCoalesceMS() int {
+	v, exists := mgr.options["kickCoalesceMS"]
+	if !exists {
+		return 0
+	}
+	coalesceMS, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("warning: could not parse kickCoalesceMS option: %s,"+
+			" err: %v", v, err)
+		return 0
+	}
+	return coalesceMS
+}
+
+// RefreshAll forces a reload of the cached IndexDefs and PlanPIndexes
+// from the Cfg and then kicks the planner and janitor, such as after
+// an out-of-band change to the Cfg by admin tooling.  Concurrent
+// readers are safe, as the cached snapshots are swapped rather than
+// modified in place.
+func (mgr *Manager) RefreshAll(msg string) error {
+	_, _, err := mgr.GetIndexDefs(true)
+	if err != nil {
+		return fmt.Errorf("error: RefreshAll could not refresh indexDefs,"+
+			" err: %v", err)
+	}
+	_, _, err = mgr.GetPlanPIndexes(true)
+	if err != nil {
+		return fmt.Errorf("error: RefreshAll could not refresh planPIndexes,"+
+			" err: %v", err)
+	}
+	mgr.Kick(msg)
+	return nil
+}
+
 // ---------------------------------------------------------------
 
 func (mgr *Manager) ClosePIndex(pindex *PIndex) error {
@@ -250,6 +503,44 @@ func (mgr *Manager) GetPIndex(pindexName string) *PIndex {
 	return mgr.pindexes[pindexName]
 }
 
+// QueryPIndex queries just the named local pindex, bypassing the
+// fan-out across all of an index's pindexes, such as to serve a
+// remote node's scatter/gather query or to inspect a single
+// partition's contents.
+func (mgr *Manager) QueryPIndex(pindexName string, req []byte, res io.Writer,
+	cancelCh chan struct{}) error {
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return &QueryBadRequestError{
+			Err: fmt.Errorf("error: QueryPIndex, no pindex, pindexName: %s",
+				pindexName),
+		}
+	}
+	if pindex.Dest == nil {
+		return fmt.Errorf("error: QueryPIndex, no pindex.Dest, pindexName: %s",
+			pindexName)
+	}
+
+	return pindex.Dest.Query(pindex, req, res, cancelCh)
+}
+
+// FlushPIndex synchronously applies the buffered mutations of a local
+// pindex, so that they're queryable right away.  See DestFlush.
+func (mgr *Manager) FlushPIndex(pindexName string) error {
+	pindex := mgr.GetPIndex(pindexName)
+	if pindex == nil {
+		return fmt.Errorf("error: FlushPIndex, no pindex, pindexName: %s",
+			pindexName)
+	}
+	destFlush, ok := pindex.Dest.(DestFlush)
+	if !ok {
+		return fmt.Errorf("error: FlushPIndex, flush unsupported,"+
+			" pindexName: %s", pindexName)
+	}
+
+	return destFlush.Flush()
+}
+
 func (mgr *Manager) registerPIndex(pindex *PIndex) error {
 	mgr.m.Lock()
 	defer mgr.m.Unlock()
@@ -258,6 +549,17 @@ func (mgr *Manager) registerPIndex(pindex *PIndex) error {
 		return fmt.Errorf("error: registered pindex already exists, name: %s",
 			pindex.Name)
 	}
+
+	// The pindex is marked as warming before it's visible to readers.
+	var warmup func() error
+	if t := pindexImplTypes[pindex.IndexType]; t != nil && t.Warmup != nil {
+		warmup = t.Warmup(pindex)
+	}
+	if warmup != nil {
+		atomic.StoreInt32(&pindex.warming, 1)
+		go mgr.warmupPIndex(pindex, warmup)
+	}
+
 	mgr.pindexes[pindex.Name] = pindex
 	if mgr.meh != nil {
 		mgr.meh.OnRegisterPIndex(pindex)
@@ -265,6 +567,23 @@ func (mgr *Manager) registerPIndex(pindex *PIndex) error {
 	return nil
 }
 
+// Runs the warmup of a pindex, after which the pindex is ready for
+// reads, even if the warmup failed, as a cold pindex is still usable.
+func (mgr *Manager) warmupPIndex(pindex *PIndex, warmup func() error) {
+	start := time.Now()
+
+	err := warmup()
+	if err != nil {
+		log.Printf("warning: pindex warmup, name: %s, err: %v",
+			pindex.Name, err)
+	} else {
+		log.Printf("pindex warmup done, name: %s, took: %v",
+			pindex.Name, time.Since(start))
+	}
+
+	atomic.StoreInt32(&pindex.warming, 0)
+}
+
 func (mgr *Manager) unregisterPIndex(name string) *PIndex {
 	mgr.m.Lock()
 	defer mgr.m.Unlock()
@@ -306,6 +625,113 @@ func (mgr *Manager) unregisterFeed(name string) Feed {
 	return nil
 }
 
+// PauseFeed pauses a registered feed, which must implement the
+// FeedPauser interface, without closing or unregistering it.
+func (mgr *Manager) PauseFeed(name string) error {
+	feedPauser, err := mgr.feedPauser(name)
+	if err != nil {
+		return err
+	}
+	return feedPauser.Pause()
+}
+
+// ResumeFeed resumes a feed that was paused via PauseFeed().
+func (mgr *Manager) ResumeFeed(name string) error {
+	feedPauser, err := mgr.feedPauser(name)
+	if err != nil {
+		return err
+	}
+	return feedPauser.Resume()
+}
+
+func (mgr *Manager) feedPauser(name string) (FeedPauser, error) {
+	mgr.m.Lock()
+	feed, exists := mgr.feeds[name]
+	mgr.m.Unlock()
+
+	if !exists || feed == nil {
+		return nil, fmt.Errorf("error: no feed, name: %s", name)
+	}
+	feedPauser, ok := feed.(FeedPauser)
+	if !ok {
+		return nil, fmt.Errorf("error: feed can't be paused, name: %s", name)
+	}
+	return feedPauser, nil
+}
+
+// ShutdownFeeds closes all the registered feeds concurrently, waiting
+// up to the timeout for them to finish closing, and returns the
+// sorted names of any feeds that didn't finish closing in time.  The
+// feeds remain registered.
+func (mgr *Manager) ShutdownFeeds(timeout time.Duration) []string {
+	feeds, _ := mgr.CurrentMaps()
+
+	doneCh := make(chan string, len(feeds))
+	for _, feed := range feeds {
+		go func(feed Feed) {
+			err := feed.Close()
+			if err != nil {
+				log.Printf("error: ShutdownFeeds, could not close feed: %s,"+
+					" err: %v", feed.Name(), err)
+			}
+			doneCh <- feed.Name()
+		}(feed)
+	}
+
+	timeoutCh := time.After(timeout)
+	for len(feeds) > 0 {
+		select {
+		case name := <-doneCh:
+			delete(feeds, name)
+		case <-timeoutCh:
+			rv := make([]string, 0, len(feeds))
+			for name := range feeds {
+				rv = append(rv, name)
+			}
+			sort.Strings(rv)
+			log.Printf("warning: ShutdownFeeds, timeout: %v,"+
+				" feeds not closed: %v", timeout, rv)
+			return rv
+		}
+	}
+
+	return nil
+}
+
+// A feed that stopped on a fatal error is recreated by a janitor kick
+// this long afterwards, so that a feed whose problem isn't resolved
+// yet isn't restarted in a tight loop.  Overridable for testing.
+var FeedFatalErrorRestartMS = 30000
+
+// Invoked by a feed that has stopped due to a non-recoverable error.
+// The feed is unregistered, so that the janitor recreates it, such as
+// once an operator resolves the problem, on a kick that's scheduled
+// after FeedFatalErrorRestartMS.
+func (mgr *Manager) feedFatalError(srcType string, feed Feed, err error) {
+	atomic.AddUint64(&mgr.stats.TotFeedFatalError, 1)
+
+	log.Printf("error: feed stopped on fatal error, srcType: %s, name: %s,"+
+		" err: %v", srcType, feed.Name(), err)
+
+	if meh, ok := mgr.meh.(ManagerFeedEventHandlers); ok {
+		meh.OnFeedError(srcType, feed, err)
+	}
+
+	mgr.m.Lock()
+	registered := mgr.feeds[feed.Name()] == feed
+	if registered {
+		delete(mgr.feeds, feed.Name())
+	}
+	mgr.m.Unlock()
+
+	if registered {
+		time.AfterFunc(time.Duration(FeedFatalErrorRestartMS)*
+			time.Millisecond, func() {
+			mgr.JanitorKick("feed fatal error, name: " + feed.Name())
+		})
+	}
+}
+
 // ---------------------------------------------------------------
 
 // Returns a snapshot copy of the current feeds and pindexes.
@@ -384,6 +810,174 @@ func (mgr *Manager) GetPlanPIndexes(refresh bool) (
 
 // ---------------------------------------------------------------
 
+// PlanProgress describes how much of the plan assigned to a node has
+// been realized, as returned by Manager.PlanProgress().
+type PlanProgress struct {
+	Indexes map[string]*IndexPlanProgress `json:"indexes"` // Key is IndexName.
+
+	// Aggregates of the IndexPlanProgress fields across all indexes.
+	NumPartitions int     `json:"numPartitions"`
+	NumOpen       int     `json:"numOpen"`
+	NumReady      int     `json:"numReady"`
+	Progress      float64 `json:"progress"`
+}
+
+type IndexPlanProgress struct {
+	// Number of source partitions assigned to this node.
+	NumPartitions int `json:"numPartitions"`
+
+	// Number of assigned source partitions whose pindex is open.
+	NumOpen int `json:"numOpen"`
+
+	// Number of open source partitions that are caught up to within
+	// the maxSeqLag of their current snapshot end.
+	NumReady int `json:"numReady"`
+
+	// NumReady / NumPartitions.
+	Progress float64 `json:"progress"`
+}
+
+// PlanProgress compares the plan's pindexes that are assigned to this
+// node against the registered pindexes, such as to gate readiness
+// during a rebalance.  A partition is ready when its pindex is open
+// and its max received seq is within maxSeqLag of its snapshot end
+// seq, or, when the pindex's Dest doesn't implement DestSeqs, as
+// soon as its pindex is open.
+func (mgr *Manager) PlanProgress(maxSeqLag uint64) (*PlanProgress, error) {
+	_, planPIndexesByName, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, pindexes := mgr.CurrentMaps()
+
+	rv := &PlanProgress{Indexes: map[string]*IndexPlanProgress{}}
+
+	for indexName, planPIndexes := range planPIndexesByName {
+		ipp := &IndexPlanProgress{}
+
+		for _, planPIndex := range planPIndexes {
+			if planPIndex.Nodes[mgr.uuid] == nil {
+				continue
+			}
+
+			partitions := strings.Split(planPIndex.SourcePartitions, ",")
+			ipp.NumPartitions += len(partitions)
+
+			pindex := pindexes[planPIndex.Name]
+			if pindex == nil || !PIndexMatchesPlan(pindex, planPIndex) {
+				continue
+			}
+			ipp.NumOpen += len(partitions)
+
+			destSeqs, ok := pindex.Dest.(DestSeqs)
+			if !ok {
+				ipp.NumReady += len(partitions)
+				continue
+			}
+			for _, partition := range partitions {
+				ready := true
+				for _, vbPartition := range VBucketPartitions(partition) {
+					seqMax, seqSnapEnd, err :=
+						destSeqs.PartitionSeqs(vbPartition)
+					if err != nil || seqMax+maxSeqLag < seqSnapEnd {
+						ready = false
+						break
+					}
+				}
+				if ready {
+					ipp.NumReady += 1
+				}
+			}
+		}
+
+		if ipp.NumPartitions > 0 {
+			ipp.Progress = float64(ipp.NumReady) / float64(ipp.NumPartitions)
+			rv.Indexes[indexName] = ipp
+		}
+
+		rv.NumPartitions += ipp.NumPartitions
+		rv.NumOpen += ipp.NumOpen
+		rv.NumReady += ipp.NumReady
+	}
+
+	rv.Progress = 1.0
+	if rv.NumPartitions > 0 {
+		rv.Progress = float64(rv.NumReady) / float64(rv.NumPartitions)
+	}
+
+	return rv, nil
+}
+
+// How often DrainNode() rechecks the plan.  Overridable for testing.
+var drainNodePollInterval = 100 * time.Millisecond
+
+// DrainNode takes this node out of service ahead of a planned
+// shutdown, by removing its wanted NodeDef, so that the planner
+// reassigns its partitions to the other wanted nodes and so that
+// queries stop routing to it (see CoveringPIndexes), and then waits
+// until the plan assigns no more partitions to this node (see
+// PlanProgress), or until the timeout.  The known NodeDef is kept, so
+// the node can rejoin via SaveNodeDef(NODE_DEFS_WANTED, ...).
+func (mgr *Manager) DrainNode(timeout time.Duration) error {
+	if mgr.cfg == nil {
+		return nil // Occurs during testing.
+	}
+
+	var nodeDefs *NodeDefs
+	err := CfgUpdate(
+		func() (cas uint64, err error) {
+			nodeDefs, cas, err = CfgGetNodeDefs(mgr.cfg, NODE_DEFS_WANTED)
+			return cas, err
+		},
+		func() (bool, error) {
+			if nodeDefs == nil {
+				return false, nil
+			}
+			nodeDef := nodeDefs.NodeDefs[mgr.HostPort()]
+			if nodeDef == nil || nodeDef.UUID != mgr.uuid {
+				return false, nil
+			}
+			delete(nodeDefs.NodeDefs, mgr.HostPort())
+			nodeDefs.UUID = NewUUID()
+			return true, nil
+		},
+		func(cas uint64) error {
+			_, err := CfgSetNodeDefs(mgr.cfg, NODE_DEFS_WANTED, nodeDefs, cas)
+			return err
+		})
+	if err != nil {
+		return fmt.Errorf("error: DrainNode, could not remove wanted nodeDef,"+
+			" err: %v", err)
+	}
+
+	mgr.PlannerKick("drain node")
+
+	deadline := time.Now().Add(timeout)
+	for {
+		_, _, err = mgr.GetPlanPIndexes(true)
+		if err != nil {
+			return fmt.Errorf("error: DrainNode, GetPlanPIndexes err: %v", err)
+		}
+		planProgress, err := mgr.PlanProgress(0)
+		if err != nil {
+			return fmt.Errorf("error: DrainNode, PlanProgress err: %v", err)
+		}
+		if planProgress.NumPartitions <= 0 {
+			log.Printf("manager: drained node, uuid: %s", mgr.uuid)
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("error: DrainNode timeout, uuid: %s,"+
+				" numPartitions still planned: %d",
+				mgr.uuid, planProgress.NumPartitions)
+		}
+		time.Sleep(drainNodePollInterval)
+	}
+}
+
+// ---------------------------------------------------------------
+
 func (mgr *Manager) PIndexPath(pindexName string) string {
 	return PIndexPath(mgr.dataDir, pindexName)
 }
@@ -402,6 +996,221 @@ func (mgr *Manager) UUID() string {
 	return mgr.uuid
 }
 
+// HostPort returns the resolved, routable address of this node, which
+// is used as the node's NodeDef.HostPort.  It's resolved on first use,
+// rather than by the constructor, as resolving the hostname might
+// block on DNS.
+func (mgr *Manager) HostPort() string {
+	mgr.hostPortOnce.Do(func() {
+		hostPort, err := ResolveHostPort(mgr.bindAddr,
+			mgr.options["advertiseAddr"])
+		if err != nil {
+			log.Printf("warning: could not resolve bindAddr: %s, err: %v",
+				mgr.bindAddr, err)
+			hostPort = mgr.bindAddr
+		}
+		mgr.hostPort = hostPort
+	})
+	return mgr.hostPort
+}
+
 func (mgr *Manager) DataDir() string {
 	return mgr.dataDir
 }
+
+func (mgr *Manager) Options() map[string]string {
+	return mgr.options
+}
+
+// Returns a snapshot copy of the current ManagerStats.
+func (mgr *Manager) Stats() ManagerStats {
+	return ManagerStats{
+		TotLoadDataDirQuarantinedPIndex: atomic.LoadUint64(
+			&mgr.stats.TotLoadDataDirQuarantinedPIndex),
+		TotFeedFatalError: atomic.LoadUint64(
+			&mgr.stats.TotFeedFatalError),
+		TotTopologyChange: atomic.LoadUint64(
+			&mgr.stats.TotTopologyChange),
+		TotPlannerKick: atomic.LoadUint64(
+			&mgr.stats.TotPlannerKick),
+		TotPlannerCycle: atomic.LoadUint64(
+			&mgr.stats.TotPlannerCycle),
+		TotJanitorKick: atomic.LoadUint64(
+			&mgr.stats.TotJanitorKick),
+		TotJanitorCycle: atomic.LoadUint64(
+			&mgr.stats.TotJanitorCycle),
+		TotQueryDuplicateHit: atomic.LoadUint64(
+			&mgr.stats.TotQueryDuplicateHit),
+		TotQueryRejected: atomic.LoadUint64(
+			&mgr.stats.TotQueryRejected),
+		CurQueryInFlight: mgr.QueriesInFlight(),
+		CurBufferedBytes: uint64(mgr.bleveDestBuffered.bytes()),
+	}
+}
+
+// ---------------------------------------------------------------
+
+// FeedStats returns the JSON stats of all the current feeds.  Each
+// feed's stats are first collected into memory and only then
+// returned, so that a slow consumer of the result can't hold up any
+// feed's stats collection, which might contend with the feed's
+// mutation path.
+func (mgr *Manager) FeedStats() []byte {
+	feeds, _ := mgr.CurrentMaps()
+	feedNames := make([]string, 0, len(feeds))
+	for feedName := range feeds {
+		feedNames = append(feedNames, feedName)
+	}
+	sort.Strings(feedNames)
+
+	var buf bytes.Buffer
+	buf.Write([]byte("[\n"))
+	first := true
+	for _, feedName := range feedNames {
+		if !first {
+			buf.Write([]byte(",\n"))
+		}
+		first = false
+		buf.Write([]byte(fmt.Sprintf("  {\"feedName\":\"%s\",\"stats\":", feedName)))
+		feeds[feedName].Stats(&buf)
+		buf.Write([]byte("}\n"))
+	}
+	buf.Write([]byte("]\n"))
+
+	return buf.Bytes()
+}
+
+// ---------------------------------------------------------------
+
+// Decisions that a RollbackPolicy may return.
+const ROLLBACK_REBUILD = "rebuild"   // Rebuild the pindex locally from zero.
+const ROLLBACK_FAILOVER = "failover" // Leave the pindex to its replicas.
+
+// A RollbackPolicy decides how to handle a pindex whose partition was
+// rolled back by the data source to rollbackSeq, where seqMax was the
+// partition's max seq received before the rollback.  As a rollback
+// currently discards the pindex's data, a policy might choose
+// ROLLBACK_FAILOVER when seqMax - rollbackSeq is large, so that
+// replicas that didn't roll back serve the pindex instead of waiting
+// for an expensive local rebuild.
+type RollbackPolicy func(pindex *PIndex, partition string,
+	rollbackSeq, seqMax uint64) string
+
+// SetRollbackPolicy sets the policy consulted on pindex rollbacks,
+// where a nil policy means always ROLLBACK_REBUILD.
+func (mgr *Manager) SetRollbackPolicy(policy RollbackPolicy) {
+	mgr.m.Lock()
+	mgr.rollbackPolicy = policy
+	mgr.m.Unlock()
+}
+
+// Invoked by a pindex's Dest after it has discarded its data due to
+// a rollback, returning the decision that was taken.  A failover
+// hands the pindex over to its replicas in the plan, so the janitor
+// won't rebuild it here; if the failover isn't possible, such as when
+// the pindex has no replicas, the pindex is rebuilt instead.
+func (mgr *Manager) rollbackPIndex(pindex *PIndex, partition string,
+	rollbackSeq, seqMax uint64) string {
+	mgr.m.Lock()
+	policy := mgr.rollbackPolicy
+	mgr.m.Unlock()
+
+	decision := ROLLBACK_REBUILD
+	if policy != nil {
+		decision = policy(pindex, partition, rollbackSeq, seqMax)
+	}
+
+	if decision == ROLLBACK_FAILOVER {
+		err := mgr.failoverPIndex(pindex)
+		if err != nil {
+			log.Printf("rollbackPIndex: failover not possible,"+
+				" rebuilding instead, pindex: %s, err: %v", pindex.Name, err)
+			decision = ROLLBACK_REBUILD
+		}
+	}
+
+	log.Printf("rollbackPIndex: pindex: %s, partition: %s,"+
+		" rollbackSeq: %d, seqMax: %d, decision: %s",
+		pindex.Name, partition, rollbackSeq, seqMax, decision)
+
+	go func() {
+		mgr.ClosePIndex(pindex)
+		if decision == ROLLBACK_FAILOVER {
+			// Only the janitor, to drop the pindex here.  The
+			// planners restore the pindex's replica count on their
+			// own, from the plan where a replica is now the primary.
+			mgr.JanitorKick("rollback-pindex-" + decision)
+		} else {
+			mgr.Kick("rollback-pindex-" + decision)
+		}
+	}()
+
+	return decision
+}
+
+// Hands a pindex over to its other readable nodes in the plan, by
+// removing this node from the pindex's plan and, if this node was the
+// primary, by promoting the highest priority replica to primary.  As
+// the plan then already has a primary elsewhere, a planner that later
+// restores the pindex's replica count keeps that primary, and at most
+// adds this node back as a catching up replica.  Retries on CAS
+// mismatch, such as when racing with a planner.
+func (mgr *Manager) failoverPIndex(pindex *PIndex) error {
+	if mgr.cfg == nil { // Might be nil for testing.
+		return fmt.Errorf("error: failoverPIndex, no cfg")
+	}
+
+	var planPIndexes *PlanPIndexes
+	err := CfgUpdate(
+		func() (cas uint64, err error) {
+			planPIndexes, cas, err = CfgGetPlanPIndexes(mgr.cfg)
+			return cas, err
+		},
+		func() (bool, error) {
+			if planPIndexes == nil {
+				return false, fmt.Errorf("error: failoverPIndex," +
+					" no planPIndexes")
+			}
+
+			planPIndex := planPIndexes.PlanPIndexes[pindex.Name]
+			if planPIndex == nil || planPIndex.Nodes[mgr.uuid] == nil {
+				return false, fmt.Errorf("error: failoverPIndex, pindex not"+
+					" planned for this node, pindex: %s", pindex.Name)
+			}
+
+			refs := PlanPIndexNodeRefs{}
+			for nodeUUID, planPIndexNode := range planPIndex.Nodes {
+				if nodeUUID != mgr.uuid &&
+					PlanPIndexNodeCanRead(planPIndexNode) {
+					refs = append(refs, &PlanPIndexNodeRef{
+						UUID: nodeUUID,
+						Node: planPIndexNode,
+					})
+				}
+			}
+			if len(refs) <= 0 {
+				return false, fmt.Errorf("error: failoverPIndex, no replicas"+
+					" to fail over to, pindex: %s", pindex.Name)
+			}
+
+			if planPIndex.Nodes[mgr.uuid].Priority <= 0 {
+				sort.Sort(refs)
+				refs[0].Node.Priority = 0
+			}
+			delete(planPIndex.Nodes, mgr.uuid)
+
+			planPIndexes.UUID = NewUUID()
+
+			return true, nil
+		},
+		func(cas uint64) error {
+			_, err := CfgSetPlanPIndexes(mgr.cfg, planPIndexes, cas)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+
+	_, _, err = mgr.GetPlanPIndexes(true)
+	return err
+}
@@ -12,25 +12,40 @@
 package cbft
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 )
 
-// Creates a logical index, which might be comprised of many PIndex objects.
-func (mgr *Manager) CreateIndex(sourceType, sourceName, sourceUUID, sourceParams,
-	indexType, indexName, indexParams string, planParams PlanParams) error {
+// Validates the params of an index of the given indexType, without
+// creating the index, such as to check user input before a
+// CreateIndex().
+func (mgr *Manager) ValidateIndexParams(indexType, indexName,
+	indexParams string) error {
 	pindexImplType, exists := pindexImplTypes[indexType]
-	if !exists {
-		return fmt.Errorf("error: CreateIndex, unknown indexType: %s", indexType)
+	if !exists || pindexImplType == nil {
+		return fmt.Errorf("error: unknown indexType: %s", indexType)
 	}
 	if pindexImplType.Validate != nil {
 		err := pindexImplType.Validate(indexType, indexName, indexParams)
 		if err != nil {
-			return fmt.Errorf("error: CreateIndex, invalid, err: %v", err)
+			return fmt.Errorf("error: invalid indexParams, indexType: %s,"+
+				" indexName: %s, err: %v", indexType, indexName, err)
 		}
 	}
+	return nil
+}
+
+// Creates a logical index, which might be comprised of many PIndex objects.
+func (mgr *Manager) CreateIndex(sourceType, sourceName, sourceUUID, sourceParams,
+	indexType, indexName, indexParams string, planParams PlanParams) error {
+	err := mgr.ValidateIndexParams(indexType, indexName, indexParams)
+	if err != nil {
+		return fmt.Errorf("error: CreateIndex, err: %v", err)
+	}
 
 	// First, check that the source exists.
-	_, err := DataSourcePartitions(sourceType, sourceName, sourceUUID, sourceParams,
+	_, err = DataSourcePartitions(sourceType, sourceName, sourceUUID, sourceParams,
 		mgr.server)
 	if err != nil {
 		return fmt.Errorf("failed to connect to or retrieve information from source,"+
@@ -119,3 +134,380 @@ func (mgr *Manager) DeleteIndex(indexName string) error {
 
 	return nil
 }
+
+// ReindexIndex rebuilds all the pindexes of an index, on every node,
+// from scratch, such as after a change that affects indexing but that
+// isn't visible in the index definition, like a re-registered doc
+// transform or analyzer.  The index definition gets a new UUID, so
+// the planner replaces the index's pindexes with new ones, whose
+// feeds start from seq 0, and the janitors of the nodes then remove
+// the old pindexes and their data.  Index aliases whose targets pin
+// the index's old UUID no longer resolve.
+func (mgr *Manager) ReindexIndex(indexName string) error {
+	indexDefs, cas, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return err
+	}
+	if indexDefs == nil {
+		return fmt.Errorf("error: indexes do not exist during reindex of"+
+			" indexName: %s", indexName)
+	}
+	if VersionGTE(mgr.version, indexDefs.ImplVersion) == false {
+		return fmt.Errorf("error: could not reindex, indexDefs.ImplVersion: %s"+
+			" > mgr.version: %s", indexDefs.ImplVersion, mgr.version)
+	}
+	indexDef, exists := indexDefs.IndexDefs[indexName]
+	if !exists {
+		return fmt.Errorf("error: index to reindex does not exist, indexName: %s",
+			indexName)
+	}
+
+	indexDefCopy := *indexDef
+	indexDefCopy.UUID = NewUUID()
+
+	indexDefs.UUID = NewUUID()
+	indexDefs.IndexDefs[indexName] = &indexDefCopy
+	indexDefs.ImplVersion = mgr.version
+
+	_, err = CfgSetIndexDefs(mgr.cfg, indexDefs, cas)
+	if err != nil {
+		return fmt.Errorf("error: could not save indexDefs, err: %v", err)
+	}
+
+	mgr.PlannerKick("api/ReindexIndex, indexName: " + indexName)
+
+	return nil
+}
+
+// The states of an async index operation, as returned by
+// Manager.IndexOpStatus().
+const INDEX_OP_PENDING = "pending"   // The index definition isn't saved yet.
+const INDEX_OP_BUILDING = "building" // The index is planned, but not caught up.
+const INDEX_OP_READY = "ready"       // The local partitions are caught up.
+const INDEX_OP_FAILED = "failed"
+const INDEX_OP_UNKNOWN = "unknown" // No partitions are planned on this node.
+
+// IndexOpStatus describes the state of an async index operation.
+type IndexOpStatus struct {
+	OpID      string  `json:"opID"`
+	IndexName string  `json:"indexName"`
+	Status    string  `json:"status"`
+	Progress  float64 `json:"progress"` // From 0.0 to 1.0.
+	Err       string  `json:"err,omitempty"`
+}
+
+// Tracks an async index operation, whose fields are protected by the
+// Manager's mutex.
+type indexOp struct {
+	indexName string
+	indexUUID string // Non-empty once the index definition is saved.
+	err       error
+	startTime time.Time
+	doneTime  time.Time // Non-zero once failed or seen as ready.
+}
+
+// A finished async index operation is forgotten this long after it
+// failed or was first seen as ready, after which IndexOpStatus()
+// treats its opID as unknown.  Beyond indexOpsMax operations, the
+// oldest are forgotten, even if unfinished, such as the ops that are
+// never polled.  Overridable for testing.
+var indexOpsTTL = 10 * time.Minute
+var indexOpsMax = 1000
+
+// Forgets the expired async index operations, and the oldest ones
+// beyond indexOpsMax.
+func (mgr *Manager) pruneIndexOpsUnlocked(now time.Time) {
+	for opID, op := range mgr.indexOps {
+		if !op.doneTime.IsZero() && now.Sub(op.doneTime) >= indexOpsTTL {
+			delete(mgr.indexOps, opID)
+		}
+	}
+	for len(mgr.indexOps) > indexOpsMax {
+		var oldestID string
+		var oldest *indexOp
+		for opID, op := range mgr.indexOps {
+			if oldest == nil || op.startTime.Before(oldest.startTime) {
+				oldestID, oldest = opID, op
+			}
+		}
+		delete(mgr.indexOps, oldestID)
+	}
+}
+
+// Marks an async index operation as finished, so that it expires.
+func (mgr *Manager) indexOpDone(op *indexOp) {
+	mgr.m.Lock()
+	if op.doneTime.IsZero() {
+		op.doneTime = time.Now()
+	}
+	mgr.m.Unlock()
+}
+
+// CreateIndexAsync is like CreateIndex, but returns immediately with
+// an operation ID, which can be polled via IndexOpStatus(), such as
+// to show progress during an index's initial build.
+func (mgr *Manager) CreateIndexAsync(sourceType, sourceName, sourceUUID,
+	sourceParams, indexType, indexName, indexParams string,
+	planParams PlanParams) string {
+	now := time.Now()
+	opID := NewUUID()
+	op := &indexOp{indexName: indexName, startTime: now}
+
+	mgr.m.Lock()
+	if mgr.indexOps == nil {
+		mgr.indexOps = map[string]*indexOp{}
+	}
+	mgr.indexOps[opID] = op
+	mgr.pruneIndexOpsUnlocked(now)
+	mgr.m.Unlock()
+
+	go func() {
+		err := mgr.CreateIndex(sourceType, sourceName, sourceUUID,
+			sourceParams, indexType, indexName, indexParams, planParams)
+
+		var indexUUID string
+		if err == nil {
+			var indexDefsByName map[string]*IndexDef
+			_, indexDefsByName, err = mgr.GetIndexDefs(true)
+			if err == nil && indexDefsByName[indexName] != nil {
+				indexUUID = indexDefsByName[indexName].UUID
+			}
+		}
+
+		mgr.m.Lock()
+		op.indexUUID = indexUUID
+		op.err = err
+		if err != nil {
+			op.doneTime = time.Now()
+		}
+		mgr.m.Unlock()
+	}()
+
+	return opID
+}
+
+// IndexOpStatus returns the status of an async index operation, where
+// the progress of a building index is from Manager.PlanProgress(), so
+// it only covers the index partitions that are assigned to this node.
+// When the plan assigns none of them to this node, the status is
+// INDEX_OP_UNKNOWN.
+func (mgr *Manager) IndexOpStatus(opID string) (*IndexOpStatus, error) {
+	mgr.m.Lock()
+	op := mgr.indexOps[opID]
+	var indexName, indexUUID string
+	var opErr error
+	if op != nil {
+		indexName, indexUUID, opErr = op.indexName, op.indexUUID, op.err
+	}
+	mgr.m.Unlock()
+
+	if op == nil {
+		return nil, fmt.Errorf("error: IndexOpStatus, unknown opID: %s", opID)
+	}
+
+	rv := &IndexOpStatus{OpID: opID, IndexName: indexName}
+
+	if opErr != nil {
+		rv.Status = INDEX_OP_FAILED
+		rv.Err = opErr.Error()
+		return rv, nil
+	}
+
+	if indexUUID == "" {
+		rv.Status = INDEX_OP_PENDING
+		return rv, nil
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+	if indexDef := indexDefsByName[indexName]; indexDef == nil ||
+		indexDef.UUID != indexUUID {
+		rv.Status = INDEX_OP_FAILED
+		rv.Err = "index was deleted or replaced"
+		mgr.indexOpDone(op)
+		return rv, nil
+	}
+
+	planProgress, err := mgr.PlanProgress(0)
+	if err != nil {
+		return nil, err
+	}
+
+	rv.Status = INDEX_OP_BUILDING
+
+	ipp := planProgress.Indexes[indexName]
+	if ipp != nil {
+		rv.Progress = ipp.Progress
+		if ipp.NumReady >= ipp.NumPartitions {
+			rv.Status = INDEX_OP_READY
+			mgr.indexOpDone(op)
+		}
+		return rv, nil
+	}
+
+	// Without local partitions, tell whether the index isn't planned
+	// yet from it being planned only onto other nodes.
+	_, planPIndexesByName, err := mgr.GetPlanPIndexes(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, planPIndex := range planPIndexesByName[indexName] {
+		if planPIndex.IndexUUID == indexUUID {
+			rv.Status = INDEX_OP_UNKNOWN
+			break
+		}
+	}
+
+	return rv, nil
+}
+
+// ManagerMeta describes the source types and index types that a
+// Manager supports, along with sample starting params, such as for a
+// self-describing admin UI.
+type ManagerMeta struct {
+	StartSamples map[string]interface{} `json:"startSamples"`
+	SourceTypes  map[string]*MetaDesc   `json:"sourceTypes"` // Only public ones.
+	IndexTypes   map[string]*MetaDesc   `json:"indexTypes"`
+}
+
+// Meta returns the ManagerMeta, built from the registered feed types
+// and pindex impl types.
+func (mgr *Manager) Meta() *ManagerMeta {
+	return &ManagerMeta{
+		StartSamples: map[string]interface{}{
+			"planParams": &PlanParams{},
+		},
+		SourceTypes: ListFeedTypes(),
+		IndexTypes:  ListPIndexImplTypes(),
+	}
+}
+
+// ManagerMetadata is a snapshot of the index catalog in the Cfg, as
+// produced by ExportMetadata() and consumed by ImportMetadata(), such
+// as to back up the index definitions or to migrate them between
+// clusters.
+type ManagerMetadata struct {
+	IndexDefs    *IndexDefs           `json:"indexDefs"`
+	NodeDefs     map[string]*NodeDefs `json:"nodeDefs,omitempty"` // Key is kind.
+	PlanPIndexes *PlanPIndexes        `json:"planPIndexes,omitempty"`
+}
+
+// Returns the index definitions from the Cfg as a JSON encoded
+// ManagerMetadata.  The node definitions and plan are also included
+// when includePlan is true.
+func (mgr *Manager) ExportMetadata(includePlan bool) ([]byte, error) {
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error: ExportMetadata, CfgGetIndexDefs err: %v",
+			err)
+	}
+	if indexDefs == nil {
+		indexDefs = NewIndexDefs(mgr.version)
+	}
+
+	m := &ManagerMetadata{IndexDefs: indexDefs}
+
+	if includePlan {
+		m.NodeDefs = map[string]*NodeDefs{}
+		for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+			nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, kind)
+			if err != nil {
+				return nil, fmt.Errorf("error: ExportMetadata,"+
+					" CfgGetNodeDefs, kind: %s, err: %v", kind, err)
+			}
+			if nodeDefs != nil {
+				m.NodeDefs[kind] = nodeDefs
+			}
+		}
+
+		m.PlanPIndexes, _, err = CfgGetPlanPIndexes(mgr.cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error: ExportMetadata,"+
+				" CfgGetPlanPIndexes err: %v", err)
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+// Writes the JSON encoded ManagerMetadata from ExportMetadata() into
+// the Cfg, replacing the current index definitions, and the current
+// node definitions and plan if they're also provided.  Every index
+// definition is validated before anything is written.
+func (mgr *Manager) ImportMetadata(blob []byte) error {
+	m := &ManagerMetadata{}
+	err := json.Unmarshal(blob, m)
+	if err != nil {
+		return fmt.Errorf("error: ImportMetadata, could not parse, err: %v", err)
+	}
+	if m.IndexDefs == nil {
+		return fmt.Errorf("error: ImportMetadata, missing indexDefs")
+	}
+	if VersionGTE(mgr.version, m.IndexDefs.ImplVersion) == false {
+		return fmt.Errorf("error: ImportMetadata, indexDefs.ImplVersion: %s"+
+			" > mgr.version: %s", m.IndexDefs.ImplVersion, mgr.version)
+	}
+	if m.IndexDefs.IndexDefs == nil {
+		m.IndexDefs.IndexDefs = make(map[string]*IndexDef)
+	}
+	for indexName, indexDef := range m.IndexDefs.IndexDefs {
+		if indexDef == nil || indexDef.Name != indexName {
+			return fmt.Errorf("error: ImportMetadata, mismatched indexDef,"+
+				" indexName: %s", indexName)
+		}
+		err = mgr.ValidateIndexParams(indexDef.Type, indexDef.Name,
+			indexDef.Params)
+		if err != nil {
+			return fmt.Errorf("error: ImportMetadata, err: %v", err)
+		}
+	}
+
+	for kind := range m.NodeDefs {
+		if kind != NODE_DEFS_KNOWN && kind != NODE_DEFS_WANTED {
+			return fmt.Errorf("error: ImportMetadata, unknown nodeDefs kind: %s",
+				kind)
+		}
+	}
+
+	_, cas, err := CfgGetIndexDefs(mgr.cfg)
+	if err != nil {
+		return fmt.Errorf("error: ImportMetadata, CfgGetIndexDefs err: %v", err)
+	}
+	_, err = CfgSetIndexDefs(mgr.cfg, m.IndexDefs, cas)
+	if err != nil {
+		return fmt.Errorf("error: ImportMetadata, could not save indexDefs,"+
+			" err: %v", err)
+	}
+
+	for kind, nodeDefs := range m.NodeDefs {
+		_, cas, err = CfgGetNodeDefs(mgr.cfg, kind)
+		if err != nil {
+			return fmt.Errorf("error: ImportMetadata, CfgGetNodeDefs,"+
+				" kind: %s, err: %v", kind, err)
+		}
+		_, err = CfgSetNodeDefs(mgr.cfg, kind, nodeDefs, cas)
+		if err != nil {
+			return fmt.Errorf("error: ImportMetadata, could not save nodeDefs,"+
+				" kind: %s, err: %v", kind, err)
+		}
+	}
+
+	if m.PlanPIndexes != nil {
+		_, cas, err = CfgGetPlanPIndexes(mgr.cfg)
+		if err != nil {
+			return fmt.Errorf("error: ImportMetadata, CfgGetPlanPIndexes,"+
+				" err: %v", err)
+		}
+		_, err = CfgSetPlanPIndexes(mgr.cfg, m.PlanPIndexes, cas)
+		if err != nil {
+			return fmt.Errorf("error: ImportMetadata, could not save"+
+				" planPIndexes, err: %v", err)
+		}
+	}
+
+	mgr.PlannerKick("api/ImportMetadata")
+
+	return nil
+}
@@ -0,0 +1,303 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/couchbaselabs/clog"
+)
+
+// Each node periodically refreshes the LastHeartbeat of its known
+// NodeDef, and a planner node reaps the nodes whose heartbeat is
+// older than a TTL, removing them from both the known and wanted
+// NodeDefs, so that the planner reassigns their partitions.
+// Heartbeats are only written to the known NodeDefs, which the
+// planner and janitor don't subscribe to, so they don't cause
+// replanning.  A node that never heartbeats, such as an older
+// version, is never reaped, and a reaped node that's still alive
+// re-registers itself on its next heartbeat.  The TTL ("nodeTTLMS"
+// manager option) should be several times the heartbeat interval
+// ("heartbeatMS").
+
+// Overridable for testing.
+var heartbeatTimeNow = time.Now
+
+// Returns a non-negative int manager option, or 0 when the option is
+// missing or invalid.
+func (mgr *Manager) optionMS(name string) int {
+	v, exists := mgr.options[name]
+	if !exists {
+		return 0
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms < 0 {
+		log.Printf("warning: could not parse %s option: %s, err: %v",
+			name, v, err)
+		return 0
+	}
+	return ms
+}
+
+// HeartbeatLoop heartbeats every heartbeatMS millisecs forever.  When
+// nodeTTLMS > 0 and this node is a planner, dead nodes are also
+// reaped.
+func (mgr *Manager) HeartbeatLoop(heartbeatMS, nodeTTLMS int) {
+	for {
+		err := mgr.Heartbeat()
+		if err != nil {
+			log.Printf("heartbeat: Heartbeat, err: %v", err)
+		}
+
+		if nodeTTLMS > 0 && (mgr.tagsMap == nil || mgr.tagsMap["planner"]) {
+			_, err = mgr.ReapDeadNodes(time.Duration(nodeTTLMS) * time.Millisecond)
+			if err != nil {
+				log.Printf("heartbeat: ReapDeadNodes, err: %v", err)
+			}
+		}
+
+		time.Sleep(time.Duration(heartbeatMS) * time.Millisecond)
+	}
+}
+
+// Heartbeat refreshes the LastHeartbeat of this node's known NodeDef.
+// When this node's known NodeDef is missing, such as after this node
+// was reaped while it was partitioned away, the node re-registers
+// itself as it did at Manager start, so that it rejoins the cluster.
+func (mgr *Manager) Heartbeat() error {
+	if mgr.cfg == nil {
+		return nil // Occurs during testing.
+	}
+
+	missing, err := mgr.heartbeat()
+	if err != nil || !missing {
+		return err
+	}
+
+	if mgr.register != "known" && mgr.register != "knownForce" &&
+		mgr.register != "wanted" && mgr.register != "wantedForce" {
+		return nil
+	}
+
+	log.Printf("heartbeat: re-registering missing nodeDef, hostPort: %s,"+
+		" uuid: %s", mgr.HostPort(), mgr.uuid)
+
+	err = mgr.SaveNodeDef(NODE_DEFS_KNOWN, false)
+	if err != nil {
+		return err
+	}
+	if mgr.register == "wanted" || mgr.register == "wantedForce" {
+		err = mgr.SaveNodeDef(NODE_DEFS_WANTED, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = mgr.heartbeat()
+	return err
+}
+
+// Refreshes the LastHeartbeat of this node's known NodeDef, or
+// returns true when there's no known NodeDef at this node's hostPort.
+func (mgr *Manager) heartbeat() (missing bool, err error) {
+	var nodeDefs *NodeDefs
+	err = CfgUpdate(
+		func() (cas uint64, err error) {
+			nodeDefs, cas, err = CfgGetNodeDefs(mgr.cfg, NODE_DEFS_KNOWN)
+			return cas, err
+		},
+		func() (bool, error) {
+			missing = nodeDefs == nil || nodeDefs.NodeDefs[mgr.HostPort()] == nil
+			if missing {
+				return false, nil
+			}
+			nodeDef := nodeDefs.NodeDefs[mgr.HostPort()]
+			if nodeDef.UUID != mgr.uuid {
+				return false, nil
+			}
+			nodeDef.LastHeartbeat =
+				heartbeatTimeNow().UnixNano() / int64(time.Millisecond)
+			return true, nil
+		},
+		func(cas uint64) error {
+			_, err := CfgSetNodeDefs(mgr.cfg, NODE_DEFS_KNOWN, nodeDefs, cas)
+			return err
+		})
+	return missing, err
+}
+
+// ReapDeadNodes removes the known and wanted NodeDefs of the nodes
+// whose known NodeDef has a LastHeartbeat older than the ttl, and
+// kicks the planner to reassign their partitions.  Returns the UUIDs
+// of the reaped nodes.
+func (mgr *Manager) ReapDeadNodes(ttl time.Duration) ([]string, error) {
+	if mgr.cfg == nil {
+		return nil, nil // Occurs during testing.
+	}
+
+	nodeDefs, _, err := CfgGetNodeDefs(mgr.cfg, NODE_DEFS_KNOWN)
+	if err != nil || nodeDefs == nil {
+		return nil, err
+	}
+
+	oldest := (heartbeatTimeNow().UnixNano() - int64(ttl)) / int64(time.Millisecond)
+
+	dead := map[string]bool{} // Keyed by NodeDef.UUID.
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		if nodeDef.UUID != mgr.uuid &&
+			nodeDef.LastHeartbeat > 0 &&
+			nodeDef.LastHeartbeat < oldest {
+			dead[nodeDef.UUID] = true
+		}
+	}
+	if len(dead) <= 0 {
+		return nil, nil
+	}
+
+	// The known NodeDefs go first, where the heartbeats are rechecked
+	// as they might have been refreshed since we first looked.
+	reaped := map[string]bool{} // Keyed by NodeDef.UUID.
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		var nodeDefs *NodeDefs
+		err = CfgUpdate(
+			func() (cas uint64, err error) {
+				nodeDefs, cas, err = CfgGetNodeDefs(mgr.cfg, kind)
+				return cas, err
+			},
+			func() (bool, error) {
+				if nodeDefs == nil {
+					return false, nil
+				}
+				if kind == NODE_DEFS_KNOWN {
+					reaped = map[string]bool{} // Fresh on each retry.
+				}
+				changed := false
+				for hostPort, nodeDef := range nodeDefs.NodeDefs {
+					if kind == NODE_DEFS_KNOWN {
+						if !dead[nodeDef.UUID] ||
+							nodeDef.LastHeartbeat <= 0 ||
+							nodeDef.LastHeartbeat >= oldest {
+							continue
+						}
+						reaped[nodeDef.UUID] = true
+					} else if !reaped[nodeDef.UUID] {
+						continue
+					}
+					delete(nodeDefs.NodeDefs, hostPort)
+					changed = true
+				}
+				if changed {
+					nodeDefs.UUID = NewUUID()
+				}
+				return changed, nil
+			},
+			func(cas uint64) error {
+				_, err := CfgSetNodeDefs(mgr.cfg, kind, nodeDefs, cas)
+				return err
+			})
+		if err != nil {
+			return nil, fmt.Errorf("error: ReapDeadNodes, kind: %s, err: %v",
+				kind, err)
+		}
+	}
+	if len(reaped) <= 0 {
+		return nil, nil
+	}
+
+	rv := make([]string, 0, len(reaped))
+	for nodeUUID := range reaped {
+		log.Printf("heartbeat: reaped dead node, uuid: %s", nodeUUID)
+		rv = append(rv, nodeUUID)
+	}
+	sort.Strings(rv)
+
+	mgr.PlannerKick(fmt.Sprintf("reaped dead nodes: %v", rv))
+
+	return rv, nil
+}
+
+// ForceTakeoverHostPort registers this node in place of a different
+// node that's registered at the same hostPort, such as after a host
+// replacement that reused the address, which SaveNodeDef() otherwise
+// refuses.  The takeover is only allowed when the other node's known
+// LastHeartbeat is older than the ttl, so a live node, or a node that
+// never heartbeated, is never displaced.  The wanted NodeDef at the
+// hostPort, if any, is replaced too, which makes the planners
+// reassign the other node's partitions.
+func (mgr *Manager) ForceTakeoverHostPort(ttl time.Duration) error {
+	if mgr.cfg == nil {
+		return nil // Occurs during testing.
+	}
+
+	oldest := (heartbeatTimeNow().UnixNano() - int64(ttl)) / int64(time.Millisecond)
+
+	// The known NodeDefs go first, as they have the heartbeats that
+	// verify the takeover; the wanted NodeDef is only replaced once
+	// the known NodeDef is ours.
+	verified := false
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		var nodeDefs *NodeDefs
+		err := CfgUpdate(
+			func() (cas uint64, err error) {
+				nodeDefs, cas, err = CfgGetNodeDefs(mgr.cfg, kind)
+				return cas, err
+			},
+			func() (bool, error) {
+				var nodeDefPrev *NodeDef
+				if nodeDefs != nil {
+					nodeDefPrev = nodeDefs.NodeDefs[mgr.HostPort()]
+				}
+				if nodeDefPrev != nil && nodeDefPrev.UUID == mgr.uuid {
+					verified = verified || kind == NODE_DEFS_KNOWN
+					return false, nil
+				}
+				if nodeDefPrev == nil {
+					return false, nil
+				}
+				if kind == NODE_DEFS_KNOWN {
+					if nodeDefPrev.LastHeartbeat <= 0 ||
+						nodeDefPrev.LastHeartbeat >= oldest {
+						return false, fmt.Errorf("error: ForceTakeoverHostPort,"+
+							" node at hostPort: %s, uuid: %s, is not stale,"+
+							" lastHeartbeat: %d", mgr.HostPort(),
+							nodeDefPrev.UUID, nodeDefPrev.LastHeartbeat)
+					}
+					verified = true
+				} else if !verified {
+					return false, fmt.Errorf("error: ForceTakeoverHostPort,"+
+						" no known nodeDef to verify the takeover,"+
+						" hostPort: %s, uuid: %s", mgr.HostPort(), nodeDefPrev.UUID)
+				}
+
+				log.Printf("heartbeat: taking over hostPort: %s, kind: %s,"+
+					" from uuid: %s", mgr.HostPort(), kind, nodeDefPrev.UUID)
+
+				nodeDefs.UUID = NewUUID()
+				nodeDefs.NodeDefs[mgr.HostPort()] = mgr.newNodeDef()
+				nodeDefs.ImplVersion = mgr.version
+
+				return true, nil
+			},
+			func(cas uint64) error {
+				_, err := CfgSetNodeDefs(mgr.cfg, kind, nodeDefs, cas)
+				return err
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync/atomic"
 
 	log "github.com/couchbaselabs/clog"
 )
@@ -24,6 +25,7 @@ import (
 
 const JANITOR_CLOSE_PINDEX = "janitor_close_pindex"
 const JANITOR_REMOVE_PINDEX = "janitor_remove_pindex"
+const JANITOR_RESTART_FEEDS = "janitor_restart_feeds"
 
 // JanitorNOOP sends a synchronous NOOP request to the manager's janitor, if any.
 func (mgr *Manager) JanitorNOOP(msg string) {
@@ -39,6 +41,16 @@ func (mgr *Manager) JanitorKick(msg string) {
 	}
 }
 
+// JanitorRestartFeeds synchronously has the manager's janitor, if any,
+// restart the local feeds of the given data sources, such as after
+// their topology changed.  The sourceKeys are as from
+// topologySourceKey().
+func (mgr *Manager) JanitorRestartFeeds(msg string, sourceKeys []string) {
+	if mgr.tagsMap == nil || (mgr.tagsMap["pindex"] && mgr.tagsMap["janitor"]) {
+		SyncWorkReq(mgr.janitorCh, JANITOR_RESTART_FEEDS, msg, sourceKeys)
+	}
+}
+
 // JanitorLoop is the main loop for the janitor.
 func (mgr *Manager) JanitorLoop() {
 	if mgr.cfg != nil { // Might be nil for testing.
@@ -52,11 +64,30 @@ func (mgr *Manager) JanitorLoop() {
 		}()
 	}
 
-	for m := range mgr.janitorCh {
+	coalesceMS := mgr.kickCoalesceMS()
+
+	var next *WorkReq
+	for {
+		m := next
+		next = nil
+		if m == nil {
+			var ok bool
+			m, ok = <-mgr.janitorCh
+			if !ok {
+				return
+			}
+		}
+
 		log.Printf("janitor awakes, reason: %s", m.msg)
 
+		kicks := []*WorkReq{m}
+
 		var err error
 		if m.op == WORK_KICK {
+			kicks, next = CoalesceWorkReqs(mgr.janitorCh, m, coalesceMS)
+			atomic.AddUint64(&mgr.stats.TotJanitorKick, uint64(len(kicks)))
+			atomic.AddUint64(&mgr.stats.TotJanitorCycle, 1)
+
 			err = mgr.JanitorOnce(m.msg)
 			if err != nil {
 				// Keep looping as perhaps it's a transient issue.
@@ -69,14 +100,16 @@ func (mgr *Manager) JanitorLoop() {
 			mgr.stopPIndex(m.obj.(*PIndex), false)
 		} else if m.op == JANITOR_REMOVE_PINDEX {
 			mgr.stopPIndex(m.obj.(*PIndex), true)
+		} else if m.op == JANITOR_RESTART_FEEDS {
+			err = mgr.restartFeeds(m.obj.([]string))
+			if err == nil {
+				err = mgr.JanitorOnce(m.msg)
+			}
 		} else {
 			err = fmt.Errorf("error: unknown janitor op: %s, m: %#v", m.op, m)
 		}
-		if m.resCh != nil {
-			if err != nil {
-				m.resCh <- err
-			}
-			close(m.resCh)
+		for _, k := range kicks {
+			replyWorkReq(k, err)
 		}
 	}
 }
@@ -99,6 +132,13 @@ func (mgr *Manager) JanitorOnce(reason string) error {
 		return fmt.Errorf("janitor skipped on nil planPIndexes")
 	}
 
+	// Forget the query limiters of indexes that were deleted, whether
+	// on this node or another.
+	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
+	if err == nil {
+		mgr.pruneQueryLimiters(indexDefs)
+	}
+
 	currFeeds, currPIndexes := mgr.CurrentMaps()
 
 	addPlanPIndexes, removePIndexes :=
@@ -407,6 +447,40 @@ func (mgr *Manager) startFeedByType(feedName, indexName, indexUUID,
 		sourceType, sourceName, sourceUUID, sourceParams, dests)
 }
 
+// Stops the current feeds whose pindexes use any of the given data
+// sources, keyed by topologySourceKey(), so that a following
+// JanitorOnce() starts them afresh.
+func (mgr *Manager) restartFeeds(sourceKeys []string) error {
+	restartSources := map[string]bool{}
+	for _, sourceKey := range sourceKeys {
+		restartSources[sourceKey] = true
+	}
+
+	currFeeds, currPIndexes := mgr.CurrentMaps()
+
+	restartFeedNames := map[string]bool{}
+	for _, pindex := range currPIndexes {
+		if restartSources[topologySourceKey(pindex.SourceType,
+			pindex.SourceName, pindex.SourceUUID, pindex.SourceParams)] {
+			restartFeedNames[FeedName(pindex)] = true
+		}
+	}
+
+	for feedName, feed := range currFeeds {
+		if !restartFeedNames[feedName] {
+			continue
+		}
+		log.Printf("janitor restarting feed: %s", feedName)
+		err := mgr.stopFeed(feed)
+		if err != nil {
+			return fmt.Errorf("error: janitor restarting feed: %s, err: %v",
+				feedName, err)
+		}
+	}
+
+	return nil
+}
+
 func (mgr *Manager) stopFeed(feed Feed) error {
 	feedUnreg := mgr.unregisterFeed(feed.Name())
 	if feedUnreg != nil && feedUnreg != feed {
@@ -17,6 +17,7 @@ import (
 	"io"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/couchbaselabs/blance"
 	log "github.com/couchbaselabs/clog"
@@ -53,9 +54,28 @@ func (mgr *Manager) PlannerLoop() {
 		}()
 	}
 
-	for m := range mgr.plannerCh {
+	coalesceMS := mgr.kickCoalesceMS()
+
+	var next *WorkReq
+	for {
+		m := next
+		next = nil
+		if m == nil {
+			var ok bool
+			m, ok = <-mgr.plannerCh
+			if !ok {
+				return
+			}
+		}
+
+		kicks := []*WorkReq{m}
+
 		var err error
 		if m.op == WORK_KICK {
+			kicks, next = CoalesceWorkReqs(mgr.plannerCh, m, coalesceMS)
+			atomic.AddUint64(&mgr.stats.TotPlannerKick, uint64(len(kicks)))
+			atomic.AddUint64(&mgr.stats.TotPlannerCycle, 1)
+
 			changed, err := mgr.PlannerOnce(m.msg)
 			if err != nil {
 				log.Printf("error: PlannerOnce, err: %v", err)
@@ -68,11 +88,8 @@ func (mgr *Manager) PlannerLoop() {
 		} else {
 			err = fmt.Errorf("error: unknown planner op: %s, m: %#v", m.op, m)
 		}
-		if m.resCh != nil {
-			if err != nil {
-				m.resCh <- err
-			}
-			close(m.resCh)
+		for _, k := range kicks {
+			replyWorkReq(k, err)
 		}
 	}
 }
@@ -91,7 +108,7 @@ func (mgr *Manager) PlannerOnce(reason string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	nodeDefs, err := PlannerGetNodeDefs(mgr.cfg, mgr.version, mgr.uuid, mgr.bindAddr)
+	nodeDefs, err := PlannerGetNodeDefs(mgr.cfg, mgr.version, mgr.uuid, mgr.HostPort())
 	if err != nil {
 		return false, err
 	}
@@ -114,6 +131,11 @@ func (mgr *Manager) PlannerOnce(reason string) (bool, error) {
 			" perhaps a concurrent planner won, cas: %d, err: %v",
 			cas, err)
 	}
+
+	if meh, ok := mgr.meh.(ManagerPlanEventHandlers); ok {
+		meh.OnPlanChanged(planPIndexesPrev, planPIndexes)
+	}
+
 	return true, nil
 }
 
@@ -143,7 +165,7 @@ func PlannerGetIndexDefs(cfg Cfg, version string) (*IndexDefs, error) {
 	return indexDefs, nil
 }
 
-func PlannerGetNodeDefs(cfg Cfg, version, uuid, bindAddr string) (*NodeDefs, error) {
+func PlannerGetNodeDefs(cfg Cfg, version, uuid, hostPort string) (*NodeDefs, error) {
 	nodeDefs, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
 	if err != nil {
 		return nil, fmt.Errorf("planner skipped on CfgGetNodeDefs err: %v", err)
@@ -155,19 +177,19 @@ func PlannerGetNodeDefs(cfg Cfg, version, uuid, bindAddr string) (*NodeDefs, err
 		return nil, fmt.Errorf("planner ended since nodeDefs.ImplVersion: %s"+
 			" > version: %s", nodeDefs.ImplVersion, version)
 	}
-	nodeDef, exists := nodeDefs.NodeDefs[bindAddr]
+	nodeDef, exists := nodeDefs.NodeDefs[hostPort]
 	if !exists || nodeDef == nil {
-		return nil, fmt.Errorf("planner ended since no NodeDef, bindAddr: %s", bindAddr)
+		return nil, fmt.Errorf("planner ended since no NodeDef, hostPort: %s", hostPort)
 	}
 	if nodeDef.ImplVersion != version {
-		return nil, fmt.Errorf("planner ended since NodeDef, bindAddr: %s,"+
+		return nil, fmt.Errorf("planner ended since NodeDef, hostPort: %s,"+
 			" NodeDef.ImplVersion: %s != version: %s",
-			bindAddr, nodeDef.ImplVersion, version)
+			hostPort, nodeDef.ImplVersion, version)
 	}
 	if nodeDef.UUID != uuid {
-		return nil, fmt.Errorf("planner ended since NodeDef, bindAddr: %s,"+
+		return nil, fmt.Errorf("planner ended since NodeDef, hostPort: %s,"+
 			" NodeDef.UUID: %s != uuid: %s",
-			bindAddr, nodeDef.UUID, uuid)
+			hostPort, nodeDef.UUID, uuid)
 	}
 	isPlanner := true
 	if nodeDef.Tags != nil && len(nodeDef.Tags) > 0 {
@@ -179,8 +201,8 @@ func PlannerGetNodeDefs(cfg Cfg, version, uuid, bindAddr string) (*NodeDefs, err
 		}
 	}
 	if !isPlanner {
-		return nil, fmt.Errorf("planner ended since node, bindAddr: %s,"+
-			" is not a planner, tags: %#v", bindAddr, nodeDef.Tags)
+		return nil, fmt.Errorf("planner ended since node, hostPort: %s,"+
+			" is not a planner, tags: %#v", hostPort, nodeDef.Tags)
 	}
 	return nodeDefs, nil
 }
@@ -315,6 +337,145 @@ func getNodesLayout(indexDefs *IndexDefs, nodeDefs *NodeDefs,
 		nodeWeights, nodeHierarchy
 }
 
+// PlanWeightedAssignment assigns each of the partitions to a single
+// node, where a node receives a share of the partitions proportional
+// to its NodeDef.Weight.  Only nodes that can support pindexes are
+// considered, and nodes with a weight <= 0 are excluded.  The output
+// is deterministic and maps partition to node UUID; partitions are
+// left unassigned when there are no eligible nodes.
+func PlanWeightedAssignment(nodeDefs *NodeDefs,
+	partitions []string) map[string]string {
+	rv := map[string]string{}
+	if nodeDefs == nil {
+		return rv
+	}
+
+	nodeUUIDs := make([]string, 0)
+	nodeWeights := make(map[string]int)
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		tags := StringsToMap(nodeDef.Tags)
+		if (tags == nil || tags["pindex"]) && nodeDef.Weight > 0 {
+			nodeUUIDs = append(nodeUUIDs, nodeDef.UUID)
+			nodeWeights[nodeDef.UUID] = nodeDef.Weight
+		}
+	}
+	if len(nodeUUIDs) <= 0 {
+		return rv
+	}
+	sort.Strings(nodeUUIDs)
+
+	// Each partition goes to the node that would have the lowest
+	// count/weight ratio after receiving it, with ties going to the
+	// lowest node UUID for stability.
+	nodeCounts := make(map[string]int)
+	for _, partition := range partitions {
+		best := ""
+		for _, nodeUUID := range nodeUUIDs {
+			if best == "" ||
+				(nodeCounts[nodeUUID]+1)*nodeWeights[best] <
+					(nodeCounts[best]+1)*nodeWeights[nodeUUID] {
+				best = nodeUUID
+			}
+		}
+		nodeCounts[best] += 1
+		rv[partition] = best
+	}
+
+	return rv
+}
+
+// PlanReplicaPlacement places each partition onto 1 + numReplicas
+// distinct nodes, returning a map of partition to node UUIDs, where
+// the first node UUID is the primary (see PlanWeightedAssignment)
+// and the rest are replicas.  Replicas are spread across the
+// NodeDef.Container hierarchy, preferring nodes that share the least
+// containment with the nodes already chosen for a partition, so that
+// losing a single container (like a rack) doesn't lose all copies of
+// a partition.  When there aren't enough distinct containers, nodes
+// in shared containers are used; when there aren't enough nodes, a
+// partition gets fewer replicas.
+func PlanReplicaPlacement(nodeDefs *NodeDefs, partitions []string,
+	numReplicas int) map[string][]string {
+	rv := map[string][]string{}
+
+	primaries := PlanWeightedAssignment(nodeDefs, partitions)
+	if len(primaries) <= 0 {
+		return rv
+	}
+
+	nodeUUIDs := make([]string, 0)
+	nodeDefsByUUID := make(map[string]*NodeDef)
+	for _, nodeDef := range nodeDefs.NodeDefs {
+		tags := StringsToMap(nodeDef.Tags)
+		if (tags == nil || tags["pindex"]) && nodeDef.Weight > 0 {
+			nodeUUIDs = append(nodeUUIDs, nodeDef.UUID)
+			nodeDefsByUUID[nodeDef.UUID] = nodeDef
+		}
+	}
+	sort.Strings(nodeUUIDs)
+
+	replicaCounts := make(map[string]int)
+	for _, partition := range partitions {
+		chosen := []string{primaries[partition]}
+		chosenMap := map[string]bool{primaries[partition]: true}
+
+		for len(chosen) < 1+numReplicas {
+			best := ""
+			bestShared := 0
+			for _, nodeUUID := range nodeUUIDs {
+				if chosenMap[nodeUUID] {
+					continue
+				}
+				shared := 0
+				for _, chosenUUID := range chosen {
+					d := containerSharedDepth(
+						nodeDefsByUUID[nodeUUID].Container,
+						nodeDefsByUUID[chosenUUID].Container)
+					if shared < d {
+						shared = d
+					}
+				}
+				if best == "" || shared < bestShared ||
+					(shared == bestShared &&
+						(replicaCounts[nodeUUID]+1)*nodeDefsByUUID[best].Weight <
+							(replicaCounts[best]+1)*nodeDefsByUUID[nodeUUID].Weight) {
+					best = nodeUUID
+					bestShared = shared
+				}
+			}
+			if best == "" {
+				break // Not enough nodes.
+			}
+			replicaCounts[best] += 1
+			chosen = append(chosen, best)
+			chosenMap[best] = true
+		}
+
+		rv[partition] = chosen
+	}
+
+	return rv
+}
+
+// Returns how much containment two slash-separated container paths
+// have in common, as the number of shared leading containers, plus 1
+// when the paths are the same (so nodes are in the same container).
+func containerSharedDepth(a, b string) int {
+	a = strings.Trim(a, "/")
+	b = strings.Trim(b, "/")
+	aa := strings.Split(a, "/")
+	ba := strings.Split(b, "/")
+	depth := 0
+	for depth < len(aa) && depth < len(ba) &&
+		aa[depth] != "" && aa[depth] == ba[depth] {
+		depth++
+	}
+	if a == b {
+		return depth + 1
+	}
+	return depth
+}
+
 // Split an IndexDef into 1 or more PlanPIndex'es, assigning data
 // source partitions from the IndexDef to a PlanPIndex based on
 // modulus of MaxPartitionsPerPIndex.
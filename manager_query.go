@@ -0,0 +1,169 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbaselabs/clog"
+)
+
+// Query admission bounds the concurrent in-flight queries of each
+// index (or index alias), so that an expensive fan-out query load
+// against one index can't starve the queries of the other indexes
+// served by the same Manager.  The "queryConcurrencyMax" manager
+// option is the per-index bound, where <= 0 means unbounded, and
+// excess queries wait up to the "queryQueueTimeoutMS" manager option
+// for a slot before they're rejected with a QueryTooManyError.
+
+// A QueryTooManyError is returned when an index already has the max
+// number of concurrent in-flight queries.
+type QueryTooManyError struct {
+	IndexName string
+	Max       int
+}
+
+func (e *QueryTooManyError) Error() string {
+	return fmt.Sprintf("error: too many concurrent queries,"+
+		" indexName: %s, max: %d", e.IndexName, e.Max)
+}
+
+// A queryLimiter tracks the in-flight queries of an index.
+type queryLimiter struct {
+	slotCh   chan struct{} // Nil when unbounded.
+	inFlight int64         // Only access via the sync/atomic functions.
+}
+
+// QueryConcurrencyMax returns the max concurrent in-flight queries
+// per index from the "queryConcurrencyMax" manager option, where <= 0
+// means unbounded.
+func (mgr *Manager) QueryConcurrencyMax() int {
+	return mgr.queryOptionInt("queryConcurrencyMax")
+}
+
+// QueryQueueTimeoutMS returns how long a query waits for an in-flight
+// slot of its index from the "queryQueueTimeoutMS" manager option,
+// where <= 0 means excess queries are rejected immediately.
+func (mgr *Manager) QueryQueueTimeoutMS() int {
+	return mgr.queryOptionInt("queryQueueTimeoutMS")
+}
+
+func (mgr *Manager) queryOptionInt(name string) int {
+	v, exists := mgr.options[name]
+	if !exists {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("warning: could not parse %s option: %s, err: %v",
+			name, v, err)
+		return 0
+	}
+	return n
+}
+
+// QueryBegin admits a query against an index, waiting for an
+// in-flight slot if the index is at its QueryConcurrencyMax.  The
+// returned done func must be invoked when the query completes.
+func (mgr *Manager) QueryBegin(indexName string) (done func(), err error) {
+	max := mgr.QueryConcurrencyMax()
+
+	l := mgr.queryLimiter(indexName, max)
+	if l.slotCh != nil {
+		select {
+		case l.slotCh <- struct{}{}:
+		default:
+			timeoutMS := mgr.QueryQueueTimeoutMS()
+			if timeoutMS <= 0 {
+				atomic.AddUint64(&mgr.stats.TotQueryRejected, 1)
+				return nil, &QueryTooManyError{IndexName: indexName, Max: max}
+			}
+
+			timer := time.NewTimer(time.Duration(timeoutMS) * time.Millisecond)
+			select {
+			case l.slotCh <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				atomic.AddUint64(&mgr.stats.TotQueryRejected, 1)
+				return nil, &QueryTooManyError{IndexName: indexName, Max: max}
+			}
+		}
+	}
+
+	atomic.AddInt64(&l.inFlight, 1)
+
+	var doneCalled int32
+	return func() {
+		if !atomic.CompareAndSwapInt32(&doneCalled, 0, 1) {
+			return
+		}
+		atomic.AddInt64(&l.inFlight, -1)
+		if l.slotCh != nil {
+			<-l.slotCh
+		}
+	}, nil
+}
+
+// Returns the queryLimiter of an index, creating it on first use.
+func (mgr *Manager) queryLimiter(indexName string, max int) *queryLimiter {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	l := mgr.queryLimiters[indexName]
+	if l == nil {
+		l = &queryLimiter{}
+		if max > 0 {
+			l.slotCh = make(chan struct{}, max)
+		}
+		if mgr.queryLimiters == nil {
+			mgr.queryLimiters = map[string]*queryLimiter{}
+		}
+		mgr.queryLimiters[indexName] = l
+	}
+	return l
+}
+
+// Removes the queryLimiters of indexes that are no longer defined,
+// unless they still have in-flight queries, which a later prune
+// catches.  Deleted limiters stay usable by any done funcs that still
+// reference them.
+func (mgr *Manager) pruneQueryLimiters(indexDefs *IndexDefs) {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	for indexName, l := range mgr.queryLimiters {
+		if indexDefs != nil {
+			if _, exists := indexDefs.IndexDefs[indexName]; exists {
+				continue
+			}
+		}
+		if atomic.LoadInt64(&l.inFlight) <= 0 {
+			delete(mgr.queryLimiters, indexName)
+		}
+	}
+}
+
+// QueriesInFlight returns the current number of in-flight queries of
+// each index that has been queried, keyed by index name.
+func (mgr *Manager) QueriesInFlight() map[string]int64 {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+
+	rv := make(map[string]int64, len(mgr.queryLimiters))
+	for indexName, l := range mgr.queryLimiters {
+		rv[indexName] = atomic.LoadInt64(&l.inFlight)
+	}
+	return rv
+}
@@ -12,19 +12,26 @@
 package cbft
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/blevesearch/bleve"
 
 	log "github.com/couchbaselabs/clog"
+	"github.com/couchbaselabs/go-couchbase"
 )
 
-// Implements ManagerEventHandlers interface.
+// Implements ManagerEventHandlers and ManagerFeedEventHandlers
+// interfaces.
 type TestMEH struct {
 	lastPIndex *PIndex
 	lastCall   string
@@ -47,6 +54,29 @@ func (meh *TestMEH) OnUnregisterPIndex(pindex *PIndex) {
 	}
 }
 
+func (meh *TestMEH) OnFeedError(srcType string, r Feed, err error) {
+	meh.lastCall = "OnFeedError"
+	if meh.ch != nil {
+		meh.ch <- true
+	}
+}
+
+// A TestMEH that also observes plan changes.
+type TestPlanMEH struct {
+	TestMEH
+	plans [][2]*PlanPIndexes // Pairs of old and new plans.
+}
+
+func (meh *TestPlanMEH) OnPlanChanged(old, new *PlanPIndexes) {
+	meh.plans = append(meh.plans, [2]*PlanPIndexes{old, new})
+}
+
+// Implements only the required ManagerEventHandlers interface.
+type TestBaseMEH struct{}
+
+func (meh *TestBaseMEH) OnRegisterPIndex(pindex *PIndex)   {}
+func (meh *TestBaseMEH) OnUnregisterPIndex(pindex *PIndex) {}
+
 func TestPIndexPath(t *testing.T) {
 	m := NewManager(VERSION, nil, NewUUID(), nil, "", 1, "", "dir", "svr", nil)
 	p := m.PIndexPath("x")
@@ -122,6 +152,161 @@ func TestManagerStart(t *testing.T) {
 	}
 }
 
+func TestManagerAdvertiseAddr(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	uuid := NewUUID()
+
+	// An entry of this node from before the advertiseAddr, which was
+	// keyed by its bindAddr.
+	old := NewNodeDefs(VERSION)
+	old.NodeDefs[":1000"] = &NodeDef{HostPort: ":1000", UUID: uuid}
+	if _, err := CfgSetNodeDefs(cfg, NODE_DEFS_KNOWN, old, 0); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+
+	m := NewManagerEx(VERSION, cfg, uuid, nil, "", 1, ":1000", emptyDir,
+		"some-datasource", nil, map[string]string{"advertiseAddr": "cbft-0:1000"})
+	if m.HostPort() != "cbft-0:1000" {
+		t.Errorf("expected advertiseAddr to override, got: %s", m.HostPort())
+	}
+	if err := m.Start("known"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+	nd, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if err != nil || nd == nil {
+		t.Errorf("expected node defs known, %v, %v", nd, err)
+	}
+	nodeDef, exists := nd.NodeDefs["cbft-0:1000"]
+	if !exists || nodeDef.HostPort != "cbft-0:1000" {
+		t.Errorf("expected nodeDef keyed by advertiseAddr, got: %#v", nd)
+	}
+	if _, exists = nd.NodeDefs[":1000"]; exists || len(nd.NodeDefs) != 1 {
+		t.Errorf("expected the bindAddr keyed nodeDef to be migrated,"+
+			" got: %#v", nd)
+	}
+}
+
+func TestCoalesceCfgEvents(t *testing.T) {
+	var m sync.Mutex
+	numSent := 0
+	numRefreshes := 0
+	lastSeen := 0
+
+	ch := make(chan CfgEvent)
+	doneCh := make(chan struct{})
+	go func() {
+		coalesceCfgEvents(ch, 20, func() {
+			m.Lock()
+			numRefreshes += 1
+			lastSeen = numSent
+			m.Unlock()
+		})
+		close(doneCh)
+	}()
+
+	for i := 0; i < 1000; i++ {
+		m.Lock()
+		numSent += 1
+		m.Unlock()
+		ch <- CfgEvent{Key: "k", CAS: uint64(i)}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	m.Lock()
+	if numRefreshes < 1 || numRefreshes > 100 {
+		t.Errorf("expected a bounded # of refreshes, got: %d", numRefreshes)
+	}
+	if lastSeen != numSent {
+		t.Errorf("expected final refresh after last event, lastSeen: %d,"+
+			" numSent: %d", lastSeen, numSent)
+	}
+	numRefreshesPrev := numRefreshes
+	m.Unlock()
+
+	ch <- CfgEvent{Key: "k"}
+	close(ch)
+	<-doneCh
+
+	m.Lock()
+	if numRefreshes != numRefreshesPrev+1 {
+		t.Errorf("expected pending refresh to run on close, got: %d vs %d",
+			numRefreshes, numRefreshesPrev)
+	}
+	m.Unlock()
+}
+
+// A Cfg whose first subscription to a key has its event channel
+// closed, as if the subscription was lost.
+type ClosingSubscribeCfg struct {
+	Cfg
+
+	m             sync.Mutex
+	numSubscribes map[string]int
+}
+
+func (c *ClosingSubscribeCfg) Subscribe(key string, ch chan CfgEvent) error {
+	c.m.Lock()
+	c.numSubscribes[key] += 1
+	n := c.numSubscribes[key]
+	c.m.Unlock()
+
+	if n <= 1 {
+		go close(ch)
+		return nil
+	}
+	return c.Cfg.Subscribe(key, ch)
+}
+
+func (c *ClosingSubscribeCfg) NumSubscribes(key string) int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.numSubscribes[key]
+}
+
+func TestManagerCfgResubscribe(t *testing.T) {
+	cfg := &ClosingSubscribeCfg{
+		Cfg:           NewCfgMem(),
+		numSubscribes: map[string]int{},
+	}
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"}, "", 1,
+		":1000", "dir", "some-datasource", nil)
+	if err := m.Start("notRegistered"); err != nil {
+		t.Errorf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if cfg.NumSubscribes(INDEX_DEFS_KEY) >= 2 &&
+			cfg.NumSubscribes(PLAN_PINDEXES_KEY) >= 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if cfg.NumSubscribes(INDEX_DEFS_KEY) < 2 ||
+		cfg.NumSubscribes(PLAN_PINDEXES_KEY) < 2 {
+		t.Errorf("expected re-subscriptions, got: %#v", cfg.numSubscribes)
+	}
+
+	// The re-subscription should see later changes.
+	indexDefs := NewIndexDefs(VERSION)
+	if _, err := CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Errorf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		m.m.Lock()
+		lastIndexDefs := m.lastIndexDefs
+		m.m.Unlock()
+		if lastIndexDefs != nil && lastIndexDefs.UUID == indexDefs.UUID {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("expected manager to see indexDefs change after re-subscribe")
+}
+
 func TestManagerRestart(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
@@ -164,6 +349,112 @@ func TestManagerRestart(t *testing.T) {
 	}
 }
 
+func TestManagerRefreshAll(t *testing.T) {
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"}, "", 1,
+		":1000", "dir", "some-datasource", nil)
+
+	indexDefs, _, err := m.GetIndexDefs(false)
+	if err != nil || indexDefs != nil {
+		t.Errorf("expected no indexDefs initially, err: %v", err)
+	}
+
+	// Out-of-band changes to the Cfg.
+	indexDefs = NewIndexDefs(VERSION)
+	if _, err = CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Errorf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	planPIndexes := NewPlanPIndexes(VERSION)
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Errorf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+
+	if err = m.RefreshAll("test"); err != nil {
+		t.Errorf("expected RefreshAll to work, err: %v", err)
+	}
+	indexDefs2, _, err := m.GetIndexDefs(false)
+	if err != nil || indexDefs2 == nil || indexDefs2.UUID != indexDefs.UUID {
+		t.Errorf("expected RefreshAll to reload indexDefs, err: %v", err)
+	}
+	planPIndexes2, _, err := m.GetPlanPIndexes(false)
+	if err != nil || planPIndexes2 == nil ||
+		planPIndexes2.UUID != planPIndexes.UUID {
+		t.Errorf("expected RefreshAll to reload planPIndexes, err: %v", err)
+	}
+
+	m = NewManager(VERSION, &ErrorOnlyCfg{}, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "dir", "some-datasource", nil)
+	if err = m.RefreshAll("test"); err == nil {
+		t.Errorf("expected RefreshAll to fail on bad cfg")
+	}
+}
+
+func TestManagerLoadDataDirQuarantine(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	// A pindex directory with no PINDEX_META file can't be opened.
+	corruptPath := PIndexPath(emptyDir, "corrupt")
+	if err := os.MkdirAll(corruptPath, 0700); err != nil {
+		t.Errorf("expected mkdir to work, err: %v", err)
+	}
+
+	// A pindex written by a newer version isn't corrupt.
+	newerPath := PIndexPath(emptyDir, "newer")
+	newer, err := NewPIndex(nil, "newer", "uuid",
+		"blackhole", "indexName", "indexUUID", "",
+		"sourceType", "sourceName", "sourceUUID", "sourceParams",
+		"sourcePartitions", newerPath)
+	if newer == nil || err != nil {
+		t.Errorf("expected NewPIndex to work, err: %v", err)
+	}
+	newer.Close(false)
+	newer.ImplVersion = "1000.0.0"
+	buf, _ := json.Marshal(newer)
+	ioutil.WriteFile(newerPath+string(os.PathSeparator)+PINDEX_META_FILENAME,
+		buf, 0600)
+
+	m := NewManager(VERSION, nil, NewUUID(), nil, "", 1, "", emptyDir, "", nil)
+	if err := m.LoadDataDir(); err != nil {
+		t.Errorf("expected LoadDataDir() to work, err: %v", err)
+	}
+	if _, err := os.Stat(corruptPath); err != nil {
+		t.Errorf("expected corrupt pindex to be left alone without option")
+	}
+	if m.Stats().TotLoadDataDirQuarantinedPIndex != 0 {
+		t.Errorf("expected no quarantine stat without option")
+	}
+
+	m = NewManagerEx(VERSION, nil, NewUUID(), nil, "", 1, "", emptyDir, "", nil,
+		map[string]string{"quarantineCorruptPIndexes": "true"})
+	if err := m.LoadDataDir(); err != nil {
+		t.Errorf("expected LoadDataDir() to work, err: %v", err)
+	}
+	if _, err := os.Stat(corruptPath); err == nil {
+		t.Errorf("expected corrupt pindex to be moved away")
+	}
+	if _, err := os.Stat(corruptPath + pindexQuarantineSuffix); err != nil {
+		t.Errorf("expected quarantined pindex, err: %v", err)
+	}
+	if _, err := os.Stat(newerPath); err != nil {
+		t.Errorf("expected newer pindex to be left alone, err: %v", err)
+	}
+	if m.Stats().TotLoadDataDirQuarantinedPIndex != 1 {
+		t.Errorf("expected quarantine stat to be 1")
+	}
+	_, pindexes := m.CurrentMaps()
+	if len(pindexes) != 0 {
+		t.Errorf("expected no pindexes, got: %#v", pindexes)
+	}
+
+	if err := m.LoadDataDir(); err != nil {
+		t.Errorf("expected reload LoadDataDir() to work, err: %v", err)
+	}
+	if m.Stats().TotLoadDataDirQuarantinedPIndex != 1 {
+		t.Errorf("expected quarantined pindex to be skipped on reload")
+	}
+}
+
 func TestManagerCreateDeleteIndex(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
@@ -207,6 +498,32 @@ func TestManagerCreateDeleteIndex(t *testing.T) {
 	}
 }
 
+func TestManagerValidateIndexParams(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil, "", 1,
+		":1000", "dir", "some-datasource", nil)
+
+	if err := m.ValidateIndexParams("bleve", "foo", ""); err != nil {
+		t.Errorf("expected empty params to be valid, err: %v", err)
+	}
+	if err := m.ValidateIndexParams("bleve", "foo",
+		`{"default_analyzer":"standard"}`); err != nil {
+		t.Errorf("expected valid mapping to be valid, err: %v", err)
+	}
+	if err := m.ValidateIndexParams("bleve", "foo",
+		"} hey this isn't json :-("); err == nil {
+		t.Errorf("expected invalid json params to be invalid")
+	}
+	if err := m.ValidateIndexParams("AN UNKNOWN INDEX TYPE", "foo",
+		""); err == nil {
+		t.Errorf("expected unknown indexType to be invalid")
+	}
+	if err := m.ValidateIndexParams("blackhole", "foo",
+		"anything"); err != nil {
+		t.Errorf("expected indexType without Validate to be valid, err: %v",
+			err)
+	}
+}
+
 func TestManagerRegisterPIndex(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
@@ -236,6 +553,9 @@ func TestManagerRegisterPIndex(t *testing.T) {
 	if err != nil {
 		t.Errorf("expected NewPIndex() to work")
 	}
+	if p.Dest.(*BleveDest).buffered != m.bleveDestBuffered {
+		t.Errorf("expected the pindex to share the manager's budget")
+	}
 	px := m.unregisterPIndex(p.Name)
 	if px != nil {
 		t.Errorf("expected unregisterPIndex() on newborn manager to fail")
@@ -388,6 +708,69 @@ func TestManagerRegisterFeed(t *testing.T) {
 	}
 }
 
+// A ShutdownFeed is a feed whose Close() blocks until its blockCh
+// is closed, if any.
+type ShutdownFeed struct {
+	NILFeed
+
+	m       sync.Mutex
+	closed  bool
+	blockCh chan struct{}
+}
+
+func (t *ShutdownFeed) Close() error {
+	t.m.Lock()
+	t.closed = true
+	t.m.Unlock()
+	if t.blockCh != nil {
+		<-t.blockCh
+	}
+	return nil
+}
+
+func (t *ShutdownFeed) Closed() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.closed
+}
+
+func TestManagerShutdownFeeds(t *testing.T) {
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "dir", "some-datasource", nil)
+
+	if notClosed := m.ShutdownFeeds(time.Second); len(notClosed) != 0 {
+		t.Errorf("expected no feeds to shutdown, got: %v", notClosed)
+	}
+
+	blockCh := make(chan struct{})
+	defer close(blockCh)
+
+	feeds := []*ShutdownFeed{
+		{NILFeed: NILFeed{name: "a"}},
+		{NILFeed: NILFeed{name: "b"}},
+		{NILFeed: NILFeed{name: "slow"}, blockCh: blockCh},
+	}
+	for _, feed := range feeds {
+		if err := m.registerFeed(feed); err != nil {
+			t.Errorf("expected registerFeed to work, err: %v", err)
+		}
+	}
+
+	start := time.Now()
+	notClosed := m.ShutdownFeeds(100 * time.Millisecond)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("expected ShutdownFeeds to not hang on slow feeds")
+	}
+	if len(notClosed) != 1 || notClosed[0] != "slow" {
+		t.Errorf("expected only slow feed to time out, got: %v", notClosed)
+	}
+	for _, feed := range feeds {
+		if !feed.Closed() {
+			t.Errorf("expected Close() invoked on feed: %s", feed.Name())
+		}
+	}
+}
+
 func TestManagerStartDCPFeed(t *testing.T) {
 	testManagerStartDCPFeed(t, "couchbase")
 	testManagerStartDCPFeed(t, "couchbase-dcp")
@@ -1024,6 +1407,212 @@ func TestPartitioning(t *testing.T) {
 		expectedNumPIndexes, expectedNumStreams, nil)
 }
 
+func TestPlanWeightedAssignment(t *testing.T) {
+	partitions := []string{}
+	for i := 0; i < 12; i++ {
+		partitions = append(partitions, fmt.Sprintf("%d", i))
+	}
+
+	countNodes := func(assignment map[string]string) map[string]int {
+		rv := map[string]int{}
+		for _, nodeUUID := range assignment {
+			rv[nodeUUID] += 1
+		}
+		return rv
+	}
+
+	tests := []struct {
+		label    string
+		weights  map[string]int
+		tags     map[string][]string
+		expected map[string]int
+	}{
+		{"no nodes",
+			map[string]int{},
+			nil,
+			map[string]int{}},
+		{"equal weights",
+			map[string]int{"a": 1, "b": 1, "c": 1},
+			nil,
+			map[string]int{"a": 4, "b": 4, "c": 4}},
+		{"zero weight excluded",
+			map[string]int{"a": 1, "b": 0, "c": 1},
+			nil,
+			map[string]int{"a": 6, "c": 6}},
+		{"all zero weights",
+			map[string]int{"a": 0, "b": 0},
+			nil,
+			map[string]int{}},
+		{"skewed weights",
+			map[string]int{"a": 1, "b": 2, "c": 3},
+			nil,
+			map[string]int{"a": 2, "b": 4, "c": 6}},
+		{"very skewed weights",
+			map[string]int{"a": 1, "b": 11},
+			nil,
+			map[string]int{"a": 1, "b": 11}},
+		{"non-pindex node excluded",
+			map[string]int{"a": 1, "b": 1},
+			map[string][]string{"b": []string{"queryer"}},
+			map[string]int{"a": 12}},
+	}
+
+	for _, test := range tests {
+		nodeDefs := NewNodeDefs(VERSION)
+		for nodeUUID, weight := range test.weights {
+			nodeDefs.NodeDefs[nodeUUID] = &NodeDef{
+				UUID:   nodeUUID,
+				Weight: weight,
+				Tags:   test.tags[nodeUUID],
+			}
+		}
+
+		assignment := PlanWeightedAssignment(nodeDefs, partitions)
+		counts := countNodes(assignment)
+		if !reflect.DeepEqual(counts, test.expected) {
+			t.Errorf("test: %s, expected counts: %v, got: %v",
+				test.label, test.expected, counts)
+		}
+
+		assignment2 := PlanWeightedAssignment(nodeDefs, partitions)
+		if !reflect.DeepEqual(assignment, assignment2) {
+			t.Errorf("test: %s, expected deterministic assignment,"+
+				" got: %v vs %v", test.label, assignment, assignment2)
+		}
+	}
+
+	if len(PlanWeightedAssignment(nil, partitions)) != 0 {
+		t.Errorf("expected empty assignment on nil nodeDefs")
+	}
+}
+
+func TestPlanReplicaPlacement(t *testing.T) {
+	partitions := []string{}
+	for i := 0; i < 8; i++ {
+		partitions = append(partitions, fmt.Sprintf("%d", i))
+	}
+
+	topLevel := func(container string) string {
+		return strings.Split(container, "/")[0]
+	}
+
+	tests := []struct {
+		label       string
+		containers  map[string]string // Keyed by node UUID.
+		numReplicas int
+		expectLen   int
+		// Container path prefix func where copies must be distinct.
+		distinctBy func(string) string
+	}{
+		{"no nodes",
+			map[string]string{}, 1, 0, nil},
+		{"zero replicas",
+			map[string]string{"a": "r0", "b": "r1"}, 0, 1, nil},
+		{"two racks",
+			map[string]string{"a": "r0", "b": "r0", "c": "r1", "d": "r1"},
+			1, 2, topLevel},
+		{"three racks, two replicas",
+			map[string]string{"a": "r0", "b": "r0", "c": "r1", "d": "r1",
+				"e": "r2", "f": "r2"},
+			2, 3, topLevel},
+		{"zones and racks",
+			map[string]string{"a": "z0/r0", "b": "z0/r1",
+				"c": "z1/r0", "d": "z1/r1"},
+			1, 2, topLevel},
+		{"zones and racks, more replicas than zones",
+			map[string]string{"a": "z0/r0", "b": "z0/r1",
+				"c": "z1/r0", "d": "z1/r1"},
+			3, 4, func(c string) string { return c }},
+		{"single rack fallback",
+			map[string]string{"a": "r0", "b": "r0", "c": "r0"},
+			1, 2, nil},
+		{"no containers fallback",
+			map[string]string{"a": "", "b": "", "c": ""},
+			2, 3, nil},
+		{"not enough nodes",
+			map[string]string{"a": "r0", "b": "r1"},
+			3, 2, topLevel},
+	}
+
+	for _, test := range tests {
+		nodeDefs := NewNodeDefs(VERSION)
+		for nodeUUID, container := range test.containers {
+			nodeDefs.NodeDefs[nodeUUID] = &NodeDef{
+				UUID:      nodeUUID,
+				Weight:    1,
+				Container: container,
+			}
+		}
+
+		placements := PlanReplicaPlacement(nodeDefs, partitions,
+			test.numReplicas)
+		if test.expectLen == 0 {
+			if len(placements) != 0 {
+				t.Errorf("test: %s, expected no placements, got: %v",
+					test.label, placements)
+			}
+			continue
+		}
+		if len(placements) != len(partitions) {
+			t.Errorf("test: %s, expected placements for all partitions,"+
+				" got: %v", test.label, placements)
+		}
+		for partition, nodeUUIDs := range placements {
+			if len(nodeUUIDs) != test.expectLen {
+				t.Errorf("test: %s, partition: %s, expected len: %d, got: %v",
+					test.label, partition, test.expectLen, nodeUUIDs)
+			}
+			seenNodes := map[string]bool{}
+			seenContainers := map[string]bool{}
+			for _, nodeUUID := range nodeUUIDs {
+				if seenNodes[nodeUUID] {
+					t.Errorf("test: %s, partition: %s, dupe node: %v",
+						test.label, partition, nodeUUIDs)
+				}
+				seenNodes[nodeUUID] = true
+				if test.distinctBy != nil {
+					c := test.distinctBy(test.containers[nodeUUID])
+					if seenContainers[c] {
+						t.Errorf("test: %s, partition: %s, expected distinct"+
+							" containers, got: %v", test.label, partition, nodeUUIDs)
+					}
+					seenContainers[c] = true
+				}
+			}
+		}
+
+		placements2 := PlanReplicaPlacement(nodeDefs, partitions,
+			test.numReplicas)
+		if !reflect.DeepEqual(placements, placements2) {
+			t.Errorf("test: %s, expected deterministic placements", test.label)
+		}
+	}
+}
+
+func TestContainerSharedDepth(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 1},
+		{"r0", "r0", 2},
+		{"r0", "r1", 0},
+		{"", "r0", 0},
+		{"z0/r0", "z0/r0", 3},
+		{"z0/r0", "z0/r1", 1},
+		{"z0/r0", "z1/r0", 0},
+		{"z0", "z0/r0", 1},
+		{"/z0/r0/", "z0/r0", 3},
+	}
+	for _, test := range tests {
+		actual := containerSharedDepth(test.a, test.b)
+		if actual != test.expected {
+			t.Errorf("expected: %d, got: %d, for a: %q, b: %q",
+				test.expected, actual, test.a, test.b)
+		}
+	}
+}
+
 func TestPartitioningMutations(t *testing.T) {
 	sourceParams := "{\"numPartitions\":2}"
 	planParams := PlanParams{
@@ -1226,3 +1815,1201 @@ func TestFanInPartitioningMutations(t *testing.T) {
 			}
 		})
 }
+
+func TestManagerExportImportMetadata(t *testing.T) {
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "dir", "some-datasource", nil)
+
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{
+		Type: "bleve", Name: "foo", UUID: "fooUUID",
+		SourceType: "dest", SourceName: "default",
+	}
+	indexDefs.IndexDefs["bar"] = &IndexDef{
+		Type: "blackhole", Name: "bar", UUID: "barUUID",
+		SourceType: "nil", PlanParams: PlanParams{NumReplicas: 1},
+	}
+	if _, err := CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs["a:1000"] = &NodeDef{HostPort: "a:1000", UUID: "a"}
+	if _, err := CfgSetNodeDefs(cfg, NODE_DEFS_KNOWN, nodeDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name: "foo_0", IndexName: "foo", IndexUUID: "fooUUID",
+		Nodes: map[string]*PlanPIndexNode{"a": {CanRead: true}},
+	}
+	if _, err := CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+
+	blob, err := m.ExportMetadata(true)
+	if err != nil {
+		t.Fatalf("expected ExportMetadata to work, err: %v", err)
+	}
+	blobIndexDefsOnly, err := m.ExportMetadata(false)
+	if err != nil {
+		t.Fatalf("expected ExportMetadata to work, err: %v", err)
+	}
+
+	cfg.Del(INDEX_DEFS_KEY, 0)
+	cfg.Del(CfgNodeDefsKey(NODE_DEFS_KNOWN), 0)
+	cfg.Del(PLAN_PINDEXES_KEY, 0)
+
+	if err = m.ImportMetadata(blob); err != nil {
+		t.Fatalf("expected ImportMetadata to work, err: %v", err)
+	}
+
+	indexDefs2, _, err := CfgGetIndexDefs(cfg)
+	if err != nil || !reflect.DeepEqual(indexDefs, indexDefs2) {
+		t.Errorf("expected imported indexDefs to match, got: %#v, err: %v",
+			indexDefs2, err)
+	}
+	nodeDefs2, _, err := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if err != nil || !reflect.DeepEqual(nodeDefs, nodeDefs2) {
+		t.Errorf("expected imported nodeDefs to match, got: %#v, err: %v",
+			nodeDefs2, err)
+	}
+	planPIndexes2, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || !reflect.DeepEqual(planPIndexes, planPIndexes2) {
+		t.Errorf("expected imported planPIndexes to match, got: %#v, err: %v",
+			planPIndexes2, err)
+	}
+
+	// Importing over existing entries uses their CAS.
+	if err = m.ImportMetadata(blobIndexDefsOnly); err != nil {
+		t.Errorf("expected re-ImportMetadata to work, err: %v", err)
+	}
+
+	bad := NewIndexDefs(VERSION)
+	bad.IndexDefs["baz"] = &IndexDef{Type: "not-a-type", Name: "baz"}
+	badBlob, _ := json.Marshal(&ManagerMetadata{IndexDefs: bad})
+	if m.ImportMetadata(badBlob) == nil {
+		t.Errorf("expected ImportMetadata to fail on an invalid indexDef")
+	}
+	indexDefs2, _, _ = CfgGetIndexDefs(cfg)
+	if indexDefs2 == nil || indexDefs2.IndexDefs["baz"] != nil {
+		t.Errorf("expected invalid import to not change the cfg")
+	}
+
+	badBlob, _ = json.Marshal(&ManagerMetadata{IndexDefs: indexDefs,
+		NodeDefs: map[string]*NodeDefs{"bogus": nodeDefs}})
+	if m.ImportMetadata(badBlob) == nil {
+		t.Errorf("expected ImportMetadata to fail on an unknown nodeDefs kind")
+	}
+	if m.ImportMetadata([]byte("not json")) == nil {
+		t.Errorf("expected ImportMetadata to fail on bad json")
+	}
+	if m.ImportMetadata([]byte("{}")) == nil {
+		t.Errorf("expected ImportMetadata to fail on missing indexDefs")
+	}
+}
+
+// A SeqsDest implements DestSeqs with fixed per-partition seqs.
+type SeqsDest struct {
+	TestDest
+
+	seqs map[string][2]uint64 // Value is [seqMax, seqSnapEnd].
+}
+
+func (t *SeqsDest) PartitionSeqs(partition string) (
+	seqMax, seqSnapEnd uint64, err error) {
+	s := t.seqs[partition]
+	return s[0], s[1], nil
+}
+
+func TestManagerPlanProgress(t *testing.T) {
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "dir", "some-datasource", nil)
+
+	progress, err := m.PlanProgress(0)
+	if err != nil || progress.NumPartitions != 0 || progress.Progress != 1.0 {
+		t.Errorf("expected full progress with no plan, got: %#v, err: %v",
+			progress, err)
+	}
+
+	here := map[string]*PlanPIndexNode{m.uuid: {CanRead: true, CanWrite: true}}
+	there := map[string]*PlanPIndexNode{"x": {CanRead: true, CanWrite: true}}
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	for _, p := range []*PlanPIndex{
+		{Name: "foo_0", IndexName: "foo", SourcePartitions: "0,1,2", Nodes: here},
+		{Name: "foo_1", IndexName: "foo", SourcePartitions: "3", Nodes: here},
+		{Name: "foo_2", IndexName: "foo", SourcePartitions: "4,5", Nodes: here},
+		{Name: "foo_3", IndexName: "foo", SourcePartitions: "6", Nodes: there},
+		{Name: "bar_0", IndexName: "bar", SourcePartitions: "0", Nodes: there},
+	} {
+		planPIndexes.PlanPIndexes[p.Name] = p
+	}
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	m.GetPlanPIndexes(true)
+
+	// Of foo_0's partitions, "0" is caught up, "1" lags its snapshot
+	// end by 5 seqs, and "2" lags by 50 seqs.
+	m.registerPIndex(&PIndex{Name: "foo_0", IndexName: "foo",
+		SourcePartitions: "0,1,2",
+		Dest: &SeqsDest{seqs: map[string][2]uint64{
+			"0": {10, 10}, "1": {5, 10}, "2": {50, 100},
+		}}})
+	// The foo_1 dest doesn't report seqs, so it's ready once open.
+	m.registerPIndex(&PIndex{Name: "foo_1", IndexName: "foo",
+		SourcePartitions: "3", Dest: &TestDest{}})
+	// The foo_2 pindex isn't open yet.
+
+	tests := []struct {
+		maxSeqLag uint64
+		numReady  int
+	}{
+		{0, 2},
+		{5, 3},
+		{50, 4},
+	}
+	for i, test := range tests {
+		progress, err = m.PlanProgress(test.maxSeqLag)
+		if err != nil {
+			t.Errorf("test %d, expected PlanProgress to work, err: %v", i, err)
+		}
+		if len(progress.Indexes) != 1 || progress.Indexes["foo"] == nil {
+			t.Errorf("test %d, expected only foo to be assigned, got: %#v",
+				i, progress.Indexes)
+			continue
+		}
+		ipp := progress.Indexes["foo"]
+		if ipp.NumPartitions != 6 || ipp.NumOpen != 4 ||
+			ipp.NumReady != test.numReady ||
+			ipp.Progress != float64(test.numReady)/6 {
+			t.Errorf("test %d, unexpected index progress: %#v", i, ipp)
+		}
+		if progress.NumPartitions != 6 || progress.NumReady != test.numReady ||
+			progress.Progress != ipp.Progress {
+			t.Errorf("test %d, unexpected overall progress: %#v", i, progress)
+		}
+	}
+}
+
+func TestManagerRollbackPolicy(t *testing.T) {
+	defer func(backoffMS int) { CfgUpdateBackoffMS = backoffMS }(CfgUpdateBackoffMS)
+	CfgUpdateBackoffMS = 1
+
+	cfg := &CASConflictCfg{Cfg: NewCfgMem(), race: func(cfg Cfg) {}}
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "dir", "some-datasource", nil)
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name: "foo_0", IndexName: "foo", SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{
+			m.uuid: {CanRead: true, CanWrite: true},
+			"x":    {CanRead: true, CanWrite: true, Priority: 1},
+		},
+	}
+	planPIndexes.PlanPIndexes["bar_0"] = &PlanPIndex{
+		Name: "bar_0", IndexName: "bar", SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{
+			m.uuid: {CanRead: true, CanWrite: true},
+		},
+	}
+	if _, err := CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+
+	foo := &PIndex{Name: "foo_0", IndexName: "foo"}
+	bar := &PIndex{Name: "bar_0", IndexName: "bar"}
+
+	if m.rollbackPIndex(foo, "0", 10, 1000) != ROLLBACK_REBUILD {
+		t.Errorf("expected rebuild without a rollback policy")
+	}
+
+	var gotRollbackSeq, gotSeqMax uint64
+	m.SetRollbackPolicy(func(pindex *PIndex, partition string,
+		rollbackSeq, seqMax uint64) string {
+		gotRollbackSeq, gotSeqMax = rollbackSeq, seqMax
+		if seqMax-rollbackSeq > 100 {
+			return ROLLBACK_FAILOVER
+		}
+		return ROLLBACK_REBUILD
+	})
+
+	if m.rollbackPIndex(foo, "0", 990, 1000) != ROLLBACK_REBUILD {
+		t.Errorf("expected rebuild for a short rollback")
+	}
+	if gotRollbackSeq != 990 || gotSeqMax != 1000 {
+		t.Errorf("expected policy to get rollbackSeq and seqMax,"+
+			" got: %d, %d", gotRollbackSeq, gotSeqMax)
+	}
+	if m.rollbackPIndex(bar, "0", 10, 1000) != ROLLBACK_REBUILD {
+		t.Errorf("expected rebuild when there are no replicas")
+	}
+
+	planPIndexesPrev, _, _ := CfgGetPlanPIndexes(cfg)
+
+	// The failover retries on a CAS mismatch.
+	cfg.numConflicts = 1
+	if m.rollbackPIndex(foo, "0", 10, 1000) != ROLLBACK_FAILOVER {
+		t.Errorf("expected failover for a long rollback")
+	}
+
+	planPIndexes, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil {
+		t.Fatalf("expected CfgGetPlanPIndexes to work, err: %v", err)
+	}
+	if planPIndexes.PlanPIndexes["foo_0"].Nodes[m.uuid] != nil ||
+		planPIndexes.PlanPIndexes["foo_0"].Nodes["x"] == nil {
+		t.Errorf("expected failover to remove this node from foo_0's plan")
+	}
+	if planPIndexes.PlanPIndexes["foo_0"].Nodes["x"].Priority != 0 {
+		t.Errorf("expected failover to promote the replica to primary")
+	}
+	if planPIndexes.UUID == planPIndexesPrev.UUID {
+		t.Errorf("expected failover to change the plan's UUID")
+	}
+	if planPIndexes.PlanPIndexes["bar_0"].Nodes[m.uuid] == nil {
+		t.Errorf("expected rebuild to keep this node in bar_0's plan")
+	}
+}
+
+func TestManagerReindexIndex(t *testing.T) {
+	var m sync.Mutex
+	mappingVersion := "v1"
+	RegisterBleveDocTransform("testReindex",
+		func(partition string, key, val []byte) (interface{}, error) {
+			m.Lock()
+			defer m.Unlock()
+			return map[string]interface{}{"x": mappingVersion}, nil
+		})
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := mgr.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	if mgr.ReindexIndex("foo") == nil {
+		t.Errorf("expected reindex of a missing index to fail")
+	}
+
+	if err := mgr.CreateIndex("dest", "sourceName", "sourceUUID", "",
+		"bleve", "foo", `{"docTransform":"testReindex"}`,
+		PlanParams{}); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	mgr.PlannerNOOP("test")
+	mgr.JanitorNOOP("test")
+
+	// Returns the only feed and pindex, after feeding them a doc.
+	feedDoc := func() (Feed, *PIndex) {
+		feeds, pindexes := mgr.CurrentMaps()
+		if len(feeds) != 1 || len(pindexes) != 1 {
+			t.Fatalf("expected 1 feed and 1 pindex, got feeds: %+v,"+
+				" pindexes: %+v", feeds, pindexes)
+		}
+		var feed Feed
+		for _, f := range feeds {
+			feed = f
+		}
+		var pindex *PIndex
+		for _, p := range pindexes {
+			pindex = p
+		}
+		n, _ := pindex.Impl.(bleve.Index).DocCount()
+		if n != 0 {
+			t.Errorf("expected an empty pindex, got: %d docs", n)
+		}
+		err := feed.(*DestFeed).OnDataUpdate("", []byte("a"), 1,
+			[]byte(`{"x":"hello"}`))
+		if err != nil {
+			t.Errorf("expected OnDataUpdate to work, err: %v", err)
+		}
+		return feed, pindex
+	}
+
+	// Returns the number of docs of the pindex that match the term.
+	count := func(pindex *PIndex, term string) int {
+		res, err := pindex.Impl.(bleve.Index).Search(
+			bleve.NewSearchRequest(bleve.NewMatchQuery(term)))
+		if err != nil {
+			t.Fatalf("expected Search to work, err: %v", err)
+		}
+		return len(res.Hits)
+	}
+
+	feed, pindex := feedDoc()
+	if count(pindex, "v1") != 1 {
+		t.Errorf("expected doc indexed by v1")
+	}
+
+	m.Lock()
+	mappingVersion = "v2"
+	m.Unlock()
+
+	// Waits for the janitor to replace the pindex, as the reindex
+	// goes through the plan.
+	reindex := func(via *Manager) {
+		if err := via.ReindexIndex("foo"); err != nil {
+			t.Fatalf("expected ReindexIndex to work, err: %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			_, pindexes := mgr.CurrentMaps()
+			if len(pindexes) == 1 && pindexes[pindex.Name] == nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("expected reindex to replace the pindex")
+	}
+
+	reindex(mgr)
+
+	feed2, pindex2 := feedDoc()
+	if feed2 == feed || pindex2.IndexUUID == pindex.IndexUUID {
+		t.Errorf("expected reindex to restart the feed and pindex")
+	}
+	if count(pindex2, "v2") != 1 || count(pindex2, "v1") != 0 {
+		t.Errorf("expected doc to be rebuilt by v2")
+	}
+	if _, err := os.Stat(pindex.Path); !os.IsNotExist(err) {
+		t.Errorf("expected the old pindex data to be removed, err: %v", err)
+	}
+
+	// The reindex is cluster-wide, so it works from any node.
+	pindex = pindex2
+	reindex(NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", emptyDir, "some-datasource", nil))
+}
+
+func TestManagerQueryPIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, nil, NewUUID(), nil, "", 1, "", emptyDir, "", nil)
+
+	for _, name := range []string{"foo_0", "foo_1"} {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		defer dest.Close()
+
+		dest.OnSnapshotStart("0", 1, 1)
+		dest.OnDataUpdate("0", []byte("doc-"+name), 1, []byte(`{"x":"hello"}`))
+
+		m.registerPIndex(&PIndex{Name: name, IndexName: "foo",
+			IndexType: "bleve", Impl: impl, Dest: dest})
+	}
+
+	var res bytes.Buffer
+	err := m.QueryPIndex("foo_1", []byte(`{"query":{"query":{"query":"hello"}}}`),
+		&res, nil)
+	if err != nil {
+		t.Fatalf("expected QueryPIndex to work, err: %v", err)
+	}
+	var sr struct {
+		Hits []struct {
+			ID string `json:"id"`
+		} `json:"hits"`
+	}
+	err = json.Unmarshal(res.Bytes(), &sr)
+	if err != nil {
+		t.Fatalf("expected query result to parse, err: %v", err)
+	}
+	if len(sr.Hits) != 1 || sr.Hits[0].ID != "doc-foo_1" {
+		t.Errorf("expected just the hit from foo_1, got: %s", res.Bytes())
+	}
+
+	err = m.QueryPIndex("not-a-pindex", []byte(`{}`), &res, nil)
+	if err == nil || !strings.Contains(err.Error(), "no pindex") {
+		t.Errorf("expected QueryPIndex on a missing pindex to fail, err: %v", err)
+	}
+}
+
+func TestManagerMeta(t *testing.T) {
+	m := NewManager(VERSION, nil, NewUUID(), nil, "", 1, "", "dir", "", nil)
+
+	buf, err := json.Marshal(m.Meta())
+	if err != nil {
+		t.Fatalf("expected Meta to marshal, err: %v", err)
+	}
+
+	var meta struct {
+		StartSamples map[string]json.RawMessage `json:"startSamples"`
+		SourceTypes  map[string]*MetaDesc       `json:"sourceTypes"`
+		IndexTypes   map[string]*MetaDesc       `json:"indexTypes"`
+	}
+	err = json.Unmarshal(buf, &meta)
+	if err != nil {
+		t.Fatalf("expected Meta JSON to parse, err: %v", err)
+	}
+
+	if meta.StartSamples["planParams"] == nil {
+		t.Errorf("expected a planParams start sample, got: %s", buf)
+	}
+	if meta.SourceTypes["couchbase"] == nil ||
+		meta.SourceTypes["couchbase"].StartSample == nil {
+		t.Errorf("expected public couchbase source type, got: %s", buf)
+	}
+	if meta.SourceTypes["couchbase-dcp"] != nil {
+		t.Errorf("expected non-public couchbase-dcp to be absent, got: %s", buf)
+	}
+	if meta.IndexTypes["bleve"] == nil ||
+		meta.IndexTypes["bleve"].Description == "" ||
+		meta.IndexTypes["bleve"].StartSample == nil {
+		t.Errorf("expected bleve index type with a start sample, got: %s", buf)
+	}
+}
+
+func TestManagerCheckTopologies(t *testing.T) {
+	var m sync.Mutex
+	vbm := &couchbase.VBucketServerMap{
+		ServerList: []string{"a:11210", "b:11210"},
+		VBucketMap: [][]int{{0}, {0}, {1}, {1}},
+	}
+
+	origVBServerMap := couchbaseVBServerMap
+	defer func() { couchbaseVBServerMap = origVBServerMap }()
+	couchbaseVBServerMap = func(server, poolName, bucketName string) (
+		*couchbase.VBucketServerMap, error) {
+		m.Lock()
+		defer m.Unlock()
+		return &couchbase.VBucketServerMap{
+			ServerList: vbm.ServerList,
+			VBucketMap: vbm.VBucketMap,
+		}, nil
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(VERSION, cfg, NewUUID(), []string{"planner"}, "", 1,
+		":1000", emptyDir, "some-datasource", nil)
+	if err := mgr.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	if err := mgr.CreateIndex("couchbase", "default", "", "",
+		"bleve", "foo", "", PlanParams{}); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+
+	changed, err := mgr.CheckTopologies()
+	if err != nil || len(changed) != 0 {
+		t.Errorf("expected no change on first check, changed: %v, err: %v",
+			changed, err)
+	}
+	changed, err = mgr.CheckTopologies()
+	if err != nil || len(changed) != 0 {
+		t.Errorf("expected no change on unchanged topology,"+
+			" changed: %v, err: %v", changed, err)
+	}
+	if mgr.Stats().TotTopologyChange != 0 {
+		t.Errorf("expected no topology changes, stats: %+v", mgr.Stats())
+	}
+
+	// Simulate a rebalance that moves vbucket 1 to server b.
+	m.Lock()
+	vbm.VBucketMap = [][]int{{0}, {1}, {1}, {1}}
+	m.Unlock()
+
+	changed, err = mgr.CheckTopologies()
+	if err != nil || len(changed) != 1 {
+		t.Errorf("expected a change after rebalance, changed: %v, err: %v",
+			changed, err)
+	}
+	if mgr.Stats().TotTopologyChange != 1 {
+		t.Errorf("expected 1 topology change, stats: %+v", mgr.Stats())
+	}
+
+	changed, err = mgr.CheckTopologies()
+	if err != nil || len(changed) != 0 {
+		t.Errorf("expected no change after rebalance settled,"+
+			" changed: %v, err: %v", changed, err)
+	}
+
+	// The topology of a no longer used data source is forgotten.
+	if err = mgr.DeleteIndex("foo"); err != nil {
+		t.Fatalf("expected DeleteIndex() to work, err: %v", err)
+	}
+	if _, err = mgr.CheckTopologies(); err != nil {
+		t.Errorf("expected CheckTopologies() to work, err: %v", err)
+	}
+	mgr.m.Lock()
+	numTopologies := len(mgr.topologies)
+	mgr.m.Unlock()
+	if numTopologies != 0 {
+		t.Errorf("expected no topologies after index deletion, got: %d",
+			numTopologies)
+	}
+}
+
+func TestManagerJanitorRestartFeeds(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil, "", 1,
+		":1000", emptyDir, "some-datasource", nil)
+	if err := mgr.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	for _, indexName := range []string{"foo", "bar"} {
+		if err := mgr.CreateIndex("nil", indexName, "", "",
+			"bleve", indexName, "", PlanParams{}); err != nil {
+			t.Fatalf("expected CreateIndex() to work, err: %v", err)
+		}
+	}
+	mgr.Kick("test")
+
+	feeds, _ := mgr.CurrentMaps()
+	if len(feeds) != 2 {
+		t.Fatalf("expected 2 feeds, got: %v", feeds)
+	}
+
+	mgr.JanitorRestartFeeds("test",
+		[]string{topologySourceKey("nil", "foo", "", "")})
+
+	feedsAfter, _ := mgr.CurrentMaps()
+	if len(feedsAfter) != 2 {
+		t.Fatalf("expected 2 feeds after restart, got: %v", feedsAfter)
+	}
+	for feedName, feed := range feeds {
+		restarted := feedsAfter[feedName] != feed
+		if restarted != strings.HasPrefix(feedName, "foo_") {
+			t.Errorf("expected only the foo feed to be restarted,"+
+				" feedName: %s, restarted: %v", feedName, restarted)
+		}
+	}
+}
+
+func TestManagerCreateIndexAsync(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, ":1000",
+		emptyDir, "some-datasource", nil)
+	if err := mgr.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+
+	if _, err := mgr.IndexOpStatus("not-an-op"); err == nil {
+		t.Errorf("expected IndexOpStatus of an unknown opID to fail")
+	}
+
+	opID := mgr.CreateIndexAsync("dest", "sourceName", "sourceUUID", "",
+		"bleve", "foo", "", PlanParams{})
+
+	// Waits for the fake feed's pindex to be opened by the janitor.
+	var pindex *PIndex
+	for i := 0; i < 100 && pindex == nil; i++ {
+		_, pindexes := mgr.CurrentMaps()
+		for _, p := range pindexes {
+			pindex = p
+		}
+		if pindex == nil {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if pindex == nil {
+		t.Fatalf("expected a pindex")
+	}
+
+	partition := pindex.sourcePartitionsArr[0]
+	pindex.Dest.OnSnapshotStart(partition, 1, 2)
+	pindex.Dest.OnDataUpdate(partition, []byte("a"), 1, []byte(`{}`))
+
+	status, err := mgr.IndexOpStatus(opID)
+	if err != nil || status.Status != INDEX_OP_BUILDING ||
+		status.Progress >= 1.0 || status.IndexName != "foo" {
+		t.Errorf("expected building status, got: %+v, err: %v", status, err)
+	}
+
+	pindex.Dest.OnDataUpdate(partition, []byte("b"), 2, []byte(`{}`))
+
+	status, err = mgr.IndexOpStatus(opID)
+	if err != nil || status.Status != INDEX_OP_READY ||
+		status.Progress != 1.0 {
+		t.Errorf("expected ready status, got: %+v, err: %v", status, err)
+	}
+
+	readyOpID := opID
+
+	// A failed creation, as the index already exists.
+	opID = mgr.CreateIndexAsync("dest", "sourceName", "sourceUUID", "",
+		"bleve", "foo", "", PlanParams{})
+	for i := 0; i < 100; i++ {
+		status, err = mgr.IndexOpStatus(opID)
+		if err != nil || status.Status != INDEX_OP_PENDING {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil || status.Status != INDEX_OP_FAILED || status.Err == "" {
+		t.Errorf("expected failed status, got: %+v, err: %v", status, err)
+	}
+
+	defer func(prevTTL time.Duration, prevMax int) {
+		indexOpsTTL, indexOpsMax = prevTTL, prevMax
+	}(indexOpsTTL, indexOpsMax)
+
+	// The finished ops expire.
+	indexOpsTTL = 0
+	failedOpID := opID
+	opID = mgr.CreateIndexAsync("dest", "sourceName", "sourceUUID", "",
+		"bleve", "foo", "", PlanParams{})
+	for _, id := range []string{readyOpID, failedOpID} {
+		if _, err = mgr.IndexOpStatus(id); err == nil {
+			t.Errorf("expected finished op to expire, opID: %s", id)
+		}
+	}
+
+	// Beyond the max, the oldest ops are forgotten, even if unfinished.
+	indexOpsTTL = time.Hour
+	indexOpsMax = 1
+	time.Sleep(time.Millisecond)
+	lastOpID := mgr.CreateIndexAsync("dest", "sourceName", "sourceUUID", "",
+		"bleve", "foo", "", PlanParams{})
+	if _, err = mgr.IndexOpStatus(opID); err == nil {
+		t.Errorf("expected the oldest op to be forgotten")
+	}
+	if _, err = mgr.IndexOpStatus(lastOpID); err != nil {
+		t.Errorf("expected the latest op to be kept, err: %v", err)
+	}
+}
+
+func TestManagerIndexOpStatusRemoteOnly(t *testing.T) {
+	cfg := NewCfgMem()
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, ":1000",
+		"", "some-datasource", nil)
+
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "fooUUID"}
+	if _, err := CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+
+	mgr.indexOps = map[string]*indexOp{
+		"op": {indexName: "foo", indexUUID: "fooUUID", startTime: time.Now()},
+	}
+
+	status, err := mgr.IndexOpStatus("op")
+	if err != nil || status.Status != INDEX_OP_BUILDING {
+		t.Errorf("expected building status before planning, got: %+v,"+
+			" err: %v", status, err)
+	}
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name: "foo_0", IndexName: "foo", IndexUUID: "fooUUID",
+		Nodes: map[string]*PlanPIndexNode{"other": {CanRead: true}},
+	}
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+
+	status, err = mgr.IndexOpStatus("op")
+	if err != nil || status.Status != INDEX_OP_UNKNOWN {
+		t.Errorf("expected unknown status when planned only onto other"+
+			" nodes, got: %+v, err: %v", status, err)
+	}
+}
+
+func TestManagerKickCoalescing(t *testing.T) {
+	mgr := NewManagerEx(VERSION, nil, NewUUID(), []string{"planner"}, "", 1,
+		"", "", "", nil, map[string]string{"kickCoalesceMS": "100"})
+	go mgr.PlannerLoop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			mgr.PlannerKick("test")
+			wg.Done()
+		}()
+	}
+	wg.Wait() // Every kick is served, so there are no lost wakeups.
+
+	stats := mgr.Stats()
+	if stats.TotPlannerKick != 100 {
+		t.Errorf("expected 100 kicks, got: %d", stats.TotPlannerKick)
+	}
+	if stats.TotPlannerCycle < 1 || stats.TotPlannerCycle > 10 {
+		t.Errorf("expected coalesced cycles, got: %d", stats.TotPlannerCycle)
+	}
+
+	// A kick after the burst still gets its own cycle.
+	mgr.PlannerKick("test")
+	if mgr.Stats().TotPlannerCycle != stats.TotPlannerCycle+1 {
+		t.Errorf("expected one more cycle, got: %d",
+			mgr.Stats().TotPlannerCycle)
+	}
+}
+
+func TestManagerReapDeadNodes(t *testing.T) {
+	defer func() { heartbeatTimeNow = time.Now }()
+	now := time.Now()
+	heartbeatTimeNow = func() time.Time { return now }
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	mgrA := NewManager(VERSION, cfg, "uuidA", []string{"planner", "pindex"},
+		"", 1, "a:1000", emptyDir, "some-datasource", nil)
+	mgrB := NewManager(VERSION, cfg, "uuidB", []string{"pindex"},
+		"", 1, "b:1000", emptyDir, "some-datasource", nil)
+	for _, mgr := range []*Manager{mgrA, mgrB} {
+		if err := mgr.Start("wanted"); err != nil {
+			t.Fatalf("expected Manager.Start() to work, err: %v", err)
+		}
+	}
+
+	if err := mgrA.CreateIndex("dest", "sourceName", "sourceUUID",
+		`{"numPartitions":4}`, "bleve", "foo", "",
+		PlanParams{MaxPartitionsPerPIndex: 1}); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	mgrA.PlannerNOOP("test")
+
+	// Returns the UUIDs of the nodes that the plan assigns partitions to.
+	planNodes := func() map[string]bool {
+		planPIndexes, _, _ := CfgGetPlanPIndexes(cfg)
+		rv := map[string]bool{}
+		for _, planPIndex := range planPIndexes.PlanPIndexes {
+			for nodeUUID := range planPIndex.Nodes {
+				rv[nodeUUID] = true
+			}
+		}
+		return rv
+	}
+	if nodes := planNodes(); !nodes["uuidA"] || !nodes["uuidB"] {
+		t.Fatalf("expected partitions on both nodes, got: %v", nodes)
+	}
+
+	for _, mgr := range []*Manager{mgrA, mgrB} {
+		if err := mgr.Heartbeat(); err != nil {
+			t.Errorf("expected Heartbeat() to work, err: %v", err)
+		}
+	}
+
+	reaped, err := mgrA.ReapDeadNodes(5 * time.Second)
+	if err != nil || len(reaped) != 0 {
+		t.Errorf("expected no reaping of live nodes, got: %v, err: %v",
+			reaped, err)
+	}
+
+	// Node B dies, so only node A keeps heartbeating.
+	now = now.Add(10 * time.Second)
+	mgrA.Heartbeat()
+
+	reaped, err = mgrA.ReapDeadNodes(5 * time.Second)
+	if err != nil || !reflect.DeepEqual(reaped, []string{"uuidB"}) {
+		t.Errorf("expected node B to be reaped, got: %v, err: %v",
+			reaped, err)
+	}
+
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nodeDefs, _, _ := CfgGetNodeDefs(cfg, kind)
+		if nodeDefs.NodeDefs["b:1000"] != nil ||
+			nodeDefs.NodeDefs["a:1000"] == nil {
+			t.Errorf("expected only node A in %s nodeDefs, got: %#v",
+				kind, nodeDefs.NodeDefs)
+		}
+	}
+
+	mgrA.PlannerNOOP("test")
+	if nodes := planNodes(); !nodes["uuidA"] || nodes["uuidB"] {
+		t.Errorf("expected partitions reassigned to node A, got: %v", nodes)
+	}
+
+	// Node B comes back, and its heartbeat re-registers it.
+	if err = mgrB.Heartbeat(); err != nil {
+		t.Errorf("expected Heartbeat() to work, err: %v", err)
+	}
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		nodeDefs, _, _ := CfgGetNodeDefs(cfg, kind)
+		nodeDef := nodeDefs.NodeDefs["b:1000"]
+		if nodeDef == nil || nodeDef.UUID != "uuidB" {
+			t.Errorf("expected node B re-registered in %s nodeDefs, got: %#v",
+				kind, nodeDefs.NodeDefs)
+		}
+	}
+	nodeDefs, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if nodeDefs.NodeDefs["b:1000"].LastHeartbeat !=
+		now.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("expected a re-registered node B heartbeat, got: %#v",
+			nodeDefs.NodeDefs["b:1000"])
+	}
+
+	mgrA.PlannerNOOP("test")
+	if nodes := planNodes(); !nodes["uuidA"] || !nodes["uuidB"] {
+		t.Errorf("expected partitions on both nodes again, got: %v", nodes)
+	}
+}
+
+func TestManagerFlushPIndex(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil,
+		"", 1, ":1000", emptyDir, "some-datasource", nil)
+
+	if m.FlushPIndex("not-a-pindex") == nil {
+		t.Errorf("expected FlushPIndex of a missing pindex to fail")
+	}
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	m.registerPIndex(&PIndex{Name: "foo_0", IndexName: "foo",
+		IndexType: "bleve", SourcePartitions: "0",
+		sourcePartitionsArr: []string{"0"}, Impl: impl, Dest: dest})
+
+	dest.OnSnapshotStart("0", 1, 100)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+
+	if err = m.FlushPIndex("foo_0"); err != nil {
+		t.Errorf("expected FlushPIndex to work, err: %v", err)
+	}
+	count, err := impl.(bleve.Index).DocCount()
+	if err != nil || count != 1 {
+		t.Errorf("expected the flushed doc, count: %d, err: %v", count, err)
+	}
+
+	m.registerPIndex(&PIndex{Name: "bh_0", IndexName: "bh",
+		IndexType: "blackhole", Dest: NewBlackHole("")})
+	if m.FlushPIndex("bh_0") == nil {
+		t.Errorf("expected FlushPIndex of a dest without flush to fail")
+	}
+}
+
+func TestManagerDrainNode(t *testing.T) {
+	defer func(prev time.Duration) {
+		drainNodePollInterval = prev
+	}(drainNodePollInterval)
+	drainNodePollInterval = 10 * time.Millisecond
+
+	emptyDirA, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDirA)
+	emptyDirB, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDirB)
+
+	cfg := NewCfgMem()
+	mgrA := NewManager(VERSION, cfg, "uuidA",
+		[]string{"planner", "pindex", "janitor"},
+		"", 1, "a:1000", emptyDirA, "some-datasource", nil)
+	mgrB := NewManager(VERSION, cfg, "uuidB", []string{"pindex"},
+		"", 1, "b:1000", emptyDirB, "some-datasource", nil)
+	for _, mgr := range []*Manager{mgrA, mgrB} {
+		if err := mgr.Start("wanted"); err != nil {
+			t.Fatalf("expected Manager.Start() to work, err: %v", err)
+		}
+	}
+
+	if err := mgrA.CreateIndex("dest", "sourceName", "sourceUUID",
+		`{"numPartitions":4}`, "bleve", "foo", "",
+		PlanParams{MaxPartitionsPerPIndex: 1}); err != nil {
+		t.Fatalf("expected CreateIndex() to work, err: %v", err)
+	}
+	mgrA.PlannerNOOP("test")
+	mgrA.JanitorKick("test")
+
+	// Returns the UUIDs of the nodes that mgrA's queries route to.
+	queryNodes := func() map[string]bool {
+		mgrA.GetPlanPIndexes(true)
+		localPIndexes, remotePlanPIndexes, err :=
+			mgrA.CoveringPIndexes("foo", "", PlanPIndexNodeCanRead)
+		if err != nil {
+			t.Fatalf("expected CoveringPIndexes to work, err: %v", err)
+		}
+		rv := map[string]bool{}
+		if len(localPIndexes) > 0 {
+			rv["uuidA"] = true
+		}
+		for _, remote := range remotePlanPIndexes {
+			rv[remote.NodeDef.UUID] = true
+		}
+		return rv
+	}
+	if nodes := queryNodes(); !nodes["uuidA"] || !nodes["uuidB"] {
+		t.Fatalf("expected queries to route to both nodes, got: %v", nodes)
+	}
+
+	err := mgrB.DrainNode(10 * time.Second)
+	if err != nil {
+		t.Fatalf("expected DrainNode to work, err: %v", err)
+	}
+
+	planPIndexes, _, _ := CfgGetPlanPIndexes(cfg)
+	for _, planPIndex := range planPIndexes.PlanPIndexes {
+		if planPIndex.Nodes["uuidB"] != nil || planPIndex.Nodes["uuidA"] == nil {
+			t.Errorf("expected the drained node's partitions to move,"+
+				" got: %#v", planPIndex)
+		}
+	}
+
+	wanted, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_WANTED)
+	known, _, _ := CfgGetNodeDefs(cfg, NODE_DEFS_KNOWN)
+	if wanted.NodeDefs["b:1000"] != nil || known.NodeDefs["b:1000"] == nil {
+		t.Errorf("expected only the wanted nodeDef to be removed")
+	}
+
+	mgrA.JanitorKick("test")
+	if nodes := queryNodes(); !nodes["uuidA"] || nodes["uuidB"] {
+		t.Errorf("expected queries to no longer route to the drained node,"+
+			" got: %v", nodes)
+	}
+
+	// A node that's already drained returns right away.
+	if err = mgrB.DrainNode(0); err != nil {
+		t.Errorf("expected a repeated DrainNode to work, err: %v", err)
+	}
+}
+
+func TestManagerForceTakeoverHostPort(t *testing.T) {
+	defer func() { heartbeatTimeNow = time.Now }()
+	now := time.Now()
+	heartbeatTimeNow = func() time.Time { return now }
+
+	cfg := NewCfgMem()
+
+	mgrOld := NewManager(VERSION, cfg, "old", nil, "", 1, "a:1000",
+		"", "some-datasource", nil)
+	for _, kind := range []string{NODE_DEFS_KNOWN, NODE_DEFS_WANTED} {
+		if err := mgrOld.SaveNodeDef(kind, false); err != nil {
+			t.Fatalf("expected SaveNodeDef to work, err: %v", err)
+		}
+	}
+
+	// A replacement host that reuses the address.
+	mgrNew := NewManager(VERSION, cfg, "new", nil, "", 1, "a:1000",
+		"", "some-datasource", nil)
+	if mgrNew.SaveNodeDef(NODE_DEFS_KNOWN, false) == nil {
+		t.Errorf("expected SaveNodeDef to refuse a taken bindAddr")
+	}
+
+	// The old node never heartbeated, so its staleness is unknown.
+	if mgrNew.ForceTakeoverHostPort(5*time.Second) == nil {
+		t.Errorf("expected takeover of a node without heartbeats to fail")
+	}
+
+	mgrOld.Heartbeat()
+
+	now = now.Add(time.Second)
+	if mgrNew.ForceTakeoverHostPort(5*time.Second) == nil {
+		t.Errorf("expected takeover of a live node to fail")
+	}
+
+	nodeUUID := func(kind string) string {
+		nodeDefs, _, _ := CfgGetNodeDefs(cfg, kind)
+		return nodeDefs.NodeDefs["a:1000"].UUID
+	}
+	if nodeUUID(NODE_DEFS_KNOWN) != "old" || nodeUUID(NODE_DEFS_WANTED) != "old" {
+		t.Errorf("expected the live node to keep its nodeDefs")
+	}
+
+	now = now.Add(10 * time.Second)
+	if err := mgrNew.ForceTakeoverHostPort(5 * time.Second); err != nil {
+		t.Errorf("expected takeover of a stale node to work, err: %v", err)
+	}
+	if nodeUUID(NODE_DEFS_KNOWN) != "new" || nodeUUID(NODE_DEFS_WANTED) != "new" {
+		t.Errorf("expected the new node to own the nodeDefs")
+	}
+
+	if err := mgrNew.SaveNodeDef(NODE_DEFS_KNOWN, false); err != nil {
+		t.Errorf("expected SaveNodeDef after takeover to work, err: %v", err)
+	}
+	if err := mgrNew.ForceTakeoverHostPort(5 * time.Second); err != nil {
+		t.Errorf("expected a repeated takeover to be a no-op, err: %v", err)
+	}
+}
+
+func TestManagerOnPlanChanged(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	meh := &TestPlanMEH{}
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, ":1000",
+		emptyDir, "some-datasource", meh)
+	if err := mgr.Start("wanted"); err != nil {
+		t.Fatalf("expected Manager.Start() to work, err: %v", err)
+	}
+	mgr.PlannerNOOP("prime the planner")
+
+	err := mgr.CreateIndex("dest", "default", "123", "",
+		"bleve", "foo", "", PlanParams{})
+	if err != nil {
+		t.Fatalf("expected CreateIndex to work, err: %v", err)
+	}
+	mgr.PlannerNOOP("wait for the planner")
+
+	plan, _, err := CfgGetPlanPIndexes(cfg)
+	if err != nil || plan == nil {
+		t.Fatalf("expected a plan, err: %v", err)
+	}
+	if len(meh.plans) != 1 {
+		t.Fatalf("expected 1 plan change, got: %d", len(meh.plans))
+	}
+	old, new := meh.plans[0][0], meh.plans[0][1]
+	if old == nil || len(old.PlanPIndexes) != 0 {
+		t.Errorf("expected an empty old plan, got: %#v", old)
+	}
+	if !SamePlanPIndexes(new, plan) || len(new.PlanPIndexes) != 1 {
+		t.Errorf("expected the new plan to be the saved plan,"+
+			" new: %#v, saved: %#v", new, plan)
+	}
+
+	// A replan that computes the same plan isn't a change.
+	changed, err := mgr.PlannerOnce("test")
+	if err != nil || changed {
+		t.Errorf("expected no plan change, changed: %v, err: %v", changed, err)
+	}
+	if len(meh.plans) != 1 {
+		t.Errorf("expected no more plan changes, got: %d", len(meh.plans))
+	}
+
+	err = mgr.DeleteIndex("foo")
+	if err != nil {
+		t.Fatalf("expected DeleteIndex to work, err: %v", err)
+	}
+	mgr.PlannerNOOP("wait for the planner")
+
+	if len(meh.plans) != 2 {
+		t.Fatalf("expected 2 plan changes, got: %d", len(meh.plans))
+	}
+	if !SamePlanPIndexes(meh.plans[1][0], plan) ||
+		len(meh.plans[1][1].PlanPIndexes) != 0 {
+		t.Errorf("expected the deletion to replan from the saved plan"+
+			" to an empty plan, got: %#v", meh.plans[1])
+	}
+}
+
+func TestManagerQueryBegin(t *testing.T) {
+	mgr := NewManagerEx(VERSION, nil, NewUUID(), nil, "", 1,
+		"", "", "", nil, map[string]string{"queryConcurrencyMax": "2"})
+
+	// Saturate the foo index.
+	var fooDones []func()
+	for i := 0; i < 2; i++ {
+		done, err := mgr.QueryBegin("foo")
+		if err != nil {
+			t.Fatalf("expected QueryBegin to work, err: %v", err)
+		}
+		fooDones = append(fooDones, done)
+	}
+	_, err := mgr.QueryBegin("foo")
+	if _, ok := err.(*QueryTooManyError); !ok ||
+		!strings.Contains(err.Error(), "too many concurrent queries") {
+		t.Errorf("expected a saturated index to reject, err: %v", err)
+	}
+
+	// Another index's queries still proceed.
+	barDone, err := mgr.QueryBegin("bar")
+	if err != nil {
+		t.Errorf("expected another index to work, err: %v", err)
+	}
+
+	stats := mgr.Stats()
+	if stats.TotQueryRejected != 1 {
+		t.Errorf("expected 1 rejected query, got: %d", stats.TotQueryRejected)
+	}
+	if stats.CurQueryInFlight["foo"] != 2 || stats.CurQueryInFlight["bar"] != 1 {
+		t.Errorf("expected in-flight counts, got: %v", stats.CurQueryInFlight)
+	}
+
+	// Completing a query frees its slot, and done is idempotent.
+	fooDones[0]()
+	fooDones[0]()
+	barDone()
+	done, err := mgr.QueryBegin("foo")
+	if err != nil {
+		t.Errorf("expected a freed slot to work, err: %v", err)
+	}
+	done()
+	fooDones[1]()
+	if inFlight := mgr.QueriesInFlight(); inFlight["foo"] != 0 ||
+		inFlight["bar"] != 0 {
+		t.Errorf("expected no in-flight queries, got: %v", inFlight)
+	}
+}
+
+func TestManagerQueryBeginQueued(t *testing.T) {
+	mgr := NewManagerEx(VERSION, nil, NewUUID(), nil, "", 1,
+		"", "", "", nil, map[string]string{
+			"queryConcurrencyMax": "1",
+			"queryQueueTimeoutMS": "5000",
+		})
+
+	firstDone, err := mgr.QueryBegin("foo")
+	if err != nil {
+		t.Fatalf("expected QueryBegin to work, err: %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		firstDone()
+	}()
+
+	// The excess query waits for the slot instead of being rejected.
+	done, err := mgr.QueryBegin("foo")
+	if err != nil {
+		t.Errorf("expected a queued query to work, err: %v", err)
+	}
+	done()
+
+	// Unless it waits longer than the queue timeout.
+	mgr.options["queryQueueTimeoutMS"] = "10"
+	done, _ = mgr.QueryBegin("foo")
+	_, err = mgr.QueryBegin("foo")
+	if err == nil {
+		t.Errorf("expected a queue timeout to reject")
+	}
+	done()
+}
+
+func TestManagerPruneQueryLimiters(t *testing.T) {
+	mgr := NewManagerEx(VERSION, nil, NewUUID(), nil, "", 1,
+		"", "", "", nil, map[string]string{"queryConcurrencyMax": "1"})
+
+	fooDone, _ := mgr.QueryBegin("foo")
+	barDone, _ := mgr.QueryBegin("bar")
+	bazDone, _ := mgr.QueryBegin("baz")
+	bazDone()
+
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo"}
+
+	// The deleted baz goes, but bar stays while it's in flight.
+	mgr.pruneQueryLimiters(indexDefs)
+	inFlight := mgr.QueriesInFlight()
+	if len(inFlight) != 2 || inFlight["foo"] != 1 || inFlight["bar"] != 1 {
+		t.Errorf("expected foo and bar limiters, got: %v", inFlight)
+	}
+
+	barDone()
+	mgr.pruneQueryLimiters(indexDefs)
+	inFlight = mgr.QueriesInFlight()
+	if len(inFlight) != 1 || inFlight["foo"] != 1 {
+		t.Errorf("expected only the foo limiter, got: %v", inFlight)
+	}
+
+	fooDone()
+	mgr.pruneQueryLimiters(nil)
+	if inFlight = mgr.QueriesInFlight(); len(inFlight) != 0 {
+		t.Errorf("expected no limiters, got: %v", inFlight)
+	}
+}
@@ -0,0 +1,131 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cbft
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/couchbaselabs/clog"
+)
+
+// The topology poller periodically asks each data source that's
+// referenced by an index definition for its topology signature (see
+// FeedType.Topology).  When a signature changes, such as when a
+// rebalance moves vbuckets between servers, the poller kicks the
+// planner and has the janitor restart the local feeds of that data
+// source, so that they reconnect to the partitions' new servers.
+
+// TopologyPollMS returns the interval between topology polls from
+// the "topologyPollMS" manager option, where <= 0 means disabled.
+func (mgr *Manager) TopologyPollMS() int {
+	v, exists := mgr.options["topologyPollMS"]
+	if !exists {
+		return 0
+	}
+	pollMS, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("warning: could not parse topologyPollMS option: %s,"+
+			" err: %v", v, err)
+		return 0
+	}
+	return pollMS
+}
+
+// TopologyLoop polls the data source topologies forever, every
+// pollMS millisecs.
+func (mgr *Manager) TopologyLoop(pollMS int) {
+	for {
+		time.Sleep(time.Duration(pollMS) * time.Millisecond)
+
+		_, err := mgr.CheckTopologies()
+		if err != nil {
+			log.Printf("topology: CheckTopologies, err: %v", err)
+		}
+	}
+}
+
+// CheckTopologies retrieves the current topology signature of every
+// data source used by an index definition.  If any signature differs
+// from the previously seen one, it kicks the planner and restarts the
+// feeds of the changed data sources via the janitor.  The first
+// signature seen for a data source is only remembered, and the
+// signatures of data sources that are no longer used are forgotten.
+// Returns the keys of the data sources whose topology changed.
+func (mgr *Manager) CheckTopologies() ([]string, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, fmt.Errorf("error: CheckTopologies could not"+
+			" retrieve index defs, err: %v", err)
+	}
+
+	used := map[string]bool{}   // Key is sourceKey.
+	sigs := map[string]string{} // Key is sourceKey.
+	for _, indexDef := range indexDefsByName {
+		sourceKey := topologySourceKey(indexDef.SourceType,
+			indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams)
+		if used[sourceKey] {
+			continue
+		}
+		used[sourceKey] = true
+
+		sig, err := DataSourceTopology(indexDef.SourceType,
+			indexDef.SourceName, indexDef.SourceUUID, indexDef.SourceParams,
+			mgr.server)
+		if err != nil {
+			// Keep the last known signature, as the data source
+			// might just be temporarily unreachable.
+			log.Printf("topology: DataSourceTopology, sourceKey: %s, err: %v",
+				sourceKey, err)
+			continue
+		}
+
+		sigs[sourceKey] = sig
+	}
+
+	var changed []string
+
+	mgr.m.Lock()
+	if mgr.topologies == nil {
+		mgr.topologies = map[string]string{}
+	}
+	for sourceKey := range mgr.topologies {
+		if !used[sourceKey] {
+			delete(mgr.topologies, sourceKey)
+		}
+	}
+	for sourceKey, sig := range sigs {
+		prev, exists := mgr.topologies[sourceKey]
+		if exists && prev != sig {
+			changed = append(changed, sourceKey)
+		}
+		mgr.topologies[sourceKey] = sig
+	}
+	mgr.m.Unlock()
+
+	if len(changed) > 0 {
+		atomic.AddUint64(&mgr.stats.TotTopologyChange, uint64(len(changed)))
+
+		msg := fmt.Sprintf("topology changed, sources: %v", changed)
+		mgr.PlannerKick(msg)
+		mgr.JanitorRestartFeeds(msg, changed)
+	}
+
+	return changed, nil
+}
+
+func topologySourceKey(sourceType, sourceName, sourceUUID,
+	sourceParams string) string {
+	return sourceType + "/" + sourceName + "/" + sourceUUID + "/" + sourceParams
+}
@@ -16,7 +16,9 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -25,30 +27,129 @@ import (
 )
 
 // Compares two dotted versioning strings, like "1.0.1" and "1.2.3".
-// Returns true when x >= y.
+// Returns true when x >= y.  Returns false when either version can't
+// be parsed.  See VersionCompare() for the supported syntax.
 func VersionGTE(x, y string) bool {
-	xa := strings.Split(x, ".")
-	ya := strings.Split(y, ".")
-	for i := range xa {
-		if i >= len(ya) {
-			return true
+	c, err := VersionCompare(x, y)
+	return err == nil && c >= 0
+}
+
+// VersionCompare compares two versions of the form
+// "MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD]", returning -1, 0 or 1 when
+// x is less than, equal to or greater than y.
+//
+// There may be any number of dotted numeric components, where missing
+// trailing components are treated as 0, so that "1.0" equals "1.0.0".
+// A version with a pre-release suffix is less than the same version
+// without one, so "1.0.0-beta" < "1.0.0".  Pre-release suffixes are
+// compared by their dotted identifiers, where numeric identifiers are
+// compared numerically and are less than alphanumeric identifiers,
+// which are compared lexically, so "1.0.0-beta.2" < "1.0.0-beta.10".
+// Build metadata is ignored, so "1.0.0+abc" equals "1.0.0".
+func VersionCompare(x, y string) (int, error) {
+	xn, xp, err := parseVersion(x)
+	if err != nil {
+		return 0, err
+	}
+	yn, yp, err := parseVersion(y)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(xn) || i < len(yn); i++ {
+		var xv, yv int
+		if i < len(xn) {
+			xv = xn[i]
+		}
+		if i < len(yn) {
+			yv = yn[i]
 		}
-		xv, err := strconv.Atoi(xa[i])
-		if err != nil {
-			return false
+		if xv != yv {
+			return compareInts(xv, yv), nil
 		}
-		yv, err := strconv.Atoi(ya[i])
-		if err != nil {
-			return false
+	}
+
+	if len(xp) == 0 || len(yp) == 0 {
+		return compareInts(len(yp), len(xp)), nil // No pre-release is greater.
+	}
+
+	for i := 0; i < len(xp) && i < len(yp); i++ {
+		xv, xerr := strconv.Atoi(xp[i])
+		yv, yerr := strconv.Atoi(yp[i])
+		switch {
+		case xerr == nil && yerr == nil:
+			if xv != yv {
+				return compareInts(xv, yv), nil
+			}
+		case xerr == nil:
+			return -1, nil // Numeric identifiers are less.
+		case yerr == nil:
+			return 1, nil
+		default:
+			if c := strings.Compare(xp[i], yp[i]); c != 0 {
+				return c, nil
+			}
+		}
+	}
+
+	return compareInts(len(xp), len(yp)), nil
+}
+
+// Parses a version into its numeric components and its pre-release
+// identifiers, if any.
+func parseVersion(v string) ([]int, []string, error) {
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i] // Ignore any build metadata.
+	}
+
+	var pre []string
+	if i := strings.Index(v, "-"); i >= 0 {
+		pre = strings.Split(v[i+1:], ".")
+		for _, p := range pre {
+			if p == "" {
+				return nil, nil, fmt.Errorf("error: invalid version"+
+					" pre-release: %s", v)
+			}
 		}
-		if xv < yv {
-			return false
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("error: invalid version: %s", v)
 		}
+		nums[i] = n
 	}
-	return len(xa) >= len(ya)
+
+	return nums, pre, nil
 }
 
+func compareInts(x, y int) int {
+	if x < y {
+		return -1
+	}
+	if x > y {
+		return 1
+	}
+	return 0
+}
+
+// UUIDGenerator is used by NewUUID() to generate UUIDs, and may be
+// replaced, such as with a deterministic generator for testing or
+// with one that adds a prefix for traceability.
+var UUIDGenerator func() string = RandomUUID
+
+// NewUUID returns a new UUID from the UUIDGenerator.
 func NewUUID() string {
+	return UUIDGenerator()
+}
+
+// RandomUUID returns a random, 16 hex character UUID, and is the
+// default UUIDGenerator.
+func RandomUUID() string {
 	val1 := rand.Int63()
 	val2 := rand.Int63()
 	uuid := fmt.Sprintf("%x%x", val1, val2)
@@ -128,6 +229,38 @@ func StringsIntersectStrings(a, b []string) []string {
 	return rv
 }
 
+var osHostname = os.Hostname
+var netLookupCNAME = net.LookupCNAME
+
+// ResolveHostPort returns a host:port that remote nodes can use to
+// reach a bindAddr.  A non-empty advertiseAddr overrides everything.
+// Otherwise, a bindAddr with a missing or wildcard host (like ":8095"
+// or "0.0.0.0:8095") has its host replaced by this node's hostname,
+// canonicalized to a FQDN when possible.
+func ResolveHostPort(bindAddr, advertiseAddr string) (string, error) {
+	if advertiseAddr != "" {
+		return advertiseAddr, nil
+	}
+	host, port, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return "", fmt.Errorf("error: could not parse bindAddr: %s, err: %v",
+			bindAddr, err)
+	}
+	if host != "" && host != "0.0.0.0" && host != "::" {
+		return bindAddr, nil
+	}
+	hostname, err := osHostname()
+	if err != nil {
+		return "", fmt.Errorf("error: could not get hostname for bindAddr: %s,"+
+			" err: %v", bindAddr, err)
+	}
+	cname, err := netLookupCNAME(hostname)
+	if err == nil && cname != "" {
+		hostname = strings.TrimSuffix(cname, ".")
+	}
+	return net.JoinHostPort(hostname, port), nil
+}
+
 func mustEncode(w io.Writer, i interface{}) {
 	if headered, ok := w.(http.ResponseWriter); ok {
 		headered.Header().Set("Cache-Control", "no-cache")
@@ -12,6 +12,8 @@
 package cbft
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -28,8 +30,29 @@ func TestVersionGTE(t *testing.T) {
 		{"2.0.0", "2.0", true},
 		{"2.0.1", "2.0", true},
 		{"2.0.0", "2.5", false},
-		{"1.0", "1.0.0", false},
-		{"0.0", "0.0.0", false},
+		{"1.0", "1.0.0", true},
+		{"0.0", "0.0.0", true},
+		{"1", "1.0.0", true},
+		{"1.0.0", "1.0.1", false},
+		{"2.5.0", "1.9", true},
+		{"1.10", "1.9", true},
+		{"1.0.0-beta", "1.0.0", false},
+		{"1.0.0", "1.0.0-beta", true},
+		{"1.0.0-beta", "1.0.0-beta", true},
+		{"1.0.0-beta", "1.0.0-alpha", true},
+		{"1.0.0-alpha", "1.0.0-beta", false},
+		{"1.0.0-beta.10", "1.0.0-beta.2", true},
+		{"1.0.0-beta.2", "1.0.0-beta.10", false},
+		{"1.0.0-1", "1.0.0-alpha", false},
+		{"1.0.0-alpha", "1.0.0-alpha.1", false},
+		{"1.0.0-alpha.1", "1.0.0-alpha", true},
+		{"1.0-rc1", "0.9", true},
+		{"1.0.0+build.5", "1.0.0", true},
+		{"1.0.0", "1.0.0+build.5", true},
+		{"1.0.0-", "1.0.0", false},
+		{"1.0.0-a..b", "1.0.0", false},
+		{"1..0", "1.0", false},
+		{"-1", "0", false},
 		{"", "", false},
 		{"0", "", false},
 		{"0.0", "", false},
@@ -59,6 +82,71 @@ func TestNewUUID(t *testing.T) {
 	}
 }
 
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		x        string
+		y        string
+		expected int
+	}{
+		{"1.0", "1.0.0", 0},
+		{"1.0.0+abc", "1.0.0+def", 0},
+		{"1.0.0-rc.1", "1.0.0-rc.1+abc", 0},
+		{"0.9", "1.0.0-alpha", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+	}
+
+	for i, test := range tests {
+		actual, err := VersionCompare(test.x, test.y)
+		if err != nil || actual != test.expected {
+			t.Errorf("test: %d, expected: %d, when comparing %s to %s,"+
+				" got: %d, err: %v", i, test.expected, test.x, test.y,
+				actual, err)
+		}
+	}
+
+	for _, v := range []string{"", "hello", "1.x", "1.0-", "1.0-a..b"} {
+		_, err := VersionCompare(v, "1.0")
+		if err == nil {
+			t.Errorf("expected invalid version: %q to fail", v)
+		}
+	}
+}
+
+func TestUUIDGenerator(t *testing.T) {
+	defer func() { UUIDGenerator = RandomUUID }()
+
+	n := 0
+	UUIDGenerator = func() string {
+		n++
+		return fmt.Sprintf("test-%d", n)
+	}
+
+	if NewUUID() != "test-1" || NewUUID() != "test-2" {
+		t.Errorf("expected NewUUID() to use the UUIDGenerator")
+	}
+
+	cfg := NewCfgMem()
+	mgr := NewManager(VERSION, cfg, NewUUID(), nil, "", 1, ":1000",
+		"", "some-datasource", nil)
+	if mgr.UUID() != "test-3" {
+		t.Errorf("expected manager uuid test-3, got: %s", mgr.UUID())
+	}
+	if NewNodeDefs(VERSION).UUID != "test-4" {
+		t.Errorf("expected nodeDefs uuid test-4")
+	}
+
+	UUIDGenerator = func() string {
+		return "prefix-" + RandomUUID()
+	}
+	if !strings.HasPrefix(NewUUID(), "prefix-") {
+		t.Errorf("expected a prefixed uuid")
+	}
+}
+
 func TestExponentialBackoffLoop(t *testing.T) {
 	called := 0
 	ExponentialBackoffLoop("test", func() int {
@@ -111,3 +199,56 @@ func TestExponentialBackoffLoop(t *testing.T) {
 		t.Errorf("expected 2 calls")
 	}
 }
+
+func TestResolveHostPort(t *testing.T) {
+	osHostnamePrev := osHostname
+	netLookupCNAMEPrev := netLookupCNAME
+	defer func() {
+		osHostname = osHostnamePrev
+		netLookupCNAME = netLookupCNAMEPrev
+	}()
+
+	osHostname = func() (string, error) { return "box", nil }
+	netLookupCNAME = func(host string) (string, error) {
+		return host + ".example.com.", nil
+	}
+
+	tests := []struct {
+		bindAddr      string
+		advertiseAddr string
+		expected      string
+		expectErr     bool
+	}{
+		{":8095", "", "box.example.com:8095", false},
+		{"0.0.0.0:8095", "", "box.example.com:8095", false},
+		{"[::]:8095", "", "box.example.com:8095", false},
+		{"localhost:8095", "", "localhost:8095", false},
+		{"10.1.1.1:8095", "", "10.1.1.1:8095", false},
+		{":8095", "cbft-0:9000", "cbft-0:9000", false},
+		{"not-a-host-port", "", "", true},
+		{"", "", "", true},
+	}
+	for i, test := range tests {
+		actual, err := ResolveHostPort(test.bindAddr, test.advertiseAddr)
+		if (err != nil) != test.expectErr || actual != test.expected {
+			t.Errorf("test %d, bindAddr: %s, advertiseAddr: %s,"+
+				" expected: %s, got: %s, err: %v", i,
+				test.bindAddr, test.advertiseAddr, test.expected, actual, err)
+		}
+	}
+
+	netLookupCNAME = func(host string) (string, error) {
+		return "", fmt.Errorf("no dns")
+	}
+	actual, err := ResolveHostPort(":8095", "")
+	if err != nil || actual != "box:8095" {
+		t.Errorf("expected plain hostname on lookup err, got: %s, err: %v",
+			actual, err)
+	}
+
+	osHostname = func() (string, error) { return "", fmt.Errorf("no hostname") }
+	actual, err = ResolveHostPort(":8095", "")
+	if err == nil || actual != "" {
+		t.Errorf("expected err on hostname err, got: %s", actual)
+	}
+}
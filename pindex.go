@@ -15,8 +15,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/couchbaselabs/clog"
 )
 
 // A PIndex represents a "physical" index or a index "partition".
@@ -36,11 +42,45 @@ type PIndex struct {
 	SourceUUID       string     `json:"sourceUUID"`
 	SourceParams     string     `json:"sourceParams"`
 	SourcePartitions string     `json:"sourcePartitions"`
+	ImplVersion      string     `json:"implVersion"`
 	Path             string     `json:"-"` // Transient, not persisted.
 	Impl             PIndexImpl `json:"-"` // Transient, not persisted.
 	Dest             Dest       `json:"-"` // Transient, not persisted.
 
 	sourcePartitionsArr []string // Non-persisted memoization.
+
+	warming int32 // Non-zero while warming up, via sync/atomic.
+}
+
+// Returns the partitions that the pindex's dest tracks seqs for, and
+// that consistency vectors are keyed by, which are the source
+// partitions, except that a logical partition that groups several
+// vbuckets is expanded into its vbuckets' partitions.  See
+// VBucketPartitions().
+func (p *PIndex) seqPartitions() []string {
+	var rv []string
+	for i, partition := range p.sourcePartitionsArr {
+		if !dcpFeedPartitionIsGroup(partition) {
+			if rv != nil {
+				rv = append(rv, partition)
+			}
+			continue
+		}
+		if rv == nil {
+			rv = append([]string(nil), p.sourcePartitionsArr[:i]...)
+		}
+		rv = append(rv, VBucketPartitions(partition)...)
+	}
+	if rv == nil {
+		return p.sourcePartitionsArr
+	}
+	return rv
+}
+
+// Ready returns false while the pindex is warming up, during which
+// it's not used for reads.  See PIndexImplType.Warmup.
+func (p *PIndex) Ready() bool {
+	return atomic.LoadInt32(&p.warming) == 0
 }
 
 func (p *PIndex) Close(remove bool) error {
@@ -85,6 +125,17 @@ func NewPIndex(mgr *Manager, name, uuid,
 			" path: %s, err: %s", indexType, indexParams, path, err)
 	}
 
+	if dmh, ok := dest.(DestManagerHandler); ok && mgr != nil {
+		dmh.SetManager(mgr)
+	}
+
+	if drh, ok := dest.(DestRollbackHandler); ok && mgr != nil {
+		drh.SetRollbackHandler(func(partition string,
+			rollbackSeq, seqMax uint64) {
+			mgr.rollbackPIndex(pindex, partition, rollbackSeq, seqMax)
+		})
+	}
+
 	pindex = &PIndex{
 		Name:             name,
 		UUID:             uuid,
@@ -97,6 +148,7 @@ func NewPIndex(mgr *Manager, name, uuid,
 		SourceUUID:       sourceUUID,
 		SourceParams:     sourceParams,
 		SourcePartitions: sourcePartitions,
+		ImplVersion:      pindexVersion(mgr),
 		Path:             path,
 		Impl:             impl,
 		Dest:             dest,
@@ -126,15 +178,30 @@ func NewPIndex(mgr *Manager, name, uuid,
 func OpenPIndex(mgr *Manager, path string) (*PIndex, error) {
 	buf, err := ioutil.ReadFile(path + string(os.PathSeparator) + PINDEX_META_FILENAME)
 	if err != nil {
-		return nil, fmt.Errorf("error: could not load PINDEX_META_FILENAME,"+
+		missing := os.IsNotExist(err)
+		err = fmt.Errorf("error: could not load PINDEX_META_FILENAME,"+
 			" path: %s, err: %v", path, err)
+		if missing {
+			return nil, &PIndexCorruptError{Path: path, Err: err}
+		}
+		return nil, err
 	}
 
 	pindex := &PIndex{}
 	err = json.Unmarshal(buf, pindex)
 	if err != nil {
-		return nil, fmt.Errorf("error: could not parse pindex json,"+
-			" path: %s, err: %v", path, err)
+		return nil, &PIndexCorruptError{Path: path,
+			Err: fmt.Errorf("error: could not parse pindex json,"+
+				" path: %s, err: %v", path, err)}
+	}
+
+	// Refuse to open a pindex written by a newer, possibly
+	// incompatible version, such as after a downgrade.  A pindex
+	// without an ImplVersion predates versioning, so is allowed.
+	version := pindexVersion(mgr)
+	if pindex.ImplVersion != "" && !VersionGTE(version, pindex.ImplVersion) {
+		return nil, &PIndexVersionError{Path: path,
+			ImplVersion: pindex.ImplVersion, Version: version}
 	}
 
 	restart := func() {
@@ -146,8 +213,24 @@ func OpenPIndex(mgr *Manager, path string) (*PIndex, error) {
 
 	impl, dest, err := OpenPIndexImpl(pindex.IndexType, path, restart)
 	if err != nil {
-		return nil, fmt.Errorf("error: could not open indexType: %s, path: %s, err: %v",
+		transient := isTransientOpenError(err)
+		err = fmt.Errorf("error: could not open indexType: %s, path: %s, err: %v",
 			pindex.IndexType, path, err)
+		if transient {
+			return nil, err
+		}
+		return nil, &PIndexCorruptError{Path: path, Err: err}
+	}
+
+	if dmh, ok := dest.(DestManagerHandler); ok && mgr != nil {
+		dmh.SetManager(mgr)
+	}
+
+	if drh, ok := dest.(DestRollbackHandler); ok && mgr != nil {
+		drh.SetRollbackHandler(func(partition string,
+			rollbackSeq, seqMax uint64) {
+			mgr.rollbackPIndex(pindex, partition, rollbackSeq, seqMax)
+		})
 	}
 
 	pindex.Path = path
@@ -158,6 +241,65 @@ func OpenPIndex(mgr *Manager, path string) (*PIndex, error) {
 	return pindex, nil
 }
 
+// The error returned by OpenPIndex() for a pindex whose files can't
+// be parsed or opened by its PIndexImplType, such as after a crash or
+// disk corruption, so that retrying the open won't help.
+type PIndexCorruptError struct {
+	Path string
+	Err  error
+}
+
+func (e *PIndexCorruptError) Error() string {
+	return e.Err.Error()
+}
+
+// The error returned by OpenPIndex() for a pindex that was written by
+// a newer, possibly incompatible, version of the software, which a
+// later upgrade could open again.
+type PIndexVersionError struct {
+	Path        string
+	ImplVersion string
+	Version     string
+}
+
+func (e *PIndexVersionError) Error() string {
+	return fmt.Sprintf("error: could not open pindex,"+
+		" pindex.ImplVersion: %s > version: %s, path: %s",
+		e.ImplVersion, e.Version, e.Path)
+}
+
+// Returns true when an error from opening a pindex's files is due to
+// the state of the process or machine, such as running out of file
+// descriptors, rather than due to the files themselves.
+func isTransientOpenError(err error) bool {
+	if os.IsPermission(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch err {
+	case syscall.EMFILE, syscall.ENFILE, syscall.ENOMEM, syscall.ENOSPC,
+		syscall.EAGAIN, syscall.EBUSY, syscall.EINTR:
+		return true
+	}
+	return false
+}
+
+// Returns the software VERSION to record into and check against a
+// pindex's ImplVersion.  The mgr might be nil for testing.
+func pindexVersion(mgr *Manager) string {
+	if mgr != nil && mgr.version != "" {
+		return mgr.version
+	}
+	return VERSION
+}
+
 func PIndexPath(dataDir, pindexName string) string {
 	// TODO: path security checks / mapping here; ex: "../etc/pswd"
 	return dataDir + string(os.PathSeparator) + pindexName + pindexPathSuffix
@@ -183,20 +325,46 @@ type RemotePlanPIndex struct {
 	NodeDef    *NodeDef
 }
 
+// The values of the "queryRouting" manager option, which controls
+// which replica CoveringPIndexes() chooses for a PlanPIndex that
+// several nodes can serve.  QUERY_ROUTING_LOCAL_FIRST, the default,
+// chooses the local pindex when there is one; QUERY_ROUTING_LOCAL_ONLY
+// only chooses local pindexes, failing when a PlanPIndex has none;
+// and QUERY_ROUTING_BALANCED chooses randomly amongst the local and
+// remote replicas, to spread the query load.
+const QUERY_ROUTING_LOCAL_ONLY = "localOnly"
+const QUERY_ROUTING_LOCAL_FIRST = "localFirst"
+const QUERY_ROUTING_BALANCED = "balanced"
+
+// Overridable for testing.
+var queryRoutingIntn = rand.Intn
+
+func (mgr *Manager) queryRouting() string {
+	v := mgr.Options()["queryRouting"]
+	switch v {
+	case "":
+		return QUERY_ROUTING_LOCAL_FIRST
+	case QUERY_ROUTING_LOCAL_ONLY, QUERY_ROUTING_LOCAL_FIRST,
+		QUERY_ROUTING_BALANCED:
+		return v
+	}
+	log.Printf("warning: unknown queryRouting option: %s, using: %s",
+		v, QUERY_ROUTING_LOCAL_FIRST)
+	return QUERY_ROUTING_LOCAL_FIRST
+}
+
 // Returns a non-overlapping, disjoint set (or cut) of PIndexes
 // (either local or remote) that cover all the partitons of an index
 // so that the caller can perform scatter/gather queries, etc.  Only
-// PlanPIndexes on wanted nodes that pass the wantNode filter will be
-// returned.
+// PlanPIndexes on wanted nodes that have the "pindex" tag and that
+// pass the wantNode filter will be returned.  The replica that's
+// chosen for a PlanPIndex depends on the "queryRouting" manager
+// option; see QUERY_ROUTING_LOCAL_FIRST.
 //
 // TODO: Perhaps need a tighter check around indexUUID, as the current
 // implementation might have a race where old pindexes with a matching
 // (but outdated) indexUUID might be chosen.
 //
-// TODO: This implementation currently always favors the local node's
-// pindex, but should it?  Perhaps a remote node is more up-to-date
-// than the local pindex?
-//
 // TODO: We should favor the most up-to-date node rather than
 // the first one that we run into here?  But, perhaps the most
 // up-to-date node is also the most overloaded?  Or, perhaps
@@ -211,8 +379,13 @@ func (mgr *Manager) CoveringPIndexes(indexName, indexUUID string,
 		return nil, nil, fmt.Errorf("could not retrieve wanted nodeDefs, err: %v", err)
 	}
 
-	// Returns true if the node has the "pindex" tag.
+	// Returns true if the node is wanted and has the "pindex" tag, as
+	// a node without the "pindex" tag, like a planner-only or
+	// queryer-only node, holds no data, even if a stale plan says so.
 	nodeDoesPIndexes := func(nodeUUID string) (*NodeDef, bool) {
+		if nodeDefs == nil {
+			return nil, false
+		}
 		for _, nodeDef := range nodeDefs.NodeDefs {
 			if nodeDef.UUID == nodeUUID {
 				if len(nodeDef.Tags) <= 0 {
@@ -243,41 +416,91 @@ func (mgr *Manager) CoveringPIndexes(indexName, indexUUID string,
 
 	_, pindexes := mgr.CurrentMaps()
 
+	// Our own tags are authoritative for ourselves, even if our
+	// wanted nodeDef in the Cfg is outdated.
 	selfUUID := mgr.UUID()
 	_, selfDoesPIndexes := nodeDoesPIndexes(selfUUID)
+	selfDoesPIndexes = selfDoesPIndexes &&
+		(mgr.tagsMap == nil || mgr.tagsMap["pindex"])
+
+	routing := mgr.queryRouting()
 
-build_alias_loop:
 	for _, planPIndex := range planPIndexes {
 		// First check whether this local node serves that planPIndex.
+		var localPIndex *PIndex
 		if selfDoesPIndexes &&
 			wantNode(planPIndex.Nodes[selfUUID]) {
-			localPIndex, exists := pindexes[planPIndex.Name]
+			p, exists := pindexes[planPIndex.Name]
 			if exists &&
-				localPIndex != nil &&
-				localPIndex.Name == planPIndex.Name &&
-				localPIndex.IndexName == indexName &&
-				(indexUUID == "" || localPIndex.IndexUUID == indexUUID) {
-				localPIndexes = append(localPIndexes, localPIndex)
-				continue build_alias_loop
+				p != nil &&
+				p.Name == planPIndex.Name &&
+				p.IndexName == indexName &&
+				p.Ready() &&
+				(indexUUID == "" || p.IndexUUID == indexUUID) {
+				localPIndex = p
 			}
 		}
 
-		// Otherwise, look for a remote node that serves that planPIndex.
+		if localPIndex != nil && routing != QUERY_ROUTING_BALANCED {
+			localPIndexes = append(localPIndexes, localPIndex)
+			continue
+		}
+		if localPIndex == nil && routing == QUERY_ROUTING_LOCAL_ONLY {
+			return nil, nil, fmt.Errorf("no local pindex covers planPIndex,"+
+				" with queryRouting: %s, planPIndex: %#v", routing, planPIndex)
+		}
+
+		// Otherwise, look for the remote nodes that serve that planPIndex.
+		var remotes []*RemotePlanPIndex
 		for nodeUUID, planPIndexNode := range planPIndex.Nodes {
 			if nodeUUID != selfUUID {
 				nodeDef, ok := nodeDoesPIndexes(nodeUUID)
 				if ok && wantNode(planPIndexNode) {
-					remotePlanPIndexes = append(remotePlanPIndexes, &RemotePlanPIndex{
+					remotes = append(remotes, &RemotePlanPIndex{
 						PlanPIndex: planPIndex,
 						NodeDef:    nodeDef,
 					})
-					continue build_alias_loop
+					if routing != QUERY_ROUTING_BALANCED {
+						break
+					}
 				}
 			}
 		}
 
-		return nil, nil, fmt.Errorf("no node covers planPIndex: %#v", planPIndex)
+		n := len(remotes)
+		if localPIndex != nil {
+			n++
+		}
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("no node covers planPIndex: %#v", planPIndex)
+		}
+
+		i := 0
+		if n > 1 {
+			sort.Sort(remotePlanPIndexesByNodeUUID(remotes))
+			i = queryRoutingIntn(n)
+		}
+		if i < len(remotes) {
+			remotePlanPIndexes = append(remotePlanPIndexes, remotes[i])
+		} else {
+			localPIndexes = append(localPIndexes, localPIndex)
+		}
 	}
 
 	return localPIndexes, remotePlanPIndexes, nil
 }
+
+// Sorts remote plan pindexes by their node UUID.
+type remotePlanPIndexesByNodeUUID []*RemotePlanPIndex
+
+func (a remotePlanPIndexesByNodeUUID) Len() int {
+	return len(a)
+}
+
+func (a remotePlanPIndexesByNodeUUID) Less(i, j int) bool {
+	return a[i].NodeDef.UUID < a[j].NodeDef.UUID
+}
+
+func (a remotePlanPIndexesByNodeUUID) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
@@ -14,6 +14,8 @@ package cbft
 import (
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 )
 
 type PIndexImpl interface {
@@ -23,18 +25,117 @@ type PIndexImpl interface {
 type ConsistencyParams struct {
 	// A Level value of "" means stale is ok; "at_plus" means we need
 	// consistency at least at or beyond the consistency vector but
-	// not before.
+	// not before; "as_of" means the query must see exactly the
+	// consistency vector, waiting like "at_plus" for seqs that aren't
+	// applied yet.  As older snapshots aren't retained, "as_of" isn't
+	// time-travel, nor a point-in-time snapshot of the whole index,
+	// but an exact-seq check: it only succeeds while the vector is the
+	// latest applied snapshot of each of the vector's partitions
+	// throughout the query, and otherwise fails with a
+	// SnapshotNotAvailableError, such as for a seq that's older than
+	// the latest applied seq, or that a batch applied past.  The
+	// partitions that aren't in the vector might change during the
+	// query.
 	Level string `json:"level"`
 
 	// Keyed by indexName.
 	Vectors map[string]ConsistencyVector `json:"vectors"`
 
+	// When > 0, bounds in millisecs just the wait for consistency,
+	// separately from the overall query timeout.  A wait that runs
+	// out of time fails with a ConsistencyTimeoutError.
+	Timeout int64 `json:"timeout"`
+
 	// TODO: Can user specify certain partition UUID (like vbucket UUID)?
 }
 
 // Key is partition, value is seq.
 type ConsistencyVector map[string]uint64
 
+// The error used when a consistency wait exceeds its
+// ConsistencyParams.Timeout, which lets callers tell indexing that's
+// lagging apart from a search that's slow.
+type ConsistencyTimeoutError struct {
+	TimeoutMS int64
+}
+
+func (e *ConsistencyTimeoutError) Error() string {
+	return fmt.Sprintf("consistency timeout, timeout: %dms", e.TimeoutMS)
+}
+
+// The error used when an "as_of" consistency level query asks for a
+// partition seq whose snapshot isn't available, which is any seq but
+// the partition's latest applied seq, SeqAvailable.
+type SnapshotNotAvailableError struct {
+	Partition    string
+	Seq          uint64
+	SeqAvailable uint64
+}
+
+func (e *SnapshotNotAvailableError) Error() string {
+	return fmt.Sprintf("snapshot not available, partition: %s, seq: %d,"+
+		" available seq: %d", e.Partition, e.Seq, e.SeqAvailable)
+}
+
+// Returns true for the consistency errors that are returned to
+// clients as-is, so they can tell them apart from other errors.
+func isConsistencyError(err error) bool {
+	switch err.(type) {
+	case *ConsistencyTimeoutError, *SnapshotNotAvailableError:
+		return true
+	}
+	return false
+}
+
+// A QueryBadRequestError wraps the cause of a query that fails due to
+// the request itself, such as a malformed or invalid query, or a query
+// of an index or index alias that doesn't resolve, so that retrying
+// the same request won't help.
+type QueryBadRequestError struct {
+	Err error
+}
+
+func (e *QueryBadRequestError) Error() string {
+	return e.Err.Error()
+}
+
+// A QueryUnavailableError wraps the cause of a query that fails as the
+// index can't serve it right now, such as when its pindexes aren't
+// all planned or reachable, or when the query is cancelled or times
+// out, so that the same request might succeed later.
+type QueryUnavailableError struct {
+	Err error
+}
+
+func (e *QueryUnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+// Returns true for the query errors that have a type, which are
+// returned to callers as-is rather than wrapped in untyped context.
+func isQueryError(err error) bool {
+	switch err.(type) {
+	case *QueryBadRequestError, *QueryUnavailableError, *QueryTooManyError:
+		return true
+	}
+	return isConsistencyError(err)
+}
+
+// QueryErrorStatus returns the HTTP status code for an error from the
+// query path, where an error without a query error type is internal.
+func QueryErrorStatus(err error) int {
+	switch err.(type) {
+	case *QueryBadRequestError:
+		return 400
+	case *QueryTooManyError:
+		return 429
+	case *QueryUnavailableError,
+		*ConsistencyTimeoutError, *SnapshotNotAvailableError:
+		return 503
+	}
+	return 500
+}
+
 // ---------------------------------------------------------------
 
 type PIndexImplType struct {
@@ -49,9 +150,24 @@ type PIndexImplType struct {
 	Count func(mgr *Manager, indexName, indexUUID string) (
 		uint64, error)
 
+	// Optional, counts just the docs that match a query, where the
+	// req has the same format as for Query().
+	CountQuery func(mgr *Manager, indexName, indexUUID string,
+		req []byte) (uint64, error)
+
 	Query func(mgr *Manager, indexName, indexUUID string,
 		req []byte, res io.Writer) error
 
+	// Optional, returns the storage footprint of a single pindex.
+	StorageStats func(pindex *PIndex) (*PIndexStorageStats, error)
+
+	// Optional, returns a func that primes the caches of a pindex
+	// that's being registered, such as after a restart or failover,
+	// or nil when the pindex's index params don't ask for a warmup.
+	// The pindex isn't used for reads by CoveringPIndexes() until the
+	// returned func completes.
+	Warmup func(pindex *PIndex) func() error
+
 	Description string
 	StartSample interface{}
 }
@@ -62,6 +178,19 @@ func RegisterPIndexImplType(indexType string, t *PIndexImplType) {
 	pindexImplTypes[indexType] = t
 }
 
+// ListPIndexImplTypes returns the registered pindex implementation
+// types, keyed by indexType.
+func ListPIndexImplTypes() map[string]*MetaDesc {
+	rv := map[string]*MetaDesc{}
+	for indexType, t := range pindexImplTypes {
+		rv[indexType] = &MetaDesc{
+			Description: t.Description,
+			StartSample: t.StartSample,
+		}
+	}
+	return rv
+}
+
 func NewPIndexImpl(indexType, indexParams, path string, restart func()) (
 	PIndexImpl, Dest, error) {
 	t, exists := pindexImplTypes[indexType]
@@ -98,3 +227,94 @@ func PIndexImplTypeForIndex(cfg Cfg, indexName string) (*PIndexImplType, error)
 	}
 	return pindexImplType, nil
 }
+
+// ---------------------------------------------------------------
+
+// PIndexStorageStats is the storage footprint of a pindex, which
+// operators can use for capacity planning.
+type PIndexStorageStats struct {
+	DocCount  uint64 `json:"docCount"`
+	DiskBytes uint64 `json:"diskBytes"`
+
+	// The durability policy of the pindex's storage, when its pindex
+	// impl type has one, such as "safe" or "fast" for bleve.
+	Durability string `json:"durability,omitempty"`
+}
+
+// Returns the total bytes of the files under a pindex path.  Files
+// or the whole path that are removed during the walk, such as by a
+// concurrent rollback, are just not counted.
+func pindexDiskBytes(path string) (uint64, error) {
+	var rv uint64
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rv += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error: pindexDiskBytes, path: %s, err: %v",
+			path, err)
+	}
+	return rv, nil
+}
+
+// Copies the files under a pindex path into the dstPath, which must
+// not exist, such as to export or import a pindex.  On error, the
+// partial copy is removed.
+func copyPIndexPath(path, dstPath string) error {
+	if _, err := os.Stat(dstPath); err == nil {
+		return fmt.Errorf("error: copyPIndexPath, dstPath already exists: %s",
+			dstPath)
+	}
+
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstPath, rel)
+		if info.IsDir() {
+			return os.MkdirAll(dst, 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyPIndexFile(p, dst)
+	})
+	if err != nil {
+		os.RemoveAll(dstPath)
+	}
+	return err
+}
+
+func copyPIndexFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
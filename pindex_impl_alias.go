@@ -15,9 +15,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"time"
-
-	"github.com/blevesearch/bleve"
+	"sync/atomic"
 )
 
 var maxAliasTargets = 50000
@@ -60,7 +58,10 @@ func ValidateAlias(indexType, indexName, indexParams string) error {
 
 func CountAlias(mgr *Manager, indexName, indexUUID string) (uint64, error) {
 	alias, err := bleveIndexAliasForUserIndexAlias(mgr,
-		indexName, indexUUID, nil, nil)
+		indexName, indexUUID, nil, nil, true)
+	if err == nil {
+		err = bleveSkippedError(alias.skipped)
+	}
 	if err != nil {
 		return 0, fmt.Errorf("CountAlias indexAlias error,"+
 			" indexName: %s, indexUUID: %s, err: %v", indexName, indexUUID, err)
@@ -74,38 +75,93 @@ func QueryAlias(mgr *Manager, indexName, indexUUID string,
 	var bleveQueryParams BleveQueryParams
 	err := json.Unmarshal(req, &bleveQueryParams)
 	if err != nil {
-		return fmt.Errorf("QueryAlias parsing bleveQueryParams, err: %v", err)
+		return &QueryBadRequestError{
+			Err: fmt.Errorf("QueryAlias parsing bleveQueryParams, err: %v", err),
+		}
+	}
+
+	err = bleveQueryParams.Validate()
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	// The hits of an alias don't say which target index, and so
+	// which data source, they're from.
+	if bleveQueryParams.IncludeSource {
+		return &QueryBadRequestError{
+			Err: fmt.Errorf("error: QueryAlias includeSource unsupported,"+
+				" indexName: %s", indexName),
+		}
+	}
+	if bleveQueryParams.IncludeTombstones {
+		return &QueryBadRequestError{
+			Err: fmt.Errorf("error: QueryAlias includeTombstones unsupported,"+
+				" indexName: %s", indexName),
+		}
+	}
+
+	err = bleveQueryParams.prepareIdsOnly(req)
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	err = checkBleveQueryExpansion(mgr, req)
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	err = checkBleveQueryAnalyzers(mgr, indexName, req)
+	if err != nil {
+		return err
 	}
 
-	var cancelCh chan struct{} // TOOD: get cancelCh from caller.
-	if bleveQueryParams.Timeout > 0 {
-		cancelCh = make(chan struct{})
-		go func() {
-			time.Sleep(time.Duration(bleveQueryParams.Timeout) * time.Millisecond)
-			close(cancelCh)
-		}()
+	err = checkBleveQueryFields(mgr, indexName, req)
+	if err != nil {
+		return err
 	}
 
+	// TOOD: get cancelCh from caller.
+	cancelCh, cancelDone := queryTimeoutCancelCh(
+		bleveQueryTimeoutMS(mgr, indexName, bleveQueryParams.Timeout))
+	defer cancelDone()
+
 	alias, err := bleveIndexAliasForUserIndexAlias(mgr, indexName, indexUUID,
-		bleveQueryParams.Consistency, cancelCh)
+		bleveQueryParams.Consistency, cancelCh,
+		!bleveQueryParams.SkipRemoteProbe)
 	if err != nil {
+		if isQueryError(err) {
+			return err
+		}
 		return fmt.Errorf("QueryAlias indexAlias error,"+
 			" indexName: %s, indexUUID: %s, err: %v", indexName, indexUUID, err)
 	}
 
-	err = bleveQueryParams.Query.Query.Validate()
+	err = bleveQueryParams.checkSkipped(alias)
 	if err != nil {
 		return err
 	}
 
-	searchResponse, err := alias.Search(bleveQueryParams.Query)
+	searchResponse, dups, cursor, err := bleveQueryParams.search(mgr, alias)
 	if err != nil {
 		return err
 	}
+	if dups > 0 {
+		atomic.AddUint64(&mgr.stats.TotQueryDuplicateHit, uint64(dups))
+	}
+
+	if bleveQueryParams.IdsOnly {
+		return encodeBleveSearchResultIds(res, searchResponse)
+	}
 
-	mustEncode(res, searchResponse)
+	extras := map[string]interface{}{}
+	if bleveQueryParams.scrolling() {
+		extras["cursor"] = cursor
+	}
+	if len(alias.skipped) > 0 {
+		extras["skipped"] = alias.skipped
+	}
 
-	return nil
+	return encodeBleveSearchResult(res, searchResponse, extras, nil)
 }
 
 // The indexName/indexUUID is for a user-defined index alias.
@@ -113,9 +169,9 @@ func QueryAlias(mgr *Manager, indexName, indexUUID string,
 // TODO: One day support user-defined aliases for non-bleve indexes.
 func bleveIndexAliasForUserIndexAlias(mgr *Manager,
 	indexName, indexUUID string, consistencyParams *ConsistencyParams,
-	cancelCh chan struct{}) (
-	bleve.IndexAlias, error) {
-	alias := bleve.NewIndexAlias()
+	cancelCh chan struct{}, probeRemote bool) (
+	*bleveFanOut, error) {
+	alias := newBleveFanOut()
 
 	indexDefs, _, err := CfgGetIndexDefs(mgr.cfg)
 	if err != nil {
@@ -125,21 +181,26 @@ func bleveIndexAliasForUserIndexAlias(mgr *Manager,
 
 	num := 0
 
+	// The errors of an alias that doesn't resolve to its targets.
+	badAlias := func(format string, args ...interface{}) error {
+		return &QueryBadRequestError{Err: fmt.Errorf(format, args...)}
+	}
+
 	var fillAlias func(aliasName, aliasUUID string) error
 
 	fillAlias = func(aliasName, aliasUUID string) error {
 		aliasDef := indexDefs.IndexDefs[aliasName]
 		if aliasDef == nil {
-			return fmt.Errorf("could not get aliasDef, aliasName: %s, indexName: %s",
+			return badAlias("could not get aliasDef, aliasName: %s, indexName: %s",
 				aliasName, indexName)
 		}
 		if aliasDef.Type != "alias" {
-			return fmt.Errorf("not alias type: %s, aliasName: %s, indexName: %s",
+			return badAlias("not alias type: %s, aliasName: %s, indexName: %s",
 				aliasDef.Type, aliasName, indexName)
 		}
 		if aliasUUID != "" &&
 			aliasUUID != aliasDef.UUID {
-			return fmt.Errorf("mismatched aliasUUID: %s, aliasDef.UUID: %s,"+
+			return badAlias("mismatched aliasUUID: %s, aliasDef.UUID: %s,"+
 				" aliasName: %s, indexName: %s", aliasUUID, aliasDef.UUID,
 				aliasName, indexName)
 		}
@@ -147,24 +208,24 @@ func bleveIndexAliasForUserIndexAlias(mgr *Manager,
 		params := AliasParams{}
 		err := json.Unmarshal([]byte(aliasDef.Params), &params)
 		if err != nil {
-			return fmt.Errorf("could not parse aliasDef.Params: %s, aliasName: %s,"+
+			return badAlias("could not parse aliasDef.Params: %s, aliasName: %s,"+
 				" indexName: %s", aliasDef.Params, aliasName, indexName)
 		}
 
 		for targetName, targetSpec := range params.Targets {
 			if num > maxAliasTargets {
-				return fmt.Errorf("too many alias targets,"+
+				return badAlias("too many alias targets,"+
 					" perhaps there's a cycle, aliasName: %s, indexName: %s",
 					aliasName, indexName)
 			}
 			targetDef := indexDefs.IndexDefs[targetName]
 			if targetDef == nil {
-				return fmt.Errorf("no indexDef for targetName: %s, aliasName: %s,"+
+				return badAlias("no indexDef for targetName: %s, aliasName: %s,"+
 					" indexName: %s", targetName, aliasName, indexName)
 			}
 			if targetSpec.IndexUUID != "" &&
 				targetSpec.IndexUUID != targetDef.UUID {
-				return fmt.Errorf("mismatched targetSpec.UUID: %s, targetDef.UUID: %s,"+
+				return badAlias("mismatched targetSpec.UUID: %s, targetDef.UUID: %s,"+
 					" targetName: %s, aliasName: %s, indexName: %s",
 					targetSpec.IndexUUID, targetDef.UUID, targetName, aliasName, indexName)
 			}
@@ -177,8 +238,12 @@ func bleveIndexAliasForUserIndexAlias(mgr *Manager,
 				}
 			} else if targetDef.Type == "bleve" {
 				subAlias, err := bleveIndexAlias(mgr, targetName,
-					targetSpec.IndexUUID, consistencyParams, cancelCh)
+					targetSpec.IndexUUID, consistencyParams, cancelCh,
+					probeRemote, false, nil)
 				if err != nil {
+					if isQueryError(err) {
+						return err
+					}
 					return fmt.Errorf("bleveIndexAlias, indexName: %s,"+
 						" targetName: %s, targetSpec: %#v, err: %v",
 						indexName, targetName, targetSpec, err)
@@ -186,7 +251,7 @@ func bleveIndexAliasForUserIndexAlias(mgr *Manager,
 				alias.Add(subAlias)
 				num += 1
 			} else {
-				return fmt.Errorf("unsupported alias target type: %s,"+
+				return badAlias("unsupported alias target type: %s,"+
 					" targetName: %s, aliasName: %s, indexName: %s",
 					targetDef.Type, targetName, aliasName, indexName)
 			}
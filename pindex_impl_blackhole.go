@@ -16,6 +16,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 func init() {
@@ -30,7 +32,7 @@ func init() {
 			return fmt.Errorf("blackhole is unqueryable")
 		},
 		Description: "blackhole - ignores all incoming data" +
-			" and is not queryable; used for testing",
+			" and is not queryable; used for testing and benchmarking",
 	})
 }
 
@@ -47,7 +49,7 @@ func NewBlackHolePIndexImpl(indexType, indexParams, path string, restart func())
 		return nil, nil, err
 	}
 
-	dest := &BlackHole{path: path}
+	dest := NewBlackHole(path)
 	return dest, dest, nil
 }
 
@@ -61,15 +63,72 @@ func OpenBlackHolePIndexImpl(indexType, path string, restart func()) (
 		return nil, nil, fmt.Errorf("expected black.hole to be empty")
 	}
 
-	dest := &BlackHole{path: path}
+	dest := NewBlackHole(path)
 	return dest, dest, nil
 }
 
 // ---------------------------------------------------------
 
-// Implements both Dest and PIndexImpl interfaces.
+// Implements both Dest and PIndexImpl interfaces.  A BlackHole
+// doesn't store any data, but it counts the incoming data and
+// remembers each partition's seqMax and opaque in memory, so that a
+// feed can restart correctly, which is useful for benchmarking feed
+// throughput independent of any indexing cost.
 type BlackHole struct {
 	path string
+
+	numUpdate        uint64 // Accessed via atomic.
+	numDelete        uint64 // Accessed via atomic.
+	numSnapshotStart uint64 // Accessed via atomic.
+
+	m          sync.Mutex
+	partitions map[string]*blackHolePartition
+}
+
+type blackHolePartition struct {
+	seqMax uint64
+	opaque []byte
+}
+
+// BlackHoleStats holds the counts of data received by a BlackHole.
+type BlackHoleStats struct {
+	NumUpdate        uint64 `json:"numUpdate"`
+	NumDelete        uint64 `json:"numDelete"`
+	NumSnapshotStart uint64 `json:"numSnapshotStart"`
+}
+
+func NewBlackHole(path string) *BlackHole {
+	return &BlackHole{
+		path:       path,
+		partitions: map[string]*blackHolePartition{},
+	}
+}
+
+func (t *BlackHole) Stats() BlackHoleStats {
+	return BlackHoleStats{
+		NumUpdate:        atomic.LoadUint64(&t.numUpdate),
+		NumDelete:        atomic.LoadUint64(&t.numDelete),
+		NumSnapshotStart: atomic.LoadUint64(&t.numSnapshotStart),
+	}
+}
+
+// Returns the partition, which must be accessed with t.m locked.
+func (t *BlackHole) partitionUnlocked(partition string) *blackHolePartition {
+	bhp := t.partitions[partition]
+	if bhp == nil {
+		bhp = &blackHolePartition{}
+		t.partitions[partition] = bhp
+	}
+	return bhp
+}
+
+func (t *BlackHole) updateSeq(partition string, seq uint64) {
+	t.m.Lock()
+	bhp := t.partitionUnlocked(partition)
+	if bhp.seqMax < seq {
+		bhp.seqMax = seq
+	}
+	t.m.Unlock()
 }
 
 func (t *BlackHole) Close() error {
@@ -78,29 +137,50 @@ func (t *BlackHole) Close() error {
 
 func (t *BlackHole) OnDataUpdate(partition string,
 	key []byte, seq uint64, val []byte) error {
+	atomic.AddUint64(&t.numUpdate, 1)
+	t.updateSeq(partition, seq)
 	return nil
 }
 
 func (t *BlackHole) OnDataDelete(partition string,
 	key []byte, seq uint64) error {
+	atomic.AddUint64(&t.numDelete, 1)
+	t.updateSeq(partition, seq)
 	return nil
 }
 
 func (t *BlackHole) OnSnapshotStart(partition string,
 	snapStart, snapEnd uint64) error {
+	atomic.AddUint64(&t.numSnapshotStart, 1)
 	return nil
 }
 
 func (t *BlackHole) SetOpaque(partition string, value []byte) error {
+	t.m.Lock()
+	t.partitionUnlocked(partition).opaque = append([]byte(nil), value...)
+	t.m.Unlock()
 	return nil
 }
 
 func (t *BlackHole) GetOpaque(partition string) (
 	value []byte, lastSeq uint64, err error) {
-	return nil, 0, nil
+	t.m.Lock()
+	defer t.m.Unlock()
+	bhp := t.partitions[partition]
+	if bhp == nil {
+		return nil, 0, nil
+	}
+	return bhp.opaque, bhp.seqMax, nil
 }
 
 func (t *BlackHole) Rollback(partition string, rollbackSeq uint64) error {
+	t.m.Lock()
+	bhp := t.partitions[partition]
+	if bhp != nil && bhp.seqMax > rollbackSeq {
+		// There's no data to roll back, so just restart from zero.
+		delete(t.partitions, partition)
+	}
+	t.m.Unlock()
 	return nil
 }
 
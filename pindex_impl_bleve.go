@@ -12,16 +12,30 @@
 package cbft
 
 import (
+	"bytes"
 	"container/heap"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
 
 	log "github.com/couchbaselabs/clog"
 )
@@ -35,730 +49,5009 @@ func init() {
 		Count: CountBlevePIndexImpl,
 		Query: QueryBlevePIndexImpl,
 
+		CountQuery:   CountQueryBlevePIndexImpl,
+		StorageStats: StorageStatsBlevePIndexImpl,
+		Warmup:       WarmupBlevePIndexImpl,
+
 		Description: "bleve - full-text index powered by the bleve full-text-search engine",
 		StartSample: bleve.NewIndexMapping(),
 	})
 }
 
-func ValidateBlevePIndexImpl(indexType, indexName, indexParams string) error {
-	bindexMapping := bleve.NewIndexMapping()
-	if len(indexParams) > 0 {
-		return json.Unmarshal([]byte(indexParams), &bindexMapping)
-	}
-	return nil
+// BleveIndexParams are optional, cbft-specific params that may be
+// provided alongside the bleve index mapping in a bleve index's
+// params JSON, and are removed before the mapping is parsed.
+type BleveIndexParams struct {
+	// Default query timeout in millisecs for queries that don't
+	// provide their own timeout.  When 0, the Manager's
+	// "queryTimeoutMS" option is used.
+	QueryTimeout int64 `json:"queryTimeout"`
+
+	// When true, mutations are only applied to the bleve index at
+	// snapshot boundaries, so queries never see a partially applied
+	// snapshot.  The tradeoff is higher indexing latency, as nothing
+	// from a snapshot becomes visible until its last mutation
+	// arrives, and more memory, as the pending batch grows up to
+	// BLEVE_DEST_SNAPSHOT_ATOMIC_BUF_SIZE_BYTES before it's applied
+	// anyway.
+	SnapshotAtomic bool `json:"snapshotAtomic"`
+
+	// When > 0, a partition forces a batch apply this many millisecs
+	// after an at_plus consistency waiter's seq has been received but
+	// not yet applied, rather than waiting for the snapshot end, which
+	// bounds consistency wait latency.  The delay also coalesces the
+	// forced applies of many waiters.  When 0, there are no forced
+	// applies.
+	ForceFlushMS int64 `json:"forceFlushMS"`
+
+	// Name of a registered BleveDocIdTransform that's applied to
+	// source document keys before indexing and deleting, where ""
+	// means the keys are used as-is.  See RegisterBleveDocIdTransform().
+	DocIdTransform string `json:"docIdTransform"`
+
+	// Name of a registered BleveDocTransform that preprocesses source
+	// document values before indexing, where "" means the values are
+	// indexed as-is.  See RegisterBleveDocTransform().
+	DocTransform string `json:"docTransform"`
+
+	// When > 0, a deletion, including an expiration, indexes a small
+	// tombstone document with a BLEVE_DEST_TOMBSTONE_FIELD timestamp
+	// in place of the deleted document, so that recently deleted keys
+	// can be queried with the includeTombstones query param.  Other
+	// queries and doc counts exclude the tombstones.  Tombstones older
+	// than this many millisecs are purged in the background.  See
+	// BleveDest.PurgeTombstones().
+	TombstoneTTL int64 `json:"tombstoneTTL"`
+
+	// When non-empty, names a top-level field of JSON documents whose
+	// string value, such as "en" or "fr", is looked up in
+	// LanguageMappings to choose the bleve type mapping, and so the
+	// analyzers, that a document is indexed with.  Documents with a
+	// missing or unknown language use the index mapping's defaults.
+	LanguageField string `json:"languageField"`
+
+	// Maps a LanguageField value to the name of a type mapping in the
+	// index mapping's "types".
+	LanguageMappings map[string]string `json:"languageMappings"`
+
+	// When non-empty, only the JSON documents that match the filter
+	// are indexed, and a document that stops matching is removed.
+	// See BleveDocFilter.
+	DocFilter BleveDocFilter `json:"docFilter"`
+
+	// When true, a pindex primes its caches before it serves reads,
+	// by iterating all the rows of its bleve index and then running
+	// the WarmupQuery, if any, which is in bleve's query string
+	// syntax.  See BleveDest.Warmup().
+	Warmup      bool   `json:"warmup"`
+	WarmupQuery string `json:"warmupQuery"`
+
+	// When true, each partition of a pindex has its own bleve index,
+	// in a subdirectory of the pindex's path, and queries fan out
+	// across them, so that a rollback of a partition only rebuilds
+	// that partition's index instead of the whole pindex.  The
+	// tradeoff is more files and slower queries for pindexes with
+	// many partitions.
+	PartitionIndexes bool `json:"partitionIndexes"`
+
+	// Either BLEVE_DURABILITY_SAFE, the default when "", where every
+	// applied batch is fsync'ed before it's acknowledged, or
+	// BLEVE_DURABILITY_FAST, where applied batches are only fsync'ed
+	// every BleveDestSyncMS, for higher indexing throughput.  With
+	// "fast", a process crash loses nothing, but an OS crash or power
+	// loss can lose the batches applied since the last fsync, which
+	// the feed then restreams, or in the worst case can corrupt the
+	// index, which then needs a rebuild.
+	Durability string `json:"durability"`
+
+	// When non-empty, queries may only reference these fields, such
+	// as "name" or "address.city", where a field also permits its
+	// nested fields.  Query terms without a field search the default
+	// "_all" field, which must be allowed for such queries to work.
+	QueryAllowFields []string `json:"queryAllowFields"`
+
+	// Queries that reference these fields, or their nested fields,
+	// are rejected, such as to hide internal fields from end-users.
+	QueryDenyFields []string `json:"queryDenyFields"`
+
+	// Either "", where document keys are used as-is, or
+	// BLEVE_KEY_ENCODING_BASE64 or BLEVE_KEY_ENCODING_HEX, where keys
+	// that aren't valid UTF-8, such as from binary-keyed buckets, are
+	// encoded into document IDs (see BleveEncodeKey), so that hit IDs
+	// serialize cleanly as JSON.
+	KeyEncoding string `json:"keyEncoding"`
+
+	// When > 0, the max size in bytes of a source document value that
+	// is indexed.  Larger documents are skipped, and counted, rather
+	// than indexed, and any previously indexed version is removed, so
+	// that a pathologically large document can't bloat memory or slow
+	// indexing.  When 0, document sizes are unlimited.
+	MaxDocSize int `json:"maxDocSize"`
 }
 
-func NewBlevePIndexImpl(indexType, indexParams, path string, restart func()) (
-	PIndexImpl, Dest, error) {
-	bindexMapping := bleve.NewIndexMapping()
-	if len(indexParams) > 0 {
-		err := json.Unmarshal([]byte(indexParams), &bindexMapping)
-		if err != nil {
-			return nil, nil, fmt.Errorf("error: parse bleve index mapping: %v", err)
-		}
-	}
-
-	bindex, err := bleve.New(path, bindexMapping)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error: new bleve index, path: %s, err: %s",
-			path, err)
-	}
-
-	return bindex, NewBleveDest(path, bindex, restart), err
-}
+const BLEVE_DURABILITY_SAFE = "safe"
+const BLEVE_DURABILITY_FAST = "fast"
 
-func OpenBlevePIndexImpl(indexType, path string, restart func()) (PIndexImpl, Dest, error) {
-	// TODO: boltdb sometimes locks on Open(), so need to investigate,
-	// where perhaps there was a previous missing or race-y Close().
-	bindex, err := bleve.Open(path)
-	if err != nil {
-		return nil, nil, err
+func validateBleveDurability(durability string) error {
+	if durability != "" &&
+		durability != BLEVE_DURABILITY_SAFE &&
+		durability != BLEVE_DURABILITY_FAST {
+		return fmt.Errorf("error: unknown durability: %s", durability)
 	}
-
-	return bindex, NewBleveDest(path, bindex, restart), err
+	return nil
 }
 
-func CountBlevePIndexImpl(mgr *Manager, indexName, indexUUID string) (uint64, error) {
-	alias, err := bleveIndexAlias(mgr, indexName, indexUUID, nil, nil)
-	if err != nil {
-		return 0, fmt.Errorf("CountBlevePIndexImpl indexAlias error,"+
-			" indexName: %s, indexUUID: %s, err: %v", indexName, indexUUID, err)
+// Returns a new bleve index that's stored per the durability policy,
+// where "fast" turns off boltdb's fsync of each commit, leaving the
+// fsync'ing to BleveDest.runStoreSyncer().
+func newBleveIndex(path string, bindexMapping *bleve.IndexMapping,
+	durability string) (bleve.Index, error) {
+	if durability == BLEVE_DURABILITY_FAST {
+		return bleve.NewUsing(path, bindexMapping, "boltdb",
+			map[string]interface{}{"nosync": true})
 	}
-
-	return alias.DocCount()
+	return bleve.New(path, bindexMapping)
 }
 
-type BleveQueryParams struct {
-	Query       *bleve.SearchRequest `json:"query"`
-	Consistency *ConsistencyParams   `json:"consistency"`
-	Timeout     int64                `json:"timeout"`
-}
+const BLEVE_KEY_ENCODING_BASE64 = "base64"
+const BLEVE_KEY_ENCODING_HEX = "hex"
 
-func QueryBlevePIndexImpl(mgr *Manager, indexName, indexUUID string,
-	req []byte, res io.Writer) error {
-	var bleveQueryParams BleveQueryParams
-	err := json.Unmarshal(req, &bleveQueryParams)
-	if err != nil {
-		return fmt.Errorf("QueryBlevePIndexImpl parsing bleveQueryParams,"+
-			" req: %s, err: %v", req, err)
+func validateBleveKeyEncoding(keyEncoding string) error {
+	if keyEncoding != "" &&
+		keyEncoding != BLEVE_KEY_ENCODING_BASE64 &&
+		keyEncoding != BLEVE_KEY_ENCODING_HEX {
+		return fmt.Errorf("error: unknown keyEncoding: %s", keyEncoding)
 	}
+	return nil
+}
 
-	var cancelCh chan struct{} // TOOD: get cancelCh from caller.
-	if bleveQueryParams.Timeout > 0 {
-		cancelCh = make(chan struct{})
-		go func() {
-			time.Sleep(time.Duration(bleveQueryParams.Timeout) * time.Millisecond)
-			close(cancelCh)
-		}()
+// BleveEncodeKey returns the document ID of a source document key
+// per the keyEncoding.  A key that isn't valid UTF-8 is encoded with
+// a "<keyEncoding>:" prefix, such as "base64:/w==", as is a key that
+// already has that prefix, so that decoding is unambiguous.  Other
+// keys, and all keys when the keyEncoding is "", are used as-is.
+func BleveEncodeKey(keyEncoding string, key []byte) string {
+	prefix := keyEncoding + ":"
+	if keyEncoding == "" ||
+		(utf8.Valid(key) && !bytes.HasPrefix(key, []byte(prefix))) {
+		return string(key)
 	}
-
-	alias, err := bleveIndexAlias(mgr, indexName, indexUUID,
-		bleveQueryParams.Consistency, cancelCh)
-	if err != nil {
-		return fmt.Errorf("QueryBlevePIndexImpl indexAlias error,"+
-			" indexName: %s, indexUUID: %s, err: %v", indexName, indexUUID, err)
+	if keyEncoding == BLEVE_KEY_ENCODING_HEX {
+		return prefix + hex.EncodeToString(key)
 	}
+	return prefix + base64.StdEncoding.EncodeToString(key)
+}
 
-	err = bleveQueryParams.Query.Query.Validate()
-	if err != nil {
-		return err
+// BleveDecodeKey returns the source document key of a document ID
+// that was produced by BleveEncodeKey.
+func BleveDecodeKey(keyEncoding string, docId string) ([]byte, error) {
+	prefix := keyEncoding + ":"
+	if keyEncoding == "" || !strings.HasPrefix(docId, prefix) {
+		return []byte(docId), nil
 	}
-
-	searchResponse, err := alias.Search(bleveQueryParams.Query)
-	if err != nil {
-		return err
+	if keyEncoding == BLEVE_KEY_ENCODING_HEX {
+		return hex.DecodeString(docId[len(prefix):])
 	}
-
-	mustEncode(res, searchResponse)
-
-	return nil
+	return base64.StdEncoding.DecodeString(docId[len(prefix):])
 }
 
-// ---------------------------------------------------------
-
-const BLEVE_DEST_INITIAL_BUF_SIZE_BYTES = 20000
-const BLEVE_DEST_APPLY_BUF_SIZE_BYTES = 200000
-
-type BleveDest struct {
-	path    string
-	restart func() // Invoked when caller should restart this BleveDest, like on rollback.
+// A BleveDocIdTransform maps a source document key, received for a
+// partition, to the document ID that's used in the bleve index.
+type BleveDocIdTransform func(partition string, key []byte) string
 
-	m          sync.Mutex // Protects the fields that follow.
-	bindex     bleve.Index
-	partitions map[string]*BleveDestPartition
+// Doc id transforms, keyed by name, where a nil transform means the
+// identity transform.
+var bleveDocIdTransforms = map[string]BleveDocIdTransform{
+	"":                nil,
+	"identity":        nil,
+	"namespacePrefix": bleveDocIdNamespacePrefix,
 }
 
-// Used to track state for a single partition.
-type BleveDestPartition struct {
-	partition       string
-	partitionOpaque string // Key used to implement SetOpaque/GetOpaque().
-
-	m           sync.Mutex   // Protects the fields that follow.
-	seqMax      uint64       // Max seq # we've seen for this partition.
-	seqMaxBuf   []byte       // For binary encoded seqMax uint64.
-	seqMaxBatch uint64       // Max seq # that got through batch apply/commit.
-	seqSnapEnd  uint64       // To track snapshot end seq # for this partition.
-	buf         []byte       // The batch points to slices from buf, which we reuse.
-	batch       *bleve.Batch // Batch is applied when too big or when we hit seqSnapEnd.
-
-	lastOpaque []byte // Cache most recent value for SetOpaque()/GetOpaque().
-
-	cwrCh    chan *consistencyWaitReq
-	cwrQueue cwrQueue
+// RegisterBleveDocIdTransform makes a doc id transform available to
+// the docIdTransform bleve index param, and should be invoked during
+// process initialization.
+func RegisterBleveDocIdTransform(name string, f BleveDocIdTransform) {
+	bleveDocIdTransforms[name] = f
 }
 
-type consistencyWaitReq struct {
-	consistencyLevel string
-	consistencySeq   uint64
-	cancelCh         chan struct{}
-	doneCh           chan error
+// A BleveDocIdInverse maps a document ID back to the source document
+// key that a BleveDocIdTransform transformed, and to the namespace of
+// the key's partition, if the document ID tells, such as the bucket
+// name of a multi-bucket source.  The namespaces are those of the
+// source, which are nil for a source whose partitions aren't
+// namespaced.  It returns false for a document ID that it can't map
+// back.
+type BleveDocIdInverse func(docId string, namespaces []string) (
+	namespace string, key []byte, ok bool)
+
+// Doc id transform inverses, keyed by the name of their doc id
+// transform, where a nil inverse means the identity inverse.
+var bleveDocIdInverses = map[string]BleveDocIdInverse{
+	"":                nil,
+	"identity":        nil,
+	"namespacePrefix": bleveDocIdNamespacePrefixInverse,
 }
 
-// ---------------------------------------------------------
-
-// A cwrQueue implements heap.Interface for consistencyWaitReq's.
-type cwrQueue []*consistencyWaitReq
-
-func (pq cwrQueue) Len() int { return len(pq) }
-
-func (pq cwrQueue) Less(i, j int) bool {
-	return pq[i].consistencySeq < pq[j].consistencySeq
+// RegisterBleveDocIdInverse makes the inverse of a registered doc id
+// transform available, such as for the includeSource query param,
+// and should be invoked during process initialization.
+func RegisterBleveDocIdInverse(name string, f BleveDocIdInverse) {
+	bleveDocIdInverses[name] = f
 }
 
-func (pq cwrQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
+func bleveDocIdInverse(name string) (BleveDocIdInverse, error) {
+	f, exists := bleveDocIdInverses[name]
+	if !exists {
+		return nil, fmt.Errorf("error: no inverse for docIdTransform: %s", name)
+	}
+	return f, nil
 }
 
-func (pq *cwrQueue) Push(x interface{}) {
-	*pq = append(*pq, x.(*consistencyWaitReq))
+func bleveDocIdTransform(name string) (BleveDocIdTransform, error) {
+	f, exists := bleveDocIdTransforms[name]
+	if !exists {
+		return nil, fmt.Errorf("error: unknown docIdTransform: %s", name)
+	}
+	return f, nil
 }
 
-func (pq *cwrQueue) Pop() interface{} {
-	old := *pq
-	n := len(old)
-	item := old[n-1]
-	*pq = old[0 : n-1]
-	return item
+// A BleveDocTransform preprocesses a source document value, such as
+// to decompress it or to extract a nested field, returning what's to
+// be indexed: either JSON bytes or a parsed document.  A nil result
+// means the document is skipped, where any previously indexed version
+// of the document is deleted.  The val is only valid until the
+// pending batch is applied, which also holds for any result that
+// references it.
+type BleveDocTransform func(partition string, key, val []byte) (
+	interface{}, error)
+
+// Doc transforms, keyed by name, where a nil transform means the
+// passthrough transform.
+var bleveDocTransforms = map[string]BleveDocTransform{
+	"":            nil,
+	"passthrough": nil,
 }
 
-// ---------------------------------------------------------
+// RegisterBleveDocTransform makes a doc transform available to the
+// docTransform bleve index param, and should be invoked during process
+// initialization.
+func RegisterBleveDocTransform(name string, f BleveDocTransform) {
+	bleveDocTransforms[name] = f
+}
 
-func NewBleveDest(path string, bindex bleve.Index, restart func()) Dest {
-	return &BleveDest{
-		path:       path,
-		restart:    restart,
-		bindex:     bindex,
-		partitions: make(map[string]*BleveDestPartition),
+func bleveDocTransform(name string) (BleveDocTransform, error) {
+	f, exists := bleveDocTransforms[name]
+	if !exists {
+		return nil, fmt.Errorf("error: unknown docTransform: %s", name)
 	}
+	return f, nil
 }
 
-func (t *BleveDest) getPartition(partition string) (
-	*BleveDestPartition, bleve.Index, error) {
-	t.m.Lock()
-	defer t.m.Unlock()
-
-	return t.getPartitionUnlocked(partition)
+// A BleveDocFilter maps document field paths, where nested fields are
+// separated by ".", to the value that a matching document must have,
+// such as {"type":"product"}.  A filter value that's an array matches
+// any of its elements.  A document matches when every field matches.
+type BleveDocFilter map[string]interface{}
+
+// Checks that the filter values are strings, numbers, bools or null,
+// or arrays of them.
+func (f BleveDocFilter) Validate() error {
+	for field, v := range f {
+		vs, ok := v.([]interface{})
+		if !ok {
+			vs = []interface{}{v}
+		}
+		for _, v := range vs {
+			switch v.(type) {
+			case string, float64, bool, nil:
+			default:
+				return fmt.Errorf("error: docFilter, field: %s,"+
+					" unsupported value: %v", field, v)
+			}
+		}
+	}
+	return nil
 }
 
-func (t *BleveDest) getPartitionUnlocked(partition string) (
-	*BleveDestPartition, bleve.Index, error) {
-	if t.bindex == nil {
-		return nil, nil, fmt.Errorf("BleveDest already closed")
+func (f BleveDocFilter) Matches(doc map[string]interface{}) bool {
+	for field, expected := range f {
+		actual, exists := bleveDocField(doc, field)
+		if !exists {
+			return false
+		}
+		expecteds, ok := expected.([]interface{})
+		if !ok {
+			expecteds = []interface{}{expected}
+		}
+		found := false
+		for _, e := range expecteds {
+			if e == actual {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
 	}
+	return true
+}
 
-	bdp, exists := t.partitions[partition]
-	if !exists || bdp == nil {
-		bdp = &BleveDestPartition{
-			partition:       partition,
-			partitionOpaque: "o:" + partition,
-			seqMaxBuf:       make([]byte, 8), // Binary encoded seqMax uint64.
-			batch:           bleve.NewBatch(),
-			cwrCh:           make(chan *consistencyWaitReq, 1),
-			cwrQueue:        cwrQueue{},
+// Returns the value of a "." separated field path of a JSON document.
+func bleveDocField(doc map[string]interface{}, path string) (
+	interface{}, bool) {
+	var v interface{} = doc
+	for _, field := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = m[field]
+		if !ok {
+			return nil, false
 		}
-		heap.Init(&bdp.cwrQueue)
-
-		go bdp.run()
-
-		t.partitions[partition] = bdp
 	}
-
-	return bdp, t.bindex, nil
+	return v, true
 }
 
-func (t *BleveDest) Close() error {
-	t.m.Lock()
-	defer t.m.Unlock()
-
-	return t.closeUnlocked()
+// Prefixes a key with the namespace of its partition, if any, such as
+// the bucket name of a multi-bucket source, so that the same key from
+// different buckets is indexed as different documents.
+func bleveDocIdNamespacePrefix(partition string, key []byte) string {
+	namespace, _ := SplitNamespacedPartition(partition)
+	return NamespacedPartition(namespace, string(key))
 }
 
-func (t *BleveDest) closeUnlocked() error {
-	if t.bindex == nil {
-		return fmt.Errorf("BleveDest already closed")
+func bleveDocIdNamespacePrefixInverse(docId string, namespaces []string) (
+	string, []byte, bool) {
+	if len(namespaces) <= 0 {
+		return "", []byte(docId), true
+	}
+	for _, namespace := range namespaces {
+		prefix := NamespacedPartition(namespace, "")
+		if strings.HasPrefix(docId, prefix) {
+			return namespace, []byte(docId[len(prefix):]), true
+		}
 	}
+	return "", nil, false
+}
 
-	for _, bdp := range t.partitions {
-		close(bdp.cwrCh)
+// Parses the BleveIndexParams from a bleve index's params JSON, also
+// returning the remaining bleve index mapping JSON.
+func ParseBleveIndexParams(indexParams string) (
+	*BleveIndexParams, string, error) {
+	bip := &BleveIndexParams{}
+	if len(indexParams) <= 0 {
+		return bip, indexParams, nil
 	}
-	t.partitions = make(map[string]*BleveDestPartition)
 
-	err := t.bindex.Close()
+	m := map[string]json.RawMessage{}
+	err := json.Unmarshal([]byte(indexParams), &m)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	t.bindex = nil
+	found := false
+	for key, dst := range map[string]interface{}{
+		"queryTimeout":   &bip.QueryTimeout,
+		"snapshotAtomic": &bip.SnapshotAtomic,
+		"forceFlushMS":   &bip.ForceFlushMS,
+		"docIdTransform": &bip.DocIdTransform,
+		"docTransform":   &bip.DocTransform,
+		"tombstoneTTL":   &bip.TombstoneTTL,
 
-	return nil
-}
+		"languageField":    &bip.LanguageField,
+		"languageMappings": &bip.LanguageMappings,
 
-// ---------------------------------------------------------
+		"docFilter": &bip.DocFilter,
 
-func (t *BleveDest) OnDataUpdate(partition string,
-	key []byte, seq uint64, val []byte) error {
-	log.Printf("bleve dest update, partition: %s, key: %s, seq: %d",
-		partition, key, seq)
+		"warmup":      &bip.Warmup,
+		"warmupQuery": &bip.WarmupQuery,
 
-	bdp, bindex, err := t.getPartition(partition)
-	if err != nil {
-		return err
-	}
+		"partitionIndexes": &bip.PartitionIndexes,
+		"durability":       &bip.Durability,
 
-	return bdp.OnDataUpdate(bindex, key, seq, val)
-}
+		"queryAllowFields": &bip.QueryAllowFields,
+		"queryDenyFields":  &bip.QueryDenyFields,
 
-func (t *BleveDest) OnDataDelete(partition string,
-	key []byte, seq uint64) error {
-	log.Printf("bleve dest delete, partition: %s, key: %s, seq: %d",
-		partition, key, seq)
+		"keyEncoding": &bip.KeyEncoding,
+		"maxDocSize":  &bip.MaxDocSize,
+	} {
+		v, exists := m[key]
+		if !exists {
+			continue
+		}
+		err = json.Unmarshal(v, dst)
+		if err != nil {
+			return nil, "", fmt.Errorf("error: parse %s: %v", key, err)
+		}
+		delete(m, key)
+		found = true
+	}
+	if !found {
+		return bip, indexParams, nil
+	}
 
-	bdp, bindex, err := t.getPartition(partition)
+	buf, err := json.Marshal(m)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-
-	return bdp.OnDataDelete(bindex, key, seq)
+	return bip, string(buf), nil
 }
 
-func (t *BleveDest) OnSnapshotStart(partition string,
-	snapStart, snapEnd uint64) error {
-	log.Printf("bleve dest snapshot-start, partition: %s, snapStart: %d, snapEnd: %d",
-		partition, snapStart, snapEnd)
-
-	bdp, bindex, err := t.getPartition(partition)
+func ValidateBlevePIndexImpl(indexType, indexName, indexParams string) error {
+	bip, indexParams, err := ParseBleveIndexParams(indexParams)
 	if err != nil {
 		return err
 	}
-
-	return bdp.OnSnapshotStart(bindex, snapStart, snapEnd)
-}
-
-func (t *BleveDest) SetOpaque(partition string, value []byte) error {
-	log.Printf("bleve dest set-opaque, partition: %s, value: %s",
-		partition, value)
-
-	bdp, bindex, err := t.getPartition(partition)
+	_, err = bleveDocIdTransform(bip.DocIdTransform)
 	if err != nil {
 		return err
 	}
-
-	return bdp.SetOpaque(bindex, value)
+	_, err = bleveDocTransform(bip.DocTransform)
+	if err != nil {
+		return err
+	}
+	err = bip.DocFilter.Validate()
+	if err != nil {
+		return err
+	}
+	err = validateBleveDurability(bip.Durability)
+	if err != nil {
+		return err
+	}
+	err = validateBleveKeyEncoding(bip.KeyEncoding)
+	if err != nil {
+		return err
+	}
+	if bip.MaxDocSize < 0 {
+		return fmt.Errorf("error: invalid maxDocSize: %d", bip.MaxDocSize)
+	}
+	if bip.ForceFlushMS < 0 {
+		return fmt.Errorf("error: invalid forceFlushMS: %d", bip.ForceFlushMS)
+	}
+	if bip.WarmupQuery != "" {
+		err = bleve.NewQueryStringQuery(bip.WarmupQuery).Validate()
+		if err != nil {
+			return fmt.Errorf("error: invalid warmupQuery, err: %v", err)
+		}
+	}
+	bindexMapping, err := parseBleveIndexMapping(indexParams)
+	if err != nil {
+		return err
+	}
+	return validateBleveLanguageMappings(bip, bindexMapping)
 }
 
-func (t *BleveDest) GetOpaque(partition string) (
-	value []byte, lastSeq uint64, err error) {
-	log.Printf("bleve dest get-opaque, partition: %s", partition)
-
-	bdp, bindex, err := t.getPartition(partition)
-	if err != nil {
-		return nil, 0, err
+// Parses the bleve index mapping of index params whose
+// BleveIndexParams were removed, where "" means the default mapping.
+func parseBleveIndexMapping(indexParams string) (*bleve.IndexMapping, error) {
+	bindexMapping := bleve.NewIndexMapping()
+	if len(indexParams) > 0 {
+		err := json.Unmarshal([]byte(indexParams), &bindexMapping)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return bindexMapping, nil
+}
 
-	return bdp.GetOpaque(bindex)
+// Checks that every type mapping referenced by the
+// BleveIndexParams.LanguageMappings is defined in the index mapping.
+func validateBleveLanguageMappings(bip *BleveIndexParams,
+	bindexMapping *bleve.IndexMapping) error {
+	if len(bip.LanguageMappings) > 0 && bip.LanguageField == "" {
+		return fmt.Errorf("error: languageMappings requires a languageField")
+	}
+	for language, typeName := range bip.LanguageMappings {
+		if _, exists := bindexMapping.TypeMapping[typeName]; !exists {
+			return fmt.Errorf("error: languageMappings, language: %s,"+
+				" unknown type mapping: %s", language, typeName)
+		}
+	}
+	return nil
 }
 
-func (t *BleveDest) Rollback(partition string, rollbackSeq uint64) error {
-	log.Printf("bleve dest rollback, partition: %s, rollbackSeq: %d",
-		partition, rollbackSeq)
+func NewBlevePIndexImpl(indexType, indexParams, path string, restart func()) (
+	PIndexImpl, Dest, error) {
+	bip, indexParams, err := ParseBleveIndexParams(indexParams)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error: parse bleve index params: %v", err)
+	}
+	bindexMapping, err := parseBleveIndexMapping(indexParams)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error: parse bleve index mapping: %v", err)
+	}
+	err = validateBleveLanguageMappings(bip, bindexMapping)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var bindex bleve.Index
+	if bip.PartitionIndexes {
+		err = os.MkdirAll(path, 0700)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error: new bleve partition indexes,"+
+				" path: %s, err: %v", path, err)
+		}
+	} else {
+		bindex, err = newBleveIndex(path, bindexMapping, bip.Durability)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error: new bleve index, path: %s, err: %s",
+				path, err)
+		}
+	}
+
+	bdest, err := newBleveDestWithParams(path, bindex, restart, bip,
+		bindexMapping)
+	if err != nil {
+		if bindex != nil {
+			bindex.Close()
+		}
+		os.RemoveAll(path)
+		return nil, nil, err
+	}
+
+	return bdest.bindex, bdest, err
+}
+
+func OpenBlevePIndexImpl(indexType, path string, restart func()) (PIndexImpl, Dest, error) {
+	bip, indexParams := readBleveIndexParams(path)
+	if bip.PartitionIndexes {
+		bindexMapping, err := parseBleveIndexMapping(indexParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		bdest, err := newBleveDestWithParams(path, nil, restart, bip,
+			bindexMapping)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bdest.bindex, bdest, err
+	}
+
+	// TODO: boltdb sometimes locks on Open(), so need to investigate,
+	// where perhaps there was a previous missing or race-y Close().
+	bindex, err := bleve.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bdest, err := newBleveDestWithParams(path, bindex, restart, bip,
+		bindex.Mapping())
+	if err != nil {
+		bindex.Close()
+		return nil, nil, err
+	}
+
+	return bindex, bdest, err
+}
+
+// Returns a BleveDest that's configured by the BleveIndexParams.  With
+// the partitionIndexes param, the bindex is ignored, and instead the
+// existing partition indexes under the path are opened, and new
+// partition indexes are created with the bindexMapping.
+func newBleveDestWithParams(path string, bindex bleve.Index, restart func(),
+	bip *BleveIndexParams, bindexMapping *bleve.IndexMapping) (
+	*BleveDest, error) {
+	docIdTransform, err := bleveDocIdTransform(bip.DocIdTransform)
+	if err != nil {
+		return nil, err
+	}
+	docTransform, err := bleveDocTransform(bip.DocTransform)
+	if err != nil {
+		return nil, err
+	}
+	err = bip.DocFilter.Validate()
+	if err != nil {
+		return nil, err
+	}
+	err = validateBleveKeyEncoding(bip.KeyEncoding)
+	if err != nil {
+		return nil, err
+	}
+	err = validateBleveDurability(bip.Durability)
+	if err != nil {
+		return nil, err
+	}
+	if bip.MaxDocSize < 0 {
+		return nil, fmt.Errorf("error: invalid maxDocSize: %d", bip.MaxDocSize)
+	}
+	if bip.ForceFlushMS < 0 {
+		return nil, fmt.Errorf("error: invalid forceFlushMS: %d",
+			bip.ForceFlushMS)
+	}
+
+	if bip.PartitionIndexes {
+		bindex, err = newBlevePartitionAlias(path, bindexMapping,
+			bip.Durability)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bdest := NewBleveDest(path, bindex, restart).(*BleveDest)
+	if pa, ok := bindex.(*blevePartitionAlias); ok {
+		bdest.partitionAlias = pa
+	}
+	bdest.snapshotAtomic = bip.SnapshotAtomic
+	bdest.forceFlushAfter = time.Duration(bip.ForceFlushMS) * time.Millisecond
+	bdest.keyEncoding = bip.KeyEncoding
+	bdest.maxDocSize = bip.MaxDocSize
+	bdest.docIdTransform = docIdTransform
+	bdest.docTransform = docTransform
+
+	if len(bip.DocFilter) > 0 {
+		bdest.docFilter = bip.DocFilter
+	}
+
+	if bip.LanguageField != "" {
+		bdest.languageField = bip.LanguageField
+		bdest.languageMappings = bip.LanguageMappings
+		bdest.typeField = bindexMapping.TypeField
+	}
+
+	if bip.TombstoneTTL > 0 {
+		bdest.tombstoneTTL = time.Duration(bip.TombstoneTTL) * time.Millisecond
+		go bdest.runTombstonePurger()
+	}
+
+	bdest.durability = bip.Durability
+	if bdest.durability == "" {
+		bdest.durability = BLEVE_DURABILITY_SAFE
+	}
+	if bdest.durability == BLEVE_DURABILITY_FAST {
+		go bdest.runStoreSyncer()
+	}
+
+	return bdest, nil
+}
+
+// Best-effort read of the BleveIndexParams, and the rest of the index
+// params, from the PINDEX_META file of a pindex, since opening a
+// pindex impl isn't given the index params.  On any error, the
+// default BleveIndexParams are returned.
+func readBleveIndexParams(path string) (*BleveIndexParams, string) {
+	buf, err := ioutil.ReadFile(path + string(os.PathSeparator) + PINDEX_META_FILENAME)
+	if err != nil {
+		return &BleveIndexParams{}, ""
+	}
+	pindex := &PIndex{}
+	err = json.Unmarshal(buf, pindex)
+	if err != nil {
+		return &BleveIndexParams{}, ""
+	}
+	bip, indexParams, err := ParseBleveIndexParams(pindex.IndexParams)
+	if err != nil {
+		log.Printf("readBleveIndexParams, path: %s, err: %v", path, err)
+		return &BleveIndexParams{}, ""
+	}
+	return bip, indexParams
+}
+
+func WarmupBlevePIndexImpl(pindex *PIndex) func() error {
+	bip, _, err := ParseBleveIndexParams(pindex.IndexParams)
+	if err != nil || !bip.Warmup {
+		return nil
+	}
+	bdest, ok := pindex.Dest.(*BleveDest)
+	if !ok {
+		return nil
+	}
+	return func() error {
+		return bdest.Warmup(bip.WarmupQuery)
+	}
+}
+
+func CountBlevePIndexImpl(mgr *Manager, indexName, indexUUID string) (uint64, error) {
+	alias, err := bleveIndexAlias(mgr, indexName, indexUUID, nil, nil,
+		true, false, nil)
+	if err == nil {
+		err = bleveSkippedError(alias.skipped)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("CountBlevePIndexImpl indexAlias error,"+
+			" indexName: %s, indexUUID: %s, err: %v", indexName, indexUUID, err)
+	}
+
+	return alias.DocCount()
+}
+
+func StorageStatsBlevePIndexImpl(pindex *PIndex) (*PIndexStorageStats, error) {
+	bdest, ok := pindex.Dest.(*BleveDest)
+	if !ok || bdest == nil {
+		return nil, fmt.Errorf("StorageStatsBlevePIndexImpl pindex not"+
+			" a BleveDest, pindex: %s", pindex.Name)
+	}
+
+	return bdest.StorageStats()
+}
+
+// Counts the docs that match the query of a req, which has the same
+// format as for QueryBlevePIndexImpl(), by searching for zero hits
+// and returning the merged total.  A req without a query counts all
+// docs, via the cheaper DocCount().
+func CountQueryBlevePIndexImpl(mgr *Manager, indexName, indexUUID string,
+	req []byte) (uint64, error) {
+	var bleveQueryParams BleveQueryParams
+	err := json.Unmarshal(req, &bleveQueryParams)
+	if err != nil {
+		return 0, &QueryBadRequestError{
+			Err: fmt.Errorf("CountQueryBlevePIndexImpl parsing bleveQueryParams,"+
+				" req: %s, err: %v", req, err),
+		}
+	}
+
+	if bleveQueryParams.Query == nil {
+		return CountBlevePIndexImpl(mgr, indexName, indexUUID)
+	}
+
+	err = bleveQueryParams.Validate()
+	if err != nil {
+		return 0, &QueryBadRequestError{Err: err}
+	}
+
+	err = checkBleveQueryExpansion(mgr, req)
+	if err != nil {
+		return 0, &QueryBadRequestError{Err: err}
+	}
+
+	err = checkBleveQueryAnalyzers(mgr, indexName, req)
+	if err != nil {
+		return 0, err
+	}
+
+	err = checkBleveQueryFields(mgr, indexName, req)
+	if err != nil {
+		return 0, err
+	}
+
+	cancelCh, cancelDone := queryTimeoutCancelCh(
+		bleveQueryTimeoutMS(mgr, indexName, bleveQueryParams.Timeout))
+	defer cancelDone()
+
+	alias, err := bleveIndexAlias(mgr, indexName, indexUUID,
+		bleveQueryParams.Consistency, cancelCh,
+		!bleveQueryParams.SkipRemoteProbe,
+		bleveQueryParams.IncludeTombstones, nil)
+	if err != nil {
+		if isQueryError(err) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("CountQueryBlevePIndexImpl indexAlias error,"+
+			" indexName: %s, indexUUID: %s, err: %v", indexName, indexUUID, err)
+	}
+
+	err = bleveQueryParams.checkSkipped(alias)
+	if err != nil {
+		return 0, err
+	}
+
+	searchResponse, err := alias.Search(bleve.NewSearchRequestOptions(
+		bleveQueryParams.Query.Query, 0, 0, false))
+	if err != nil {
+		return 0, err
+	}
+
+	return searchResponse.Total, nil
+}
+
+type BleveQueryParams struct {
+	Query       *bleve.SearchRequest `json:"query"`
+	Consistency *ConsistencyParams   `json:"consistency"`
+	Timeout     int64                `json:"timeout"` // Millisecs, < 0 for unlimited.
+	Sort        []string             `json:"sort"`    // See bleveSearchSorted().
+
+	// When true, remote pindexes are queried without a health probe.
+	SkipRemoteProbe bool `json:"skipRemoteProbe"`
+
+	// When true, the remote pindexes that fail their health probe are
+	// left out of the results, and are listed in the response's
+	// "skipped" section, rather than failing the query.
+	Partial bool `json:"partial"`
+
+	// When true, the query response includes a "cbft" section of
+	// BleveQueryStats.  It's off by default to avoid the overhead.
+	Debug bool `json:"debug"`
+
+	// When true, hits with the same doc ID from different pindexes,
+	// such as while a partition is moving between nodes, are merged
+	// into the highest scoring hit.  See bleveSearchMerged().
+	Dedupe bool `json:"dedupe"`
+
+	// When true, or when a Cursor is provided, the response includes
+	// a "cursor" token for the next page, which is "" after the last
+	// page.  A Cursor from a previous response continues the scroll
+	// instead of using From.  See bleveCursor.
+	Scroll bool   `json:"scroll"`
+	Cursor string `json:"cursor"`
+
+	// When true, each hit includes a "source" field with its full
+	// doc, fetched from the couchbase data source after the search,
+	// so that the index needn't store the full docs.  A doc that's
+	// no longer in the data source has no "source" field.
+	IncludeSource bool `json:"includeSource"`
+
+	// When true, the response is only a JSON array of the matching
+	// doc IDs, such as for existence checks, where the stored fields,
+	// highlighting, facets and explanations aren't computed, and where
+	// a query without a size returns up to BLEVE_QUERY_IDS_ONLY_SIZE.
+	IdsOnly bool `json:"idsOnly"`
+
+	// When true, the tombstones of an index with a tombstoneTTL are
+	// matched like any other doc, such as to query recently deleted
+	// keys.  See BleveIndexParams.TombstoneTTL.
+	IncludeTombstones bool `json:"includeTombstones"`
+}
+
+// The max number of doc IDs returned by an idsOnly query that doesn't
+// specify a size.
+const BLEVE_QUERY_IDS_ONLY_SIZE = 1000
+
+// BleveQueryStats are cbft-specific stats about a query's fan-out,
+// which bleve's own SearchResult timing doesn't cover.  Durations
+// are in nanoseconds.
+type BleveQueryStats struct {
+	TotalNS           int64 `json:"totalNS"`
+	ConsistencyWaitNS int64 `json:"consistencyWaitNS"`
+	NumLocalPIndexes  int   `json:"numLocalPIndexes"`
+	NumRemotePIndexes int   `json:"numRemotePIndexes"`
+	NumDuplicateHits  int   `json:"numDuplicateHits"`
+
+	m        sync.Mutex       // Protects RemoteNS.
+	RemoteNS map[string]int64 `json:"remoteNS"` // Keyed by remote QueryURL.
+}
+
+func (s *BleveQueryStats) addRemote(queryURL string, d time.Duration) {
+	s.m.Lock()
+	if s.RemoteNS == nil {
+		s.RemoteNS = map[string]int64{}
+	}
+	s.RemoteNS[queryURL] = int64(d)
+	s.m.Unlock()
+}
+
+// Checks that the query params hold a valid bleve query, so that
+// malformed queries fail with a descriptive error, rather than a
+// panic, before any consistency waits or fan-out.
+func (p *BleveQueryParams) Validate() error {
+	if p.Query == nil || p.Query.Query == nil {
+		return fmt.Errorf("error: missing query")
+	}
+	if p.Query.Size < 0 {
+		return fmt.Errorf("error: invalid size: %d", p.Query.Size)
+	}
+	if p.Query.From < 0 {
+		return fmt.Errorf("error: invalid from: %d", p.Query.From)
+	}
+	if p.Cursor != "" {
+		if p.Query.From > 0 {
+			return fmt.Errorf("error: from: %d, not allowed with a cursor",
+				p.Query.From)
+		}
+		_, err := decodeBleveCursor(p.Cursor, bleveScrollSortSpec(p.Sort))
+		if err != nil {
+			return err
+		}
+	}
+	if p.IdsOnly && (p.scrolling() || p.IncludeSource) {
+		return fmt.Errorf("error: idsOnly not allowed with scroll," +
+			" cursor or includeSource")
+	}
+	if p.Consistency != nil && p.Consistency.Level != "" &&
+		p.Consistency.Level != "at_plus" && p.Consistency.Level != "as_of" {
+		return fmt.Errorf("error: unsupported consistency level: %s",
+			p.Consistency.Level)
+	}
+	err := p.Query.Query.Validate()
+	if err != nil {
+		return fmt.Errorf("error: invalid query, err: %v", err)
+	}
+	return nil
+}
+
+// Default limits on the term expansion of fuzzy, prefix, wildcard and
+// regexp queries, which are fanned out to every pindex of an index,
+// and which are overridden by the "queryMaxFuzziness" and
+// "queryMinPrefixLen" manager options.  A limit < 0 disables a check.
+const BLEVE_QUERY_MAX_FUZZINESS = 2
+const BLEVE_QUERY_MIN_PREFIX_LEN = 1
+
+// Checks the query tree of a query req against the manager's query
+// expansion limits, returning an error for a query that's too
+// expensive, such as a very fuzzy term, or a prefix, wildcard or
+// regexp whose literal prefix is too short, which might match every
+// term of the index.  The mgr might be nil, for the default limits.
+func checkBleveQueryExpansion(mgr *Manager, req []byte) error {
+	var options map[string]string
+	if mgr != nil {
+		options = mgr.Options()
+	}
+
+	var r struct {
+		Query struct {
+			Query interface{} `json:"query"`
+		} `json:"query"`
+	}
+	err := json.Unmarshal(req, &r)
+	if err != nil {
+		return fmt.Errorf("error: checkBleveQueryExpansion parsing req,"+
+			" err: %v", err)
+	}
+
+	maxFuzziness := bleveQueryLimit(options, "queryMaxFuzziness",
+		BLEVE_QUERY_MAX_FUZZINESS)
+	minPrefixLen := bleveQueryLimit(options, "queryMinPrefixLen",
+		BLEVE_QUERY_MIN_PREFIX_LEN)
+
+	var visit func(q interface{}) error
+	visit = func(q interface{}) error {
+		switch x := q.(type) {
+		case []interface{}:
+			for _, child := range x {
+				if err := visit(child); err != nil {
+					return err
+				}
+			}
+		case map[string]interface{}:
+			if f, ok := x["fuzziness"].(float64); ok &&
+				maxFuzziness >= 0 && int(f) > maxFuzziness {
+				return fmt.Errorf("error: query too expensive,"+
+					" fuzziness: %d exceeds max: %d", int(f), maxFuzziness)
+			}
+			for _, k := range []string{"prefix", "wildcard", "regexp"} {
+				v, ok := x[k].(string)
+				if !ok || minPrefixLen < 0 {
+					continue
+				}
+				literal := v
+				if k == "wildcard" {
+					literal = v[:literalPrefixLen(v, "*?")]
+				} else if k == "regexp" {
+					literal = v[:literalPrefixLen(v, `.*+?()[]{}|\^$`)]
+				}
+				if len(literal) < minPrefixLen {
+					return fmt.Errorf("error: query too expensive,"+
+						" %s: %q has a literal prefix shorter than: %d",
+						k, v, minPrefixLen)
+				}
+			}
+			for _, child := range x {
+				if err := visit(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return visit(r.Query.Query)
+}
+
+// Checks that every analyzer that's named in the query tree of a query
+// req, such as by a match query's analyzer override, is known to the
+// index mapping of the index, or of every bleve index that's targeted
+// by an index alias, so that an unknown analyzer fails with a clear
+// error before any fan-out.
+func checkBleveQueryAnalyzers(mgr *Manager, indexName string,
+	req []byte) error {
+	var r struct {
+		Query struct {
+			Query interface{} `json:"query"`
+		} `json:"query"`
+	}
+	err := json.Unmarshal(req, &r)
+	if err != nil {
+		return &QueryBadRequestError{
+			Err: fmt.Errorf("error: checkBleveQueryAnalyzers parsing req,"+
+				" err: %v", err),
+		}
+	}
+
+	analyzers := map[string]bool{}
+
+	var visit func(q interface{})
+	visit = func(q interface{}) {
+		switch x := q.(type) {
+		case []interface{}:
+			for _, child := range x {
+				visit(child)
+			}
+		case map[string]interface{}:
+			if analyzer, ok := x["analyzer"].(string); ok && analyzer != "" {
+				analyzers[analyzer] = true
+			}
+			for _, child := range x {
+				visit(child)
+			}
+		}
+	}
+	visit(r.Query.Query)
+
+	if len(analyzers) <= 0 || mgr == nil {
+		return nil
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return err
+	}
+
+	indexDefs := map[string]*IndexDef{}
+	err = bleveTargetIndexDefs(indexDefsByName, indexName, indexDefs)
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	for name, indexDef := range indexDefs {
+		if indexDef == nil {
+			continue // An index alias.
+		}
+		_, indexParams, err := ParseBleveIndexParams(indexDef.Params)
+		if err != nil {
+			return err
+		}
+		bindexMapping, err := parseBleveIndexMapping(indexParams)
+		if err != nil {
+			return fmt.Errorf("error: could not parse index mapping,"+
+				" indexName: %s, err: %v", name, err)
+		}
+		for analyzer := range analyzers {
+			if bindexMapping.AnalyzerNamed(analyzer) == nil {
+				return &QueryBadRequestError{
+					Err: fmt.Errorf("error: unknown analyzer: %s,"+
+						" indexName: %s", analyzer, name),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Adds the index def of an index, or of the bleve indexes that an
+// index alias targets, to the indexDefs, keyed by index name, where an
+// index alias maps to nil.
+func bleveTargetIndexDefs(indexDefsByName map[string]*IndexDef,
+	indexName string, indexDefs map[string]*IndexDef) error {
+	if _, exists := indexDefs[indexName]; exists {
+		return nil // Already visited, such as via an alias cycle.
+	}
+
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return fmt.Errorf("error: no indexDef, indexName: %s", indexName)
+	}
+
+	if indexDef.Type == "alias" {
+		indexDefs[indexName] = nil
+
+		params := AliasParams{}
+		err := json.Unmarshal([]byte(indexDef.Params), &params)
+		if err != nil {
+			return fmt.Errorf("error: could not parse alias params,"+
+				" indexName: %s, err: %v", indexName, err)
+		}
+		for targetName := range params.Targets {
+			err = bleveTargetIndexDefs(indexDefsByName, targetName, indexDefs)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	indexDefs[indexName] = indexDef
+
+	return nil
+}
+
+// ------------------------------------------------------------------------
+
+// The default field that's searched by query terms without a field.
+const BLEVE_DEFAULT_QUERY_FIELD = "_all"
+
+// Query tree keys whose values are child queries rather than leaf
+// queries that search a field.
+var bleveCompoundQueryKeys = []string{
+	"conjuncts", "disjuncts", "must", "must_not", "should",
+}
+
+// Query tree keys of leaf queries that don't search any field.
+var bleveFieldlessQueryKeys = []string{
+	"match_all", "match_none", "ids",
+}
+
+// Matches the quoted phrases of a query string query.
+var bleveQueryStringQuotedRE = regexp.MustCompile(`"[^"]*"`)
+
+// Checks the fields that are referenced by the query tree of a query
+// req against the queryAllowFields and queryDenyFields of the index,
+// or of every bleve index that's targeted by an index alias.
+func checkBleveQueryFields(mgr *Manager, indexName string,
+	req []byte) error {
+	if mgr == nil {
+		return nil
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil || indexDefsByName == nil {
+		return err
+	}
+
+	indexDefs := map[string]*IndexDef{}
+	err = bleveTargetIndexDefs(indexDefsByName, indexName, indexDefs)
+	if err != nil {
+		return nil // Let the query report the missing index.
+	}
+
+	var fields map[string]bool
+
+	for name, indexDef := range indexDefs {
+		if indexDef == nil {
+			continue // An index alias.
+		}
+		bip, _, err := ParseBleveIndexParams(indexDef.Params)
+		if err != nil {
+			return err
+		}
+		if len(bip.QueryAllowFields) <= 0 && len(bip.QueryDenyFields) <= 0 {
+			continue
+		}
+		if fields == nil {
+			fields, err = bleveQueryFields(req)
+			if err != nil {
+				return &QueryBadRequestError{Err: err}
+			}
+		}
+		err = checkBleveIndexQueryFields(bip, name, fields)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks the fields referenced by a query against the
+// queryAllowFields and queryDenyFields of an index's params.
+func checkBleveIndexQueryFields(bip *BleveIndexParams, indexName string,
+	fields map[string]bool) error {
+	for field := range fields {
+		if len(bip.QueryAllowFields) > 0 &&
+			!bleveFieldMatches(bip.QueryAllowFields, field) {
+			return &QueryBadRequestError{
+				Err: fmt.Errorf("error: query field not allowed: %s,"+
+					" indexName: %s", field, indexName),
+			}
+		}
+		if bleveFieldMatches(bip.QueryDenyFields, field) {
+			return &QueryBadRequestError{
+				Err: fmt.Errorf("error: query field denied: %s,"+
+					" indexName: %s", field, indexName),
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the fields that are referenced by the query tree of a query
+// req, where a leaf query without a field references the default
+// BLEVE_DEFAULT_QUERY_FIELD.
+func bleveQueryFields(req []byte) (map[string]bool, error) {
+	var r struct {
+		Query struct {
+			Query interface{} `json:"query"`
+		} `json:"query"`
+	}
+	err := json.Unmarshal(req, &r)
+	if err != nil {
+		return nil, fmt.Errorf("error: bleveQueryFields parsing req,"+
+			" err: %v", err)
+	}
+
+	fields := map[string]bool{}
+
+	var visit func(q interface{})
+	visit = func(q interface{}) {
+		switch x := q.(type) {
+		case []interface{}:
+			for _, child := range x {
+				visit(child)
+			}
+		case map[string]interface{}:
+			compound := false
+			for _, key := range bleveCompoundQueryKeys {
+				if child, exists := x[key]; exists {
+					visit(child)
+					compound = true
+				}
+			}
+			if compound {
+				return
+			}
+			for _, key := range bleveFieldlessQueryKeys {
+				if _, exists := x[key]; exists {
+					return
+				}
+			}
+			if qs, ok := x["query"].(string); ok {
+				for _, field := range bleveQueryStringFields(qs) {
+					fields[field] = true
+				}
+				return
+			}
+			field, _ := x["field"].(string)
+			if field == "" {
+				field = BLEVE_DEFAULT_QUERY_FIELD
+			}
+			fields[field] = true
+		}
+	}
+	visit(r.Query.Query)
+
+	return fields, nil
+}
+
+// Returns the fields that are referenced by a query string query,
+// such as "name" for "+name:joe", including BLEVE_DEFAULT_QUERY_FIELD
+// for any terms without a field.
+func bleveQueryStringFields(qs string) []string {
+	var rv []string
+	for _, term := range strings.Fields(
+		bleveQueryStringQuotedRE.ReplaceAllString(qs, `""`)) {
+		term = strings.TrimLeft(term, "+-(")
+		if term == "" || term == ")" {
+			continue
+		}
+		i := strings.Index(term, ":")
+		if i > 0 {
+			rv = append(rv, term[:i])
+		} else {
+			rv = append(rv, BLEVE_DEFAULT_QUERY_FIELD)
+		}
+	}
+	return rv
+}
+
+// Returns true when the field is one of the fields, or is nested
+// under one of them, such as "meta.id" under "meta".
+func bleveFieldMatches(fields []string, field string) bool {
+	for _, f := range fields {
+		if field == f || strings.HasPrefix(field, f+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the length of the prefix of s before any of the meta chars.
+func literalPrefixLen(s, meta string) int {
+	i := strings.IndexAny(s, meta)
+	if i < 0 {
+		return len(s)
+	}
+	return i
+}
+
+// Returns a query limit from the manager options, or the defaultVal.
+func bleveQueryLimit(options map[string]string, name string,
+	defaultVal int) int {
+	v, exists := options[name]
+	if !exists {
+		return defaultVal
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("warning: could not parse %s option: %s, err: %v",
+			name, v, err)
+		return defaultVal
+	}
+	return limit
+}
+
+// Returns the effective query timeout in millisecs, where a timeout
+// provided by the query request wins, else the index's
+// BleveIndexParams.QueryTimeout, else the Manager's "queryTimeoutMS"
+// option.  A result <= 0 means no timeout.
+func bleveQueryTimeoutMS(mgr *Manager, indexName string, timeout int64) int64 {
+	if timeout != 0 || mgr == nil {
+		return timeout
+	}
+
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err == nil && indexDefsByName != nil {
+		indexDef := indexDefsByName[indexName]
+		if indexDef != nil {
+			bip, _, err := ParseBleveIndexParams(indexDef.Params)
+			if err == nil && bip.QueryTimeout != 0 {
+				return bip.QueryTimeout
+			}
+		}
+	}
+
+	v, exists := mgr.Options()["queryTimeoutMS"]
+	if exists {
+		timeout, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("warning: could not parse queryTimeoutMS option: %s,"+
+				" err: %v", v, err)
+			return 0
+		}
+	}
+	return timeout
+}
+
+// Returns a cancelCh that's closed after timeoutMS millisecs, or nil
+// if timeoutMS <= 0.  The returned func must be called when the query
+// is done, to release the timer.
+func queryTimeoutCancelCh(timeoutMS int64) (chan struct{}, func()) {
+	if timeoutMS <= 0 {
+		return nil, func() {}
+	}
+	cancelCh := make(chan struct{})
+	timer := time.AfterFunc(time.Duration(timeoutMS)*time.Millisecond,
+		func() { close(cancelCh) })
+	return cancelCh, func() { timer.Stop() }
+}
+
+// Returns the cancel channel for the consistency wait phase of a
+// query, which is closed when either the query's cancelCh is closed
+// or the consistency params' timeout fires.  The returned timedOut
+// func reports whether it was the consistency timeout that fired.
+func consistencyWaitCancelCh(cancelCh chan struct{},
+	consistencyParams *ConsistencyParams) (
+	waitCancelCh chan struct{}, timedOut func() bool, done func()) {
+	if consistencyParams == nil || consistencyParams.Timeout <= 0 {
+		return cancelCh, func() bool { return false }, func() {}
+	}
+
+	waitCancelCh = make(chan struct{})
+	doneCh := make(chan struct{})
+
+	var m sync.Mutex
+	fired := false
+
+	timer := time.NewTimer(
+		time.Duration(consistencyParams.Timeout) * time.Millisecond)
+	go func() {
+		select {
+		case <-timer.C:
+			m.Lock()
+			fired = true
+			m.Unlock()
+			close(waitCancelCh)
+		case <-cancelCh:
+			close(waitCancelCh)
+		case <-doneCh:
+		}
+	}()
+
+	timedOut = func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return fired
+	}
+
+	return waitCancelCh, timedOut, func() {
+		timer.Stop()
+		close(doneCh)
+	}
+}
+
+// bleveDefaultSortSpec orders hits by descending score, with ties
+// broken by doc ID, so that paging through the merged hits of
+// fanned-out pindexes is stable across repeated queries.
+var bleveDefaultSortSpec = []string{"-_score", "_id"}
+
+// bleveSearchSorted performs a search where the hits are ordered by
+// a sort spec.  Each entry of the sort spec is a stored field name,
+// or "_id" or "_score", optionally prefixed with "-" for descending
+// order; later entries break ties of earlier entries.  Hits missing a
+// field sort last for that field.  An empty sort spec means
+// bleveDefaultSortSpec.
+//
+// The underlying search is score-ordered, so a single pindex
+// retrieves all its matching hits (bounded by its doc count) along
+// with the sort fields, and then sorts and pages them here, failing
+// when there are more than the sort window max (see
+// BLEVE_QUERY_SORT_WINDOW_MAX).  When the
+// index is a bleveFanOut, each of its targets, including remote
+// pindexes, does that itself and returns only its top From+Size hits
+// by the sort spec, which are then merged, sorted and paged here.
+// Scrolls are also pushed down to a bleveFanOut's targets, so that
+// each target only returns its top hits after the cursor.
+func bleveSearchSorted(index bleve.Index, req *bleve.SearchRequest,
+	sortSpec []string) (*bleve.SearchResult, error) {
+	rv, _, _, err := bleveSearchMerged(index, req, sortSpec,
+		bleveSearchOptions{})
+	return rv, err
+}
+
+// bleveSearchOptions are the optional behaviors of
+// bleveSearchMerged().
+type bleveSearchOptions struct {
+	// Hits with the same doc ID are merged into the one with the
+	// highest score, and the Total is reduced by the number of
+	// duplicates found.
+	Dedupe bool
+
+	// The sort spec must be a total order (see bleveScrollSortSpec),
+	// and only the hits that sort after the After sort values, from
+	// the last hit of a previous page, are paged.
+	Scroll bool
+	After  []interface{}
+
+	// The max number of hits that a field sort may retrieve and sort,
+	// where 0 means BLEVE_QUERY_SORT_WINDOW_MAX and < 0 means no max.
+	SortWindowMax int
+
+	// When scrolling, the number of hits of each pindex, keyed by
+	// pindex name, that sort at or before the After sort values, as
+	// kept by the cursor.  See bleveCursor.
+	Positions map[string]int
+
+	// The pindex of each hit of a pushed down scroll, which is shared
+	// by the nested bleveFanOuts of a scroll.
+	origins *bleveHitOrigins
+}
+
+// A bleveNamedIndex is a bleve.Index for a single pindex, which
+// might be remote.
+type bleveNamedIndex interface {
+	pindexName() string
+}
+
+// bleveHitOrigins tracks the pindex of each hit, by the pindex's
+// name, for the hits of the targets of a bleveFanOut that are
+// searched concurrently.
+type bleveHitOrigins struct {
+	m     sync.Mutex
+	names map[*search.DocumentMatch]string
+}
+
+func (o *bleveHitOrigins) add(hits search.DocumentMatchCollection,
+	name string) {
+	o.m.Lock()
+	for _, hit := range hits {
+		o.names[hit] = name
+	}
+	o.m.Unlock()
+}
+
+// BLEVE_QUERY_SORT_WINDOW_MAX is the default max number of hits that
+// a field sort may retrieve and sort, which can be overridden by the
+// Manager's "querySortWindowMax" option.  A field sorted query whose
+// From+Size, or whose number of matches in a pindex, exceeds the max
+// fails, so the query should be narrowed or scrolled instead.
+const BLEVE_QUERY_SORT_WINDOW_MAX = 10000
+
+func bleveQuerySortWindowMax(mgr *Manager) int {
+	if mgr == nil {
+		return BLEVE_QUERY_SORT_WINDOW_MAX
+	}
+	return bleveQueryLimit(mgr.Options(), "querySortWindowMax",
+		BLEVE_QUERY_SORT_WINDOW_MAX)
+}
+
+// bleveSearchMerged is bleveSearchSorted() with bleveSearchOptions,
+// also returning the number of duplicate hits removed and, when
+// scrolling, the cursor of the next page, which is nil when the page
+// is empty.
+//
+// In score order, or when each target of a bleveFanOut sorts its own
+// hits, only the top hits are retrieved, so when duplicates, or hits
+// before the After position that weren't pushed down, are removed,
+// the hits are re-fetched with a doubled size until the page is
+// filled or all the matches were retrieved.  When scrolling, hits are
+// also re-fetched while the lowest retrieved score ties the last hit
+// of the page, as the underlying search might have cut off equally
+// scored hits that belong on the page.  A single pindex that knows
+// its position from the cursor instead retrieves its hits through the
+// page in one search.
+func bleveSearchMerged(index bleve.Index, req *bleve.SearchRequest,
+	sortSpec []string, opts bleveSearchOptions) (
+	*bleve.SearchResult, int, *bleveCursor, error) {
+	requested := map[string]bool{}
+	for _, field := range req.Fields {
+		requested[field] = true
+	}
+
+	sub := *req
+	sub.From = 0
+
+	scoreOrdered := len(sortSpec) <= 0 ||
+		reflect.DeepEqual(sortSpec, bleveDefaultSortSpec)
+
+	sortWindowMax := opts.SortWindowMax
+	if sortWindowMax == 0 {
+		sortWindowMax = BLEVE_QUERY_SORT_WINDOW_MAX
+	}
+	if !scoreOrdered && sortWindowMax > 0 &&
+		req.From+req.Size > sortWindowMax {
+		return nil, 0, nil, &QueryBadRequestError{
+			Err: fmt.Errorf("error: sorted query from + size: %d"+
+				" exceeds sort window max: %d, use a scroll instead",
+				req.From+req.Size, sortWindowMax),
+		}
+	}
+
+	fanOut, pushDown := index.(*bleveFanOut)
+	pushDown = pushDown && (!scoreOrdered || opts.Scroll)
+
+	// The pindex of the index, if it's a single pindex, and the number
+	// of its hits before the cursor.
+	var name string
+	var position int
+	if named, ok := index.(bleveNamedIndex); ok {
+		name = named.pindexName()
+		position = opts.Positions[name]
+	}
+
+	// Only the outermost bleveFanOut of a scroll tracks the pindex of
+	// each hit, for the positions of the next cursor.
+	var origins *bleveHitOrigins
+	if pushDown && opts.Scroll && opts.origins == nil {
+		origins = &bleveHitOrigins{names: map[*search.DocumentMatch]string{}}
+		opts.origins = origins
+	}
+
+	if pushDown {
+		// Each target only needs its top From+Size hits.
+		if scoreOrdered {
+			sortSpec = bleveDefaultSortSpec
+		}
+		sub.Size = req.From + req.Size
+	} else if scoreOrdered {
+		// Score order only needs the top From+Size hits.
+		sortSpec = bleveDefaultSortSpec
+		sub.Size = req.From + req.Size
+		if opts.Scroll {
+			sub.Size++ // To see whether the page's last score ties.
+		}
+		if opts.After != nil {
+			// Also the hits that the previous pages already returned.
+			sub.Size += position
+		}
+	} else {
+		docCount, err := index.DocCount()
+		if err != nil {
+			return nil, 0, nil,
+				fmt.Errorf("bleveSearchSorted DocCount, err: %v", err)
+		}
+
+		// The field sort happens here, so retrieve every match, up
+		// to the sort window max.
+		sub.Size = int(docCount)
+		if sortWindowMax > 0 && sub.Size > sortWindowMax {
+			sub.Size = sortWindowMax
+		}
+	}
+
+	if !scoreOrdered {
+		sub.Fields = append([]string(nil), req.Fields...)
+		for _, s := range sortSpec {
+			field := strings.TrimPrefix(s, "-")
+			if field != "_id" && field != "_score" && !requested[field] {
+				sub.Fields = append(sub.Fields, field)
+			}
+		}
+	}
+
+	var rv *bleve.SearchResult
+	var dups int
+	for {
+		var retrievedAll bool
+		var err error
+		if pushDown {
+			rv, retrievedAll, err = fanOut.searchSorted(&sub, sortSpec,
+				bleveSearchOptions{Scroll: opts.Scroll, After: opts.After,
+					SortWindowMax: opts.SortWindowMax,
+					Positions:     opts.Positions, origins: opts.origins})
+		} else {
+			rv, err = index.Search(&sub)
+			if err == nil {
+				retrievedAll = len(rv.Hits) < sub.Size ||
+					uint64(sub.Size) >= rv.Total
+			}
+		}
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if !scoreOrdered && !pushDown && rv.Total > uint64(sub.Size) {
+			return nil, 0, nil, &QueryBadRequestError{
+				Err: fmt.Errorf("error: sorted query matches: %d hits,"+
+					" which exceeds sort window max: %d,"+
+					" narrow the query or sort by score instead",
+					rv.Total, sortWindowMax),
+			}
+		}
+
+		minScore := 0.0
+		for i, hit := range rv.Hits {
+			if i == 0 || hit.Score < minScore {
+				minScore = hit.Score
+			}
+		}
+
+		if opts.After != nil && !pushDown {
+			rv.Hits = bleveHitsAfter(rv.Hits, sortSpec, opts.After)
+		}
+		if opts.Dedupe {
+			rv.Hits, dups = bleveDedupeHits(rv.Hits)
+		}
+		if (!scoreOrdered && !pushDown) || retrievedAll {
+			break
+		}
+
+		need := req.From + req.Size
+		if len(rv.Hits) >= need {
+			// A pushed down scroll's targets already saw to ties.
+			if !opts.Scroll || !scoreOrdered || pushDown {
+				break
+			}
+			sort.Stable(&bleveHitsSorter{hits: rv.Hits, sortSpec: sortSpec})
+			if need <= 0 || minScore < rv.Hits[need-1].Score {
+				break
+			}
+		} else if !opts.Dedupe && opts.After == nil {
+			break
+		}
+		sub.Size = sub.Size * 2
+	}
+	if dups > 0 {
+		if uint64(dups) < rv.Total {
+			rv.Total -= uint64(dups)
+		} else {
+			rv.Total = uint64(len(rv.Hits))
+		}
+	}
+
+	sort.Stable(&bleveHitsSorter{hits: rv.Hits, sortSpec: sortSpec})
+
+	from := req.From
+	if from > len(rv.Hits) {
+		from = len(rv.Hits)
+	}
+	to := from + req.Size
+	if to > len(rv.Hits) {
+		to = len(rv.Hits)
+	}
+	var next *bleveCursor
+	if opts.Scroll && to > from {
+		// Every retrieved hit sorts after the cursor, so the hits
+		// through the page's last hit move each pindex's position.
+		next = &bleveCursor{
+			Sort:  sortSpec,
+			After: bleveHitSortValues(rv.Hits[to-1], sortSpec),
+		}
+		if origins != nil {
+			next.Positions = map[string]int{}
+			for k, v := range opts.Positions {
+				next.Positions[k] = v
+			}
+			for _, hit := range rv.Hits[:to] {
+				if name, ok := origins.names[hit]; ok {
+					next.Positions[name]++
+				}
+			}
+		} else if name != "" {
+			next.Positions = map[string]int{name: position + to}
+		}
+	}
+
+	rv.Hits = rv.Hits[from:to]
+
+	// Don't leak the fields that were only retrieved for sorting.  A
+	// hit without any requested stored fields has nil Fields, as a
+	// local hit might have an empty map where a hit from a remote
+	// BleveClient has none, so that they're encoded the same.
+	for _, hit := range rv.Hits {
+		for field := range hit.Fields {
+			if !requested[field] {
+				delete(hit.Fields, field)
+			}
+		}
+		if len(hit.Fields) <= 0 {
+			hit.Fields = nil
+		}
+	}
+
+	rv.Request = req
+
+	return rv, dups, next, nil
+}
+
+// ---------------------------------------------------------
+
+// A scroll pages through the hits of a query by a cursor token
+// instead of From, where each response holds the cursor of the next
+// page.  The token is stateless, as it holds the sort values of the
+// last hit returned, and the next page is the hits that sort after
+// those values, which is the same position for every pindex, since
+// the scroll sort spec is a total order.  The cursor is pushed down to
+// every pindex of the fan-out, including remote ones, so that each
+// only returns its top hits after the cursor, and a deep page doesn't
+// retrieve and merge the hits of the earlier pages.
+//
+// As bleve's collectors don't support seeking, nor can a query
+// constrain scores, a pindex still collects its hits from the top.
+// So the token also holds each pindex's position, which is the number
+// of its hits that the previous pages returned, so that a pindex
+// collects its hits through the next page in one search, rather than
+// re-collecting with a doubled size.  The positions are only a hint,
+// as the hits after the cursor are still chosen by their sort values,
+// so a pindex whose hits changed between pages re-collects as needed.
+
+// bleveCursor is the content of a scroll cursor token.
+type bleveCursor struct {
+	Sort      []string       `json:"sort"`
+	After     []interface{}  `json:"after"`
+	Positions map[string]int `json:"positions,omitempty"`
+}
+
+// bleveScrollSortSpec returns the sort spec with "_id" appended,
+// unless it's already there, to make it a total order.
+func bleveScrollSortSpec(sortSpec []string) []string {
+	if len(sortSpec) <= 0 {
+		return bleveDefaultSortSpec
+	}
+	for _, s := range sortSpec {
+		if strings.TrimPrefix(s, "-") == "_id" {
+			return sortSpec
+		}
+	}
+	return append(append([]string(nil), sortSpec...), "_id")
+}
+
+func encodeBleveCursor(c *bleveCursor) (string, error) {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// Parses a cursor token, which must be for the same sort spec.
+func decodeBleveCursor(token string, sortSpec []string) (
+	*bleveCursor, error) {
+	buf, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("error: invalid cursor: %q, err: %v", token, err)
+	}
+	var c bleveCursor
+	err = json.Unmarshal(buf, &c)
+	if err != nil {
+		return nil, fmt.Errorf("error: invalid cursor: %q, err: %v", token, err)
+	}
+	if !reflect.DeepEqual(c.Sort, sortSpec) {
+		return nil, fmt.Errorf("error: cursor sort: %v, does not match"+
+			" query sort: %v", c.Sort, sortSpec)
+	}
+	if len(c.After) != len(sortSpec) {
+		return nil, fmt.Errorf("error: invalid cursor: %q", token)
+	}
+	return &c, nil
+}
+
+func bleveHitSortValues(hit *search.DocumentMatch,
+	sortSpec []string) []interface{} {
+	rv := make([]interface{}, len(sortSpec))
+	for i, spec := range sortSpec {
+		rv[i] = bleveHitValue(hit, strings.TrimPrefix(spec, "-"))
+	}
+	return rv
+}
+
+// Returns the hits that sort strictly after the after sort values.
+func bleveHitsAfter(hits search.DocumentMatchCollection,
+	sortSpec []string, after []interface{}) search.DocumentMatchCollection {
+	rv := make(search.DocumentMatchCollection, 0, len(hits))
+	for _, hit := range hits {
+		c := 0
+		for i, spec := range sortSpec {
+			a := after[i]
+			b := bleveHitValue(hit, strings.TrimPrefix(spec, "-"))
+			c = compareBleveHitValues(a, b)
+			if c != 0 {
+				// Missing values sort last even when descending.
+				if a != nil && b != nil && strings.HasPrefix(spec, "-") {
+					c = -c
+				}
+				break
+			}
+		}
+		if c < 0 {
+			rv = append(rv, hit)
+		}
+	}
+	return rv
+}
+
+// Removes the hits whose doc ID repeats, keeping the highest scoring
+// hit of each ID in its original position.  Returns the remaining
+// hits and the number removed.
+func bleveDedupeHits(hits search.DocumentMatchCollection) (
+	search.DocumentMatchCollection, int) {
+	best := map[string]*search.DocumentMatch{} // Keyed by doc ID.
+	for _, hit := range hits {
+		prev, exists := best[hit.ID]
+		if !exists || hit.Score > prev.Score {
+			best[hit.ID] = hit
+		}
+	}
+	if len(best) == len(hits) {
+		return hits, 0
+	}
+
+	rv := make(search.DocumentMatchCollection, 0, len(best))
+	for _, hit := range hits {
+		if best[hit.ID] == hit {
+			rv = append(rv, hit)
+		}
+	}
+	return rv, len(hits) - len(rv)
+}
+
+type bleveHitsSorter struct {
+	hits     search.DocumentMatchCollection
+	sortSpec []string
+}
+
+func (s *bleveHitsSorter) Len() int      { return len(s.hits) }
+func (s *bleveHitsSorter) Swap(i, j int) { s.hits[i], s.hits[j] = s.hits[j], s.hits[i] }
+
+func (s *bleveHitsSorter) Less(i, j int) bool {
+	for _, spec := range s.sortSpec {
+		field := strings.TrimPrefix(spec, "-")
+		a := bleveHitValue(s.hits[i], field)
+		b := bleveHitValue(s.hits[j], field)
+		c := compareBleveHitValues(a, b)
+		if c != 0 {
+			// Missing values sort last even when descending.
+			if a != nil && b != nil && strings.HasPrefix(spec, "-") {
+				return c > 0
+			}
+			return c < 0
+		}
+	}
+	return false
+}
+
+func bleveHitValue(hit *search.DocumentMatch, field string) interface{} {
+	switch field {
+	case "_id":
+		return hit.ID
+	case "_score":
+		return hit.Score
+	}
+	return hit.Fields[field]
+}
+
+// compareBleveHitValues orders numbers before strings before other
+// values, with nil (missing) values last.
+func compareBleveHitValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case float64:
+			return 0
+		case string:
+			return 1
+		case nil:
+			return 3
+		}
+		return 2
+	}
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch av := a.(type) {
+	case float64:
+		bv := b.(float64)
+		if av < bv {
+			return -1
+		}
+		if av > bv {
+			return 1
+		}
+	case string:
+		bv := b.(string)
+		if av < bv {
+			return -1
+		}
+		if av > bv {
+			return 1
+		}
+	}
+	return 0
+}
+
+func QueryBlevePIndexImpl(mgr *Manager, indexName, indexUUID string,
+	req []byte, res io.Writer) error {
+	var bleveQueryParams BleveQueryParams
+	err := json.Unmarshal(req, &bleveQueryParams)
+	if err != nil {
+		return &QueryBadRequestError{
+			Err: fmt.Errorf("QueryBlevePIndexImpl parsing bleveQueryParams,"+
+				" req: %s, err: %v", req, err),
+		}
+	}
+
+	err = bleveQueryParams.Validate()
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	err = bleveQueryParams.prepareIdsOnly(req)
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	err = checkBleveQueryExpansion(mgr, req)
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	err = checkBleveQueryAnalyzers(mgr, indexName, req)
+	if err != nil {
+		return err
+	}
+
+	err = checkBleveQueryFields(mgr, indexName, req)
+	if err != nil {
+		return err
+	}
+
+	// TOOD: get cancelCh from caller.
+	cancelCh, cancelDone := queryTimeoutCancelCh(
+		bleveQueryTimeoutMS(mgr, indexName, bleveQueryParams.Timeout))
+	defer cancelDone()
+
+	var stats *BleveQueryStats
+	if bleveQueryParams.Debug {
+		stats = &BleveQueryStats{}
+	}
+	start := time.Now()
+
+	alias, err := bleveIndexAlias(mgr, indexName, indexUUID,
+		bleveQueryParams.Consistency, cancelCh,
+		!bleveQueryParams.SkipRemoteProbe,
+		bleveQueryParams.IncludeTombstones, stats)
+	if err != nil {
+		if isQueryError(err) {
+			return err
+		}
+		return fmt.Errorf("QueryBlevePIndexImpl indexAlias error,"+
+			" indexName: %s, indexUUID: %s, err: %v", indexName, indexUUID, err)
+	}
+
+	err = bleveQueryParams.checkSkipped(alias)
+	if err != nil {
+		return err
+	}
+
+	searchResponse, dups, cursor, err := bleveQueryParams.search(mgr, alias)
+	if err != nil {
+		return err
+	}
+	if dups > 0 {
+		atomic.AddUint64(&mgr.stats.TotQueryDuplicateHit, uint64(dups))
+	}
+
+	if bleveQueryParams.IdsOnly {
+		return encodeBleveSearchResultIds(res, searchResponse)
+	}
+
+	var sources map[string][]byte
+	if bleveQueryParams.IncludeSource {
+		sources, err = bleveHitSources(mgr, indexName, searchResponse)
+		if err != nil {
+			return err
+		}
+	}
+
+	extras := map[string]interface{}{}
+	if bleveQueryParams.scrolling() {
+		extras["cursor"] = cursor
+	}
+	if len(alias.skipped) > 0 {
+		extras["skipped"] = alias.skipped
+	}
+	if stats != nil {
+		stats.TotalNS = int64(time.Since(start))
+		stats.NumDuplicateHits = dups
+
+		extras["cbft"] = stats
+	}
+
+	return encodeBleveSearchResult(res, searchResponse, extras, sources)
+}
+
+// Returns the full docs of the search result's hits, keyed by doc ID,
+// from the couchbase data source of the index.
+func bleveHitSources(mgr *Manager, indexName string,
+	searchResponse *bleve.SearchResult) (map[string][]byte, error) {
+	_, indexDefsByName, err := mgr.GetIndexDefs(false)
+	if err != nil {
+		return nil, err
+	}
+	indexDef := indexDefsByName[indexName]
+	if indexDef == nil {
+		return nil, fmt.Errorf("error: includeSource no indexDef,"+
+			" indexName: %s", indexName)
+	}
+	if !strings.HasPrefix(indexDef.SourceType, "couchbase") {
+		return nil, fmt.Errorf("error: includeSource unsupported sourceType: %s,"+
+			" indexName: %s", indexDef.SourceType, indexName)
+	}
+
+	bip, _, err := ParseBleveIndexParams(indexDef.Params)
+	if err != nil {
+		return nil, err
+	}
+	inverse, err := bleveDocIdInverse(bip.DocIdTransform)
+	if err != nil {
+		return nil, fmt.Errorf("error: includeSource unsupported,"+
+			" indexName: %s, err: %v", indexName, err)
+	}
+
+	// The partitions of a multi-bucket source are namespaced by
+	// bucket name.
+	var namespaces []string
+	bucketNames := SourceBucketNames(indexDef.SourceName)
+	if len(bucketNames) > 1 {
+		namespaces = bucketNames
+	}
+
+	// The bucket, if known, and source key of each hit ID, as the
+	// docIdTransform and keyEncoding transformed them.
+	type sourceKey struct {
+		bucketName string
+		key        string
+	}
+	sourceKeys := map[string]sourceKey{}
+	keys := map[string][]string{}
+	for _, hit := range searchResponse.Hits {
+		if _, exists := sourceKeys[hit.ID]; exists {
+			continue
+		}
+		namespace, key, ok := "", []byte(hit.ID), true
+		if inverse != nil {
+			namespace, key, ok = inverse(hit.ID, namespaces)
+		}
+		if !ok {
+			return nil, fmt.Errorf("error: includeSource could not invert"+
+				" docIdTransform: %s, id: %s, indexName: %s",
+				bip.DocIdTransform, hit.ID, indexName)
+		}
+		key, err = BleveDecodeKey(bip.KeyEncoding, string(key))
+		if err != nil {
+			return nil, fmt.Errorf("error: includeSource could not decode"+
+				" id: %s, indexName: %s, err: %v", hit.ID, indexName, err)
+		}
+		sourceKeys[hit.ID] = sourceKey{namespace, string(key)}
+		keys[namespace] = append(keys[namespace], string(key))
+	}
+	if len(keys) <= 0 {
+		return map[string][]byte{}, nil
+	}
+
+	docs, err := CouchbaseSourceDocs(mgr.sourceBuckets,
+		indexDef.SourceName, mgr.server, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make(map[string][]byte, len(sourceKeys))
+	for id, sk := range sourceKeys {
+		if doc, exists := docs[sk.bucketName][sk.key]; exists {
+			rv[id] = doc
+		}
+	}
+	return rv, nil
+}
+
+// Strips the parts of an idsOnly query's search request that don't
+// affect which doc IDs match, so that neither the pindexes nor the
+// remote fan-out do that work, and defaults the size of a req that
+// doesn't specify one.
+func (p *BleveQueryParams) prepareIdsOnly(req []byte) error {
+	if !p.IdsOnly {
+		return nil
+	}
+
+	var r struct {
+		Query struct {
+			Size *int `json:"size"`
+		} `json:"query"`
+	}
+	err := json.Unmarshal(req, &r)
+	if err != nil {
+		return fmt.Errorf("error: prepareIdsOnly parsing req, err: %v", err)
+	}
+	if r.Query.Size == nil {
+		p.Query.Size = BLEVE_QUERY_IDS_ONLY_SIZE
+	}
+
+	p.Query.Fields = nil
+	p.Query.Highlight = nil
+	p.Query.Facets = nil
+	p.Query.Explain = false
+
+	return nil
+}
+
+// Writes the doc IDs of the search result's hits as a JSON array.
+func encodeBleveSearchResultIds(res io.Writer,
+	searchResponse *bleve.SearchResult) error {
+	ids := make([]string, 0, len(searchResponse.Hits))
+	for _, hit := range searchResponse.Hits {
+		ids = append(ids, hit.ID)
+	}
+	mustEncode(res, ids)
+	return nil
+}
+
+func (p *BleveQueryParams) scrolling() bool {
+	return p.Scroll || p.Cursor != ""
+}
+
+// Fails a query whose alias skipped unhealthy remote pindexes, unless
+// the query allows partial results.
+func (p *BleveQueryParams) checkSkipped(alias *bleveFanOut) error {
+	if p.Partial {
+		return nil
+	}
+	return bleveSkippedError(alias.skipped)
+}
+
+// Returns a QueryUnavailableError that lists the skipped remote
+// pindexes, if any.
+func bleveSkippedError(skipped map[string]string) error {
+	if len(skipped) <= 0 {
+		return nil
+	}
+	names := make([]string, 0, len(skipped))
+	for name := range skipped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &QueryUnavailableError{
+		Err: fmt.Errorf("error: unhealthy remote pindexes: %v,"+
+			" which a partial query skips", names),
+	}
+}
+
+// Searches the index per the query params, returning the number of
+// duplicate hits removed and, when scrolling, the cursor of the next
+// page.
+func (p *BleveQueryParams) search(mgr *Manager, index bleve.Index) (
+	*bleve.SearchResult, int, string, error) {
+	sortSpec := p.Sort
+	opts := bleveSearchOptions{Dedupe: p.Dedupe, Scroll: p.scrolling(),
+		SortWindowMax: bleveQuerySortWindowMax(mgr)}
+	if opts.Scroll {
+		sortSpec = bleveScrollSortSpec(p.Sort)
+		if p.Cursor != "" {
+			c, err := decodeBleveCursor(p.Cursor, sortSpec)
+			if err != nil {
+				return nil, 0, "", err
+			}
+			opts.After = c.After
+			opts.Positions = c.Positions
+		}
+	}
+
+	rv, dups, next, err := bleveSearchMerged(index, p.Query, sortSpec, opts)
+	if err != nil || next == nil {
+		return rv, dups, "", err
+	}
+
+	cursor, err := encodeBleveCursor(next)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	return rv, dups, cursor, nil
+}
+
+// Encodes a search result, adding any extras as sections alongside
+// bleve's fields.
+func encodeBleveSearchResult(res io.Writer, searchResponse *bleve.SearchResult,
+	extras map[string]interface{}, sources map[string][]byte) error {
+	if len(extras) <= 0 && sources == nil {
+		mustEncode(res, searchResponse)
+		return nil
+	}
+
+	buf, err := json.Marshal(searchResponse)
+	if err != nil {
+		return err
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(buf, &m)
+	if err != nil {
+		return err
+	}
+	for k, v := range extras {
+		m[k] = v
+	}
+
+	hits, _ := m["hits"].([]interface{})
+	for i, hit := range searchResponse.Hits {
+		body, exists := sources[hit.ID]
+		if !exists || i >= len(hits) {
+			continue
+		}
+		if h, ok := hits[i].(map[string]interface{}); ok {
+			if json.Valid(body) {
+				h["source"] = json.RawMessage(body)
+			} else {
+				h["source"] = string(body)
+			}
+		}
+	}
+
+	mustEncode(res, m)
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+const BLEVE_DEST_INITIAL_BUF_SIZE_BYTES = 20000
+const BLEVE_DEST_APPLY_BUF_SIZE_BYTES = 200000
+
+// Max bytes of a pending batch when the snapshotAtomic index param is
+// enabled, beyond which the batch is applied even though the snapshot
+// isn't complete, bounding memory usage for very large snapshots.
+const BLEVE_DEST_SNAPSHOT_ATOMIC_BUF_SIZE_BYTES = 20000000
+
+// Max number of consistency wait requests that can be buffered for a
+// partition before being queued, and max number of consistency wait
+// requests that can be queued for a partition.  Beyond these limits,
+// consistency waits are rejected with an error rather than blocking.
+const BLEVE_DEST_CWR_CH_SIZE = 1000
+const BLEVE_DEST_CWR_QUEUE_MAX = 10000
+
+// The field of a tombstone document that holds its deletion time, in
+// unix millisecs.  See BleveIndexParams.TombstoneTTL.
+const BLEVE_DEST_TOMBSTONE_FIELD = "_deletedAt"
+
+// How often expired tombstones are purged, in millisecs.
+var BleveDestTombstonePurgeMS = 10000
+
+// The max number of tombstones that are purged per batch.
+const BLEVE_DEST_PURGE_BATCH_SIZE = 1000
+
+// Returns a query for the tombstones whose deletion time is within
+// the optional min and max, in unix millisecs.
+func newBleveTombstoneQuery(min, max *float64) bleve.Query {
+	if min == nil {
+		zero := 0.0
+		min = &zero
+	}
+	query := bleve.NewNumericRangeQuery(min, max)
+	query.SetField(BLEVE_DEST_TOMBSTONE_FIELD)
+	return query
+}
+
+var bleveDestTimeNow = time.Now // Overridable for testing.
+
+// How often the stores of a BleveDest with the "fast" durability are
+// fsync'ed, in millisecs, which bounds the batches that an OS crash
+// can lose.  See BleveIndexParams.Durability.
+var BleveDestSyncMS = 1000
+
+// Max millisecs that closing a BleveDest waits for inflight queries
+// to complete before it closes the bleve index anyway.
+var BleveDestCloseQueryWaitMS = 10000
+
+// The error of a query against a BleveDest that's closed or closing.
+var errBleveDestClosed = fmt.Errorf("error: BleveDest closed")
+
+type BleveDest struct {
+	path    string
+	restart func() // Invoked when caller should restart this BleveDest, like on rollback.
+
+	// When non-nil, invoked instead of restart after a rollback.
+	rollbackHandler func(partition string, rollbackSeq, seqMax uint64)
+
+	// When true, batches are only applied at snapshot boundaries.
+	// See BleveIndexParams.SnapshotAtomic.
+	snapshotAtomic bool
+
+	// When > 0, a partition with an at_plus consistency waiter forces
+	// a batch apply after this.  See BleveIndexParams.ForceFlushMS.
+	forceFlushAfter time.Duration
+
+	// See BleveIndexParams.KeyEncoding.
+	keyEncoding string
+
+	// When > 0, larger document values are skipped rather than
+	// indexed.  See BleveIndexParams.MaxDocSize.
+	maxDocSize int
+
+	numDocsTooLarge uint64 // Atomic counter of skipped documents.
+
+	// When nil, source document keys are indexed as-is.
+	docIdTransform BleveDocIdTransform
+
+	// When nil, source document values are indexed as-is.
+	docTransform BleveDocTransform
+
+	// When non-nil, only matching documents are indexed.
+	docFilter BleveDocFilter
+
+	// When > 0, deletions index tombstones that expire after this.
+	tombstoneTTL time.Duration
+
+	// See BleveIndexParams.Durability, where "" means "safe".
+	durability string
+
+	// When non-empty, documents are routed to the type mapping that
+	// languageMappings associates with their languageField value, by
+	// setting the index mapping's typeField.
+	languageField    string
+	languageMappings map[string]string
+	typeField        string
+
+	// Non-nil when each partition has its own bleve index, where the
+	// partitionAlias is also the bindex.
+	partitionAlias *blevePartitionAlias
+
+	// The Manager that owns this BleveDest's pindex, if any, whose
+	// options limit the queries that are served directly by the dest,
+	// such as via the /api/pindex/{pindexName}/query endpoint.
+	mgr *Manager
+
+	// The budget of buffered bytes, which is unlimited and private
+	// to this BleveDest unless shared by a Manager via SetManager().
+	buffered *bleveDestBudget
+
+	// When > 0, batch applies are left pending, such as while Export()
+	// copies the index files.  Only accessed via sync/atomic.
+	applyPaused int32
+
+	// Time from when mutations are received to when they're applied.
+	ingestLag LatencyHistogram
+
+	m          sync.Mutex // Protects the fields that follow.
+	bindex     bleve.Index
+	partitions map[string]*BleveDestPartition
+	purging    bool // True while PurgeTombstones() searches.
+
+	// The current generation of the refs of the inflight queries,
+	// which a close or a partition rollback waits for.  See
+	// bleveDestIndex.
+	queries *bleveQueryRefs
+}
+
+// Used to track state for a single partition.
+type BleveDestPartition struct {
+	bdest           *BleveDest
+	partition       string
+	partitionBytes  []byte // Key used to persist seqMax; never modified.
+	partitionOpaque []byte // Key used to implement SetOpaque/GetOpaque().
+
+	m           sync.Mutex   // Protects the fields that follow.
+	seqMax      uint64       // Max seq # we've seen for this partition.
+	seqMaxBuf   []byte       // For binary encoded seqMax uint64.
+	seqMaxRead  bool         // True when seqMax was read from the bindex.
+	seqMaxBatch uint64       // Max seq # that got through batch apply/commit.
+	seqSnapEnd  uint64       // To track snapshot end seq # for this partition.
+	numBatches  uint64       // Number of batches applied, see checkExactSeqs().
+	buf         []byte       // The batch points to slices from buf, which we reuse.
+	batch       *bleve.Batch // Batch is applied when too big or when we hit seqSnapEnd.
+	recvTimes   []int64      // Unix nanosecs each mutation of the batch was received.
+
+	lastOpaque     []byte // Cache most recent value for SetOpaque()/GetOpaque().
+	lastOpaqueRead bool   // True when lastOpaque was read from the bindex.
+
+	cwrCh    chan *consistencyWaitReq
+	cwrQueue cwrQueue
+
+	forceFlushPending bool // True when a forced batch apply is scheduled.
+
+	// The doc IDs of the batch, tracked when the BleveDest has a
+	// tombstoneTTL, and the doc IDs of the batches that were applied
+	// while PurgeTombstones() searched, whose tombstones the search
+	// might have found but which are no longer tombstones, or are
+	// younger ones.  The purgeDocIds is nil when not purging.
+	batchDocIds map[string]struct{}
+	purgeDocIds map[string]struct{}
+}
+
+type consistencyWaitReq struct {
+	consistencyLevel string
+	consistencySeq   uint64
+	cancelCh         chan struct{}
+	doneCh           chan error
+	startTime        time.Time
+}
+
+// ---------------------------------------------------------
+
+// A cwrQueue implements heap.Interface for consistencyWaitReq's.
+type cwrQueue []*consistencyWaitReq
+
+func (pq cwrQueue) Len() int { return len(pq) }
+
+func (pq cwrQueue) Less(i, j int) bool {
+	return pq[i].consistencySeq < pq[j].consistencySeq
+}
+
+func (pq cwrQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+}
+
+func (pq *cwrQueue) Push(x interface{}) {
+	*pq = append(*pq, x.(*consistencyWaitReq))
+}
+
+func (pq *cwrQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	*pq = old[0 : n-1]
+	return item
+}
+
+// ---------------------------------------------------------
+
+func NewBleveDest(path string, bindex bleve.Index, restart func()) Dest {
+	return &BleveDest{
+		path:       path,
+		restart:    restart,
+		bindex:     bindex,
+		partitions: make(map[string]*BleveDestPartition),
+		buffered:   newBleveDestBudget(0),
+		queries:    newBleveQueryRefs(nil),
+	}
+}
+
+// Implements the DestManagerHandler interface.
+func (t *BleveDest) SetManager(mgr *Manager) {
+	t.mgr = mgr
+	t.buffered = mgr.bleveDestBuffered
+}
+
+// Implements the DestSeqs interface.
+func (t *BleveDest) PartitionSeqs(partition string) (
+	seqMax, seqSnapEnd uint64, err error) {
+	t.m.Lock()
+	if t.bindex == nil {
+		t.m.Unlock()
+		return 0, 0, fmt.Errorf("BleveDest already closed")
+	}
+	bdp := t.partitions[partition]
+	t.m.Unlock()
+
+	if bdp == nil {
+		return 0, 0, nil
+	}
+
+	bdp.m.Lock()
+	defer bdp.m.Unlock()
+	return bdp.seqMax, bdp.seqSnapEnd, nil
+}
+
+func (t *BleveDest) getPartition(partition string) (
+	*BleveDestPartition, bleve.Index, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return t.getPartitionUnlocked(partition)
+}
+
+func (t *BleveDest) getPartitionUnlocked(partition string) (
+	*BleveDestPartition, bleve.Index, error) {
+	if t.bindex == nil {
+		return nil, nil, fmt.Errorf("BleveDest already closed")
+	}
+
+	bindex := t.bindex
+	if t.partitionAlias != nil {
+		var err error
+		bindex, err = t.partitionAlias.partitionIndex(partition)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	bdp, exists := t.partitions[partition]
+	if !exists || bdp == nil {
+		bdp = &BleveDestPartition{
+			bdest:           t,
+			partition:       partition,
+			partitionBytes:  []byte(partition),
+			partitionOpaque: []byte("o:" + partition),
+			seqMaxBuf:       make([]byte, 8), // Binary encoded seqMax uint64.
+			batch:           bleve.NewBatch(),
+			cwrCh:           make(chan *consistencyWaitReq, BLEVE_DEST_CWR_CH_SIZE),
+			cwrQueue:        cwrQueue{},
+		}
+		heap.Init(&bdp.cwrQueue)
+
+		if t.purging {
+			bdp.purgeDocIds = map[string]struct{}{}
+		}
+
+		go bdp.run()
+
+		t.partitions[partition] = bdp
+	}
+
+	return bdp, bindex, nil
+}
+
+// Returns the bleve indexes that hold the documents of the BleveDest,
+// which are the partition indexes when there's a partitionAlias.
+func (t *BleveDest) bindexesUnlocked() []bleve.Index {
+	if t.partitionAlias != nil {
+		return t.partitionAlias.partitionIndexes()
+	}
+	return []bleve.Index{t.bindex}
+}
+
+func (t *BleveDest) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return t.closeUnlocked()
+}
+
+func (t *BleveDest) closeUnlocked() error {
+	if t.bindex == nil {
+		return fmt.Errorf("BleveDest already closed")
+	}
+
+	for _, bdp := range t.partitions {
+		close(bdp.cwrCh)
+		t.buffered.release(bdp)
+	}
+	t.partitions = make(map[string]*BleveDestPartition)
+
+	// As t.m is held, no more queries can start.
+	t.waitQueries(t.retireQueriesUnlocked(),
+		time.Duration(BleveDestCloseQueryWaitMS)*time.Millisecond)
+
+	if t.durability == BLEVE_DURABILITY_FAST {
+		// A clean close doesn't lose the batches since the last sync.
+		_, err := syncBleveStores(t.storePathsUnlocked())
+		if err != nil {
+			log.Printf("bleve dest close sync, path: %s, err: %v", t.path, err)
+		}
+	}
+
+	err := t.bindex.Close()
+	if err != nil {
+		return err
+	}
+
+	t.bindex = nil
+
+	return nil
+}
+
+// Starts a new generation of query refs, returning the retired one
+// for waitQueries().  The caller must hold t.m.
+func (t *BleveDest) retireQueriesUnlocked() *bleveQueryRefs {
+	q := t.queries
+	t.queries = newBleveQueryRefs(q)
+	q.retire()
+	return q
+}
+
+// Waits up to the timeout for the queries that hold refs of the
+// retired generation, or of any earlier one, to complete.
+func (t *BleveDest) waitQueries(q *bleveQueryRefs, timeout time.Duration) {
+	if !q.wait(timeout) {
+		log.Printf("bleve dest, path: %s, inflight queries"+
+			" did not complete within: %v", t.path, timeout)
+	}
+}
+
+// bleveQueryRefs counts the refs that are held by the queries which
+// started during one generation, where a ref holds off the close of
+// the bleve indexes that its query uses.  A close or a partition
+// rollback retires the current generation, and then waits only for
+// the refs of it and of the earlier generations, while the queries
+// that start afterwards take refs of the next generation.
+type bleveQueryRefs struct {
+	prev *bleveQueryRefs // An earlier generation, which might not be done.
+
+	m       sync.Mutex // Protects the fields that follow.
+	n       int
+	retired bool
+	doneCh  chan struct{} // Closed once retired and without refs.
+}
+
+func newBleveQueryRefs(prev *bleveQueryRefs) *bleveQueryRefs {
+	for prev != nil && prev.done() {
+		prev = prev.prev
+	}
+	return &bleveQueryRefs{prev: prev, doneCh: make(chan struct{})}
+}
+
+// Takes a ref, which the caller must hold the BleveDest's t.m for, so
+// that it's never taken after the generation is retired.
+func (q *bleveQueryRefs) acquire() {
+	q.m.Lock()
+	q.n++
+	q.m.Unlock()
+}
+
+func (q *bleveQueryRefs) release() {
+	q.m.Lock()
+	q.n--
+	if q.n == 0 && q.retired {
+		close(q.doneCh)
+	}
+	q.m.Unlock()
+}
+
+func (q *bleveQueryRefs) retire() {
+	q.m.Lock()
+	q.retired = true
+	if q.n == 0 {
+		close(q.doneCh)
+	}
+	q.m.Unlock()
+}
+
+func (q *bleveQueryRefs) done() bool {
+	select {
+	case <-q.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns whether the generation and the earlier ones are done before
+// the timeout.
+func (q *bleveQueryRefs) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for ; q != nil; q = q.prev {
+		select {
+		case <-q.doneCh:
+		case <-timer.C:
+			return false
+		}
+	}
+	return true
+}
+
+// Warmup primes the boltdb and OS caches of the bleve index by
+// iterating all of its rows, and then by running the warmupQuery, if
+// it's not "".
+func (t *BleveDest) Warmup(warmupQuery string) error {
+	// NOTE: t.m must not be taken while holding the query ref, as a
+	// close holds t.m while it waits for the queries.
+	bindex, bindexes, q, err := t.acquireQueryIndexes()
+	if err != nil {
+		return err
+	}
+	defer q.release()
+
+	// The dumps are always drained, so their producers don't leak.
+	var dumpErr error
+	for _, b := range bindexes {
+		for v := range b.DumpAll() {
+			if err, ok := v.(error); ok && dumpErr == nil {
+				dumpErr = err
+			}
+		}
+	}
+	if dumpErr != nil {
+		return dumpErr
+	}
+
+	if warmupQuery == "" {
+		return nil
+	}
+	_, err = bindex.Search(bleve.NewSearchRequest(
+		bleve.NewQueryStringQuery(warmupQuery)))
+	return err
+}
+
+// Returns the bleve index for a query, along with the query ref that
+// must be released when the query completes.
+func (t *BleveDest) acquireQuery() (bleve.Index, *bleveQueryRefs, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.bindex == nil {
+		return nil, nil, errBleveDestClosed
+	}
+	t.queries.acquire()
+
+	return t.bindex, t.queries, nil
+}
+
+// Like acquireQuery(), but also returns the bleve indexes that hold
+// the documents, snapshotted under the same lock.
+func (t *BleveDest) acquireQueryIndexes() (
+	bleve.Index, []bleve.Index, *bleveQueryRefs, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.bindex == nil {
+		return nil, nil, nil, errBleveDestClosed
+	}
+	t.queries.acquire()
+
+	return t.bindex, t.bindexesUnlocked(), t.queries, nil
+}
+
+// bleveDestIndex is the bleve.Index of a BleveDest as used by
+// queries, where Search() and DocCount() hold off the BleveDest's
+// close until they complete, and fail with errBleveDestClosed rather
+// than a raw bleve error once the BleveDest is closed.
+//
+// When asOf is non-nil, for an "as_of" consistency level query, a
+// search fails with a SnapshotNotAvailableError unless each of the
+// asOf partitions was at exactly its asOf seq throughout the search.
+// See checkExactSeqs().
+//
+// The tombstones of a BleveDest with a tombstoneTTL are excluded from
+// the searches and the doc count, unless includeTombstones is true.
+type bleveDestIndex struct {
+	bleve.Index
+	bdest *BleveDest
+	asOf  ConsistencyVector
+	name  string // The pindex name, which is optional.
+
+	includeTombstones bool
+}
+
+func (b *bleveDestIndex) pindexName() string {
+	return b.name
+}
+
+func (b *bleveDestIndex) excludeTombstones() bool {
+	return b.bdest.tombstoneTTL > 0 && !b.includeTombstones
+}
+
+func (b *bleveDestIndex) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	if b.excludeTombstones() {
+		reqCopy := *req
+		reqCopy.Query = bleve.NewBooleanQuery([]bleve.Query{req.Query},
+			nil, []bleve.Query{newBleveTombstoneQuery(nil, nil)})
+		req = &reqCopy
+	}
+
+	var batches map[string]uint64
+	if b.asOf != nil {
+		batches = b.bdest.numBatches(b.asOf)
+	}
+
+	bindex, q, err := b.bdest.acquireQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	rv, err := bindex.Search(req)
+
+	// Released before checkExactSeqs() takes t.m, as a close holds t.m
+	// while waiting for the inflight queries.
+	q.release()
+
+	if err != nil || b.asOf == nil {
+		return rv, err
+	}
+
+	err = b.bdest.checkExactSeqs(b.asOf, batches)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// Returns the number of batches applied so far to each partition of
+// the vector, for checkExactSeqs().
+func (t *BleveDest) numBatches(vector ConsistencyVector) map[string]uint64 {
+	rv := make(map[string]uint64, len(vector))
+	for partition := range vector {
+		t.m.Lock()
+		bdp := t.partitions[partition]
+		t.m.Unlock()
+
+		if bdp != nil {
+			bdp.m.Lock()
+			rv[partition] = bdp.numBatches
+			bdp.m.Unlock()
+		}
+	}
+	return rv
+}
+
+// An exact-seq check, after a search, that returns a
+// SnapshotNotAvailableError unless the latest applied seq of each
+// partition is the seq in the vector, and no batch was applied to the
+// partition since numBatches() counted them before the search.  A
+// partition that's not known, such as after a close, has no snapshot
+// available.
+//
+// This isn't a point-in-time check of the whole index, as older
+// snapshots aren't retained: the partitions of the index that aren't
+// in the vector, and the purges of expired tombstones, might still
+// change what the search saw.
+func (t *BleveDest) checkExactSeqs(vector ConsistencyVector,
+	batches map[string]uint64) error {
+	for partition, seq := range vector {
+		t.m.Lock()
+		bdp := t.partitions[partition]
+		t.m.Unlock()
+
+		var seqMaxBatch, numBatches uint64
+		if bdp != nil {
+			bdp.m.Lock()
+			seqMaxBatch = bdp.seqMaxBatch
+			numBatches = bdp.numBatches
+			bdp.m.Unlock()
+		}
+
+		if seqMaxBatch != seq || numBatches != batches[partition] {
+			return &SnapshotNotAvailableError{
+				Partition:    partition,
+				Seq:          seq,
+				SeqAvailable: seqMaxBatch,
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the subset of an "as_of" consistency level's vector for the
+// partitions of the pindex, or nil for other consistency levels.
+func bleveAsOfVector(pindex *PIndex,
+	consistencyParams *ConsistencyParams) ConsistencyVector {
+	if consistencyParams == nil || consistencyParams.Level != "as_of" {
+		return nil
+	}
+	consistencyVector := consistencyParams.Vectors[pindex.IndexName]
+	rv := ConsistencyVector{}
+	for _, partition := range pindex.seqPartitions() {
+		if seq := consistencyVector[partition]; seq > 0 {
+			rv[partition] = seq
+		}
+	}
+	return rv
+}
+
+func (b *bleveDestIndex) DocCount() (uint64, error) {
+	bindex, q, err := b.bdest.acquireQuery()
+	if err != nil {
+		return 0, err
+	}
+	defer q.release()
+
+	count, err := bindex.DocCount()
+	if err != nil || !b.excludeTombstones() {
+		return count, err
+	}
+
+	res, err := bindex.Search(bleve.NewSearchRequestOptions(
+		newBleveTombstoneQuery(nil, nil), 0, 0, false))
+	if err != nil {
+		return 0, err
+	}
+	if res.Total > count {
+		return 0, nil
+	}
+	return count - res.Total, nil
+}
+
+// Periodically purges expired tombstones until the BleveDest closes.
+func (t *BleveDest) runTombstonePurger() {
+	for {
+		time.Sleep(time.Duration(BleveDestTombstonePurgeMS) * time.Millisecond)
+
+		n, err := t.PurgeTombstones()
+		if err != nil {
+			t.m.Lock()
+			closed := t.bindex == nil
+			t.m.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("bleve dest purge tombstones, path: %s, err: %v",
+				t.path, err)
+		} else if n > 0 {
+			log.Printf("bleve dest purge tombstones, path: %s, purged: %d",
+				t.path, n)
+		}
+	}
+}
+
+// Periodically fsyncs the stores of a BleveDest with the "fast"
+// durability, until the BleveDest closes.
+func (t *BleveDest) runStoreSyncer() {
+	for {
+		time.Sleep(time.Duration(BleveDestSyncMS) * time.Millisecond)
+
+		t.m.Lock()
+		closed := t.bindex == nil
+		storePaths := t.storePathsUnlocked()
+		t.m.Unlock()
+		if closed {
+			return
+		}
+
+		// The fsync's are outside of t.m, so they don't stall the
+		// mutation path.
+		_, err := syncBleveStores(storePaths)
+		if err != nil {
+			log.Printf("bleve dest sync stores, path: %s, err: %v",
+				t.path, err)
+		}
+	}
+}
+
+// Returns the paths of the boltdb files of the BleveDest's indexes.
+func (t *BleveDest) storePathsUnlocked() []string {
+	paths := []string{t.path}
+	if t.partitionAlias != nil {
+		paths = t.partitionAlias.partitionPaths()
+	}
+	for i, path := range paths {
+		paths[i] = path + string(os.PathSeparator) + "store"
+	}
+	return paths
+}
+
+// Fsyncs the files, which needn't be the file handles that wrote
+// them, returning how many were synced.  Files that don't exist, such
+// as after a rollback, are skipped.
+func syncBleveStores(paths []string) (int, error) {
+	n := 0
+	for _, path := range paths {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return n, err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Export copies the files of the BleveDest's index, along with its
+// PINDEX_META, into the exportPath, which must not exist, such as to
+// migrate or debug a pindex without rebuilding it from its source
+// (see ImportBlevePIndexImpl).  The partitions' pending batches are
+// applied first, unless the index is snapshotAtomic.  The index files
+// are then left unchanged during the copy by pausing the batch
+// applies, which the feeds keep buffering, without holding any lock,
+// so the copy is consistent.  As the seqs are persisted in the same
+// batches as the docs, a pindex that's restored from the copy resumes
+// its feed from where the copy ends.
+func (t *BleveDest) Export(exportPath string) error {
+	err := t.Flush()
+	if err != nil {
+		return err
+	}
+
+	partitionPaths, q, err := t.pauseApplies()
+	if err != nil {
+		return err
+	}
+
+	err = copyPIndexPath(t.path, exportPath)
+	if err == nil && t.partitionAlias != nil {
+		err = removeNewPartitionPaths(exportPath, partitionPaths)
+		if err != nil {
+			os.RemoveAll(exportPath)
+		}
+	}
+
+	// Released before resuming takes t.m, as a close holds t.m while
+	// waiting for the query refs.
+	q.release()
+
+	t.resumeApplies()
+
+	if err != nil {
+		return fmt.Errorf("error: BleveDest.Export, path: %s,"+
+			" exportPath: %s, err: %v", t.path, exportPath, err)
+	}
+	return nil
+}
+
+// Pauses the batch applies, returning the paths of the partition
+// indexes, if any, as of the pause, along with a query ref that holds
+// off a close or rollback, which the caller must release before
+// calling resumeApplies().
+func (t *BleveDest) pauseApplies() ([]string, *bleveQueryRefs, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.bindex == nil {
+		return nil, nil, errBleveDestClosed
+	}
+	t.queries.acquire()
+
+	// As every batch apply holds its partition's lock, grabbing each
+	// lock waits out any apply that's already in progress.
+	atomic.AddInt32(&t.applyPaused, 1)
+	for _, bdp := range t.partitions {
+		bdp.m.Lock()
+		bdp.m.Unlock()
+	}
+
+	if t.partitionAlias != nil {
+		return t.partitionAlias.partitionPaths(), t.queries, nil
+	}
+	return nil, t.queries, nil
+}
+
+// Resumes the batch applies, applying the batches that became due
+// while paused.
+func (t *BleveDest) resumeApplies() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if atomic.AddInt32(&t.applyPaused, -1) > 0 || t.bindex == nil {
+		return
+	}
+
+	for partition, bdp := range t.partitions {
+		_, bindex, err := t.getPartitionUnlocked(partition)
+		if err != nil {
+			continue
+		}
+
+		bdp.m.Lock()
+		if bdp.seqMaxBatch < bdp.seqMax &&
+			(!t.snapshotAtomic || bdp.seqMax >= bdp.seqSnapEnd) {
+			err = bdp.applyBatchUnlocked(bindex)
+			if err != nil {
+				log.Printf("bleve dest resume applies, partition: %s,"+
+					" err: %v", partition, err)
+			}
+		}
+		bdp.m.Unlock()
+	}
+}
+
+// Removes the partition indexes from the exportPath of an Export()
+// that weren't among the partitionPaths when the batch applies were
+// paused, as they were created during the copy, and so might be torn,
+// but hold no applied data.
+func removeNewPartitionPaths(exportPath string,
+	partitionPaths []string) error {
+	dir := exportPath + string(os.PathSeparator) + BLEVE_PARTITION_INDEXES_DIR
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	paused := map[string]bool{}
+	for _, partitionPath := range partitionPaths {
+		paused[filepath.Base(partitionPath)] = true
+	}
+
+	for _, fileInfo := range fileInfos {
+		if !paused[fileInfo.Name()] {
+			err = os.RemoveAll(dir + string(os.PathSeparator) + fileInfo.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ImportBlevePIndexImpl restores a pindex that was exported by
+// BleveDest.Export into the path, which must not exist, and then
+// opens it.
+func ImportBlevePIndexImpl(indexType, exportPath, path string,
+	restart func()) (PIndexImpl, Dest, error) {
+	err := copyPIndexPath(exportPath, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error: ImportBlevePIndexImpl,"+
+			" exportPath: %s, path: %s, err: %v", exportPath, path, err)
+	}
+
+	return OpenBlevePIndexImpl(indexType, path, restart)
+}
+
+// PurgeTombstones deletes the tombstones that are older than the
+// tombstoneTTL, returning how many were purged.  The tombstones are
+// searched for without holding off the feeds, and the locks are only
+// held to delete them, skipping any doc that a batch applied in the
+// meantime, such as a recreated doc.
+func (t *BleveDest) PurgeTombstones() (int, error) {
+	if t.tombstoneTTL <= 0 {
+		return 0, nil
+	}
+
+	cutoff := float64(bleveDestTimeNow().Add(-t.tombstoneTTL).UnixNano() /
+		int64(time.Millisecond))
+
+	query := newBleveTombstoneQuery(nil, &cutoff)
+
+	n := 0
+	for {
+		bindexes, q, err := t.startPurge()
+		if err != nil {
+			return n, err
+		}
+
+		docIds := make([][]string, len(bindexes))
+		for i, bindex := range bindexes {
+			var res *bleve.SearchResult
+			res, err = bindex.Search(bleve.NewSearchRequestOptions(query,
+				BLEVE_DEST_PURGE_BATCH_SIZE, 0, false))
+			if err != nil {
+				break
+			}
+			for _, hit := range res.Hits {
+				docIds[i] = append(docIds[i], hit.ID)
+			}
+		}
+
+		q.release()
+
+		if err != nil {
+			t.endPurge()
+			return n, err
+		}
+
+		purged, err := t.purge(bindexes, docIds)
+		n += purged
+		if err != nil || purged <= 0 {
+			return n, err
+		}
+	}
+}
+
+// Starts tracking the docs of the batches that are applied, returning
+// the bleve indexes to search for tombstones along with a query ref,
+// which the caller must release.
+func (t *BleveDest) startPurge() ([]bleve.Index, *bleveQueryRefs, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.bindex == nil {
+		return nil, nil, errBleveDestClosed
+	}
+	t.queries.acquire()
+
+	t.purging = true
+	for _, bdp := range t.partitions {
+		bdp.m.Lock()
+		bdp.purgeDocIds = map[string]struct{}{}
+		bdp.m.Unlock()
+	}
+
+	return t.bindexesUnlocked(), t.queries, nil
+}
+
+// Stops tracking the docs of the batches that are applied, returning
+// the doc IDs that were tracked.  The caller must hold t.m and the locks
+// of all the partitions.
+func (t *BleveDest) endPurgeUnlocked() map[string]struct{} {
+	rv := map[string]struct{}{}
+
+	t.purging = false
+	for _, bdp := range t.partitions {
+		for docId := range bdp.purgeDocIds {
+			rv[docId] = struct{}{}
+		}
+		bdp.purgeDocIds = nil
+	}
+
+	return rv
+}
+
+func (t *BleveDest) endPurge() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for _, bdp := range t.partitions {
+		bdp.m.Lock()
+		defer bdp.m.Unlock()
+	}
+
+	t.endPurgeUnlocked()
+}
+
+// Deletes the found tombstones of each of the bindexes, except for
+// the docs of the batches that were applied since the purge started.
+func (t *BleveDest) purge(bindexes []bleve.Index, docIds [][]string) (
+	int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// Hold off batch applies until the tombstones are deleted.
+	for _, bdp := range t.partitions {
+		bdp.m.Lock()
+		defer bdp.m.Unlock()
+	}
+
+	changed := t.endPurgeUnlocked()
+
+	if t.bindex == nil {
+		return 0, errBleveDestClosed
+	}
+	if atomic.LoadInt32(&t.applyPaused) > 0 {
+		return 0, nil // Left for the next purge, as an Export() copies.
+	}
+
+	n := 0
+	for i, bindex := range bindexes {
+		batch := bleve.NewBatch()
+		batchSize := 0
+		for _, docId := range docIds[i] {
+			if _, exists := changed[docId]; !exists {
+				batch.Delete(docId)
+				batchSize++
+			}
+		}
+		if batchSize <= 0 {
+			continue
+		}
+		err := bindex.Batch(batch)
+		if err != nil {
+			return n, err
+		}
+		n += batchSize
+	}
+	return n, nil
+}
+
+// NumDocsTooLarge returns the number of documents that were skipped
+// rather than indexed as they were larger than the maxDocSize.
+func (t *BleveDest) NumDocsTooLarge() uint64 {
+	return atomic.LoadUint64(&t.numDocsTooLarge)
+}
+
+// ---------------------------------------------------------
+
+func (t *BleveDest) OnDataUpdate(partition string,
+	key []byte, seq uint64, val []byte) error {
+	log.Printf("bleve dest update, partition: %s, key: %s, seq: %d",
+		partition, key, seq)
+
+	t.buffered.reserve(int64(len(val)))
+
+	bdp, bindex, err := t.getPartition(partition)
+	if err != nil {
+		return err
+	}
+
+	return bdp.OnDataUpdate(bindex, key, seq, val)
+}
+
+func (t *BleveDest) OnDataUpdateBatch(partition string,
+	mutations []DestMutation) error {
+	log.Printf("bleve dest update-batch, partition: %s, mutations: %d",
+		partition, len(mutations))
+
+	var n int64
+	for _, m := range mutations {
+		n += int64(len(m.Val))
+	}
+	t.buffered.reserve(n)
+
+	bdp, bindex, err := t.getPartition(partition)
+	if err != nil {
+		return err
+	}
+
+	return bdp.OnDataUpdateBatch(bindex, mutations)
+}
+
+func (t *BleveDest) OnDataDelete(partition string,
+	key []byte, seq uint64) error {
+	log.Printf("bleve dest delete, partition: %s, key: %s, seq: %d",
+		partition, key, seq)
+
+	bdp, bindex, err := t.getPartition(partition)
+	if err != nil {
+		return err
+	}
+
+	return bdp.OnDataDelete(bindex, key, seq)
+}
+
+func (t *BleveDest) OnSnapshotStart(partition string,
+	snapStart, snapEnd uint64) error {
+	log.Printf("bleve dest snapshot-start, partition: %s, snapStart: %d, snapEnd: %d",
+		partition, snapStart, snapEnd)
+
+	bdp, bindex, err := t.getPartition(partition)
+	if err != nil {
+		return err
+	}
+
+	return bdp.OnSnapshotStart(bindex, snapStart, snapEnd)
+}
+
+func (t *BleveDest) SetOpaque(partition string, value []byte) error {
+	log.Printf("bleve dest set-opaque, partition: %s, value: %s",
+		partition, value)
+
+	bdp, bindex, err := t.getPartition(partition)
+	if err != nil {
+		return err
+	}
+
+	return bdp.SetOpaque(bindex, value)
+}
+
+func (t *BleveDest) GetOpaque(partition string) (
+	value []byte, lastSeq uint64, err error) {
+	log.Printf("bleve dest get-opaque, partition: %s", partition)
+
+	bdp, bindex, err := t.getPartition(partition)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return bdp.GetOpaque(bindex)
+}
+
+// Implements the DestOpaqueApplied interface.
+func (t *BleveDest) GetOpaqueApplied(partition string) (
+	value []byte, lastSeqApplied uint64, err error) {
+	bdp, bindex, err := t.getPartition(partition)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return bdp.GetOpaqueApplied(bindex)
+}
+
+// Flush synchronously applies the pending batches of all partitions,
+// without waiting for their snapshot ends or size thresholds, so that
+// the mutations received so far are queryable when it returns.  With
+// snapshotAtomic, nothing is applied, as only whole snapshots are.
+func (t *BleveDest) Flush() error {
+	t.m.Lock()
+	if t.bindex == nil {
+		t.m.Unlock()
+		return fmt.Errorf("BleveDest already closed")
+	}
+	bdps := make([]*BleveDestPartition, 0, len(t.partitions))
+	for _, bdp := range t.partitions {
+		bdps = append(bdps, bdp)
+	}
+	snapshotAtomic := t.snapshotAtomic
+	t.m.Unlock()
+
+	if snapshotAtomic {
+		return nil
+	}
+
+	for _, bdp := range bdps {
+		err := bdp.applyBuffered()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *BleveDest) Rollback(partition string, rollbackSeq uint64) error {
+	log.Printf("bleve dest rollback, partition: %s, rollbackSeq: %d",
+		partition, rollbackSeq)
+
+	if t.partitionAlias != nil {
+		return t.rollbackPartition(partition)
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// NOTE: A rollback of any partition means a rollback of all
+	// partitions, since they all share a single bleve.Index backend,
+	// unless the partitionIndexes index param gave each partition its
+	// own bleve.Index.  That's why we grab and keep BleveDest.m locked.
+	//
+	// TODO: Implement partial rollback one day.  Implementation
+	// sketch: we expect bleve to one day to provide an additional
+	// Snapshot() and Rollback() API, where Snapshot() returns some
+	// opaque and persistable snapshot ID ("SID"), which cbft can
+	// occasionally record into the bleve's Get/SetInternal() storage.
+	// A stream rollback operation then needs to loop through
+	// appropriate candidate SID's until a Rollback(SID) succeeds.
+	// Else, we eventually devolve down to restarting/rebuilding
+	// everything from scratch or zero.
+	//
+	// For now, always rollback to zero, in which we close the pindex
+	// and erase files.  Then, the rollbackHandler (if any) decides
+	// whether to rebuild from scratch or to fail over to a replica;
+	// otherwise the janitor rebuilds from scratch.
+
+	var seqMax uint64
+	if bdp := t.partitions[partition]; bdp != nil && t.bindex != nil {
+		_, seqMax, _ = bdp.GetOpaque(t.bindex)
+	}
+
+	err := t.closeUnlocked()
+	if err != nil {
+		return fmt.Errorf("BleveDest can't close during rollback, err: %v", err)
+	}
+
+	os.RemoveAll(t.path)
+
+	if t.rollbackHandler != nil {
+		t.rollbackHandler(partition, rollbackSeq, seqMax)
+	} else {
+		t.restart()
+	}
+
+	return nil
+}
+
+// Rolls back a partition that has its own bleve index to zero, by
+// erasing just that index and resetting the partition, while the
+// other partitions keep serving.  The pindex isn't restarted, so the
+// rollbackHandler isn't invoked, and the feed restreams the partition
+// from zero as its opaque and seqs are gone.  The queries that
+// started before the index was removed from the alias are waited for
+// without holding t.m, so the other partitions keep applying and new
+// queries keep starting meanwhile.
+func (t *BleveDest) rollbackPartition(partition string) error {
+	t.m.Lock()
+	if t.bindex == nil {
+		t.m.Unlock()
+		return fmt.Errorf("BleveDest already closed")
+	}
+	bindex := t.partitionAlias.removePartitionIndex(partition)
+	var q *bleveQueryRefs
+	if bindex != nil {
+		q = t.retireQueriesUnlocked()
+	}
+	t.m.Unlock()
+
+	err := t.erasePartitionIndex(partition, bindex, q)
+
+	t.m.Lock()
+	t.partitionAlias.endRemovePartitionIndex(partition)
+	if bdp := t.partitions[partition]; bdp != nil && err == nil {
+		bdp.Reset()
+	}
+	t.m.Unlock()
+
+	return err
+}
+
+// Closes the removed bleve index of a partition, if any, once the
+// queries that hold refs of the retired generation q complete, and
+// then erases its files.
+func (t *BleveDest) erasePartitionIndex(partition string,
+	bindex bleve.Index, q *bleveQueryRefs) error {
+	if bindex != nil {
+		t.waitQueries(q, time.Duration(BleveDestCloseQueryWaitMS)*
+			time.Millisecond)
+
+		err := bindex.Close()
+		if err != nil {
+			return fmt.Errorf("BleveDest can't close partition index"+
+				" during rollback, partition: %s, err: %v", partition, err)
+		}
+	}
+
+	err := os.RemoveAll(t.partitionAlias.partitionPath(partition))
+	if err != nil {
+		return fmt.Errorf("BleveDest can't remove partition index"+
+			" during rollback, partition: %s, err: %v", partition, err)
+	}
+
+	return nil
+}
+
+// Implements the DestIngestLag interface.
+func (t *BleveDest) IngestLag() *LatencyHistogramStats {
+	return t.ingestLag.Stats()
+}
+
+// Implements the DestRollbackHandler interface.
+func (t *BleveDest) SetRollbackHandler(handler func(partition string,
+	rollbackSeq, seqMax uint64)) {
+	t.m.Lock()
+	t.rollbackHandler = handler
+	t.m.Unlock()
+}
+
+// Implements the DestConsistencyWaiters interface.  Waits that were
+// just requested might not be queued yet, so they might be missed.
+func (t *BleveDest) ConsistencyWaiters() map[string]*PartitionConsistencyWaiters {
+	t.m.Lock()
+	bdps := make([]*BleveDestPartition, 0, len(t.partitions))
+	for _, bdp := range t.partitions {
+		bdps = append(bdps, bdp)
+	}
+	t.m.Unlock()
+
+	now := time.Now()
+
+	rv := map[string]*PartitionConsistencyWaiters{}
+	for _, bdp := range bdps {
+		bdp.m.Lock()
+		if bdp.cwrQueue.Len() > 0 {
+			pcw := &PartitionConsistencyWaiters{
+				SeqMax:      bdp.seqMax,
+				SeqMaxBatch: bdp.seqMaxBatch,
+				Waiters:     make([]*ConsistencyWaiter, 0, bdp.cwrQueue.Len()),
+			}
+			for _, cwr := range bdp.cwrQueue {
+				cancelled := false
+				if cwr.cancelCh != nil {
+					select {
+					case <-cwr.cancelCh:
+						cancelled = true
+					default:
+					}
+				}
+				pcw.Waiters = append(pcw.Waiters, &ConsistencyWaiter{
+					ConsistencyLevel: cwr.consistencyLevel,
+					ConsistencySeq:   cwr.consistencySeq,
+					WaitNS:           int64(now.Sub(cwr.startTime)),
+					Cancelled:        cancelled,
+				})
+			}
+			rv[bdp.partition] = pcw
+		}
+		bdp.m.Unlock()
+	}
+
+	return rv
+}
+
+func (t *BleveDest) ConsistencyWait(partition string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh chan struct{}) error {
+	cwr := &consistencyWaitReq{
+		consistencyLevel: consistencyLevel,
+		consistencySeq:   consistencySeq,
+		cancelCh:         cancelCh,
+		doneCh:           make(chan error, 1),
+		startTime:        time.Now(),
+	}
+
+	t.m.Lock()
+
+	bdp, _, err := t.getPartitionUnlocked(partition)
+	if err != nil {
+		t.m.Unlock()
+		return err
+	}
+
+	// Want getPartitionUnlocked() & cwr send under lock, so the send
+	// is non-blocking to avoid holding the lock when under load.
+	select {
+	case bdp.cwrCh <- cwr:
+	default:
+		t.m.Unlock()
+		return fmt.Errorf("consistency wait rejected, too many waiters,"+
+			" partition: %s", partition)
+	}
+
+	t.m.Unlock()
+
+	if cancelCh != nil {
+		select {
+		case <-cancelCh:
+			return fmt.Errorf("cancelled")
+		case err = <-cwr.doneCh:
+			return err
+		}
+	}
+
+	err = <-cwr.doneCh
+	return err
+}
+
+func (t *BleveDest) Count(pindex *PIndex, cancelCh chan struct{}) (uint64, error) {
+	if pindex == nil ||
+		pindex.Impl == nil ||
+		pindex.IndexType != "bleve" {
+		return 0, fmt.Errorf("BleveDest.Count bad pindex: %#v", pindex)
+	}
+
+	bindex, ok := pindex.Impl.(bleve.Index)
+	if !ok || bindex == nil {
+		return 0, fmt.Errorf("BleveDest.Count pindex not a bleve.Index: %#v", pindex)
+	}
+
+	return (&bleveDestIndex{Index: bindex, bdest: t}).DocCount()
+}
+
+// StorageStats returns the doc count and the bytes on disk of the
+// BleveDest's index.
+func (t *BleveDest) StorageStats() (*PIndexStorageStats, error) {
+	t.m.Lock()
+	bindex := t.bindex
+	t.m.Unlock()
+
+	if bindex == nil {
+		return nil, fmt.Errorf("BleveDest already closed")
+	}
+
+	docCount, err := (&bleveDestIndex{Index: bindex, bdest: t}).DocCount()
+	if err != nil {
+		return nil, err
+	}
+
+	diskBytes, err := pindexDiskBytes(t.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PIndexStorageStats{
+		DocCount:   docCount,
+		DiskBytes:  diskBytes,
+		Durability: t.durability,
+	}, nil
+}
+
+func (t *BleveDest) Query(pindex *PIndex, req []byte, res io.Writer,
+	cancelCh chan struct{}) error {
+	if pindex == nil ||
+		pindex.Impl == nil ||
+		pindex.IndexType != "bleve" {
+		return fmt.Errorf("BleveDest.Query bad pindex: %#v", pindex)
+	}
+
+	bindex, ok := pindex.Impl.(bleve.Index)
+	if !ok || bindex == nil {
+		return fmt.Errorf("BleveDest.Query pindex not a bleve.Index: %#v", pindex)
+	}
+
+	var bleveQueryParams BleveQueryParams
+	err := json.Unmarshal(req, &bleveQueryParams)
+	if err != nil {
+		return &QueryBadRequestError{
+			Err: fmt.Errorf("BleveDest.Query parsing bleveQueryParams,"+
+				" req: %s, err: %v", req, err),
+		}
+	}
+
+	err = bleveQueryParams.Validate()
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	err = checkBleveQueryExpansion(t.mgr, req)
+	if err != nil {
+		return &QueryBadRequestError{Err: err}
+	}
+
+	// The pindex is also queried directly, so it enforces its own
+	// field policy rather than relying on the fan-out's check.
+	bip, _, err := ParseBleveIndexParams(pindex.IndexParams)
+	if err != nil {
+		return fmt.Errorf("BleveDest.Query parsing indexParams,"+
+			" pindex: %s, err: %v", pindex.Name, err)
+	}
+	if len(bip.QueryAllowFields) > 0 || len(bip.QueryDenyFields) > 0 {
+		fields, err := bleveQueryFields(req)
+		if err != nil {
+			return &QueryBadRequestError{Err: err}
+		}
+		err = checkBleveIndexQueryFields(bip, pindex.IndexName, fields)
+		if err != nil {
+			return err
+		}
+	}
+
+	consistencyParams := bleveQueryParams.Consistency
+	if consistencyParams != nil &&
+		consistencyParams.Level != "" &&
+		consistencyParams.Vectors != nil {
+		consistencyVector := consistencyParams.Vectors[pindex.IndexName]
+		if consistencyVector != nil {
+			waitCancelCh, timedOut, waitDone :=
+				consistencyWaitCancelCh(cancelCh, consistencyParams)
+			defer waitDone()
+
+			for _, partition := range pindex.seqPartitions() {
+				consistencySeq := consistencyVector[partition]
+				if consistencySeq > 0 {
+					err := t.ConsistencyWait(partition,
+						consistencyParams.Level,
+						consistencySeq,
+						waitCancelCh)
+					if err != nil {
+						if timedOut() {
+							return &ConsistencyTimeoutError{
+								TimeoutMS: consistencyParams.Timeout,
+							}
+						}
+						if isConsistencyError(err) {
+							return err
+						}
+						return &QueryUnavailableError{
+							Err: fmt.Errorf("BleveDest.Query cancelled,"+
+								" req: %s, err: %v", req, err),
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Also honors a scroll's cursor, as pushed down by a BleveClient.
+	searchResponse, _, _, err := bleveQueryParams.search(t.mgr,
+		&bleveDestIndex{Index: bindex, bdest: t,
+			asOf:              bleveAsOfVector(pindex, consistencyParams),
+			name:              pindex.Name,
+			includeTombstones: bleveQueryParams.IncludeTombstones})
+	if err != nil {
+		return err
+	}
+
+	mustEncode(res, searchResponse)
+
+	return nil
+}
+
+// ---------------------------------------------------------
+
+func (t *BleveDestPartition) run() {
+	for cwr := range t.cwrCh {
+		t.m.Lock()
+
+		if cwr.consistencyLevel == "" {
+			close(cwr.doneCh) // We treat "" like stale=ok, so we're done.
+		} else if cwr.consistencyLevel == "at_plus" {
+			if cwr.consistencySeq <= t.seqMaxBatch {
+				close(cwr.doneCh)
+			} else if t.cwrQueue.Len() >= BLEVE_DEST_CWR_QUEUE_MAX {
+				cwr.doneCh <- fmt.Errorf("consistency wait rejected,"+
+					" queue too deep, partition: %s", t.partition)
+				close(cwr.doneCh)
+			} else {
+				heap.Push(&t.cwrQueue, cwr)
+				t.maybeForceFlushUnlocked()
+			}
+		} else if cwr.consistencyLevel == "as_of" {
+			if cwr.consistencySeq < t.seqMaxBatch {
+				// Older snapshots aren't retained.
+				cwr.doneCh <- t.snapshotNotAvailableUnlocked(cwr)
+				close(cwr.doneCh)
+			} else if cwr.consistencySeq == t.seqMaxBatch {
+				close(cwr.doneCh)
+			} else if t.cwrQueue.Len() >= BLEVE_DEST_CWR_QUEUE_MAX {
+				cwr.doneCh <- fmt.Errorf("consistency wait rejected,"+
+					" queue too deep, partition: %s", t.partition)
+				close(cwr.doneCh)
+			} else {
+				// Waits like "at_plus" for the seq to be applied.
+				heap.Push(&t.cwrQueue, cwr)
+				t.maybeForceFlushUnlocked()
+			}
+		} else {
+			cwr.doneCh <- fmt.Errorf("consistency wait unsupported level: %s,"+
+				" cwr: %#v", cwr.consistencyLevel, cwr)
+			close(cwr.doneCh)
+		}
+
+		t.m.Unlock()
+	}
+
+	// If we reach here, then we're closing down so cancel/error any
+	// callers waiting for consistency.
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	err := fmt.Errorf("consistency wait closed")
+
+	for _, cwr := range t.cwrQueue {
+		cwr.doneCh <- err
+		close(cwr.doneCh)
+	}
+}
+
+func (t *BleveDestPartition) snapshotNotAvailableUnlocked(
+	cwr *consistencyWaitReq) error {
+	return &SnapshotNotAvailableError{
+		Partition:    t.partition,
+		Seq:          cwr.consistencySeq,
+		SeqAvailable: t.seqMaxBatch,
+	}
+}
+
+// ---------------------------------------------------------
+
+func (t *BleveDestPartition) OnDataUpdate(bindex bleve.Index,
+	key []byte, seq uint64, val []byte) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.recvTimes = append(t.recvTimes, bleveDestTimeNow().UnixNano())
+
+	t.indexUnlocked(key, val)
+
+	return t.updateSeqUnlocked(bindex, seq)
+}
+
+// Adds all the mutations to the batch under a single lock
+// acquisition, applying the batch as the seq's reach seqSnapEnd.
+func (t *BleveDestPartition) OnDataUpdateBatch(bindex bleve.Index,
+	mutations []DestMutation) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	now := bleveDestTimeNow().UnixNano()
+
+	for _, m := range mutations {
+		t.recvTimes = append(t.recvTimes, now)
+
+		if m.Delete {
+			t.deleteUnlocked(m.Key)
+		} else {
+			t.indexUnlocked(m.Key, m.Val)
+		}
 
+		err := t.updateSeqUnlocked(bindex, m.Seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *BleveDestPartition) OnDataDelete(bindex bleve.Index,
+	key []byte, seq uint64) error {
 	t.m.Lock()
 	defer t.m.Unlock()
 
-	// NOTE: A rollback of any partition means a rollback of all
-	// partitions, since they all share a single bleve.Index backend.
-	// That's why we grab and keep BleveDest.m locked.
-	//
-	// TODO: Implement partial rollback one day.  Implementation
-	// sketch: we expect bleve to one day to provide an additional
-	// Snapshot() and Rollback() API, where Snapshot() returns some
-	// opaque and persistable snapshot ID ("SID"), which cbft can
-	// occasionally record into the bleve's Get/SetInternal() storage.
-	// A stream rollback operation then needs to loop through
-	// appropriate candidate SID's until a Rollback(SID) succeeds.
-	// Else, we eventually devolve down to restarting/rebuilding
-	// everything from scratch or zero.
-	//
-	// For now, always rollback to zero, in which we close the pindex,
-	// erase files and have the janitor rebuild from scratch.
+	t.recvTimes = append(t.recvTimes, bleveDestTimeNow().UnixNano())
 
-	err := t.closeUnlocked()
-	if err != nil {
-		return fmt.Errorf("BleveDest can't close during rollback, err: %v", err)
+	t.deleteUnlocked(key)
+
+	return t.updateSeqUnlocked(bindex, seq)
+}
+
+func (t *BleveDestPartition) trackDocIdUnlocked(docId string) {
+	if t.bdest.tombstoneTTL > 0 {
+		if t.batchDocIds == nil {
+			t.batchDocIds = map[string]struct{}{}
+		}
+		t.batchDocIds[docId] = struct{}{}
 	}
+}
 
-	os.RemoveAll(t.path)
+// Adds a document deletion to the batch, which is a tombstone when
+// the BleveDest has a tombstoneTTL.
+func (t *BleveDestPartition) deleteUnlocked(key []byte) {
+	docId := t.docId(key) // TODO: string(key) makes garbage?
 
-	t.restart()
+	t.trackDocIdUnlocked(docId)
 
-	return nil
+	if t.bdest.tombstoneTTL > 0 {
+		t.batch.Index(docId, map[string]interface{}{
+			BLEVE_DEST_TOMBSTONE_FIELD: float64(
+				bleveDestTimeNow().UnixNano() / int64(time.Millisecond)),
+		})
+		return
+	}
+
+	t.batch.Delete(docId)
 }
 
-func (t *BleveDest) ConsistencyWait(partition string,
-	consistencyLevel string,
-	consistencySeq uint64,
-	cancelCh chan struct{}) error {
-	cwr := &consistencyWaitReq{
-		consistencyLevel: consistencyLevel,
-		consistencySeq:   consistencySeq,
-		cancelCh:         cancelCh,
-		doneCh:           make(chan error),
+// Adds a document update to the batch, applying the doc transform, if
+// any.  A document whose transform fails, or that's larger than the
+// maxDocSize, is skipped, rather than stalling the partition.
+func (t *BleveDestPartition) indexUnlocked(key, val []byte) {
+	docId := t.docId(key) // TODO: string(key) makes garbage?
+
+	t.trackDocIdUnlocked(docId)
+
+	if t.bdest.maxDocSize > 0 && len(val) > t.bdest.maxDocSize {
+		atomic.AddUint64(&t.bdest.numDocsTooLarge, 1)
+		log.Printf("bleve dest doc too large, skipping doc,"+
+			" partition: %s, key: %s, size: %d, maxDocSize: %d",
+			t.partition, key, len(val), t.bdest.maxDocSize)
+		// Removes any previously indexed version of the doc.
+		t.batch.Delete(docId)
+		return
+	}
+
+	bufVal := t.appendToBufUnlocked(val)
+
+	if t.bdest.docTransform == nil && t.bdest.docFilter == nil &&
+		t.bdest.languageField == "" {
+		t.batch.Index(docId, bufVal)
+		return
+	}
+
+	var doc interface{} = bufVal
+	if t.bdest.docTransform != nil {
+		var err error
+		doc, err = t.bdest.docTransform(t.partition, key, bufVal)
+		if err != nil {
+			log.Printf("bleve dest docTransform, skipping doc,"+
+				" partition: %s, key: %s, err: %v", t.partition, key, err)
+			doc = nil
+		}
+		if b, ok := doc.([]byte); doc == nil || (ok && b == nil) {
+			t.batch.Delete(docId)
+			return
+		}
+	}
+
+	if t.bdest.docFilter != nil {
+		m, ok := bleveDocMap(doc)
+		if !ok || !t.bdest.docFilter.Matches(m) {
+			// Removes any previously matching version of the doc.
+			t.batch.Delete(docId)
+			return
+		}
+		doc = m
+	}
+
+	if t.bdest.languageField != "" {
+		doc = t.bdest.languageDoc(doc)
+	}
+
+	t.batch.Index(docId, doc)
+}
+
+// Returns the doc as a parsed JSON object, if it's one.
+func bleveDocMap(doc interface{}) (map[string]interface{}, bool) {
+	switch d := doc.(type) {
+	case []byte:
+		var m map[string]interface{}
+		if json.Unmarshal(d, &m) != nil || m == nil {
+			return nil, false
+		}
+		return m, true
+	case map[string]interface{}:
+		return d, true
+	}
+	return nil, false
+}
+
+// Returns the doc with the index mapping's type field set to the type
+// mapping of the doc's language, if the doc is a JSON object that has
+// a known language; otherwise the doc is returned unchanged.
+func (t *BleveDest) languageDoc(doc interface{}) interface{} {
+	m, ok := bleveDocMap(doc)
+	if !ok {
+		return doc
+	}
+
+	language, ok := m[t.languageField].(string)
+	if !ok {
+		return doc
+	}
+	typeName, exists := t.languageMappings[language]
+	if !exists {
+		return doc
+	}
+
+	m[t.typeField] = typeName
+	return m
+}
+
+// Returns the bleve document ID for a source document key.
+func (t *BleveDestPartition) docId(key []byte) string {
+	if t.bdest.keyEncoding != "" {
+		key = []byte(BleveEncodeKey(t.bdest.keyEncoding, key))
+	}
+	if t.bdest.docIdTransform != nil {
+		return t.bdest.docIdTransform(t.partition, key)
 	}
+	return string(key)
+}
 
+func (t *BleveDestPartition) OnSnapshotStart(bindex bleve.Index,
+	snapStart, snapEnd uint64) error {
 	t.m.Lock()
+	defer t.m.Unlock()
 
-	bdp, _, err := t.getPartitionUnlocked(partition)
+	err := t.applyBatchUnlocked(bindex)
 	if err != nil {
-		t.m.Unlock()
 		return err
 	}
 
-	bdp.cwrCh <- cwr // Want getPartitionUnlocked() & cwr send under lock.
+	t.seqSnapEnd = snapEnd
 
-	t.m.Unlock()
+	return nil
+}
+
+func (t *BleveDestPartition) SetOpaque(bindex bleve.Index, value []byte) error {
+	t.m.Lock()
+	defer t.m.Unlock()
 
-	// TODO: Need stats to see how many inflight waits we have.
+	t.lastOpaque = append(t.lastOpaque[0:0], value...)
 
-	if cancelCh != nil {
-		select {
-		case <-cancelCh:
-			return fmt.Errorf("cancelled")
-		case err = <-cwr.doneCh:
-			// TODO: track stats.
-			return err
+	t.setInternalUnlocked(t.partitionOpaque, t.lastOpaque)
+
+	return nil
+}
+
+func (t *BleveDestPartition) GetOpaque(bindex bleve.Index) ([]byte, uint64, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return t.getOpaqueUnlocked(bindex)
+}
+
+// Like GetOpaque(), but returns seqMaxBatch instead of seqMax.  The
+// seqMax is persisted as part of every batch, so the persisted seqMax
+// is always the applied seq, and it's what a restarted BleveDest
+// reads back as both its seqMax and seqMaxBatch.
+func (t *BleveDestPartition) GetOpaqueApplied(bindex bleve.Index) (
+	[]byte, uint64, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	value, _, err := t.getOpaqueUnlocked(bindex)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, t.seqMaxBatch, nil
+}
+
+func (t *BleveDestPartition) getOpaqueUnlocked(bindex bleve.Index) (
+	[]byte, uint64, error) {
+	// NOTE: bleve's GetInternal() doesn't accept a caller-provided
+	// buffer, so we instead avoid repeated GetInternal() calls by
+	// caching, and reuse our own buffers and pre-converted keys.
+	if t.lastOpaque == nil && !t.lastOpaqueRead {
+		value, err := bindex.GetInternal(t.partitionOpaque)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(value) > 0 {
+			t.lastOpaque = append([]byte(nil), value...) // Note: copies value.
 		}
+		t.lastOpaqueRead = true
 	}
 
-	err = <-cwr.doneCh
-	// TODO: track stats.
-	return err
+	if t.seqMax <= 0 && !t.seqMaxRead {
+		buf, err := bindex.GetInternal(t.partitionBytes)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(buf) > 0 && len(buf) != 8 {
+			// Rather than failing the pindex, treat the corrupt seqMax
+			// as 0, so the feed restreams the partition from the start,
+			// and repair the entry as part of the next applied batch.
+			log.Printf("warning: bleve dest, partition: %s, unexpected size"+
+				" for seqMax bytes: %d, restreaming from seq 0",
+				t.partition, len(buf))
+			binary.BigEndian.PutUint64(t.seqMaxBuf, 0)
+			t.setInternalUnlocked(t.partitionBytes, t.seqMaxBuf)
+		} else if len(buf) > 0 {
+			t.seqMax = binary.BigEndian.Uint64(buf[0:8])
+			binary.BigEndian.PutUint64(t.seqMaxBuf, t.seqMax)
+			if t.seqMaxBatch < t.seqMax {
+				t.seqMaxBatch = t.seqMax // The persisted seqMax was applied.
+			}
+		} // Else, no seqMax buf is a valid case.
+		t.seqMaxRead = true
+	}
+
+	return t.lastOpaque, t.seqMax, nil
 }
 
-func (t *BleveDest) Count(pindex *PIndex, cancelCh chan struct{}) (uint64, error) {
-	if pindex == nil ||
-		pindex.Impl == nil ||
-		pindex.IndexType != "bleve" {
-		return 0, fmt.Errorf("BleveDest.Count bad pindex: %#v", pindex)
+// ---------------------------------------------------------
+
+func (t *BleveDestPartition) updateSeqUnlocked(bindex bleve.Index,
+	seq uint64) error {
+	if t.seqMax < seq {
+		t.seqMax = seq
+		binary.BigEndian.PutUint64(t.seqMaxBuf, t.seqMax)
+
+		// NOTE: No copy of partitionBytes to buf as it's never modified.
+		t.setInternalUnlocked(t.partitionBytes, t.seqMaxBuf)
 	}
 
-	bindex, ok := pindex.Impl.(bleve.Index)
-	if !ok || bindex == nil {
-		return 0, fmt.Errorf("BleveDest.Count pindex not a bleve.Index: %#v", pindex)
+	if seq < t.seqSnapEnd {
+		if t.bdest.snapshotAtomic {
+			// Withhold the batch until the snapshot completes, so
+			// that queries never see a partial snapshot.
+			if len(t.buf) < BLEVE_DEST_SNAPSHOT_ATOMIC_BUF_SIZE_BYTES {
+				return nil
+			}
+		} else if len(t.buf) < BLEVE_DEST_APPLY_BUF_SIZE_BYTES {
+			t.maybeForceFlushUnlocked()
+			return nil
+		}
 	}
 
-	return bindex.DocCount()
+	return t.applyBatchUnlocked(bindex)
 }
 
-func (t *BleveDest) Query(pindex *PIndex, req []byte, res io.Writer,
-	cancelCh chan struct{}) error {
-	if pindex == nil ||
-		pindex.Impl == nil ||
-		pindex.IndexType != "bleve" {
-		return fmt.Errorf("BleveDest.Query bad pindex: %#v", pindex)
+// Adds a metadata write, such as of the seqMax or opaque, to the
+// batch.  Metadata is only ever persisted as part of the same batch
+// as the mutations that preceded it, and never via a separate
+// bindex.SetInternal(), so as the batch is applied atomically, the
+// persisted metadata is never ahead of the persisted documents, and
+// a feed that resumes after a crash never skips mutations.
+func (t *BleveDestPartition) setInternalUnlocked(key, val []byte) {
+	t.batch.SetInternal(key, val)
+}
+
+// Schedules a forced batch apply if there's a consistency waiter
+// whose seq has been received but not yet applied, unless one is
+// already scheduled.  See BleveIndexParams.ForceFlushMS.
+func (t *BleveDestPartition) maybeForceFlushUnlocked() {
+	if t.bdest.forceFlushAfter <= 0 ||
+		t.forceFlushPending ||
+		t.cwrQueue.Len() <= 0 ||
+		t.cwrQueue[0].consistencySeq > t.seqMax {
+		return
 	}
 
-	bindex, ok := pindex.Impl.(bleve.Index)
-	if !ok || bindex == nil {
-		return fmt.Errorf("BleveDest.Query pindex not a bleve.Index: %#v", pindex)
+	t.forceFlushPending = true
+
+	time.AfterFunc(t.bdest.forceFlushAfter, t.forceFlush)
+}
+
+func (t *BleveDestPartition) forceFlush() {
+	_, bindex, err := t.bdest.getPartition(t.partition)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.forceFlushPending = false
+
+	if err != nil || t.seqMaxBatch >= t.seqMax {
+		return // The BleveDest was closed or the batch was applied.
 	}
 
-	var bleveQueryParams BleveQueryParams
-	err := json.Unmarshal(req, &bleveQueryParams)
+	err = t.applyBatchUnlocked(bindex)
 	if err != nil {
-		return fmt.Errorf("BleveDest.Query parsing bleveQueryParams,"+
-			" req: %s, err: %v", req, err)
+		log.Printf("bleve dest force flush, partition: %s, err: %v",
+			t.partition, err)
 	}
+}
 
-	consistencyParams := bleveQueryParams.Consistency
-	if consistencyParams != nil &&
-		consistencyParams.Level != "" &&
-		consistencyParams.Vectors != nil {
-		consistencyVector := consistencyParams.Vectors[pindex.IndexName]
-		if consistencyVector != nil {
-			for _, partition := range pindex.sourcePartitionsArr {
-				consistencySeq := consistencyVector[partition]
-				if consistencySeq > 0 {
-					err := t.ConsistencyWait(partition,
-						consistencyParams.Level,
-						consistencySeq,
-						cancelCh)
-					if err != nil {
-						return fmt.Errorf("BleveDest.Query cancelled,"+
-							" req: %s, err: %v", req, err)
-					}
-				}
+func (t *BleveDestPartition) applyBatchUnlocked(bindex bleve.Index) error {
+	if atomic.LoadInt32(&t.bdest.applyPaused) > 0 {
+		return nil // Applied by resumeApplies().
+	}
+
+	err := bindex.Batch(t.batch)
+	if err != nil {
+		return err
+	}
+
+	t.seqMaxBatch = t.seqMax
+	t.numBatches++
+
+	if len(t.recvTimes) > 0 {
+		t.bdest.ingestLag.AddSince(bleveDestTimeNow(), t.recvTimes)
+		t.recvTimes = t.recvTimes[0:0]
+	}
+
+	for t.cwrQueue.Len() > 0 &&
+		t.cwrQueue[0].consistencySeq <= t.seqMaxBatch {
+		cwr := heap.Pop(&t.cwrQueue).(*consistencyWaitReq)
+		if cwr != nil &&
+			cwr.doneCh != nil {
+			if cwr.consistencyLevel == "as_of" &&
+				cwr.consistencySeq != t.seqMaxBatch {
+				// The batch went past the seq, so that snapshot
+				// was never available.
+				cwr.doneCh <- t.snapshotNotAvailableUnlocked(cwr)
 			}
+			close(cwr.doneCh)
+		}
+	}
+
+	// TODO: would good to reuse batch; ask for a public Reset() kind
+	// of method on bleve.Batch?
+	t.batch = bleve.NewBatch()
+
+	if t.purgeDocIds != nil {
+		for docId := range t.batchDocIds {
+			t.purgeDocIds[docId] = struct{}{}
+		}
+	}
+	t.batchDocIds = nil
+
+	if t.buf != nil {
+		t.buf = t.buf[0:0] // Reset t.buf via re-slice.
+	}
+	t.bdest.buffered.release(t)
+
+	// NOTE: Leave t.seqSnapEnd unchanged in case we're applying the
+	// batch because t.buf got too big.
+
+	return nil
+}
+
+// Reset errors any pending consistency waiters and clears the seq
+// tracking, cached opaque and unapplied batch of the partition, so
+// that the partition can be reused, such as when the backing index
+// survives a partial rollback.
+func (t *BleveDestPartition) Reset() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	err := fmt.Errorf("consistency wait reset")
+
+	for t.cwrQueue.Len() > 0 {
+		cwr := heap.Pop(&t.cwrQueue).(*consistencyWaitReq)
+		if cwr != nil &&
+			cwr.doneCh != nil {
+			cwr.doneCh <- err
+			close(cwr.doneCh)
 		}
 	}
 
-	err = bleveQueryParams.Query.Query.Validate()
+	t.seqMax = 0
+	binary.BigEndian.PutUint64(t.seqMaxBuf, 0)
+	t.seqMaxRead = false
+	t.seqMaxBatch = 0
+	t.seqSnapEnd = 0
+
+	if t.buf != nil {
+		t.buf = t.buf[0:0]
+	}
+	t.bdest.buffered.release(t)
+	t.batch = bleve.NewBatch()
+	t.batchDocIds = nil
+	t.recvTimes = t.recvTimes[0:0]
+
+	t.lastOpaque = nil
+	t.lastOpaqueRead = false
+}
+
+// Appends b to end of t.buf, and returns that suffix slice of t.buf
+// that has the appended copy of the input b.
+func (t *BleveDestPartition) appendToBufUnlocked(b []byte) []byte {
+	if len(b) <= 0 {
+		return b
+	}
+	if t.buf == nil {
+		// TODO: parameterize initial buf capacity.
+		t.buf = make([]byte, 0, BLEVE_DEST_INITIAL_BUF_SIZE_BYTES)
+	}
+	t.buf = append(t.buf, b...)
+
+	t.bdest.buffered.add(t, int64(len(b)))
+
+	return t.buf[len(t.buf)-len(b):]
+}
+
+// Applies the partition's pending batch, if any, such as to free
+// buffered bytes when the BleveDest's budget is exceeded.
+func (t *BleveDestPartition) applyBuffered() error {
+	_, bindex, err := t.bdest.getPartition(t.partition)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
 	if err != nil {
+		// The BleveDest was closed, so the buffer will never be applied.
+		t.bdest.buffered.release(t)
 		return err
 	}
 
-	searchResponse, err := bindex.Search(bleveQueryParams.Query)
-	if err != nil {
-		return err
-	}
+	return t.applyBatchUnlocked(bindex)
+}
 
-	mustEncode(res, searchResponse)
+// ---------------------------------------------------------
 
-	return nil
+// A blevePartitionAlias is the bleve.Index of a BleveDest with the
+// partitionIndexes index param, which fans out to a bleve index per
+// partition, where each partition index is in a subdirectory of the
+// BLEVE_PARTITION_INDEXES_DIR of the pindex's path.
+type blevePartitionAlias struct {
+	bleve.IndexAlias
+	path          string
+	bindexMapping *bleve.IndexMapping // For new partition indexes.
+	durability    string              // For new partition indexes.
+
+	m        sync.Mutex             // Protects the fields that follow.
+	bindexes map[string]bleve.Index // Keyed by partition.
+
+	// The partitions whose indexes are being removed, which aren't
+	// recreated until endRemovePartitionIndex().
+	removing map[string]bool
 }
 
-// ---------------------------------------------------------
+const BLEVE_PARTITION_INDEXES_DIR = "partitions"
+
+// Returns a blevePartitionAlias with the existing partition indexes
+// under the path opened.
+func newBlevePartitionAlias(path string, bindexMapping *bleve.IndexMapping,
+	durability string) (*blevePartitionAlias, error) {
+	pa := &blevePartitionAlias{
+		IndexAlias:    bleve.NewIndexAlias(),
+		path:          path,
+		bindexMapping: bindexMapping,
+		durability:    durability,
+		bindexes:      map[string]bleve.Index{},
+		removing:      map[string]bool{},
+	}
 
-func (t *BleveDestPartition) run() {
-	for cwr := range t.cwrCh {
-		t.m.Lock()
+	dir := path + string(os.PathSeparator) + BLEVE_PARTITION_INDEXES_DIR
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pa, nil
+		}
+		return nil, err
+	}
 
-		if cwr.consistencyLevel == "" {
-			close(cwr.doneCh) // We treat "" like stale=ok, so we're done.
-		} else if cwr.consistencyLevel == "at_plus" {
-			if cwr.consistencySeq > t.seqMaxBatch {
-				heap.Push(&t.cwrQueue, cwr)
-			} else {
-				close(cwr.doneCh)
+	for _, fileInfo := range fileInfos {
+		partition, err := url.QueryUnescape(fileInfo.Name())
+		if err == nil {
+			var bindex bleve.Index
+			bindex, err = bleve.Open(pa.partitionPath(partition))
+			if err == nil {
+				pa.bindexes[partition] = bindex
+				pa.IndexAlias.Add(bindex)
+				continue
 			}
-		} else {
-			cwr.doneCh <- fmt.Errorf("consistency wait unsupported level: %s,"+
-				" cwr: %#v", cwr.consistencyLevel, cwr)
-			close(cwr.doneCh)
 		}
+		pa.Close()
+		return nil, fmt.Errorf("error: open bleve partition index,"+
+			" path: %s, name: %s, err: %v", path, fileInfo.Name(), err)
+	}
 
-		t.m.Unlock()
+	return pa, nil
+}
+
+func (pa *blevePartitionAlias) partitionPath(partition string) string {
+	return pa.path + string(os.PathSeparator) + BLEVE_PARTITION_INDEXES_DIR +
+		string(os.PathSeparator) + url.QueryEscape(partition)
+}
+
+// Returns the bleve index of a partition, creating it if needed.
+func (pa *blevePartitionAlias) partitionIndex(partition string) (
+	bleve.Index, error) {
+	pa.m.Lock()
+	defer pa.m.Unlock()
+
+	bindex := pa.bindexes[partition]
+	if bindex != nil {
+		return bindex, nil
 	}
 
-	// If we reach here, then we're closing down so cancel/error any
-	// callers waiting for consistency.
-	t.m.Lock()
-	defer t.m.Unlock()
+	if pa.removing[partition] {
+		return nil, fmt.Errorf("error: bleve partition index is being"+
+			" removed, path: %s, partition: %s", pa.path, partition)
+	}
 
-	err := fmt.Errorf("consistency wait closed")
+	bindex, err := newBleveIndex(pa.partitionPath(partition),
+		pa.bindexMapping, pa.durability)
+	if err != nil {
+		return nil, fmt.Errorf("error: new bleve partition index,"+
+			" path: %s, partition: %s, err: %v", pa.path, partition, err)
+	}
 
-	for _, cwr := range t.cwrQueue {
-		cwr.doneCh <- err
-		close(cwr.doneCh)
+	pa.bindexes[partition] = bindex
+	pa.IndexAlias.Add(bindex)
+
+	return bindex, nil
+}
+
+func (pa *blevePartitionAlias) partitionIndexes() []bleve.Index {
+	pa.m.Lock()
+	defer pa.m.Unlock()
+
+	rv := make([]bleve.Index, 0, len(pa.bindexes))
+	for _, bindex := range pa.bindexes {
+		rv = append(rv, bindex)
 	}
+	return rv
 }
 
-// ---------------------------------------------------------
+func (pa *blevePartitionAlias) partitionPaths() []string {
+	pa.m.Lock()
+	defer pa.m.Unlock()
 
-func (t *BleveDestPartition) OnDataUpdate(bindex bleve.Index,
-	key []byte, seq uint64, val []byte) error {
-	t.m.Lock()
-	defer t.m.Unlock()
+	rv := make([]string, 0, len(pa.bindexes))
+	for partition := range pa.bindexes {
+		rv = append(rv, pa.partitionPath(partition))
+	}
+	return rv
+}
 
-	bufVal := t.appendToBufUnlocked(val)
+// Removes the bleve index of a partition from the alias, so that new
+// queries don't use it, and returns it, if any, for the caller to
+// close.  The partition's index isn't recreated until the caller
+// invokes endRemovePartitionIndex(), such as after erasing its files.
+func (pa *blevePartitionAlias) removePartitionIndex(
+	partition string) bleve.Index {
+	pa.m.Lock()
+	defer pa.m.Unlock()
+
+	pa.removing[partition] = true
+
+	bindex := pa.bindexes[partition]
+	if bindex != nil {
+		delete(pa.bindexes, partition)
+		pa.IndexAlias.Remove(bindex)
+	}
+	return bindex
+}
 
-	t.batch.Index(string(key), bufVal) // TODO: string(key) makes garbage?
+func (pa *blevePartitionAlias) endRemovePartitionIndex(partition string) {
+	pa.m.Lock()
+	delete(pa.removing, partition)
+	pa.m.Unlock()
+}
 
-	return t.updateSeqUnlocked(bindex, seq)
+// A bleve alias of no indexes fails searches, but a pindex whose
+// partitions haven't received data yet has no hits instead.
+func (pa *blevePartitionAlias) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	pa.m.Lock()
+	n := len(pa.bindexes)
+	pa.m.Unlock()
+
+	if n <= 0 {
+		return &bleve.SearchResult{
+			Request: req,
+			Hits:    search.DocumentMatchCollection{},
+		}, nil
+	}
+
+	return pa.IndexAlias.Search(req)
 }
 
-func (t *BleveDestPartition) OnDataDelete(bindex bleve.Index,
-	key []byte, seq uint64) error {
-	t.m.Lock()
-	defer t.m.Unlock()
+func (pa *blevePartitionAlias) DocCount() (uint64, error) {
+	pa.m.Lock()
+	n := len(pa.bindexes)
+	pa.m.Unlock()
 
-	t.batch.Delete(string(key)) // TODO: string(key) makes garbage?
+	if n <= 0 {
+		return 0, nil
+	}
 
-	return t.updateSeqUnlocked(bindex, seq)
+	return pa.IndexAlias.DocCount()
 }
 
-func (t *BleveDestPartition) OnSnapshotStart(bindex bleve.Index,
-	snapStart, snapEnd uint64) error {
-	t.m.Lock()
-	defer t.m.Unlock()
+// Closes the partition indexes, as a bleve alias doesn't close the
+// indexes that it fans out to.
+func (pa *blevePartitionAlias) Close() error {
+	pa.m.Lock()
+	var rv error
+	for _, bindex := range pa.bindexes {
+		err := bindex.Close()
+		if err != nil && rv == nil {
+			rv = err
+		}
+	}
+	pa.bindexes = map[string]bleve.Index{}
+	pa.m.Unlock()
 
-	err := t.applyBatchUnlocked(bindex)
-	if err != nil {
-		return err
+	err := pa.IndexAlias.Close()
+	if err != nil && rv == nil {
+		rv = err
 	}
+	return rv
+}
 
-	t.seqSnapEnd = snapEnd
+// ---------------------------------------------------------
 
-	return nil
+// A bleveDestBudget tracks the bytes buffered in the pending batches
+// of all BleveDestPartitions, so that a fast feed into slow indexes
+// can't grow the buffers without bound.
+type bleveDestBudget struct {
+	m       sync.Mutex // Protects the fields that follow.
+	max     int64      // When <= 0, the budget is unlimited.
+	used    int64
+	holders map[*BleveDestPartition]int64 // Value is buffered bytes.
 }
 
-func (t *BleveDestPartition) SetOpaque(bindex bleve.Index, value []byte) error {
-	t.m.Lock()
-	defer t.m.Unlock()
+// Returns a budget of buffered bytes, where a max <= 0 means
+// unlimited.  A Manager's budget is shared by all of its BleveDests,
+// and its max is configured by the "bleveDestBufferedBytesMax"
+// manager option.
+func newBleveDestBudget(max int64) *bleveDestBudget {
+	return &bleveDestBudget{
+		max:     max,
+		holders: map[*BleveDestPartition]int64{},
+	}
+}
 
-	t.lastOpaque = append(t.lastOpaque[0:0], value...)
+// Returns the "bleveDestBufferedBytesMax" manager option, or 0
+// (unlimited) when the option is missing or invalid.
+func bleveDestBufferedBytesMax(options map[string]string) int64 {
+	v, exists := options["bleveDestBufferedBytesMax"]
+	if !exists {
+		return 0
+	}
+	max, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("warning: could not parse bleveDestBufferedBytesMax"+
+			" option: %s, err: %v", v, err)
+		return 0
+	}
+	return max
+}
 
-	t.batch.SetInternal([]byte(t.partitionOpaque), t.lastOpaque)
+// Returns the current number of buffered bytes.
+func (b *bleveDestBudget) bytes() int64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.used
+}
 
-	return nil
+func (b *bleveDestBudget) add(t *BleveDestPartition, n int64) {
+	b.m.Lock()
+	b.holders[t] += n
+	b.used += n
+	b.m.Unlock()
 }
 
-func (t *BleveDestPartition) GetOpaque(bindex bleve.Index) ([]byte, uint64, error) {
-	t.m.Lock()
-	defer t.m.Unlock()
+// Releases all the bytes buffered by a partition.
+func (b *bleveDestBudget) release(t *BleveDestPartition) {
+	b.m.Lock()
+	b.used -= b.holders[t]
+	delete(b.holders, t)
+	b.m.Unlock()
+}
 
-	if t.lastOpaque == nil {
-		// TODO: Need way to control memory alloc during GetInternal(),
-		// perhaps with optional memory allocator func() parameter?
-		value, err := bindex.GetInternal([]byte(t.partitionOpaque))
-		if err != nil {
-			return nil, 0, err
+// Makes room for n more buffered bytes by synchronously applying the
+// pending batches of the partitions that buffer the most bytes, which
+// backpressures the caller's feed until the applies catch up.  A
+// batch larger than the max is let through once nothing else is
+// buffered.  The partitions of snapshotAtomic dests are never picked,
+// like with Flush(), as they only apply whole snapshots, nor are the
+// partitions of dests whose applies are paused, so their bytes are
+// also let through.  Must not be invoked while holding any
+// partition lock.
+func (b *bleveDestBudget) reserve(n int64) {
+	for {
+		b.m.Lock()
+		if b.max <= 0 || b.used+n <= b.max || b.used <= 0 {
+			b.m.Unlock()
+			return
 		}
-		t.lastOpaque = append([]byte(nil), value...) // Note: copies value.
-	}
-
-	if t.seqMax <= 0 {
-		// TODO: Need way to control memory alloc during GetInternal(),
-		// perhaps with optional memory allocator func() parameter?
-		buf, err := bindex.GetInternal([]byte(t.partition))
-		if err != nil {
-			return nil, 0, err
+		var victim *BleveDestPartition
+		var victimBytes int64
+		for t, tBytes := range b.holders {
+			if t.bdest.snapshotAtomic ||
+				atomic.LoadInt32(&t.bdest.applyPaused) > 0 {
+				continue
+			}
+			if victim == nil || victimBytes < tBytes {
+				victim, victimBytes = t, tBytes
+			}
 		}
-		if len(buf) <= 0 {
-			return t.lastOpaque, 0, nil // No seqMax buf is a valid case.
+		b.m.Unlock()
+
+		if victim == nil {
+			return
 		}
-		if len(buf) != 8 {
-			return nil, 0, fmt.Errorf("unexpected size for seqMax bytes")
+
+		err := victim.applyBuffered()
+		if err != nil {
+			log.Printf("bleve dest buffered bytes over budget,"+
+				" partition: %s, err: %v", victim.partition, err)
+			return
 		}
-		t.seqMax = binary.BigEndian.Uint64(buf[0:8])
-		binary.BigEndian.PutUint64(t.seqMaxBuf, t.seqMax)
 	}
-
-	return t.lastOpaque, t.seqMax, nil
 }
 
 // ---------------------------------------------------------
 
-func (t *BleveDestPartition) updateSeqUnlocked(bindex bleve.Index,
-	seq uint64) error {
-	if t.seqMax < seq {
-		t.seqMax = seq
-		binary.BigEndian.PutUint64(t.seqMaxBuf, t.seqMax)
+// BLEVE_FAN_OUT_CONCURRENCY_MAX is the default max number of
+// concurrent consistency waits or remote queries when fanning out a
+// query, which can be overridden by the Manager's
+// "fanOutConcurrencyMax" option.
+const BLEVE_FAN_OUT_CONCURRENCY_MAX = 32
 
-		// NOTE: No copy of partition to buf as it's immutatable string bytes.
-		t.batch.SetInternal([]byte(t.partition), t.seqMaxBuf)
+func bleveFanOutConcurrency(mgr *Manager) int {
+	if mgr == nil {
+		return BLEVE_FAN_OUT_CONCURRENCY_MAX
 	}
-
-	if len(t.buf) < BLEVE_DEST_APPLY_BUF_SIZE_BYTES &&
-		seq < t.seqSnapEnd {
-		return nil
+	v, exists := mgr.Options()["fanOutConcurrencyMax"]
+	if !exists {
+		return BLEVE_FAN_OUT_CONCURRENCY_MAX
 	}
-
-	return t.applyBatchUnlocked(bindex)
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("warning: could not parse fanOutConcurrencyMax option: %s,"+
+			" err: %v", v, err)
+		return BLEVE_FAN_OUT_CONCURRENCY_MAX
+	}
+	return n
 }
 
-func (t *BleveDestPartition) applyBatchUnlocked(bindex bleve.Index) error {
-	err := bindex.Batch(t.batch)
-	if err != nil {
-		return err
+// consistencyWaitPIndexes waits for the local pindexes to reach the
+// consistency vector for the index, with at most cap(concurrencyCh)
+// waiting concurrently.  The returned error reports every partition
+// that failed to reach consistency.
+func consistencyWaitPIndexes(localPIndexes []*PIndex, indexName string,
+	consistencyParams *ConsistencyParams, cancelCh chan struct{},
+	concurrencyCh chan struct{}) error {
+	if consistencyParams == nil ||
+		consistencyParams.Level == "" ||
+		consistencyParams.Vectors == nil {
+		return nil
+	}
+	consistencyVector := consistencyParams.Vectors[indexName]
+	if consistencyVector == nil {
+		return nil
 	}
 
-	t.seqMaxBatch = t.seqMax
+	var errsM sync.Mutex
+	var errs []string // Entries look like "partition: err".
+	var errConsistency error
 
-	for t.cwrQueue.Len() > 0 &&
-		t.cwrQueue[0].consistencySeq <= t.seqMaxBatch {
-		cwr := heap.Pop(&t.cwrQueue).(*consistencyWaitReq)
-		if cwr != nil &&
-			cwr.doneCh != nil {
-			close(cwr.doneCh)
+	var wg sync.WaitGroup
+
+	for _, localPIndex := range localPIndexes {
+		if localPIndex.Dest == nil {
+			continue
 		}
-	}
 
-	// TODO: would good to reuse batch; ask for a public Reset() kind
-	// of method on bleve.Batch?
-	t.batch = bleve.NewBatch()
+		concurrencyCh <- struct{}{}
 
-	if t.buf != nil {
-		t.buf = t.buf[0:0] // Reset t.buf via re-slice.
+		wg.Add(1)
+		go func(localPIndex *PIndex) {
+			defer func() {
+				<-concurrencyCh
+				wg.Done()
+			}()
+
+			for _, partition := range localPIndex.seqPartitions() {
+				consistencySeq := consistencyVector[partition]
+				if consistencySeq > 0 {
+					err := localPIndex.Dest.ConsistencyWait(partition,
+						consistencyParams.Level,
+						consistencySeq,
+						cancelCh)
+					if err != nil {
+						errsM.Lock()
+						errs = append(errs, partition+": "+err.Error())
+						if isConsistencyError(err) {
+							errConsistency = err
+						}
+						errsM.Unlock()
+					}
+				}
+			}
+		}(localPIndex)
 	}
 
-	// NOTE: Leave t.seqSnapEnd unchanged in case we're applying the
-	// batch because t.buf got too big.
+	wg.Wait()
+
+	if errConsistency != nil {
+		return errConsistency
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("consistency wait failed for %d partition(s): %s",
+			len(errs), strings.Join(errs, "; "))
+	}
 
 	return nil
 }
 
-// Appends b to end of t.buf, and returns that suffix slice of t.buf
-// that has the appended copy of the input b.
-func (t *BleveDestPartition) appendToBufUnlocked(b []byte) []byte {
-	if len(b) <= 0 {
-		return b
+// Returns the timeout in millisecs for health probes of remote
+// pindexes from the Manager's "remoteProbeTimeoutMS" option, where a
+// result <= 0 means remote pindexes aren't probed.
+func bleveRemoteProbeTimeoutMS(mgr *Manager) int64 {
+	if mgr == nil {
+		return 0
 	}
-	if t.buf == nil {
-		// TODO: parameterize initial buf capacity.
-		t.buf = make([]byte, 0, BLEVE_DEST_INITIAL_BUF_SIZE_BYTES)
+	v, exists := mgr.Options()["remoteProbeTimeoutMS"]
+	if !exists {
+		return 0
 	}
-	t.buf = append(t.buf, b...)
+	timeout, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("warning: could not parse remoteProbeTimeoutMS option: %s,"+
+			" err: %v", v, err)
+		return 0
+	}
+	return timeout
+}
 
-	return t.buf[len(t.buf)-len(b):]
+// Returns whether queries of remote pindexes are gzip encoded, from
+// the Manager's "remoteQueryGzip" option.
+func bleveRemoteQueryGzip(mgr *Manager) bool {
+	return mgr != nil && mgr.Options()["remoteQueryGzip"] == "true"
+}
+
+// healthyBleveClients concurrently probes the remote pindex clients,
+// with at most cap(concurrencyCh) probes in flight, and returns the
+// healthy clients in their original order, along with the probe
+// errors of the unhealthy ones, keyed by pindex name.
+func healthyBleveClients(clients []*BleveClient, timeout time.Duration,
+	concurrencyCh chan struct{}) ([]*BleveClient, map[string]string) {
+	errs := make([]error, len(clients))
+
+	var wg sync.WaitGroup
+
+	for i, client := range clients {
+		concurrencyCh <- struct{}{}
+
+		wg.Add(1)
+		go func(i int, client *BleveClient) {
+			defer func() {
+				<-concurrencyCh
+				wg.Done()
+			}()
+
+			errs[i] = client.Health(timeout)
+			if errs[i] != nil {
+				log.Printf("warning: unhealthy remote pindex,"+
+					" queryURL: %s, err: %v", client.QueryURL, errs[i])
+			}
+		}(i, client)
+	}
+
+	wg.Wait()
+
+	rv := make([]*BleveClient, 0, len(clients))
+	var skipped map[string]string
+	for i, client := range clients {
+		if errs[i] == nil {
+			rv = append(rv, client)
+			continue
+		}
+		if skipped == nil {
+			skipped = map[string]string{}
+		}
+		skipped[client.PIndexName] = errs[i].Error()
+	}
+	return rv, skipped
 }
 
 // ---------------------------------------------------------
 
 // Returns a bleve.IndexAlias that represents all the PIndexes for the
-// index, including perhaps bleve remote client PIndexes.
+// index, including perhaps bleve remote client PIndexes.  When
+// probeRemote is true and the Manager's "remoteProbeTimeoutMS" option
+// is positive, remote pindexes that fail a health probe are left out
+// of the returned alias, and are listed in its skipped map, which the
+// caller must check.
 //
 // TODO: Perhaps need a tighter check around indexUUID, as the current
 // implementation might have a race where old pindexes with a matching
 // (but invalid) indexUUID might be hit.
 func bleveIndexAlias(mgr *Manager, indexName, indexUUID string,
 	consistencyParams *ConsistencyParams,
-	cancelCh chan struct{}) (bleve.IndexAlias, error) {
+	cancelCh chan struct{}, probeRemote, includeTombstones bool,
+	stats *BleveQueryStats) (*bleveFanOut, error) {
 	localPIndexes, remotePlanPIndexes, err :=
 		mgr.CoveringPIndexes(indexName, indexUUID, PlanPIndexNodeCanRead)
 	if err != nil {
-		return nil, fmt.Errorf("bleveIndexAlias, err: %v", err)
+		return nil, &QueryUnavailableError{
+			Err: fmt.Errorf("bleveIndexAlias, err: %v", err),
+		}
 	}
 
-	var errConsistencyM sync.Mutex
-	var errConsistency error
-
-	alias := bleve.NewIndexAlias()
-
-	var wg sync.WaitGroup
+	alias := newBleveFanOut()
 
 	for _, localPIndex := range localPIndexes {
 		bindex, ok := localPIndex.Impl.(bleve.Index)
 		if ok && bindex != nil && localPIndex.IndexType == "bleve" {
-			alias.Add(bindex)
-
-			if localPIndex.Dest != nil &&
-				consistencyParams != nil &&
-				consistencyParams.Level != "" &&
-				consistencyParams.Vectors != nil {
-				consistencyVector := consistencyParams.Vectors[indexName]
-				if consistencyVector != nil {
-					wg.Add(1)
-					go func() {
-						defer wg.Done()
-
-						for _, partition := range localPIndex.sourcePartitionsArr {
-							consistencySeq := consistencyVector[partition]
-							if consistencySeq > 0 {
-								err := localPIndex.Dest.ConsistencyWait(partition,
-									consistencyParams.Level,
-									consistencySeq,
-									cancelCh)
-								if err != nil {
-									errConsistencyM.Lock()
-									errConsistency = err
-									errConsistencyM.Unlock()
-								}
-							}
-						}
-					}()
-				}
+			if bdest, ok := localPIndex.Dest.(*BleveDest); ok {
+				alias.Add(&bleveDestIndex{
+					Index:             bindex,
+					bdest:             bdest,
+					asOf:              bleveAsOfVector(localPIndex, consistencyParams),
+					name:              localPIndex.Name,
+					includeTombstones: includeTombstones,
+				})
+			} else {
+				alias.Add(bindex)
 			}
 		} else {
 			return nil, fmt.Errorf("bleveIndexAlias localPIndex wasn't bleve")
 		}
 	}
 
+	// Bounds both the local consistency waits and the remote queries.
+	concurrencyCh := make(chan struct{}, bleveFanOutConcurrency(mgr))
+
+	remoteGzip := bleveRemoteQueryGzip(mgr)
+
+	clients := make([]*BleveClient, 0, len(remotePlanPIndexes))
 	for _, remotePlanPIndex := range remotePlanPIndexes {
 		baseURL := "http://" + remotePlanPIndex.NodeDef.HostPort +
 			"/api/pindex/" + remotePlanPIndex.PlanPIndex.Name
-		alias.Add(&BleveClient{
-			QueryURL:    baseURL + "/query",
-			CountURL:    baseURL + "/count",
-			Consistency: consistencyParams,
+		clients = append(clients, &BleveClient{
+			PIndexName:    remotePlanPIndex.PlanPIndex.Name,
+			QueryURL:      baseURL + "/query",
+			CountURL:      baseURL + "/count",
+			StatsURL:      baseURL + "/stats",
+			Consistency:   consistencyParams,
+			ConcurrencyCh: concurrencyCh,
+			QueryStats:    stats,
+			Gzip:          remoteGzip,
+			HTTPClient:    mgr.remoteHTTPClient,
+
+			IncludeTombstones: includeTombstones,
 			// TODO: Propagate auth to bleve client.
 		})
 	}
 
-	// TODO: Should kickoff remote queries concurrently before we wait.
-	wg.Wait()
+	if probeRemote {
+		probeTimeoutMS := bleveRemoteProbeTimeoutMS(mgr)
+		if probeTimeoutMS > 0 {
+			clients, alias.skipped = healthyBleveClients(clients,
+				time.Duration(probeTimeoutMS)*time.Millisecond, concurrencyCh)
+		}
+	}
 
-	if errConsistency != nil {
-		return nil, fmt.Errorf("bleveIndexAlias consistency wait, err: %v",
-			errConsistency)
+	for _, client := range clients {
+		alias.Add(client)
+	}
+
+	if stats != nil {
+		stats.NumLocalPIndexes += len(localPIndexes)
+		stats.NumRemotePIndexes += len(clients)
+	}
+
+	// NOTE: The remote pindexes do their own consistency waits when
+	// they're searched, so only the local pindexes are waited on here.
+	consistencyWaitStart := time.Now()
+	waitCancelCh, timedOut, waitDone :=
+		consistencyWaitCancelCh(cancelCh, consistencyParams)
+	err = consistencyWaitPIndexes(localPIndexes, indexName,
+		consistencyParams, waitCancelCh, concurrencyCh)
+	waitDone()
+	if stats != nil {
+		stats.ConsistencyWaitNS += int64(time.Since(consistencyWaitStart))
+	}
+	if err != nil {
+		if timedOut() {
+			return nil, &ConsistencyTimeoutError{
+				TimeoutMS: consistencyParams.Timeout,
+			}
+		}
+		if isConsistencyError(err) {
+			return nil, err
+		}
+		return nil, &QueryUnavailableError{
+			Err: fmt.Errorf("bleveIndexAlias consistency wait, err: %v", err),
+		}
 	}
 
 	if cancelCh != nil {
 		select {
 		case <-cancelCh:
-			return nil, fmt.Errorf("cancelled")
+			return nil, &QueryUnavailableError{Err: fmt.Errorf("cancelled")}
 		default:
 		}
 	}
 
 	return alias, nil
 }
+
+// ---------------------------------------------------------
+
+// A bleveFanOut is a bleve.IndexAlias that also keeps its targets,
+// so that a sorted search can have each target sort and page its own
+// hits.  See bleveSearchSorted().
+type bleveFanOut struct {
+	bleve.IndexAlias
+	targets []bleve.Index
+
+	// The remote pindexes that were left out as unhealthy, keyed by
+	// pindex name, with their health probe errors.
+	skipped map[string]string
+}
+
+func newBleveFanOut() *bleveFanOut {
+	return &bleveFanOut{IndexAlias: bleve.NewIndexAlias()}
+}
+
+func (f *bleveFanOut) Add(target bleve.Index) {
+	f.IndexAlias.Add(target)
+	f.targets = append(f.targets, target)
+
+	if sub, ok := target.(*bleveFanOut); ok {
+		for name, err := range sub.skipped {
+			if f.skipped == nil {
+				f.skipped = map[string]string{}
+			}
+			f.skipped[name] = err
+		}
+	}
+}
+
+// Searches every target for its top req.Size hits by the sort spec,
+// after the opts.After sort values, if any, via an alias whose size
+// lets it keep the hits of every target, to be merged by the caller.
+// Also returns true when no target has any more hits.
+func (f *bleveFanOut) searchSorted(req *bleve.SearchRequest,
+	sortSpec []string, opts bleveSearchOptions) (
+	*bleve.SearchResult, bool, error) {
+	alias := bleve.NewIndexAlias()
+	targets := make([]*bleveSortedTarget, 0, len(f.targets))
+	for _, index := range f.targets {
+		target := &bleveSortedTarget{
+			Index:    index,
+			size:     req.Size,
+			sortSpec: sortSpec,
+			opts:     opts,
+		}
+		targets = append(targets, target)
+		alias.Add(target)
+	}
+
+	all := *req
+	all.Size = req.Size * len(targets)
+
+	rv, err := alias.Search(&all)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, target := range targets {
+		if !target.retrievedAll {
+			return rv, false, nil
+		}
+	}
+	return rv, true, nil
+}
+
+// bleveSortedSearcher is implemented by the targets that sort and
+// page their hits elsewhere, like a BleveClient's remote pindex.
+type bleveSortedSearcher interface {
+	SearchSorted(req *bleve.SearchRequest, sortSpec []string,
+		opts bleveSearchOptions) (*bleve.SearchResult, error)
+}
+
+// A bleveSortedTarget is a target of a bleveFanOut whose Search()
+// returns the target's top size hits by the sort spec, where the opts
+// are only for scrolling.
+type bleveSortedTarget struct {
+	bleve.Index
+	size     int
+	sortSpec []string
+	opts     bleveSearchOptions
+
+	retrievedAll bool // True when the target has no more hits.
+}
+
+func (t *bleveSortedTarget) Search(req *bleve.SearchRequest) (
+	*bleve.SearchResult, error) {
+	sub := *req
+	sub.From = 0
+	sub.Size = t.size
+
+	var rv *bleve.SearchResult
+	var err error
+	if s, ok := t.Index.(bleveSortedSearcher); ok {
+		rv, err = s.SearchSorted(&sub, t.sortSpec, t.opts)
+	} else {
+		rv, _, _, err = bleveSearchMerged(t.Index, &sub, t.sortSpec, t.opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	named, ok := t.Index.(bleveNamedIndex)
+	if ok && named.pindexName() != "" && t.opts.origins != nil {
+		t.opts.origins.add(rv.Hits, named.pindexName())
+	}
+
+	t.retrievedAll = len(rv.Hits) < t.size
+
+	return rv, nil
+}
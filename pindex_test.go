@@ -12,9 +12,20 @@
 package cbft
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
 )
 
 func TestOpenPIndex(t *testing.T) {
@@ -41,6 +52,62 @@ func TestNewPIndex(t *testing.T) {
 	}
 }
 
+func TestOpenPIndexImplVersion(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	path := PIndexPath(emptyDir, "fake")
+	pindex, err := NewPIndex(nil, "fake", "uuid",
+		"blackhole", "indexName", "indexUUID", "",
+		"sourceType", "sourceName", "sourceUUID", "sourceParams", "sourcePartitions",
+		path)
+	if pindex == nil || err != nil {
+		t.Errorf("expected NewPIndex to work")
+	}
+	if pindex.ImplVersion != VERSION {
+		t.Errorf("expected pindex.ImplVersion to be VERSION, got: %s",
+			pindex.ImplVersion)
+	}
+	pindex.Close(false)
+
+	tests := []struct {
+		implVersion string
+		expectOk    bool
+	}{
+		{VERSION, true},
+		{"0.0.0", true},
+		{"", true}, // Predates versioning.
+		{"1000.0.0", false},
+		{VERSION + ".1", false},
+	}
+
+	for i, test := range tests {
+		pindex.ImplVersion = test.implVersion
+		buf, _ := json.Marshal(pindex)
+		ioutil.WriteFile(path+string(os.PathSeparator)+PINDEX_META_FILENAME,
+			buf, 0600)
+
+		p, err := OpenPIndex(nil, path)
+		if test.expectOk {
+			if err != nil || p == nil {
+				t.Errorf("test: %d, expected OpenPIndex to work,"+
+					" implVersion: %s, err: %v", i, test.implVersion, err)
+			} else {
+				p.Close(false)
+			}
+		} else {
+			if err == nil || p != nil {
+				t.Errorf("test: %d, expected OpenPIndex to fail,"+
+					" implVersion: %s", i, test.implVersion)
+			}
+			if _, ok := err.(*PIndexVersionError); !ok {
+				t.Errorf("test: %d, expected PIndexVersionError, got: %#v",
+					i, err)
+			}
+		}
+	}
+}
+
 func TestNewPIndexEmptyJSON(t *testing.T) {
 	emptyDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(emptyDir)
@@ -147,3 +214,1107 @@ func TestBlackholePIndexImpl(t *testing.T) {
 		t.Errorf("expected blackhole query to err")
 	}
 }
+
+func TestParseBleveIndexParams(t *testing.T) {
+	bip, mapping, err := ParseBleveIndexParams("")
+	if err != nil || bip == nil || bip.QueryTimeout != 0 || mapping != "" {
+		t.Errorf("expected empty params to work, err: %v", err)
+	}
+
+	bip, mapping, err = ParseBleveIndexParams(`{"types":{}}`)
+	if err != nil || bip.QueryTimeout != 0 || mapping != `{"types":{}}` {
+		t.Errorf("expected mapping without cbft params to be unchanged,"+
+			" mapping: %s, err: %v", mapping, err)
+	}
+
+	bip, mapping, err = ParseBleveIndexParams(`{"queryTimeout":100,"types":{}}`)
+	if err != nil || bip.QueryTimeout != 100 || mapping != `{"types":{}}` {
+		t.Errorf("expected queryTimeout to be parsed and removed,"+
+			" bip: %#v, mapping: %s, err: %v", bip, mapping, err)
+	}
+
+	_, _, err = ParseBleveIndexParams(`not json`)
+	if err == nil {
+		t.Errorf("expected err on bad json")
+	}
+
+	_, _, err = ParseBleveIndexParams(`{"queryTimeout":"not-a-number"}`)
+	if err == nil {
+		t.Errorf("expected err on bad queryTimeout")
+	}
+
+	if ValidateBlevePIndexImpl("bleve", "idx", `{"queryTimeout":100}`) != nil {
+		t.Errorf("expected validate to allow queryTimeout")
+	}
+}
+
+func TestBleveQueryTimeoutMS(t *testing.T) {
+	cfg := NewCfgMem()
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["withTimeout"] = &IndexDef{
+		Type: "bleve", Name: "withTimeout", Params: `{"queryTimeout":200}`,
+	}
+	indexDefs.IndexDefs["noTimeout"] = &IndexDef{
+		Type: "bleve", Name: "noTimeout", Params: "",
+	}
+	CfgSetIndexDefs(cfg, indexDefs, 0)
+
+	mgr := NewManagerEx(VERSION, cfg, NewUUID(), []string{"queryer"}, "", 1,
+		":1000", "dir", "some-datasource", nil,
+		map[string]string{"queryTimeoutMS": "300"})
+	mgrNoDefault := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "dir", "some-datasource", nil)
+
+	tests := []struct {
+		label     string
+		mgr       *Manager
+		indexName string
+		timeout   int64
+		expected  int64
+	}{
+		{"request override", mgr, "withTimeout", 50, 50},
+		{"request unlimited", mgr, "withTimeout", -1, -1},
+		{"index default", mgr, "withTimeout", 0, 200},
+		{"manager default", mgr, "noTimeout", 0, 300},
+		{"manager default, unknown index", mgr, "unknown", 0, 300},
+		{"index default, no manager default", mgrNoDefault, "withTimeout", 0, 200},
+		{"unlimited", mgrNoDefault, "noTimeout", 0, 0},
+		{"no manager", nil, "noTimeout", 0, 0},
+	}
+	for _, test := range tests {
+		actual := bleveQueryTimeoutMS(test.mgr, test.indexName, test.timeout)
+		if actual != test.expected {
+			t.Errorf("test: %s, expected: %d, got: %d",
+				test.label, test.expected, actual)
+		}
+	}
+}
+
+func TestQueryTimeoutCancelCh(t *testing.T) {
+	cancelCh, done := queryTimeoutCancelCh(0)
+	if cancelCh != nil {
+		t.Errorf("expected no cancelCh when unlimited")
+	}
+	done()
+
+	cancelCh, done = queryTimeoutCancelCh(10)
+	select {
+	case <-cancelCh:
+	case <-time.After(time.Second):
+		t.Errorf("expected cancelCh to be closed after timeout")
+	}
+	done()
+
+	cancelCh, done = queryTimeoutCancelCh(20)
+	done() // Like a query that completes normally before the timeout.
+	select {
+	case <-cancelCh:
+		t.Errorf("expected cancelCh to not be closed after done")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestListPIndexImplTypes(t *testing.T) {
+	indexTypes := ListPIndexImplTypes()
+	if indexTypes["bleve"] == nil || indexTypes["blackhole"] == nil {
+		t.Errorf("expected registered index types, got: %#v", indexTypes)
+	}
+	if indexTypes["bleve"].Description == "" ||
+		indexTypes["bleve"].StartSample == nil {
+		t.Errorf("expected bleve metadata, got: %#v", indexTypes["bleve"])
+	}
+}
+
+func TestBleveSearchSorted(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restart := func() {
+		t.Errorf("not expecting a restart")
+	}
+
+	docs := map[string]string{
+		"a": `{"n":3,"s":"pear"}`,
+		"b": `{"n":1,"s":"apple"}`,
+		"c": `{"n":2,"s":"fig"}`,
+		"d": `{"n":1,"s":"kiwi"}`,
+		"e": `{"s":"date"}`,
+		"f": `{"n":5}`,
+	}
+
+	// Returns a bleve index holding the given docs in one partition.
+	newBindex := func(name string, keys ...string) bleve.Index {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, restart)
+		if err != nil || impl == nil || dest == nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		dest.OnSnapshotStart(name, 1, uint64(len(keys)))
+		for i, key := range keys {
+			dest.OnDataUpdate(name, []byte(key), uint64(i+1), []byte(docs[key]))
+		}
+		err = dest.ConsistencyWait(name, "at_plus", uint64(len(keys)), nil)
+		if err != nil {
+			t.Fatalf("expected docs to be indexed, err: %v", err)
+		}
+		return impl.(bleve.Index)
+	}
+
+	baseline := newBindex("baseline", "a", "b", "c", "d", "e", "f")
+	defer baseline.Close()
+	p0 := newBindex("p0", "a", "c", "e")
+	defer p0.Close()
+	p1 := newBindex("p1", "b", "d", "f")
+	defer p1.Close()
+
+	alias := bleve.NewIndexAlias()
+	alias.Add(p0, p1)
+
+	ids := func(index bleve.Index, from, size int, sortSpec []string) string {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(),
+			size, from, false)
+		res, err := bleveSearchSorted(index, req, sortSpec)
+		if err != nil {
+			t.Fatalf("expected bleveSearchSorted to work, err: %v", err)
+		}
+		rv := ""
+		for _, hit := range res.Hits {
+			if len(hit.Fields) != 0 {
+				t.Errorf("expected no unrequested fields, got: %#v", hit.Fields)
+			}
+			rv = rv + hit.ID
+		}
+		return rv
+	}
+
+	tests := []struct {
+		sortSpec []string
+		from     int
+		size     int
+		expected string
+	}{
+		{[]string{"_id"}, 0, 10, "abcdef"},
+		{[]string{"-_id"}, 0, 10, "fedcba"},
+		{[]string{"n", "_id"}, 0, 10, "bdcafe"},
+		{[]string{"-n", "_id"}, 0, 10, "facbde"},
+		{[]string{"s"}, 0, 10, "bedcaf"},
+		{[]string{"-s"}, 0, 10, "adcebf"},
+		{[]string{"n", "-s"}, 0, 10, "dbcafe"},
+		{[]string{"n", "_id"}, 1, 3, "dca"},
+		{[]string{"n", "_id"}, 5, 10, "e"},
+		{[]string{"n", "_id"}, 10, 10, ""},
+	}
+	for i, test := range tests {
+		got := ids(alias, test.from, test.size, test.sortSpec)
+		if got != test.expected {
+			t.Errorf("test %d, sortSpec: %v, expected merged order: %s, got: %s",
+				i, test.sortSpec, test.expected, got)
+		}
+		single := ids(baseline, test.from, test.size, test.sortSpec)
+		if got != single {
+			t.Errorf("test %d, sortSpec: %v, expected merged order: %s"+
+				" to match single index order: %s", i, test.sortSpec, got, single)
+		}
+	}
+
+	sortWindowTests := []struct {
+		sortWindowMax int
+		from          int
+		size          int
+		expectErr     bool
+	}{
+		{6, 0, 6, false},
+		{5, 0, 5, true}, // Matches exceed the window.
+		{6, 2, 5, true}, // From+Size exceeds the window.
+		{-1, 0, 10, false},
+	}
+	for i, test := range sortWindowTests {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(),
+			test.size, test.from, false)
+		_, _, _, err := bleveSearchMerged(baseline, req, []string{"_id"},
+			bleveSearchOptions{SortWindowMax: test.sortWindowMax})
+		if (err != nil) != test.expectErr {
+			t.Errorf("test %d, expected err: %v, got: %v",
+				i, test.expectErr, err)
+		}
+		if err != nil {
+			if _, ok := err.(*QueryBadRequestError); !ok {
+				t.Errorf("test %d, expected QueryBadRequestError, got: %#v",
+					i, err)
+			}
+		}
+	}
+}
+
+func TestBleveSearchSortedTieBreak(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restart := func() {
+		t.Errorf("not expecting a restart")
+	}
+
+	// Returns a bleve index where every doc has an identical score.
+	newBindex := func(name string, keys ...string) bleve.Index {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, restart)
+		if err != nil || impl == nil || dest == nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		dest.OnSnapshotStart(name, 1, uint64(len(keys)))
+		for i, key := range keys {
+			dest.OnDataUpdate(name, []byte(key), uint64(i+1),
+				[]byte(`{"x":"same words"}`))
+		}
+		err = dest.ConsistencyWait(name, "at_plus", uint64(len(keys)), nil)
+		if err != nil {
+			t.Fatalf("expected docs to be indexed, err: %v", err)
+		}
+		return impl.(bleve.Index)
+	}
+
+	p0 := newBindex("p0", "f", "b", "d")
+	defer p0.Close()
+	p1 := newBindex("p1", "c", "e", "a")
+	defer p1.Close()
+
+	alias := bleve.NewIndexAlias()
+	alias.Add(p0, p1)
+
+	pages := func() []string {
+		var rv []string
+		for from := 0; from < 6; from += 2 {
+			req := bleve.NewSearchRequestOptions(bleve.NewMatchQuery("same"),
+				2, from, false)
+			res, err := bleveSearchSorted(alias, req, nil)
+			if err != nil {
+				t.Fatalf("expected bleveSearchSorted to work, err: %v", err)
+			}
+			page := ""
+			for _, hit := range res.Hits {
+				page = page + hit.ID
+			}
+			rv = append(rv, page)
+		}
+		return rv
+	}
+
+	first := pages()
+	if !reflect.DeepEqual(first, []string{"ab", "cd", "ef"}) {
+		t.Errorf("expected equal scores to be ordered by doc ID, got: %v",
+			first)
+	}
+	for i := 0; i < 10; i++ {
+		again := pages()
+		if !reflect.DeepEqual(first, again) {
+			t.Errorf("expected identical pages, first: %v, again: %v",
+				first, again)
+		}
+	}
+}
+
+func TestBleveSearchMergedDedupe(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restart := func() {
+		t.Errorf("not expecting a restart")
+	}
+
+	newBindex := func(name string, keys ...string) bleve.Index {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, restart)
+		if err != nil || impl == nil || dest == nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		dest.OnSnapshotStart(name, 1, uint64(len(keys)))
+		for i, key := range keys {
+			dest.OnDataUpdate(name, []byte(key), uint64(i+1),
+				[]byte(`{"x":"same words"}`))
+		}
+		err = dest.ConsistencyWait(name, "at_plus", uint64(len(keys)), nil)
+		if err != nil {
+			t.Fatalf("expected docs to be indexed, err: %v", err)
+		}
+		return impl.(bleve.Index)
+	}
+
+	// Keys b, c and d are in both pindexes, as during a partition move.
+	p0 := newBindex("p0", "a", "b", "c", "d")
+	defer p0.Close()
+	p1 := newBindex("p1", "b", "c", "d", "e")
+	defer p1.Close()
+
+	alias := bleve.NewIndexAlias()
+	alias.Add(p0, p1)
+
+	for _, sortSpec := range [][]string{nil, []string{"_id"}} {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchQuery("same"),
+			4, 0, false)
+		res, dups, _, err := bleveSearchMerged(alias, req, sortSpec,
+			bleveSearchOptions{})
+		if err != nil {
+			t.Fatalf("expected bleveSearchMerged to work, err: %v", err)
+		}
+		if dups != 0 || res.Total != 8 {
+			t.Errorf("expected no dedupe when off, sortSpec: %v,"+
+				" dups: %d, total: %d", sortSpec, dups, res.Total)
+		}
+
+		res, dups, _, err = bleveSearchMerged(alias, req, sortSpec,
+			bleveSearchOptions{Dedupe: true})
+		if err != nil {
+			t.Fatalf("expected bleveSearchMerged to work, err: %v", err)
+		}
+		if dups != 3 {
+			t.Errorf("expected 3 dups, sortSpec: %v, got: %d", sortSpec, dups)
+		}
+		if res.Total != 5 {
+			t.Errorf("expected total 5, sortSpec: %v, got: %d",
+				sortSpec, res.Total)
+		}
+		if len(res.Hits) != 4 {
+			t.Errorf("expected a full page of 4 hits, sortSpec: %v, got: %d",
+				sortSpec, len(res.Hits))
+		}
+		seen := map[string]bool{}
+		for _, hit := range res.Hits {
+			if seen[hit.ID] {
+				t.Errorf("expected unique hit IDs, sortSpec: %v, dup: %s",
+					sortSpec, hit.ID)
+			}
+			seen[hit.ID] = true
+		}
+	}
+}
+
+func TestBleveDedupeHits(t *testing.T) {
+	hits := search.DocumentMatchCollection{
+		&search.DocumentMatch{ID: "a", Score: 1.0},
+		&search.DocumentMatch{ID: "b", Score: 0.5},
+		&search.DocumentMatch{ID: "a", Score: 2.0},
+		&search.DocumentMatch{ID: "c", Score: 0.1},
+	}
+	rv, dups := bleveDedupeHits(hits)
+	if dups != 1 || len(rv) != 3 {
+		t.Errorf("expected 1 dup and 3 hits, got: %d, %d", dups, len(rv))
+	}
+	if rv[1].ID != "a" || rv[1].Score != 2.0 {
+		t.Errorf("expected the highest scoring a, got: %#v", rv[1])
+	}
+}
+
+func TestBleveSearchSortedPagination(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restart := func() {
+		t.Errorf("not expecting a restart")
+	}
+
+	// Docs have the same length but different term frequencies of
+	// "hit", so that they have a variety of (and some tied) scores.
+	docs := map[string]string{
+		"a": `{"x":"hit zz zz zz"}`,
+		"b": `{"x":"hit hit hit zz"}`,
+		"c": `{"x":"hit hit zz zz"}`,
+		"d": `{"x":"hit hit hit hit"}`,
+		"e": `{"x":"hit zz zz zz"}`,
+		"f": `{"x":"hit hit zz zz"}`,
+		"g": `{"x":"hit hit hit zz"}`,
+		"h": `{"x":"hit zz zz zz"}`,
+		"i": `{"x":"hit hit hit hit"}`,
+	}
+
+	newBindex := func(name string, keys ...string) bleve.Index {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, restart)
+		if err != nil || impl == nil || dest == nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		dest.OnSnapshotStart(name, 1, uint64(len(keys)))
+		for i, key := range keys {
+			dest.OnDataUpdate(name, []byte(key), uint64(i+1), []byte(docs[key]))
+		}
+		err = dest.ConsistencyWait(name, "at_plus", uint64(len(keys)), nil)
+		if err != nil {
+			t.Fatalf("expected docs to be indexed, err: %v", err)
+		}
+		return impl.(bleve.Index)
+	}
+
+	baseline := newBindex("baseline", "a", "b", "c", "d", "e", "f", "g", "h", "i")
+	defer baseline.Close()
+	p0 := newBindex("p0", "a", "d", "g")
+	defer p0.Close()
+	p1 := newBindex("p1", "b", "e", "h")
+	defer p1.Close()
+	p2 := newBindex("p2", "c", "f", "i")
+	defer p2.Close()
+
+	alias := bleve.NewIndexAlias()
+	alias.Add(p0, p1, p2)
+
+	ids := func(index bleve.Index, from, size int) []string {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchQuery("hit"),
+			size, from, false)
+		res, err := bleveSearchSorted(index, req, nil)
+		if err != nil {
+			t.Fatalf("expected bleveSearchSorted to work, err: %v", err)
+		}
+		var rv []string
+		for _, hit := range res.Hits {
+			rv = append(rv, hit.ID)
+		}
+		return rv
+	}
+
+	size := 3
+	page1 := ids(alias, 0, size)
+	page2 := ids(alias, size, size)
+	if len(page1) != size || len(page2) != size {
+		t.Fatalf("expected full pages, got: %v, %v", page1, page2)
+	}
+
+	seen := map[string]bool{}
+	for _, id := range append(append([]string(nil), page1...), page2...) {
+		if seen[id] {
+			t.Errorf("expected no overlapping hits, dupe: %s", id)
+		}
+		seen[id] = true
+	}
+
+	top := ids(baseline, 0, 2*size)
+	pages := append(append([]string(nil), page1...), page2...)
+	if !reflect.DeepEqual(pages, top) {
+		t.Errorf("expected page1 + page2: %v to equal single index top: %v",
+			pages, top)
+	}
+	if !reflect.DeepEqual(top, []string{"d", "i", "b", "g", "c", "f"}) {
+		t.Errorf("expected top hits by tf then doc ID, got: %v", top)
+	}
+}
+
+func TestBleveQueryParamsScroll(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restart := func() {
+		t.Errorf("not expecting a restart")
+	}
+
+	// Many docs share a score, so that ties span the page boundaries.
+	docs := map[string]string{}
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		docs[key] = fmt.Sprintf(`{"x":"%s","y":"%s"}`,
+			[]string{"hit zz zz", "hit hit zz", "hit hit hit"}[i%3], key)
+		keys = append(keys, key)
+	}
+
+	// Returns the named pindex's bleve index, as queried by its
+	// BleveDest.
+	newBindex := func(name string, keys ...string) *bleveDestIndex {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, restart)
+		if err != nil || impl == nil || dest == nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		dest.OnSnapshotStart(name, 1, uint64(len(keys)))
+		for i, key := range keys {
+			dest.OnDataUpdate(name, []byte(key), uint64(i+1), []byte(docs[key]))
+		}
+		err = dest.ConsistencyWait(name, "at_plus", uint64(len(keys)), nil)
+		if err != nil {
+			t.Fatalf("expected docs to be indexed, err: %v", err)
+		}
+		return &bleveDestIndex{Index: impl.(bleve.Index),
+			bdest: dest.(*BleveDest), name: name}
+	}
+
+	p0 := newBindex("p0", keys[:7]...)
+	defer p0.Close()
+	p1 := newBindex("p1", keys[7:13]...)
+	defer p1.Close()
+	p2 := newBindex("p2", keys[13:]...)
+	defer p2.Close()
+
+	alias := bleve.NewIndexAlias()
+	alias.Add(p0, p1, p2)
+
+	// A bleveFanOut pushes the scroll down to each of its pindexes.
+	fanOut := newBleveFanOut()
+	fanOut.Add(p0)
+	fanOut.Add(p1)
+	fanOut.Add(p2)
+
+	for _, index := range []bleve.Index{alias, fanOut} {
+		for _, sortSpec := range [][]string{nil, []string{"-y"}} {
+			all, err := bleveSearchSorted(alias,
+				bleve.NewSearchRequestOptions(bleve.NewMatchQuery("hit"),
+					len(keys), 0, false), bleveScrollSortSpec(sortSpec))
+			if err != nil {
+				t.Fatalf("expected bleveSearchSorted to work, err: %v", err)
+			}
+
+			var got []string
+			seen := map[string]bool{}
+			cursor := ""
+			for pages := 0; pages < len(keys); pages++ {
+				p := &BleveQueryParams{
+					Query: bleve.NewSearchRequestOptions(bleve.NewMatchQuery("hit"),
+						3, 0, false),
+					Sort:   sortSpec,
+					Scroll: true,
+					Cursor: cursor,
+				}
+				err = p.Validate()
+				if err != nil {
+					t.Fatalf("expected cursor to validate, err: %v", err)
+				}
+				res, _, next, err := p.search(nil, index)
+				if err != nil {
+					t.Fatalf("expected search to work, err: %v", err)
+				}
+				if res.Total != uint64(len(keys)) {
+					t.Errorf("expected total: %d, got: %d", len(keys), res.Total)
+				}
+				for _, hit := range res.Hits {
+					if seen[hit.ID] {
+						t.Errorf("sortSpec: %v, expected each doc once, dup: %s",
+							sortSpec, hit.ID)
+					}
+					seen[hit.ID] = true
+					got = append(got, hit.ID)
+				}
+				if next == "" {
+					break
+				}
+				if index == fanOut {
+					// Each pindex's position counts its hits so far.
+					c, err := decodeBleveCursor(next, bleveScrollSortSpec(sortSpec))
+					if err != nil {
+						t.Fatalf("expected cursor to decode, err: %v", err)
+					}
+					positions := 0
+					for _, position := range c.Positions {
+						positions += position
+					}
+					if len(c.Positions) <= 0 || positions != len(got) {
+						t.Errorf("sortSpec: %v, expected positions to sum to: %d,"+
+							" got: %v", sortSpec, len(got), c.Positions)
+					}
+				}
+				cursor = next
+			}
+
+			if len(got) != len(keys) {
+				t.Errorf("sortSpec: %v, expected all %d docs, got: %v",
+					sortSpec, len(keys), got)
+			}
+			for i, hit := range all.Hits {
+				if i < len(got) && got[i] != hit.ID {
+					t.Errorf("sortSpec: %v, expected scroll order to match,"+
+						" i: %d, expected: %s, got: %s", sortSpec, i, hit.ID, got[i])
+				}
+			}
+
+			// A cursor is only valid for its sort spec, and not with from.
+			mismatch := &BleveQueryParams{
+				Query: bleve.NewSearchRequestOptions(bleve.NewMatchQuery("hit"),
+					3, 0, false),
+				Sort:   []string{"y"},
+				Cursor: cursor,
+			}
+			if mismatch.Validate() == nil {
+				t.Errorf("expected cursor with another sort to be invalid")
+			}
+			withFrom := &BleveQueryParams{
+				Query: bleve.NewSearchRequestOptions(bleve.NewMatchQuery("hit"),
+					3, 1, false),
+				Sort:   sortSpec,
+				Cursor: cursor,
+			}
+			if withFrom.Validate() == nil {
+				t.Errorf("expected cursor with from to be invalid")
+			}
+		}
+	}
+}
+
+func TestBleveFanOutConcurrency(t *testing.T) {
+	if bleveFanOutConcurrency(nil) != BLEVE_FAN_OUT_CONCURRENCY_MAX {
+		t.Errorf("expected default concurrency for nil mgr")
+	}
+	tests := []struct {
+		options  map[string]string
+		expected int
+	}{
+		{nil, BLEVE_FAN_OUT_CONCURRENCY_MAX},
+		{map[string]string{"fanOutConcurrencyMax": "5"}, 5},
+		{map[string]string{"fanOutConcurrencyMax": "0"},
+			BLEVE_FAN_OUT_CONCURRENCY_MAX},
+		{map[string]string{"fanOutConcurrencyMax": "bogus"},
+			BLEVE_FAN_OUT_CONCURRENCY_MAX},
+	}
+	for i, test := range tests {
+		mgr := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1,
+			":1000", "dir", "some-datasource", nil, test.options)
+		got := bleveFanOutConcurrency(mgr)
+		if got != test.expected {
+			t.Errorf("test %d, expected: %d, got: %d", i, test.expected, got)
+		}
+	}
+}
+
+// A ConcurrencyDest tracks the max number of concurrent
+// ConsistencyWait() invocations.
+type ConcurrencyDest struct {
+	TestDest
+
+	m       sync.Mutex
+	curr    int
+	maxCurr int
+}
+
+func (t *ConcurrencyDest) ConsistencyWait(partition string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh chan struct{}) error {
+	t.m.Lock()
+	t.curr++
+	if t.maxCurr < t.curr {
+		t.maxCurr = t.curr
+	}
+	t.m.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	t.m.Lock()
+	t.curr--
+	t.m.Unlock()
+	return nil
+}
+
+func TestConsistencyWaitPIndexesConcurrency(t *testing.T) {
+	dest := &ConcurrencyDest{}
+
+	var localPIndexes []*PIndex
+	vector := ConsistencyVector{}
+	for i := 0; i < 200; i++ {
+		partition := fmt.Sprintf("%d", i)
+		localPIndexes = append(localPIndexes, &PIndex{
+			Dest:                dest,
+			sourcePartitionsArr: []string{partition},
+		})
+		vector[partition] = 1
+	}
+
+	consistencyParams := &ConsistencyParams{
+		Level:   "at_plus",
+		Vectors: map[string]ConsistencyVector{"idx": vector},
+	}
+
+	err := consistencyWaitPIndexes(localPIndexes, "idx",
+		consistencyParams, nil, make(chan struct{}, 4))
+	if err != nil {
+		t.Errorf("expected consistency waits to work, err: %v", err)
+	}
+	if dest.maxCurr <= 0 || dest.maxCurr > 4 {
+		t.Errorf("expected concurrency bounded by 4, got: %d", dest.maxCurr)
+	}
+
+	err = consistencyWaitPIndexes(localPIndexes, "not-idx",
+		consistencyParams, nil, make(chan struct{}, 4))
+	if err != nil {
+		t.Errorf("expected no waits for an unknown index, err: %v", err)
+	}
+}
+
+// A FailingPartitionsDest fails ConsistencyWait() for some partitions.
+type FailingPartitionsDest struct {
+	TestDest
+
+	failures map[string]bool
+}
+
+func (t *FailingPartitionsDest) ConsistencyWait(partition string,
+	consistencyLevel string,
+	consistencySeq uint64,
+	cancelCh chan struct{}) error {
+	if t.failures[partition] {
+		return fmt.Errorf("timeout on %s", partition)
+	}
+	return nil
+}
+
+func TestConsistencyWaitPIndexesErrors(t *testing.T) {
+	dest := &FailingPartitionsDest{
+		failures: map[string]bool{"3": true, "7": true},
+	}
+
+	var localPIndexes []*PIndex
+	vector := ConsistencyVector{}
+	for i := 0; i < 10; i++ {
+		partition := fmt.Sprintf("%d", i)
+		localPIndexes = append(localPIndexes, &PIndex{
+			Dest:                dest,
+			sourcePartitionsArr: []string{partition},
+		})
+		vector[partition] = 1
+	}
+
+	consistencyParams := &ConsistencyParams{
+		Level:   "at_plus",
+		Vectors: map[string]ConsistencyVector{"idx": vector},
+	}
+
+	err := consistencyWaitPIndexes(localPIndexes, "idx",
+		consistencyParams, nil, make(chan struct{}, 4))
+	if err == nil {
+		t.Fatalf("expected consistency wait errors")
+	}
+	for _, s := range []string{"2 partition(s)",
+		"3: timeout on 3", "7: timeout on 7"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected err to contain: %q, got: %v", s, err)
+		}
+	}
+}
+
+func TestBleveRemoteProbeTimeoutMS(t *testing.T) {
+	if bleveRemoteProbeTimeoutMS(nil) != 0 {
+		t.Errorf("expected no probing for nil mgr")
+	}
+	tests := []struct {
+		options  map[string]string
+		expected int64
+	}{
+		{nil, 0},
+		{map[string]string{"remoteProbeTimeoutMS": "100"}, 100},
+		{map[string]string{"remoteProbeTimeoutMS": "bogus"}, 0},
+	}
+	for i, test := range tests {
+		mgr := NewManagerEx(VERSION, NewCfgMem(), NewUUID(), nil, "", 1,
+			":1000", "dir", "some-datasource", nil, test.options)
+		got := bleveRemoteProbeTimeoutMS(mgr)
+		if got != test.expected {
+			t.Errorf("test %d, expected: %d, got: %d", i, test.expected, got)
+		}
+	}
+}
+
+func TestBlackHoleSeqsAndOpaque(t *testing.T) {
+	bh := NewBlackHole("")
+
+	bh.OnSnapshotStart("0", 1, 3)
+	bh.OnDataUpdate("0", []byte("a"), 1, nil)
+	bh.OnDataUpdate("0", []byte("b"), 3, nil)
+	bh.OnDataDelete("0", []byte("a"), 2)
+	bh.SetOpaque("0", []byte("opaque0"))
+
+	stats := bh.Stats()
+	if stats.NumUpdate != 2 || stats.NumDelete != 1 ||
+		stats.NumSnapshotStart != 1 {
+		t.Errorf("expected counts to match, got: %#v", stats)
+	}
+
+	v, lastSeq, err := bh.GetOpaque("0")
+	if err != nil || string(v) != "opaque0" || lastSeq != 3 {
+		t.Errorf("expected opaque0 and lastSeq 3, got: %s, %d, err: %v",
+			v, lastSeq, err)
+	}
+	v, lastSeq, err = bh.GetOpaque("1")
+	if err != nil || v != nil || lastSeq != 0 {
+		t.Errorf("expected nothing for an unknown partition")
+	}
+
+	bh.Rollback("0", 1)
+	v, lastSeq, err = bh.GetOpaque("0")
+	if err != nil || v != nil || lastSeq != 0 {
+		t.Errorf("expected rollback to restart from zero, got: %s, %d",
+			v, lastSeq)
+	}
+}
+
+func TestCoveringPIndexesNodeTags(t *testing.T) {
+	cfg := NewCfgMem()
+
+	nodeDefs := NewNodeDefs(VERSION)
+	for _, nodeDef := range []*NodeDef{
+		{UUID: "self", HostPort: "self:1000"}, // Outdated, as no tags.
+		{UUID: "pindexer", HostPort: "a:1000", Tags: []string{"pindex"}},
+		{UUID: "planner", HostPort: "b:1000", Tags: []string{"planner"}},
+		{UUID: "any", HostPort: "c:1000"},
+	} {
+		nodeDefs.NodeDefs[nodeDef.UUID] = nodeDef
+	}
+	CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0)
+
+	canRead := &PlanPIndexNode{CanRead: true, CanWrite: true}
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	for _, planPIndex := range []*PlanPIndex{
+		{Name: "p0", IndexName: "idx", Nodes: map[string]*PlanPIndexNode{
+			"self": canRead, "planner": canRead, "pindexer": canRead}},
+		{Name: "p1", IndexName: "idx", Nodes: map[string]*PlanPIndexNode{
+			"planner": canRead, "any": canRead}},
+		{Name: "p2", IndexName: "plannerOnly", Nodes: map[string]*PlanPIndexNode{
+			"planner": canRead}},
+	} {
+		planPIndexes.PlanPIndexes[planPIndex.Name] = planPIndex
+	}
+	CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+
+	mgr := NewManager(VERSION, cfg, "self", []string{"planner", "queryer"},
+		"", 1, ":1000", "", "some-datasource", nil)
+	mgr.registerPIndex(&PIndex{Name: "p0", IndexName: "idx"})
+
+	localPIndexes, remotePlanPIndexes, err :=
+		mgr.CoveringPIndexes("idx", "", PlanPIndexNodeCanRead)
+	if err != nil {
+		t.Fatalf("expected CoveringPIndexes to work, err: %v", err)
+	}
+	if len(localPIndexes) != 0 {
+		t.Errorf("expected no local pindexes on a planner-only node,"+
+			" got: %#v", localPIndexes)
+	}
+	chosen := map[string]string{} // Keyed by planPIndex name.
+	for _, r := range remotePlanPIndexes {
+		chosen[r.PlanPIndex.Name] = r.NodeDef.UUID
+	}
+	if len(chosen) != 2 || chosen["p0"] != "pindexer" || chosen["p1"] != "any" {
+		t.Errorf("expected only pindex nodes to be chosen, got: %v", chosen)
+	}
+
+	_, _, err = mgr.CoveringPIndexes("plannerOnly", "", PlanPIndexNodeCanRead)
+	if err == nil {
+		t.Errorf("expected no coverage by a planner-only node")
+	}
+
+	// With the "pindex" tag, the local pindex is preferred.
+	mgrPIndex := NewManager(VERSION, cfg, "self", []string{"pindex"},
+		"", 1, ":1000", "", "some-datasource", nil)
+	mgrPIndex.registerPIndex(&PIndex{Name: "p0", IndexName: "idx"})
+
+	localPIndexes, _, err =
+		mgrPIndex.CoveringPIndexes("idx", "", PlanPIndexNodeCanRead)
+	if err != nil || len(localPIndexes) != 1 {
+		t.Errorf("expected the local pindex, got: %#v, err: %v",
+			localPIndexes, err)
+	}
+}
+
+func TestCoveringPIndexesWarmup(t *testing.T) {
+	warmupCh := make(chan struct{})
+	RegisterPIndexImplType("warmupTest", &PIndexImplType{
+		Warmup: func(pindex *PIndex) func() error {
+			if pindex.IndexParams != "warmup" {
+				return nil
+			}
+			return func() error {
+				<-warmupCh
+				return nil
+			}
+		},
+	})
+	defer delete(pindexImplTypes, "warmupTest")
+
+	cfg := NewCfgMem()
+
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs["self"] = &NodeDef{UUID: "self", HostPort: "self:1000"}
+	CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0)
+
+	canRead := &PlanPIndexNode{CanRead: true, CanWrite: true}
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	for _, name := range []string{"p0", "p1"} {
+		planPIndexes.PlanPIndexes[name] = &PlanPIndex{Name: name,
+			IndexName: "idx", Nodes: map[string]*PlanPIndexNode{"self": canRead}}
+	}
+	CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+
+	mgr := NewManager(VERSION, cfg, "self", nil,
+		"", 1, ":1000", "", "some-datasource", nil)
+	mgr.registerPIndex(&PIndex{Name: "p0", IndexName: "idx",
+		IndexType: "warmupTest", IndexParams: "warmup"})
+	mgr.registerPIndex(&PIndex{Name: "p1", IndexName: "idx",
+		IndexType: "warmupTest"})
+
+	if mgr.GetPIndex("p0").Ready() || !mgr.GetPIndex("p1").Ready() {
+		t.Errorf("expected only the pindex with a warmup to be warming")
+	}
+
+	_, _, err := mgr.CoveringPIndexes("idx", "", PlanPIndexNodeCanRead)
+	if err == nil {
+		t.Errorf("expected no coverage while a pindex is warming")
+	}
+
+	close(warmupCh)
+
+	for i := 0; i < 100 && !mgr.GetPIndex("p0").Ready(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	localPIndexes, _, err :=
+		mgr.CoveringPIndexes("idx", "", PlanPIndexNodeCanRead)
+	if err != nil || len(localPIndexes) != 2 {
+		t.Errorf("expected both local pindexes after warmup, got: %#v,"+
+			" err: %v", localPIndexes, err)
+	}
+}
+
+func TestWarmupBlevePIndexImpl(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	for i, test := range []struct {
+		indexParams string
+		expWarmup   bool
+	}{
+		{"", false},
+		{`{"warmup":false}`, false},
+		{`{"warmup":true}`, true},
+		{`{"warmup":true,"warmupQuery":"x:hello"}`, true},
+	} {
+		impl, dest, err := NewBlevePIndexImpl("bleve", test.indexParams,
+			emptyDir+string(os.PathSeparator)+fmt.Sprintf("idx%d", i),
+			func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+
+		dest.OnSnapshotStart("0", 1, 1)
+		dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+
+		warmup := WarmupBlevePIndexImpl(&PIndex{IndexType: "bleve",
+			IndexParams: test.indexParams, Impl: impl, Dest: dest})
+		if (warmup != nil) != test.expWarmup {
+			t.Errorf("test %d, expected warmup: %v", i, test.expWarmup)
+		}
+		if warmup != nil {
+			err = warmup()
+			if err != nil {
+				t.Errorf("test %d, expected warmup to work, err: %v", i, err)
+			}
+		}
+
+		dest.Close()
+
+		if warmup != nil && warmup() != errBleveDestClosed {
+			t.Errorf("test %d, expected warmup of a closed pindex to fail", i)
+		}
+	}
+}
+
+func TestCoveringPIndexesQueryRouting(t *testing.T) {
+	defer func(prev func(int) int) { queryRoutingIntn = prev }(queryRoutingIntn)
+
+	cfg := NewCfgMem()
+
+	nodeDefs := NewNodeDefs(VERSION)
+	for _, nodeUUID := range []string{"self", "a", "b"} {
+		nodeDefs.NodeDefs[nodeUUID] = &NodeDef{UUID: nodeUUID,
+			HostPort: nodeUUID + ":1000"}
+	}
+	CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0)
+
+	canRead := &PlanPIndexNode{CanRead: true, CanWrite: true}
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	for _, planPIndex := range []*PlanPIndex{
+		{Name: "p0", IndexName: "idx", Nodes: map[string]*PlanPIndexNode{
+			"self": canRead, "a": canRead, "b": canRead}},
+		{Name: "p1", IndexName: "idx", Nodes: map[string]*PlanPIndexNode{
+			"a": canRead, "b": canRead}},
+		{Name: "p2", IndexName: "localIdx", Nodes: map[string]*PlanPIndexNode{
+			"self": canRead, "a": canRead}},
+	} {
+		planPIndexes.PlanPIndexes[planPIndex.Name] = planPIndex
+	}
+	CfgSetPlanPIndexes(cfg, planPIndexes, 0)
+
+	// Returns the chosen node UUID of each planPIndex name, as a
+	// string, given the queryRouting option.
+	covering := func(routing, indexName string) (string, error) {
+		mgr := NewManagerEx(VERSION, cfg, "self", nil,
+			"", 1, ":1000", "", "some-datasource", nil,
+			map[string]string{"queryRouting": routing})
+		mgr.registerPIndex(&PIndex{Name: "p0", IndexName: "idx"})
+		mgr.registerPIndex(&PIndex{Name: "p2", IndexName: "localIdx"})
+
+		localPIndexes, remotePlanPIndexes, err :=
+			mgr.CoveringPIndexes(indexName, "", PlanPIndexNodeCanRead)
+		if err != nil {
+			return "", err
+		}
+		var chosen []string
+		for _, p := range localPIndexes {
+			chosen = append(chosen, p.Name+":self")
+		}
+		for _, r := range remotePlanPIndexes {
+			chosen = append(chosen, r.PlanPIndex.Name+":"+r.NodeDef.UUID)
+		}
+		sort.Strings(chosen)
+		return strings.Join(chosen, ","), nil
+	}
+
+	tests := []struct {
+		routing   string
+		indexName string
+		intn      int // Chooses the replica for balanced routing.
+		expected  string
+		expErr    bool
+	}{
+		{"", "localIdx", 0, "p2:self", false},
+		{"localFirst", "localIdx", 0, "p2:self", false},
+		{"localOnly", "localIdx", 0, "p2:self", false},
+		{"balanced", "localIdx", 0, "p2:a", false},
+		{"balanced", "localIdx", 1, "p2:self", false},
+		{"unknown", "localIdx", 0, "p2:self", false},
+
+		{"localOnly", "idx", 0, "", true},
+		{"balanced", "idx", 0, "p0:a,p1:a", false},
+		{"balanced", "idx", 1, "p0:b,p1:b", false},
+		{"balanced", "idx", 2, "p0:self,p1:a", false},
+	}
+
+	for i, test := range tests {
+		queryRoutingIntn = func(n int) int {
+			return test.intn % n
+		}
+
+		got, err := covering(test.routing, test.indexName)
+		if (err != nil) != test.expErr {
+			t.Errorf("test %d, routing: %s, expErr: %v, got err: %v",
+				i, test.routing, test.expErr, err)
+		}
+		if err == nil && got != test.expected {
+			t.Errorf("test %d, routing: %s, expected: %s, got: %s",
+				i, test.routing, test.expected, got)
+		}
+	}
+
+	// With localFirst, a partition without a local pindex still goes
+	// to one of its remote replicas.
+	queryRoutingIntn = rand.Intn
+	got, err := covering("localFirst", "idx")
+	if err != nil || (got != "p0:self,p1:a" && got != "p0:self,p1:b") {
+		t.Errorf("expected local p0 and remote p1, got: %s, err: %v", got, err)
+	}
+
+	// Balanced routing spreads the choices across the replicas.
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		got, err := covering("balanced", "localIdx")
+		if err != nil {
+			t.Fatalf("expected balanced to work, err: %v", err)
+		}
+		seen[got] = true
+	}
+	if !seen["p2:self"] || !seen["p2:a"] || len(seen) != 2 {
+		t.Errorf("expected balanced to choose both replicas, got: %v", seen)
+	}
+}
@@ -11,18 +11,88 @@ package cbft
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/document"
+
+	log "github.com/couchbaselabs/clog"
 )
 
-var httpPost = http.Post
-var httpGet = http.Get
+// Defaults for the transport of the http.Client that a Manager's
+// remote calls share, overridable via the Manager's options.  See
+// newRemoteHTTPClient().
+const REMOTE_MAX_IDLE_CONNS_PER_HOST = 32
+const REMOTE_IDLE_CONN_TIMEOUT_MS = 90000
+const REMOTE_DIAL_TIMEOUT_MS = 30000
+
+// Used by a BleveClient that has no HTTPClient, such as one that
+// isn't created on behalf of a Manager.
+var defaultRemoteHTTPClient = newRemoteHTTPClient(nil)
+
+// Returns an http.Client whose transport keeps connections to remote
+// nodes alive for reuse across calls, tuned by the options
+// "remoteMaxIdleConnsPerHost", "remoteIdleConnTimeoutMS",
+// "remoteDialTimeoutMS" and "remoteTimeoutMS", where the last bounds
+// a whole remote call and defaults to 0, for no timeout.
+func newRemoteHTTPClient(options map[string]string) *http.Client {
+	option := func(name string, defaultVal int) int {
+		v, exists := options[name]
+		if !exists {
+			return defaultVal
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("warning: could not parse %s option: %s, err: %v",
+				name, v, err)
+			return defaultVal
+		}
+		return n
+	}
+
+	ms := func(name string, defaultVal int) time.Duration {
+		return time.Duration(option(name, defaultVal)) * time.Millisecond
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   ms("remoteDialTimeoutMS", REMOTE_DIAL_TIMEOUT_MS),
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConnsPerHost: option("remoteMaxIdleConnsPerHost",
+				REMOTE_MAX_IDLE_CONNS_PER_HOST),
+			IdleConnTimeout: ms("remoteIdleConnTimeoutMS",
+				REMOTE_IDLE_CONN_TIMEOUT_MS),
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		Timeout: ms("remoteTimeoutMS", 0),
+	}
+}
+
+var httpPost = func(c *http.Client, url, bodyType string,
+	body io.Reader) (*http.Response, error) {
+	return c.Post(url, bodyType, body)
+}
+
+var httpGet = func(c *http.Client, url string) (*http.Response, error) {
+	return c.Get(url)
+}
+
+var httpDo = func(c *http.Client, req *http.Request) (*http.Response, error) {
+	return c.Do(req)
+}
 
 var bleveClientUnimplementedErr = errors.New("unimplemented")
 
@@ -34,9 +104,43 @@ var bleveClientUnimplementedErr = errors.New("unimplemented")
 //
 // TODO: Implement propagating auth info in BleveClient.
 type BleveClient struct {
+	PIndexName  string // Optional, the name of the remote pindex.
 	QueryURL    string
 	CountURL    string
+	StatsURL    string // Optional, used by Health().
 	Consistency *ConsistencyParams
+
+	// Optional, shared amongst clients to bound their concurrent
+	// requests to cap(ConcurrencyCh).
+	ConcurrencyCh chan struct{}
+
+	// Optional, when non-nil the latency of each Search is recorded.
+	QueryStats *BleveQueryStats
+
+	// When true, Search requests are gzip encoded and accept a gzip
+	// encoded response, falling back to unencoded requests for a
+	// remote that doesn't support them.
+	Gzip bool
+
+	// Optional, such as the http.Client of the Manager whose query
+	// created the client, so that connections are reused across
+	// queries.
+	HTTPClient *http.Client
+
+	// When true, Search requests ask the remote pindex to also match
+	// its tombstones.  See BleveQueryParams.IncludeTombstones.
+	IncludeTombstones bool
+}
+
+func (r *BleveClient) pindexName() string {
+	return r.PIndexName
+}
+
+func (r *BleveClient) httpClient() *http.Client {
+	if r.HTTPClient != nil {
+		return r.HTTPClient
+	}
+	return defaultRemoteHTTPClient
 }
 
 func (r *BleveClient) Index(id string, data interface{}) error {
@@ -59,7 +163,11 @@ func (r *BleveClient) DocCount() (uint64, error) {
 	if r.CountURL == "" {
 		return 0, fmt.Errorf("no CountURL provided")
 	}
-	resp, err := httpGet(r.CountURL)
+	if r.ConcurrencyCh != nil {
+		r.ConcurrencyCh <- struct{}{}
+		defer func() { <-r.ConcurrencyCh }()
+	}
+	resp, err := httpGet(r.httpClient(), r.CountURL)
 	if err != nil {
 		return 0, err
 	}
@@ -85,31 +193,124 @@ func (r *BleveClient) DocCount() (uint64, error) {
 	return rv.Count, nil
 }
 
+// Health probes the remote pindex via its StatsURL, returning an
+// error if the remote pindex didn't respond as healthy within the
+// timeout, after which the probe's request is cancelled.
+func (r *BleveClient) Health(timeout time.Duration) error {
+	if r.StatsURL == "" {
+		return fmt.Errorf("no StatsURL provided")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", r.StatsURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpDo(r.httpClient(), req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("bleveClient.Health timeout: %v, statsURL: %s",
+				timeout, r.StatsURL)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("bleveClient.Health got status code: %d,"+
+			" statsURL: %s", resp.StatusCode, r.StatsURL)
+	}
+	rv := struct {
+		Status string `json:"status"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&rv)
+	if err != nil || rv.Status != "ok" {
+		return fmt.Errorf("bleveClient.Health unhealthy,"+
+			" statsURL: %s, status: %q, err: %v", r.StatsURL, rv.Status, err)
+	}
+	return nil
+}
+
 func (r *BleveClient) Search(req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	return r.search(req, &BleveQueryParams{
+		Query:             req,
+		Consistency:       r.Consistency,
+		IncludeTombstones: r.IncludeTombstones,
+	})
+}
+
+// SearchSorted has the remote pindex sort and page its own hits by
+// the sort spec, so that only its top req.Size hits are returned,
+// which when scrolling are the hits after the opts.After cursor.
+// See bleveSearchSorted().
+func (r *BleveClient) SearchSorted(req *bleve.SearchRequest,
+	sortSpec []string, opts bleveSearchOptions) (*bleve.SearchResult, error) {
+	bleveQueryParams := &BleveQueryParams{
+		Query:             req,
+		Consistency:       r.Consistency,
+		Sort:              sortSpec,
+		Scroll:            opts.Scroll,
+		IncludeTombstones: r.IncludeTombstones,
+	}
+	if opts.After != nil {
+		c := &bleveCursor{Sort: sortSpec, After: opts.After}
+		if position, ok := opts.Positions[r.PIndexName]; ok {
+			c.Positions = map[string]int{r.PIndexName: position}
+		}
+		cursor, err := encodeBleveCursor(c)
+		if err != nil {
+			return nil, err
+		}
+		bleveQueryParams.Cursor = cursor
+	}
+	return r.search(req, bleveQueryParams)
+}
+
+func (r *BleveClient) search(req *bleve.SearchRequest,
+	bleveQueryParams *BleveQueryParams) (*bleve.SearchResult, error) {
 	if r.QueryURL == "" {
 		return nil, fmt.Errorf("no QueryURL provided")
 	}
-
-	bleveQueryParams := &BleveQueryParams{
-		Query:       req,
-		Consistency: r.Consistency,
+	if r.ConcurrencyCh != nil {
+		r.ConcurrencyCh <- struct{}{}
+		defer func() { <-r.ConcurrencyCh }()
 	}
 
 	buf, err := json.Marshal(bleveQueryParams)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := httpPost(r.QueryURL, "application/json", bytes.NewBuffer(buf))
+	if r.QueryStats != nil {
+		start := time.Now()
+		defer func() { r.QueryStats.addRemote(r.QueryURL, time.Since(start)) }()
+	}
+	var resp *http.Response
+	if r.Gzip {
+		resp, err = r.postGzip(buf)
+	} else {
+		resp, err = httpPost(r.httpClient(), r.QueryURL,
+			"application/json", bytes.NewBuffer(buf))
+	}
 	if err != nil {
-		return nil, err
+		return nil, &QueryUnavailableError{Err: err}
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("bleveClient.Search got status code: %d,"+
+		err = fmt.Errorf("bleveClient.Search got status code: %d,"+
 			" searchURL: %s, req: %#v, resp: %#v",
 			resp.StatusCode, r.QueryURL, req, resp)
+		switch resp.StatusCode {
+		case 400:
+			return nil, &QueryBadRequestError{Err: err}
+		case 429, 503:
+			return nil, &QueryUnavailableError{Err: err}
+		}
+		return nil, err
 	}
-	respBuf, err := ioutil.ReadAll(resp.Body)
+	respBuf, err := readResponseBody(resp)
 	if err != nil {
 		return nil, fmt.Errorf("bleveClient.Search error reading resp.Body,"+
 			" searchURL: %s, req: %#v, resp: %#v",
@@ -125,6 +326,62 @@ func (r *BleveClient) Search(req *bleve.SearchRequest) (*bleve.SearchResult, err
 	return rv, nil
 }
 
+// Posts a gzip encoded query request to the QueryURL.  A remote that
+// rejects the encoding, with a 415 status, or that fails to decode the
+// encoded request, such as an older cbft that parses it as JSON, is
+// retried with an unencoded request.  Any other failure is returned
+// as-is, so that, for example, a bad query isn't sent twice.
+func (r *BleveClient) postGzip(buf []byte) (*http.Response, error) {
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	_, err := gz.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", r.QueryURL, &gzBuf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := httpDo(r.httpClient(), req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 200 {
+		return resp, nil
+	}
+	if resp.StatusCode != 415 {
+		if resp.StatusCode != 400 {
+			return resp, nil
+		}
+		respBuf, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBuf))
+		if !bytes.Contains(respBuf, gzipDecodeFailure) {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+
+	return httpPost(r.httpClient(), r.QueryURL,
+		"application/json", bytes.NewBuffer(buf))
+}
+
+// The error of a JSON parser that was given a gzip encoded body, as
+// its first byte is gzip's magic 0x1f byte.
+var gzipDecodeFailure = []byte(`invalid character '\x1f'`)
+
 func (r *BleveClient) Fields() ([]string, error) {
 	return nil, bleveClientUnimplementedErr
 }
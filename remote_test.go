@@ -12,7 +12,24 @@
 package cbft
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
 )
 
 func TestNegativeBleveClient(t *testing.T) {
@@ -86,3 +103,1693 @@ func TestBadURLsBleveClient(t *testing.T) {
 		t.Errorf("expected search error on bad QueryURL")
 	}
 }
+
+func TestBleveClientHighlightMerge(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restart := func() {
+		t.Errorf("not expecting a restart")
+	}
+
+	// Returns a bleve index holding a few docs for a single partition.
+	newBindex := func(name, partition string, keys ...string) bleve.Index {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, restart)
+		if err != nil || impl == nil || dest == nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		bindex, ok := impl.(bleve.Index)
+		if !ok {
+			t.Fatalf("expected a bleve.Index impl")
+		}
+		dest.OnSnapshotStart(partition, 1, uint64(len(keys)))
+		for i, key := range keys {
+			dest.OnDataUpdate(partition, []byte(key), uint64(i+1),
+				[]byte(`{"x":"hello from `+key+`"}`))
+		}
+		err = dest.ConsistencyWait(partition, "at_plus",
+			uint64(len(keys)), nil)
+		if err != nil {
+			t.Fatalf("expected docs to be indexed, err: %v", err)
+		}
+		return bindex
+	}
+
+	local := newBindex("local", "0", "a", "b")
+	defer local.Close()
+	remote := newBindex("remote", "1", "c", "d")
+	defer remote.Close()
+
+	// Serves the remote bleve index like a cbft pindex query endpoint.
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var bleveQueryParams BleveQueryParams
+			err := json.NewDecoder(req.Body).Decode(&bleveQueryParams)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			searchResponse, err := remote.Search(bleveQueryParams.Query)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			mustEncode(w, searchResponse)
+		}))
+	defer server.Close()
+
+	alias := bleve.NewIndexAlias()
+	alias.Add(local, &BleveClient{QueryURL: server.URL})
+
+	sr := bleve.NewSearchRequest(bleve.NewMatchQuery("hello"))
+	sr.Highlight = bleve.NewHighlight()
+
+	searchResponse, err := alias.Search(sr)
+	if err != nil {
+		t.Fatalf("expected alias search to work, err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	mustEncode(&buf, searchResponse)
+
+	var merged bleve.SearchResult
+	err = json.Unmarshal(buf.Bytes(), &merged)
+	if err != nil {
+		t.Fatalf("expected merged response to parse, err: %v", err)
+	}
+	if len(merged.Hits) != 4 {
+		t.Errorf("expected 4 hits, got: %d", len(merged.Hits))
+	}
+	for _, hit := range merged.Hits {
+		if len(hit.Fragments["x"]) <= 0 {
+			t.Errorf("expected highlight fragments for hit: %s, got: %#v",
+				hit.ID, hit.Fragments)
+		}
+	}
+}
+
+func TestBleveClientStoredFields(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	restart := func() {
+		t.Errorf("not expecting a restart")
+	}
+
+	newBindex := func(name, partition string, keys ...string) bleve.Index {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, restart)
+		if err != nil || impl == nil || dest == nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		dest.OnSnapshotStart(partition, 1, uint64(len(keys)))
+		for i, key := range keys {
+			dest.OnDataUpdate(partition, []byte(key), uint64(i+1),
+				[]byte(`{"x":"hello","y":"`+key+`","z":"zzz"}`))
+		}
+		err = dest.ConsistencyWait(partition, "at_plus",
+			uint64(len(keys)), nil)
+		if err != nil {
+			t.Fatalf("expected docs to be indexed, err: %v", err)
+		}
+		return impl.(bleve.Index)
+	}
+
+	local := newBindex("local", "0", "a", "b")
+	defer local.Close()
+	remote := newBindex("remote", "1", "c", "d")
+	defer remote.Close()
+
+	// Serves the remote bleve index like BleveDest.Query() does.
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var bleveQueryParams BleveQueryParams
+			err := json.NewDecoder(req.Body).Decode(&bleveQueryParams)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			searchResponse, err := bleveSearchSorted(remote,
+				bleveQueryParams.Query, bleveQueryParams.Sort)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			mustEncode(w, searchResponse)
+		}))
+	defer server.Close()
+
+	alias := bleve.NewIndexAlias()
+	alias.Add(local, &BleveClient{QueryURL: server.URL})
+
+	tests := []struct {
+		fields   []string
+		sortSpec []string
+	}{
+		{[]string{"y"}, nil},
+		{[]string{"x", "y"}, nil},
+		{[]string{"x", "y"}, []string{"z", "_id"}},
+		{nil, nil},
+		{nil, []string{"z", "_id"}},
+	}
+
+	for i, test := range tests {
+		sr := bleve.NewSearchRequest(bleve.NewMatchQuery("hello"))
+		sr.Fields = test.fields
+
+		searchResponse, err := bleveSearchSorted(alias, sr, test.sortSpec)
+		if err != nil {
+			t.Fatalf("test %d, expected search to work, err: %v", i, err)
+		}
+
+		// Compares the hits as the REST client would see them.
+		var buf bytes.Buffer
+		mustEncode(&buf, searchResponse)
+		var merged bleve.SearchResult
+		err = json.Unmarshal(buf.Bytes(), &merged)
+		if err != nil {
+			t.Fatalf("test %d, expected response to parse, err: %v", i, err)
+		}
+		if len(merged.Hits) != 4 {
+			t.Errorf("test %d, expected 4 hits, got: %d", i, len(merged.Hits))
+		}
+		for _, hit := range merged.Hits {
+			expected := map[string]interface{}{}
+			for _, field := range test.fields {
+				if field == "x" {
+					expected[field] = "hello"
+				} else {
+					expected[field] = hit.ID
+				}
+			}
+			if len(expected) <= 0 {
+				expected = nil
+			}
+			if !reflect.DeepEqual(hit.Fields, expected) {
+				t.Errorf("test %d, expected fields: %#v, hit: %s, got: %#v",
+					i, expected, hit.ID, hit.Fields)
+			}
+		}
+	}
+}
+
+func TestBleveFanOutSortedPushDown(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	newBindex := func(name, partition string, keys ...string) bleve.Index {
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, func() {})
+		if err != nil || impl == nil || dest == nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		dest.OnSnapshotStart(partition, 1, uint64(len(keys)))
+		for i, key := range keys {
+			dest.OnDataUpdate(partition, []byte(key), uint64(i+1),
+				[]byte(`{"x":"hello","y":"`+key+`"}`))
+		}
+		err = dest.ConsistencyWait(partition, "at_plus",
+			uint64(len(keys)), nil)
+		if err != nil {
+			t.Fatalf("expected docs to be indexed, err: %v", err)
+		}
+		return impl.(bleve.Index)
+	}
+
+	local := newBindex("local", "0", "a", "c", "e", "g")
+	defer local.Close()
+	remote := newBindex("remote", "1", "b", "d", "f", "h")
+	defer remote.Close()
+
+	var m sync.Mutex
+	var remoteSizes []int
+	var remoteCursors []string
+
+	// Serves the remote bleve index like BleveDest.Query() does.
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var bleveQueryParams BleveQueryParams
+			err := json.NewDecoder(req.Body).Decode(&bleveQueryParams)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			m.Lock()
+			remoteSizes = append(remoteSizes, bleveQueryParams.Query.Size)
+			remoteCursors = append(remoteCursors, bleveQueryParams.Cursor)
+			m.Unlock()
+			searchResponse, _, _, err := bleveQueryParams.search(nil, remote)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			mustEncode(w, searchResponse)
+		}))
+	defer server.Close()
+
+	fanOut := newBleveFanOut()
+	fanOut.Add(local)
+	fanOut.Add(&BleveClient{QueryURL: server.URL})
+
+	sr := bleve.NewSearchRequestOptions(bleve.NewMatchQuery("hello"),
+		2, 1, false)
+
+	res, err := bleveSearchSorted(fanOut, sr, []string{"-y"})
+	if err != nil {
+		t.Fatalf("expected search to work, err: %v", err)
+	}
+	if res.Total != 8 || len(res.Hits) != 2 ||
+		res.Hits[0].ID != "g" || res.Hits[1].ID != "f" {
+		t.Errorf("expected the 2nd and 3rd hits by -y, got: %#v", res)
+	}
+	for _, hit := range res.Hits {
+		if hit.Fields != nil {
+			t.Errorf("expected the sort fields not to leak, got: %#v",
+				hit.Fields)
+		}
+	}
+
+	m.Lock()
+	if !reflect.DeepEqual(remoteSizes, []int{3}) {
+		t.Errorf("expected the remote to only be asked for its top"+
+			" from+size hits, got sizes: %v", remoteSizes)
+	}
+	remoteSizes = nil
+	remoteCursors = nil
+	m.Unlock()
+
+	// A deep scroll page only asks the remote for a page of hits,
+	// after the cursor.
+	var got []string
+	cursor := ""
+	for i := 0; i < 4; i++ {
+		p := &BleveQueryParams{
+			Query: bleve.NewSearchRequestOptions(bleve.NewMatchQuery("hello"),
+				2, 0, false),
+			Sort:   []string{"-y"},
+			Cursor: cursor,
+			Scroll: true,
+		}
+		res, _, next, err := p.search(nil, fanOut)
+		if err != nil {
+			t.Fatalf("expected scroll to work, err: %v", err)
+		}
+		for _, hit := range res.Hits {
+			got = append(got, hit.ID)
+		}
+		cursor = next
+	}
+	if strings.Join(got, ",") != "h,g,f,e,d,c,b,a" {
+		t.Errorf("expected all the hits in scroll order, got: %v", got)
+	}
+
+	m.Lock()
+	if !reflect.DeepEqual(remoteSizes, []int{2, 2, 2, 2}) {
+		t.Errorf("expected the remote to only be asked for a page,"+
+			" got sizes: %v", remoteSizes)
+	}
+	for i, remoteCursor := range remoteCursors {
+		if (i == 0) != (remoteCursor == "") {
+			t.Errorf("expected the cursor to be pushed down, i: %d,"+
+				" cursor: %q", i, remoteCursor)
+		}
+	}
+	m.Unlock()
+}
+
+func TestBleveClientConcurrency(t *testing.T) {
+	var m sync.Mutex
+	curr, maxCurr, numPosts := 0, 0, 0
+
+	httpPostOrig := httpPost
+	defer func() { httpPost = httpPostOrig }()
+
+	httpPost = func(c *http.Client, url string, bodyType string,
+		body io.Reader) (*http.Response, error) {
+		m.Lock()
+		curr++
+		numPosts++
+		if maxCurr < curr {
+			maxCurr = curr
+		}
+		m.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		m.Lock()
+		curr--
+		m.Unlock()
+
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(
+				`{"hits":[],"total_hits":0}`)),
+		}, nil
+	}
+
+	concurrencyCh := make(chan struct{}, 3)
+
+	alias := bleve.NewIndexAlias()
+	for i := 0; i < 100; i++ {
+		alias.Add(&BleveClient{
+			QueryURL:      "http://fake/query",
+			ConcurrencyCh: concurrencyCh,
+		})
+	}
+
+	_, err := alias.Search(bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+	if err != nil {
+		t.Errorf("expected search to work, err: %v", err)
+	}
+	if numPosts != 100 {
+		t.Errorf("expected 100 remote queries, got: %d", numPosts)
+	}
+	if maxCurr <= 0 || maxCurr > 3 {
+		t.Errorf("expected concurrency bounded by 3, got: %d", maxCurr)
+	}
+}
+
+func TestBleveClientHealth(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(`{"status":"ok"}`))
+		}))
+	defer healthy.Close()
+
+	unhealthy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "no pindex", 400)
+		}))
+	defer unhealthy.Close()
+
+	notOk := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(`{"status":"warming"}`))
+		}))
+	defer notOk.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"status":"ok"}`))
+		}))
+	defer slow.Close()
+
+	timeout := 50 * time.Millisecond
+
+	if (&BleveClient{}).Health(timeout) == nil {
+		t.Errorf("expected health error on empty StatsURL")
+	}
+	if err := (&BleveClient{StatsURL: healthy.URL}).Health(timeout); err != nil {
+		t.Errorf("expected healthy, err: %v", err)
+	}
+	if (&BleveClient{StatsURL: unhealthy.URL}).Health(timeout) == nil {
+		t.Errorf("expected unhealthy on bad status code")
+	}
+	if (&BleveClient{StatsURL: notOk.URL}).Health(timeout) == nil {
+		t.Errorf("expected unhealthy on non-ok status")
+	}
+	if (&BleveClient{StatsURL: slow.URL}).Health(timeout) == nil {
+		t.Errorf("expected unhealthy on timeout")
+	}
+
+	clients := []*BleveClient{
+		{PIndexName: "p0", QueryURL: "0", StatsURL: healthy.URL},
+		{PIndexName: "p1", QueryURL: "1", StatsURL: unhealthy.URL},
+		{PIndexName: "p2", QueryURL: "2", StatsURL: slow.URL},
+		{PIndexName: "p3", QueryURL: "3", StatsURL: healthy.URL},
+	}
+	rv, skipped := healthyBleveClients(clients, timeout, make(chan struct{}, 2))
+	if len(rv) != 2 || rv[0].QueryURL != "0" || rv[1].QueryURL != "3" {
+		t.Errorf("expected only healthy clients, got: %#v", rv)
+	}
+	if len(skipped) != 2 || skipped["p1"] == "" || skipped["p2"] == "" {
+		t.Errorf("expected the unhealthy pindexes to be skipped, got: %v",
+			skipped)
+	}
+
+	// The skipped pindexes fail a query, unless it allows partial
+	// results.
+	alias := &bleveFanOut{skipped: skipped}
+	err := (&BleveQueryParams{}).checkSkipped(alias)
+	if _, ok := err.(*QueryUnavailableError); !ok {
+		t.Errorf("expected a QueryUnavailableError, got: %v", err)
+	}
+	if err = (&BleveQueryParams{Partial: true}).checkSkipped(alias); err != nil {
+		t.Errorf("expected a partial query to work, err: %v", err)
+	}
+
+	// A slow probe's request is cancelled, rather than left behind.
+	cancelledCh := make(chan struct{}, 1)
+	hung := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+				cancelledCh <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+		}))
+	defer hung.Close()
+
+	if (&BleveClient{StatsURL: hung.URL}).Health(timeout) == nil {
+		t.Errorf("expected unhealthy on timeout")
+	}
+	select {
+	case <-cancelledCh:
+	case <-time.After(time.Second):
+		t.Errorf("expected the timed out probe to be cancelled")
+	}
+}
+
+func TestBleveClientSearchErrorTypes(t *testing.T) {
+	tests := []struct {
+		status int
+		exp    int // Expected QueryErrorStatus.
+	}{
+		{400, 400},
+		{429, 503},
+		{503, 503},
+		{500, 500},
+	}
+	for _, test := range tests {
+		status := test.status
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, "remote error", status)
+			}))
+
+		client := &BleveClient{QueryURL: server.URL + "/query"}
+		_, err := client.Search(bleve.NewSearchRequest(
+			bleve.NewMatchQuery("hello")))
+		if err == nil || QueryErrorStatus(err) != test.exp {
+			t.Errorf("expected remote status: %d to be: %d, err: %#v",
+				test.status, test.exp, err)
+		}
+
+		server.Close()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {}))
+	queryURL := server.URL + "/query"
+	server.Close()
+
+	client := &BleveClient{QueryURL: queryURL}
+	_, err := client.Search(bleve.NewSearchRequest(bleve.NewMatchQuery("hello")))
+	if _, ok := err.(*QueryUnavailableError); !ok {
+		t.Errorf("expected an unreachable remote to be unavailable, err: %#v",
+			err)
+	}
+}
+
+func TestQueryBlevePIndexImplDebugStats(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+	dest.OnSnapshotStart("0", 1, 1)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+
+	// Serves an empty result like a remote cbft pindex query endpoint.
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mustEncode(w, &bleve.SearchResult{})
+		}))
+	defer server.Close()
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", emptyDir, "some-datasource", nil)
+
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs[m.uuid] = &NodeDef{UUID: m.uuid, HostPort: ":1000"}
+	nodeDefs.NodeDefs["x"] = &NodeDef{UUID: "x",
+		HostPort: strings.TrimPrefix(server.URL, "http://")}
+	if _, err = CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name: "foo_0", IndexName: "foo", SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{m.uuid: {CanRead: true}},
+	}
+	planPIndexes.PlanPIndexes["foo_1"] = &PlanPIndex{
+		Name: "foo_1", IndexName: "foo", SourcePartitions: "1",
+		Nodes: map[string]*PlanPIndexNode{"x": {CanRead: true}},
+	}
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	m.GetPlanPIndexes(true)
+
+	m.registerPIndex(&PIndex{Name: "foo_0", IndexName: "foo",
+		IndexType: "bleve", SourcePartitions: "0", Impl: impl, Dest: dest})
+
+	query := func(debug bool) map[string]json.RawMessage {
+		req := `{"query":{"query":{"query":"hello"}},` +
+			`"consistency":{"level":"at_plus","vectors":{"foo":{"0":1}}},` +
+			`"debug":` + strconv.FormatBool(debug) + `}`
+		var res bytes.Buffer
+		err := QueryBlevePIndexImpl(m, "foo", "", []byte(req), &res)
+		if err != nil {
+			t.Fatalf("expected QueryBlevePIndexImpl to work, err: %v", err)
+		}
+		rv := map[string]json.RawMessage{}
+		err = json.Unmarshal(res.Bytes(), &rv)
+		if err != nil {
+			t.Fatalf("expected query response to parse, err: %v", err)
+		}
+		return rv
+	}
+
+	if _, exists := query(false)["cbft"]; exists {
+		t.Errorf("expected no cbft section without debug")
+	}
+
+	rv := query(true)
+	if string(rv["total_hits"]) != "1" {
+		t.Errorf("expected bleve's fields to remain, got: %s", rv["total_hits"])
+	}
+	var stats BleveQueryStats
+	err = json.Unmarshal(rv["cbft"], &stats)
+	if err != nil {
+		t.Fatalf("expected cbft section to parse, err: %v, rv: %#v", err, rv)
+	}
+	if stats.TotalNS <= 0 || stats.ConsistencyWaitNS <= 0 ||
+		stats.TotalNS < stats.ConsistencyWaitNS ||
+		stats.NumLocalPIndexes != 1 || stats.NumRemotePIndexes != 1 ||
+		len(stats.RemoteNS) != 1 || stats.RemoteNS[server.URL+"/api/pindex/foo_1/query"] <= 0 {
+		t.Errorf("expected populated cbft stats, got: %#v", stats)
+	}
+}
+
+func TestQueryBlevePIndexImplValidate(t *testing.T) {
+	tests := []struct {
+		req string
+		exp string
+	}{
+		{`{}`, "missing query"},
+		{`{"query":null}`, "missing query"},
+		{`{"query":{"query":{"field":"x","min":null,"max":null}}}`,
+			"invalid query"},
+		{`{"consistency":{"level":"at_plus","vectors":{"foo":{"0":1}}}}`,
+			"missing query"},
+		{`{"query":{"query":{"query":"hello"},"size":-1}}`, "invalid size"},
+		{`{"query":{"query":{"query":"hello"},"from":-1}}`, "invalid from"},
+		{`{"query":{"query":{"query":"hello"}},"consistency":{"level":"x"}}`,
+			"unsupported consistency level"},
+		{`{"query":`, "parsing bleveQueryParams"},
+	}
+	for _, test := range tests {
+		for _, query := range []func(*Manager, string, string,
+			[]byte, io.Writer) error{QueryBlevePIndexImpl, QueryAlias} {
+			// A nil manager, as bad queries must fail before any
+			// alias building, consistency waiting or fan-out.
+			var res bytes.Buffer
+			err := query(nil, "foo", "", []byte(test.req), &res)
+			if err == nil || !strings.Contains(err.Error(), test.exp) {
+				t.Errorf("expected req: %s, to fail with: %s, got: %v",
+					test.req, test.exp, err)
+			}
+		}
+	}
+}
+
+func TestCheckBleveQueryExpansion(t *testing.T) {
+	tests := []struct {
+		query string
+		exp   string // Expected error substring, or "" for success.
+	}{
+		{`{"prefix":"hel","field":"x"}`, ""},
+		{`{"term":"hello","fuzziness":2}`, ""},
+		{`{"wildcard":"hel*o"}`, ""},
+		{`{"regexp":"hel.*"}`, ""},
+		{`{"query":"hello"}`, ""},
+		{`{"prefix":""}`, "literal prefix shorter"},
+		{`{"wildcard":"*ello"}`, "literal prefix shorter"},
+		{`{"regexp":".*ello"}`, "literal prefix shorter"},
+		{`{"term":"hello","fuzziness":5}`, "fuzziness: 5 exceeds max: 2"},
+		{`{"conjuncts":[{"term":"a"},{"disjuncts":[{"wildcard":"?"}]}]}`,
+			"literal prefix shorter"},
+		{`{"must":{"conjuncts":[{"term":"hello","fuzziness":3}]}}`,
+			"fuzziness: 3 exceeds max"},
+	}
+	for _, test := range tests {
+		req := `{"query":{"query":` + test.query + `}}`
+		err := checkBleveQueryExpansion(nil, []byte(req))
+		if test.exp == "" && err != nil {
+			t.Errorf("expected query: %s to work, err: %v", test.query, err)
+		}
+		if test.exp != "" &&
+			(err == nil || !strings.Contains(err.Error(), test.exp)) {
+			t.Errorf("expected query: %s to fail with: %s, got: %v",
+				test.query, test.exp, err)
+		}
+	}
+
+	// The abusive queries fail before any fan-out.
+	var res bytes.Buffer
+	err := QueryBlevePIndexImpl(nil, "foo", "",
+		[]byte(`{"query":{"query":{"prefix":"","field":"x"}}}`), &res)
+	if err == nil || !strings.Contains(err.Error(), "query too expensive") {
+		t.Errorf("expected an abusive prefix query to fail, got: %v", err)
+	}
+	_, err = CountQueryBlevePIndexImpl(nil, "foo", "",
+		[]byte(`{"query":{"query":{"wildcard":"*","field":"x"}}}`))
+	if QueryErrorStatus(err) != 400 ||
+		!strings.Contains(err.Error(), "query too expensive") {
+		t.Errorf("expected an abusive count query to be a bad request,"+
+			" got: %v", err)
+	}
+
+	// The limits are configurable via manager options.
+	mgr := NewManagerEx(VERSION, nil, NewUUID(), nil, "", 1, "", "", "", nil,
+		map[string]string{"queryMaxFuzziness": "5", "queryMinPrefixLen": "-1"})
+	for _, query := range []string{
+		`{"term":"hello","fuzziness":5}`,
+		`{"prefix":""}`,
+	} {
+		req := `{"query":{"query":` + query + `}}`
+		err = checkBleveQueryExpansion(mgr, []byte(req))
+		if err != nil {
+			t.Errorf("expected query: %s to work with raised limits,"+
+				" err: %v", query, err)
+		}
+	}
+}
+
+func TestCheckBleveQueryAnalyzers(t *testing.T) {
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "", "some-datasource", nil)
+
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "fooUUID",
+		Type: "bleve", SourceType: "couchbase", SourceName: "beer-sample"}
+	indexDefs.IndexDefs["fooAlias"] = &IndexDef{Name: "fooAlias",
+		UUID: "fooAliasUUID", Type: "alias",
+		Params: `{"targets":{"foo":{}}}`}
+	if _, err := CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	m.GetIndexDefs(true)
+
+	tests := []struct {
+		query string
+		exp   string // Expected error substring, or "" for success.
+	}{
+		{`{"match":"hello","field":"x"}`, ""},
+		{`{"match":"hello","field":"x","analyzer":"standard"}`, ""},
+		{`{"match":"hello","field":"x","analyzer":"no-such-analyzer"}`,
+			"unknown analyzer: no-such-analyzer"},
+		{`{"conjuncts":[{"match":"a","analyzer":"no-such-analyzer"}]}`,
+			"unknown analyzer: no-such-analyzer"},
+	}
+	for _, indexName := range []string{"foo", "fooAlias"} {
+		for _, test := range tests {
+			req := `{"query":{"query":` + test.query + `}}`
+			err := checkBleveQueryAnalyzers(m, indexName, []byte(req))
+			if test.exp == "" && err != nil {
+				t.Errorf("expected query: %s on: %s to work, err: %v",
+					test.query, indexName, err)
+			}
+			if test.exp != "" &&
+				(err == nil || !strings.Contains(err.Error(), test.exp)) {
+				t.Errorf("expected query: %s on: %s to fail with: %s,"+
+					" got: %v", test.query, indexName, test.exp, err)
+			}
+		}
+	}
+
+	// An unknown analyzer fails before any fan-out.
+	var res bytes.Buffer
+	err := QueryBlevePIndexImpl(m, "foo", "",
+		[]byte(`{"query":{"query":{"match":"a","analyzer":"nope"}}}`), &res)
+	if err == nil || !strings.Contains(err.Error(), "unknown analyzer") {
+		t.Errorf("expected an unknown analyzer to fail, got: %v", err)
+	}
+}
+
+func TestCheckBleveQueryFields(t *testing.T) {
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", "", "some-datasource", nil)
+
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "fooUUID",
+		Type: "bleve", SourceType: "couchbase", SourceName: "beer-sample",
+		Params: `{"queryDenyFields":["meta","secret"]}`}
+	indexDefs.IndexDefs["bar"] = &IndexDef{Name: "bar", UUID: "barUUID",
+		Type: "bleve", SourceType: "couchbase", SourceName: "beer-sample",
+		Params: `{"queryAllowFields":["name","address"]}`}
+	indexDefs.IndexDefs["fooAlias"] = &IndexDef{Name: "fooAlias",
+		UUID: "fooAliasUUID", Type: "alias",
+		Params: `{"targets":{"foo":{}}}`}
+	if _, err := CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	m.GetIndexDefs(true)
+
+	tests := []struct {
+		indexName string
+		query     string
+		exp       string // Expected error substring, or "" for success.
+	}{
+		{"foo", `{"match":"hello","field":"name"}`, ""},
+		{"foo", `{"match":"hello"}`, ""},
+		{"foo", `{"match_all":{}}`, ""},
+		{"foo", `{"query":"name:joe beer"}`, ""},
+		{"foo", `{"term":"x","field":"secret"}`, "query field denied: secret"},
+		{"foo", `{"term":"x","field":"meta.id"}`, "query field denied: meta.id"},
+		{"foo", `{"query":"+name:joe -secret:x"}`, "query field denied: secret"},
+		{"foo", `{"conjuncts":[{"match":"a"},{"disjuncts":[` +
+			`{"prefix":"a","field":"secret"}]}]}`, "query field denied"},
+		{"fooAlias", `{"match":"hello","field":"name"}`, ""},
+		{"fooAlias", `{"term":"x","field":"secret"}`, "query field denied"},
+		{"bar", `{"match":"hello","field":"name"}`, ""},
+		{"bar", `{"match":"hello","field":"address.city"}`, ""},
+		{"bar", `{"query":"name:joe \"a b:c\""}`, "not allowed: _all"},
+		{"bar", `{"match":"hello","field":"secret"}`,
+			"query field not allowed: secret"},
+		{"bar", `{"match":"hello"}`, "query field not allowed: _all"},
+	}
+	for _, test := range tests {
+		req := `{"query":{"query":` + test.query + `}}`
+		err := checkBleveQueryFields(m, test.indexName, []byte(req))
+		if test.exp == "" && err != nil {
+			t.Errorf("expected query: %s on: %s to work, err: %v",
+				test.query, test.indexName, err)
+		}
+		if test.exp != "" &&
+			(err == nil || !strings.Contains(err.Error(), test.exp)) {
+			t.Errorf("expected query: %s on: %s to fail with: %s,"+
+				" got: %v", test.query, test.indexName, test.exp, err)
+		}
+	}
+
+	// A denied field fails before any fan-out.
+	var res bytes.Buffer
+	err := QueryBlevePIndexImpl(m, "foo", "",
+		[]byte(`{"query":{"query":{"term":"x","field":"secret"}}}`), &res)
+	if err == nil || !strings.Contains(err.Error(), "query field denied") {
+		t.Errorf("expected a denied field to fail, got: %v", err)
+	}
+
+	// A pindex that's queried directly enforces its own field policy.
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	indexParams := indexDefs.IndexDefs["foo"].Params
+	impl, dest, err := NewBlevePIndexImpl("bleve", indexParams,
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	pindex := &PIndex{Name: "foo_0", IndexName: "foo", IndexType: "bleve",
+		IndexParams: indexParams, SourcePartitions: "0",
+		sourcePartitionsArr: []string{"0"}, Impl: impl, Dest: dest}
+
+	err = dest.Query(pindex,
+		[]byte(`{"query":{"query":{"term":"x","field":"secret"}}}`), &res, nil)
+	if _, ok := err.(*QueryBadRequestError); !ok ||
+		!strings.Contains(err.Error(), "query field denied") {
+		t.Errorf("expected a direct pindex query of a denied field to fail,"+
+			" got: %v", err)
+	}
+	err = dest.Query(pindex,
+		[]byte(`{"query":{"query":{"match":"hello","field":"name"}}}`),
+		&res, nil)
+	if err != nil {
+		t.Errorf("expected a direct pindex query of an allowed field"+
+			" to work, err: %v", err)
+	}
+}
+
+func TestQueryBlevePIndexImplConsistencyTimeout(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", emptyDir, "some-datasource", nil)
+
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs[m.uuid] = &NodeDef{UUID: m.uuid, HostPort: ":1000"}
+	if _, err = CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name: "foo_0", IndexName: "foo", SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{m.uuid: {CanRead: true}},
+	}
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	m.GetPlanPIndexes(true)
+
+	m.registerPIndex(&PIndex{Name: "foo_0", IndexName: "foo",
+		IndexType: "bleve", SourcePartitions: "0",
+		sourcePartitionsArr: []string{"0"}, Impl: impl, Dest: dest})
+
+	// The consistency wait is for seq 10, which never arrives.
+	query := func(timeout, consistencyTimeout int) error {
+		req := fmt.Sprintf(`{"query":{"query":{"query":"hello"}},`+
+			`"timeout":%d,"consistency":{"level":"at_plus",`+
+			`"vectors":{"foo":{"0":10}},"timeout":%d}}`,
+			timeout, consistencyTimeout)
+		var res bytes.Buffer
+		return QueryBlevePIndexImpl(m, "foo", "", []byte(req), &res)
+	}
+
+	err = query(100000, 10)
+	if _, ok := err.(*ConsistencyTimeoutError); !ok {
+		t.Errorf("expected a consistency timeout, got: %v", err)
+	}
+
+	err = query(10, 100000)
+	if err == nil {
+		t.Errorf("expected a query timeout")
+	}
+	if _, ok := err.(*ConsistencyTimeoutError); ok {
+		t.Errorf("expected a query timeout, not a consistency timeout,"+
+			" got: %v", err)
+	}
+	if _, ok := err.(*QueryUnavailableError); !ok {
+		t.Errorf("expected a query timeout to be unavailable, got: %v", err)
+	}
+}
+
+func TestQueryErrorTypes(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 1)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnSnapshotStart("0", 2, 2)
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"hello"}`))
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", emptyDir, "some-datasource", nil)
+
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs[m.uuid] = &NodeDef{UUID: m.uuid, HostPort: ":1000"}
+	if _, err = CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "fooUUID",
+		Type: "bleve", SourceType: "couchbase", SourceName: "beer-sample"}
+	indexDefs.IndexDefs["unplanned"] = &IndexDef{Name: "unplanned",
+		UUID: "unplannedUUID", Type: "bleve", SourceType: "couchbase",
+		SourceName: "beer-sample"}
+	indexDefs.IndexDefs["fooAlias"] = &IndexDef{Name: "fooAlias",
+		UUID: "fooAliasUUID", Type: "alias",
+		Params: `{"targets":{"foo":{}}}`}
+	indexDefs.IndexDefs["badAlias"] = &IndexDef{Name: "badAlias",
+		UUID: "badAliasUUID", Type: "alias",
+		Params: `{"targets":{"missing":{}}}`}
+	if _, err = CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name: "foo_0", IndexName: "foo", SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{m.uuid: {CanRead: true}},
+	}
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	m.GetIndexDefs(true)
+	m.GetPlanPIndexes(true)
+
+	pindex := &PIndex{Name: "foo_0", IndexName: "foo",
+		IndexType: "bleve", SourcePartitions: "0",
+		sourcePartitionsArr: []string{"0"}, Impl: impl, Dest: dest}
+	m.registerPIndex(pindex)
+
+	tests := []struct {
+		desc      string
+		indexName string
+		req       string
+		status    int // Expected QueryErrorStatus, or 0 for success.
+	}{
+		{"ok", "foo", `{"query":{"query":{"query":"hello"}}}`, 0},
+		{"ok alias", "fooAlias", `{"query":{"query":{"query":"hello"}}}`, 0},
+		{"parse", "foo", `>>>not json<<<`, 400},
+		{"parse alias", "fooAlias", `>>>not json<<<`, 400},
+		{"validate", "foo", `{"query":{"size":-1,"query":{"query":"hello"}}}`, 400},
+		{"validate alias", "fooAlias", `{"query":{"query":{"query":"hello"}},` +
+			`"includeSource":true}`, 400},
+		{"too expensive", "foo",
+			`{"query":{"query":{"term":"hello","fuzziness":9}}}`, 400},
+		{"unknown analyzer", "foo",
+			`{"query":{"query":{"match":"hello","analyzer":"nope"}}}`, 400},
+		{"bad alias target", "badAlias",
+			`{"query":{"query":{"query":"hello"}}}`, 400},
+		{"unplanned", "unplanned", `{"query":{"query":{"query":"hello"}}}`, 503},
+		{"snapshot not available", "foo", `{"query":{"query":{"query":"hello"}},` +
+			`"consistency":{"level":"as_of","vectors":{"foo":{"0":1}}}}`, 503},
+		{"consistency timeout", "foo", `{"query":{"query":{"query":"hello"}},` +
+			`"consistency":{"level":"at_plus","vectors":{"foo":{"0":100}},` +
+			`"timeout":10}}`, 503},
+		{"query timeout", "foo", `{"query":{"query":{"query":"hello"}},` +
+			`"timeout":10,"consistency":{"level":"at_plus",` +
+			`"vectors":{"foo":{"0":100}}}}`, 503},
+	}
+	for _, test := range tests {
+		var res bytes.Buffer
+		var err error
+		if indexDefs.IndexDefs[test.indexName].Type == "alias" {
+			err = QueryAlias(m, test.indexName, "", []byte(test.req), &res)
+		} else {
+			err = QueryBlevePIndexImpl(m, test.indexName, "",
+				[]byte(test.req), &res)
+		}
+		if test.status == 0 {
+			if err != nil {
+				t.Errorf("test: %s, expected no err, got: %v", test.desc, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("test: %s, expected an err", test.desc)
+			continue
+		}
+		if QueryErrorStatus(err) != test.status {
+			t.Errorf("test: %s, expected status: %d, got: %d, err: %#v",
+				test.desc, test.status, QueryErrorStatus(err), err)
+		}
+	}
+
+	var res bytes.Buffer
+	err = dest.Query(pindex, []byte(`>>>not json<<<`), &res, nil)
+	if _, ok := err.(*QueryBadRequestError); !ok {
+		t.Errorf("expected BleveDest.Query parse error to be a bad request,"+
+			" got: %#v", err)
+	}
+
+	err = m.QueryPIndex("foo_0",
+		[]byte(`{"query":{"query":{"term":"hello","fuzziness":9}}}`),
+		&res, nil)
+	if _, ok := err.(*QueryBadRequestError); !ok {
+		t.Errorf("expected BleveDest.Query of a too expensive query to be"+
+			" a bad request, got: %#v", err)
+	}
+
+	// The limits are those of the Manager that owns the pindex.
+	dest.(*BleveDest).SetManager(NewManagerEx(VERSION, nil, NewUUID(), nil,
+		"", 1, "", emptyDir, "", nil,
+		map[string]string{"queryMaxFuzziness": "10"}))
+	err = m.QueryPIndex("foo_0",
+		[]byte(`{"query":{"query":{"term":"hello","fuzziness":9}}}`),
+		&res, nil)
+	if err != nil {
+		t.Errorf("expected BleveDest.Query to use the limits of its"+
+			" manager, err: %v", err)
+	}
+
+	cancelCh := make(chan struct{})
+	close(cancelCh)
+	err = dest.Query(pindex, []byte(`{"query":{"query":{"query":"hello"}},`+
+		`"consistency":{"level":"at_plus","vectors":{"foo":{"0":100}}}}`),
+		&res, cancelCh)
+	if _, ok := err.(*QueryUnavailableError); !ok {
+		t.Errorf("expected BleveDest.Query cancel to be unavailable,"+
+			" got: %#v", err)
+	}
+
+	err = m.QueryPIndex("not-a-pindex", nil, &res, nil)
+	if QueryErrorStatus(err) != 400 {
+		t.Errorf("expected a missing pindex to be a bad request, got: %#v", err)
+	}
+
+	if QueryErrorStatus(&QueryTooManyError{IndexName: "foo", Max: 1}) != 429 {
+		t.Errorf("expected too many queries to be 429")
+	}
+	if QueryErrorStatus(fmt.Errorf("some internal error")) != 500 {
+		t.Errorf("expected an untyped error to be internal")
+	}
+}
+
+func TestCountQueryBlevePIndexImpl(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", emptyDir, "some-datasource", nil)
+
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs[m.uuid] = &NodeDef{UUID: m.uuid, HostPort: ":1000"}
+	if _, err := CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+
+	planPIndexes := NewPlanPIndexes(VERSION)
+	for i, name := range []string{"foo_0", "foo_1"} {
+		partition := strconv.Itoa(i)
+
+		impl, dest, err := NewBlevePIndexImpl("bleve", "",
+			emptyDir+string(os.PathSeparator)+name, func() {})
+		if err != nil {
+			t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+		}
+		defer dest.Close()
+
+		dest.OnSnapshotStart(partition, 1, 3)
+		dest.OnDataUpdate(partition, []byte(name+"-a"), 1,
+			[]byte(`{"x":"red"}`))
+		dest.OnDataUpdate(partition, []byte(name+"-b"), 2,
+			[]byte(`{"x":"red blue"}`))
+		dest.OnDataUpdate(partition, []byte(name+"-c"), 3,
+			[]byte(`{"x":"green"}`))
+
+		planPIndexes.PlanPIndexes[name] = &PlanPIndex{
+			Name: name, IndexName: "foo", SourcePartitions: partition,
+			Nodes: map[string]*PlanPIndexNode{m.uuid: {CanRead: true}},
+		}
+		m.registerPIndex(&PIndex{Name: name, IndexName: "foo",
+			IndexType: "bleve", SourcePartitions: partition,
+			Impl: impl, Dest: dest})
+	}
+	if _, err := CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	m.GetPlanPIndexes(true)
+
+	tests := []struct {
+		query string
+		exp   uint64
+	}{
+		{`{"query":"red"}`, 4},
+		{`{"query":"blue"}`, 2},
+		{`{"query":"purple"}`, 0},
+	}
+	for _, test := range tests {
+		req := []byte(`{"query":{"size":1,"query":` + test.query + `}}`)
+
+		count, err := CountQueryBlevePIndexImpl(m, "foo", "", req)
+		if err != nil || count != test.exp {
+			t.Errorf("expected count: %d, for query: %s, got: %d, err: %v",
+				test.exp, test.query, count, err)
+		}
+
+		var res bytes.Buffer
+		err = QueryBlevePIndexImpl(m, "foo", "", req, &res)
+		if err != nil {
+			t.Fatalf("expected QueryBlevePIndexImpl to work, err: %v", err)
+		}
+		var sr struct {
+			TotalHits uint64 `json:"total_hits"`
+		}
+		if err = json.Unmarshal(res.Bytes(), &sr); err != nil ||
+			sr.TotalHits != count {
+			t.Errorf("expected count: %d to match search total_hits: %d,"+
+				" query: %s, err: %v", count, sr.TotalHits, test.query, err)
+		}
+	}
+
+	count, err := CountQueryBlevePIndexImpl(m, "foo", "", []byte(`{}`))
+	if err != nil || count != 6 {
+		t.Errorf("expected a count without a query to count all 6 docs,"+
+			" got: %d, err: %v", count, err)
+	}
+}
+
+func TestQueryBlevePIndexImplIdsOnly(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 4)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("c"), 3, []byte(`{"x":"world"}`))
+	dest.OnDataUpdate("0", []byte("d"), 4, []byte(`{"x":"hello"}`))
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", emptyDir, "some-datasource", nil)
+
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs[m.uuid] = &NodeDef{UUID: m.uuid, HostPort: ":1000"}
+	if _, err = CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "fooUUID",
+		Type: "bleve", SourceType: "couchbase", SourceName: "beer-sample"}
+	indexDefs.IndexDefs["fooAlias"] = &IndexDef{Name: "fooAlias",
+		UUID: "fooAliasUUID", Type: "alias",
+		Params: `{"targets":{"foo":{}}}`}
+	if _, err = CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name: "foo_0", IndexName: "foo", SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{m.uuid: {CanRead: true}},
+	}
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	m.GetIndexDefs(true)
+	m.GetPlanPIndexes(true)
+
+	m.registerPIndex(&PIndex{Name: "foo_0", IndexName: "foo",
+		IndexType: "bleve", SourcePartitions: "0",
+		sourcePartitionsArr: []string{"0"}, Impl: impl, Dest: dest})
+
+	var res bytes.Buffer
+	err = QueryBlevePIndexImpl(m, "foo", "",
+		[]byte(`{"query":{"query":{"query":"hello"},"size":10,`+
+			`"fields":["*"],"explain":true}}`), &res)
+	if err != nil {
+		t.Fatalf("expected QueryBlevePIndexImpl to work, err: %v", err)
+	}
+	var full struct {
+		Hits []struct {
+			ID string `json:"id"`
+		} `json:"hits"`
+	}
+	if err = json.Unmarshal(res.Bytes(), &full); err != nil {
+		t.Fatalf("expected a full result, err: %v", err)
+	}
+	var fullIds []string
+	for _, hit := range full.Hits {
+		fullIds = append(fullIds, hit.ID)
+	}
+	sort.Strings(fullIds)
+	if strings.Join(fullIds, ",") != "a,b,d" {
+		t.Errorf("expected full hits a,b,d, got: %v", fullIds)
+	}
+
+	query := func(indexName, req string) []string {
+		var res bytes.Buffer
+		var err error
+		if indexName == "fooAlias" {
+			err = QueryAlias(m, indexName, "", []byte(req), &res)
+		} else {
+			err = QueryBlevePIndexImpl(m, indexName, "", []byte(req), &res)
+		}
+		if err != nil {
+			t.Fatalf("expected idsOnly query on: %s to work, err: %v",
+				indexName, err)
+		}
+		var ids []string
+		if err = json.Unmarshal(res.Bytes(), &ids); err != nil {
+			t.Fatalf("expected a JSON array of ids, got: %s, err: %v",
+				res.String(), err)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	for _, indexName := range []string{"foo", "fooAlias"} {
+		ids := query(indexName, `{"query":{"query":{"query":"hello"},`+
+			`"fields":["*"],"explain":true},"idsOnly":true}`)
+		if !reflect.DeepEqual(ids, fullIds) {
+			t.Errorf("expected idsOnly on: %s to match the full query,"+
+				" got: %v", indexName, ids)
+		}
+	}
+
+	// An explicit size still applies.
+	if ids := query("foo", `{"query":{"query":{"query":"hello"},"size":1},`+
+		`"idsOnly":true}`); len(ids) != 1 {
+		t.Errorf("expected 1 id, got: %v", ids)
+	}
+
+	err = QueryBlevePIndexImpl(m, "foo", "",
+		[]byte(`{"query":{"query":{"query":"hello"}},"idsOnly":true,`+
+			`"scroll":true}`), &res)
+	if err == nil {
+		t.Errorf("expected idsOnly with scroll to fail")
+	}
+}
+
+func TestQueryBlevePIndexImplIncludeSource(t *testing.T) {
+	defer func(prev func(*CouchbaseBuckets, string, string, string,
+		[][]string) (map[string][]byte, error)) {
+		couchbaseGetBulk = prev
+	}(couchbaseGetBulk)
+
+	bucketDocs := map[string][]byte{
+		"a": []byte(`{"x":"hello","y":"not-indexed"}`),
+		"b": []byte(`not json`),
+	}
+	var batches [][]string
+	couchbaseGetBulk = func(buckets *CouchbaseBuckets,
+		server, poolName, bucketName string,
+		keyBatches [][]string) (map[string][]byte, error) {
+		if bucketName != "beer-sample" {
+			t.Errorf("expected the source bucket, got: %s", bucketName)
+		}
+		batches = append(batches, keyBatches...)
+		rv := map[string][]byte{}
+		for _, keys := range keyBatches {
+			for _, key := range keys {
+				if body, exists := bucketDocs[key]; exists {
+					rv[key] = body
+				}
+			}
+		}
+		return rv, nil
+	}
+
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 3)
+	dest.OnDataUpdate("0", []byte("a"), 1, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("b"), 2, []byte(`{"x":"hello"}`))
+	dest.OnDataUpdate("0", []byte("c"), 3, []byte(`{"x":"hello"}`))
+
+	cfg := NewCfgMem()
+	m := NewManager(VERSION, cfg, NewUUID(), []string{"queryer"},
+		"", 1, ":1000", emptyDir, "some-datasource", nil)
+
+	nodeDefs := NewNodeDefs(VERSION)
+	nodeDefs.NodeDefs[m.uuid] = &NodeDef{UUID: m.uuid, HostPort: ":1000"}
+	if _, err = CfgSetNodeDefs(cfg, NODE_DEFS_WANTED, nodeDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetNodeDefs to work, err: %v", err)
+	}
+	indexDefs := NewIndexDefs(VERSION)
+	indexDefs.IndexDefs["foo"] = &IndexDef{Name: "foo", UUID: "fooUUID",
+		Type: "bleve", SourceType: "couchbase", SourceName: "beer-sample"}
+	if _, err = CfgSetIndexDefs(cfg, indexDefs, 0); err != nil {
+		t.Fatalf("expected CfgSetIndexDefs to work, err: %v", err)
+	}
+	planPIndexes := NewPlanPIndexes(VERSION)
+	planPIndexes.PlanPIndexes["foo_0"] = &PlanPIndex{
+		Name: "foo_0", IndexName: "foo", SourcePartitions: "0",
+		Nodes: map[string]*PlanPIndexNode{m.uuid: {CanRead: true}},
+	}
+	if _, err = CfgSetPlanPIndexes(cfg, planPIndexes, 0); err != nil {
+		t.Fatalf("expected CfgSetPlanPIndexes to work, err: %v", err)
+	}
+	m.GetIndexDefs(true)
+	m.GetPlanPIndexes(true)
+
+	m.registerPIndex(&PIndex{Name: "foo_0", IndexName: "foo",
+		IndexType: "bleve", SourcePartitions: "0",
+		sourcePartitionsArr: []string{"0"}, Impl: impl, Dest: dest})
+
+	var res bytes.Buffer
+	err = QueryBlevePIndexImpl(m, "foo", "",
+		[]byte(`{"query":{"query":{"query":"hello"}},"includeSource":true}`),
+		&res)
+	if err != nil {
+		t.Fatalf("expected QueryBlevePIndexImpl to work, err: %v", err)
+	}
+
+	var sr struct {
+		Hits []struct {
+			ID     string          `json:"id"`
+			Source json.RawMessage `json:"source"`
+		} `json:"hits"`
+	}
+	if err = json.Unmarshal(res.Bytes(), &sr); err != nil {
+		t.Fatalf("expected a json response, err: %v", err)
+	}
+	if len(sr.Hits) != 3 {
+		t.Fatalf("expected 3 hits, got: %s", res.String())
+	}
+	for _, hit := range sr.Hits {
+		exp := map[string]string{
+			"a": `{"x":"hello","y":"not-indexed"}`,
+			"b": `"not json"`,
+			"c": ``,
+		}[hit.ID]
+		if string(hit.Source) != exp {
+			t.Errorf("expected hit: %s source: %s, got: %s",
+				hit.ID, exp, hit.Source)
+		}
+	}
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Errorf("expected one batch of hit IDs, got: %v", batches)
+	}
+
+	// Without includeSource, the source isn't fetched.
+	batches = nil
+	res.Reset()
+	err = QueryBlevePIndexImpl(m, "foo", "",
+		[]byte(`{"query":{"query":{"query":"hello"}}}`), &res)
+	if err != nil || len(batches) != 0 ||
+		strings.Contains(res.String(), `"source"`) {
+		t.Errorf("expected no source docs, got: %s, err: %v", res.String(), err)
+	}
+}
+
+func TestCouchbaseSourceDocsBatches(t *testing.T) {
+	defer func(prev func(*CouchbaseBuckets, string, string, string,
+		[][]string) (map[string][]byte, error)) {
+		couchbaseGetBulk = prev
+	}(couchbaseGetBulk)
+
+	got := map[string][]int{}
+	couchbaseGetBulk = func(buckets *CouchbaseBuckets,
+		server, poolName, bucketName string,
+		keyBatches [][]string) (map[string][]byte, error) {
+		rv := map[string][]byte{}
+		for _, keys := range keyBatches {
+			got[bucketName] = append(got[bucketName], len(keys))
+			for _, key := range keys {
+				if bucketName == "b0" && key != "k0" {
+					continue
+				}
+				rv[key] = []byte(bucketName)
+			}
+		}
+		return rv, nil
+	}
+
+	keys := []string{}
+	for i := 0; i < COUCHBASE_SOURCE_DOCS_BATCH_SIZE+1; i++ {
+		keys = append(keys, fmt.Sprintf("k%d", i))
+	}
+
+	// The keys of an unknown bucket are tried in each bucket.
+	all, err := CouchbaseSourceDocs(nil, "b0,b1", "server",
+		map[string][]string{"": keys})
+	if err != nil {
+		t.Fatalf("expected CouchbaseSourceDocs to work, err: %v", err)
+	}
+	docs := all[""]
+	if len(docs) != len(keys) || string(docs["k0"]) != "b0" ||
+		string(docs["k1"]) != "b1" {
+		t.Errorf("expected docs from both buckets, got: %v", docs)
+	}
+	if !reflect.DeepEqual(got, map[string][]int{
+		"b0": {COUCHBASE_SOURCE_DOCS_BATCH_SIZE, 1},
+		"b1": {COUCHBASE_SOURCE_DOCS_BATCH_SIZE},
+	}) {
+		t.Errorf("expected batched gets of only missing keys, got: %v", got)
+	}
+
+	// The keys of a known bucket are only fetched from that bucket.
+	got = map[string][]int{}
+	all, err = CouchbaseSourceDocs(nil, "b0,b1", "server",
+		map[string][]string{"b1": {"k0"}, "b0": {"k0"}})
+	if err != nil {
+		t.Fatalf("expected CouchbaseSourceDocs to work, err: %v", err)
+	}
+	if string(all["b0"]["k0"]) != "b0" || string(all["b1"]["k0"]) != "b1" ||
+		!reflect.DeepEqual(got, map[string][]int{"b0": {1}, "b1": {1}}) {
+		t.Errorf("expected per bucket docs, got: %v, gets: %v", all, got)
+	}
+
+	_, err = CouchbaseSourceDocs(nil, "b0,b1", "server",
+		map[string][]string{"b2": {"k0"}})
+	if err == nil {
+		t.Errorf("expected a bucket that's not in the source to fail")
+	}
+}
+
+func TestBleveDocIdNamespacePrefixInverse(t *testing.T) {
+	tests := []struct {
+		partition  string
+		namespaces []string
+	}{
+		{"0", nil},
+		{NamespacedPartition("b0", "0"), []string{"b0", "b1"}},
+		{NamespacedPartition("b1", "7"), []string{"b0", "b1"}},
+	}
+	for i, test := range tests {
+		key := "k" + PARTITION_NAMESPACE_SEP + "x"
+		docId := bleveDocIdNamespacePrefix(test.partition, []byte(key))
+		namespace, got, ok := bleveDocIdNamespacePrefixInverse(docId,
+			test.namespaces)
+		expNamespace, _ := SplitNamespacedPartition(test.partition)
+		if !ok || string(got) != key || namespace != expNamespace {
+			t.Errorf("test: %d, expected key: %s, namespace: %s,"+
+				" got: %s, %s, %v", i, key, expNamespace, got, namespace, ok)
+		}
+	}
+
+	_, _, ok := bleveDocIdNamespacePrefixInverse("k", []string{"b0", "b1"})
+	if ok {
+		t.Errorf("expected an unprefixed doc id to fail")
+	}
+}
+
+func TestBleveClientGzip(t *testing.T) {
+	emptyDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(emptyDir)
+
+	impl, dest, err := NewBlevePIndexImpl("bleve", "",
+		emptyDir+string(os.PathSeparator)+"foo_0", func() {})
+	if err != nil {
+		t.Fatalf("expected NewBlevePIndexImpl to work, err: %v", err)
+	}
+	defer dest.Close()
+
+	dest.OnSnapshotStart("0", 1, 100)
+	for i := uint64(1); i <= 100; i++ {
+		dest.OnDataUpdate("0", []byte(fmt.Sprintf("doc-%d", i)), i,
+			[]byte(fmt.Sprintf(`{"x":"hello number %d"}`, i)))
+	}
+
+	m := NewManager(VERSION, NewCfgMem(), NewUUID(), nil,
+		"", 1, ":1000", emptyDir, "some-datasource", nil)
+	m.registerPIndex(&PIndex{Name: "foo_0", IndexName: "foo",
+		IndexType: "bleve", Impl: impl, Dest: dest})
+
+	ring, _ := NewMsgRing(nil, 1)
+	router, err := NewManagerRESTRouter(m, emptyDir, "", ring)
+	if err != nil {
+		t.Fatalf("expected NewManagerRESTRouter to work, err: %v", err)
+	}
+
+	var mu sync.Mutex
+	var reqEncodings, respEncodings []string
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			router.ServeHTTP(w, req)
+			mu.Lock()
+			reqEncodings = append(reqEncodings,
+				req.Header.Get("Content-Encoding"))
+			respEncodings = append(respEncodings,
+				w.Header().Get("Content-Encoding"))
+			mu.Unlock()
+		}))
+	defer server.Close()
+
+	// Emulates an older peer that supports no encodings, so that it
+	// parses an encoded request as JSON.
+	oldServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			req.Header.Del("Content-Encoding")
+			req.Header.Del("Accept-Encoding")
+			router.ServeHTTP(w, req)
+		}))
+	defer oldServer.Close()
+
+	// Emulates a peer that rejects the encoding.
+	var rejected int
+	rejectServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Content-Encoding") != "" {
+				mu.Lock()
+				rejected++
+				mu.Unlock()
+				http.Error(w, "unsupported encoding", 415)
+				return
+			}
+			router.ServeHTTP(w, req)
+		}))
+	defer rejectServer.Close()
+
+	search := func(baseURL string, gzip bool) string {
+		client := &BleveClient{
+			QueryURL: baseURL + "/api/pindex/foo_0/query",
+			Gzip:     gzip,
+		}
+		req := bleve.NewSearchRequest(bleve.NewMatchQuery("hello"))
+		req.Size = 100
+		res, err := client.Search(req)
+		if err != nil {
+			t.Fatalf("expected Search to work, gzip: %v, err: %v", gzip, err)
+		}
+		buf, _ := json.Marshal(struct {
+			Total uint64
+			Hits  interface{}
+		}{res.Total, res.Hits})
+		return string(buf)
+	}
+
+	exp := search(server.URL, false)
+	if !strings.Contains(exp, "doc-100") {
+		t.Errorf("expected hits, got: %s", exp)
+	}
+	if search(server.URL, true) != exp {
+		t.Errorf("expected gzip search to match unencoded search")
+	}
+	if search(oldServer.URL, true) != exp {
+		t.Errorf("expected gzip search of an older peer to fall back")
+	}
+	if search(rejectServer.URL, true) != exp {
+		t.Errorf("expected gzip search of a rejecting peer to fall back")
+	}
+	mu.Lock()
+	if rejected != 1 {
+		t.Errorf("expected 1 rejected request, got: %d", rejected)
+	}
+	mu.Unlock()
+
+	// Other failures, like a bad query, aren't retried unencoded.
+	var posts int
+	badServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			posts++
+			mu.Unlock()
+			http.Error(w, "bad query", 400)
+		}))
+	defer badServer.Close()
+	_, err = (&BleveClient{QueryURL: badServer.URL, Gzip: true}).Search(
+		bleve.NewSearchRequest(bleve.NewMatchQuery("hello")))
+	mu.Lock()
+	if _, ok := err.(*QueryBadRequestError); !ok || posts != 1 {
+		t.Errorf("expected one bad request, posts: %d, err: %v", posts, err)
+	}
+	mu.Unlock()
+
+	// A request whose encoding can't be decoded is rejected.
+	badReq, _ := http.NewRequest("POST",
+		server.URL+"/api/pindex/foo_0/query", strings.NewReader("{}"))
+	badReq.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(badReq)
+	if err != nil || resp.StatusCode != 415 {
+		t.Errorf("expected a 415 for a bad encoding, resp: %#v, err: %v",
+			resp, err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	// Only the request encoding is checked for the unencoded search,
+	// as Go's http transport transparently asks for gzip responses.
+	mu.Lock()
+	if !reflect.DeepEqual(reqEncodings, []string{"", "gzip", "gzip"}) ||
+		len(respEncodings) != 3 || respEncodings[1] != "gzip" {
+		t.Errorf("expected the gzip search to be encoded,"+
+			" got requests: %v, responses: %v", reqEncodings, respEncodings)
+	}
+	mu.Unlock()
+}
+
+func TestBleveClientConnectionReuse(t *testing.T) {
+	var m sync.Mutex
+	numConns := 0
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			ioutil.ReadAll(req.Body)
+			mustEncode(w, &bleve.SearchResult{})
+		}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			m.Lock()
+			numConns++
+			m.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	httpClient := newRemoteHTTPClient(map[string]string{
+		"remoteMaxIdleConnsPerHost": "4",
+	})
+
+	for _, gzip := range []bool{false, true} {
+		client := &BleveClient{QueryURL: server.URL, Gzip: gzip,
+			HTTPClient: httpClient}
+		for i := 0; i < 20; i++ {
+			_, err := client.Search(
+				bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+			if err != nil {
+				t.Fatalf("expected Search to work, err: %v", err)
+			}
+		}
+	}
+
+	m.Lock()
+	if numConns != 1 {
+		t.Errorf("expected sequential searches to reuse 1 connection,"+
+			" got: %d", numConns)
+	}
+	m.Unlock()
+}
+
+func TestNewRemoteHTTPClient(t *testing.T) {
+	c := newRemoteHTTPClient(map[string]string{
+		"remoteMaxIdleConnsPerHost": "7",
+		"remoteIdleConnTimeoutMS":   "not-a-number",
+		"remoteTimeoutMS":           "1500",
+	})
+	transport := c.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 7 {
+		t.Errorf("expected MaxIdleConnsPerHost 7, got: %d",
+			transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout !=
+		REMOTE_IDLE_CONN_TIMEOUT_MS*time.Millisecond {
+		t.Errorf("expected default IdleConnTimeout on a bad option, got: %v",
+			transport.IdleConnTimeout)
+	}
+	if c.Timeout != 1500*time.Millisecond {
+		t.Errorf("expected Timeout 1500ms, got: %v", c.Timeout)
+	}
+
+	// Each Manager has its own client, configured by its options.
+	mgr := NewManagerEx(VERSION, nil, NewUUID(), nil, "", 1, "", "", "",
+		nil, map[string]string{"remoteMaxIdleConnsPerHost": "3"})
+	transport = mgr.remoteHTTPClient.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 3 {
+		t.Errorf("expected the manager's MaxIdleConnsPerHost 3, got: %d",
+			transport.MaxIdleConnsPerHost)
+	}
+	if mgr.remoteHTTPClient == defaultRemoteHTTPClient {
+		t.Errorf("expected the manager's own client")
+	}
+}
@@ -38,6 +38,7 @@ func NewManagerRESTRouter(mgr *Manager, staticDir, staticETag string, mr *MsgRin
 
 	if mgr.tagsMap == nil || mgr.tagsMap["queryer"] {
 		r.Handle("/api/index/{indexName}/count", NewCountHandler(mgr)).Methods("GET")
+		r.Handle("/api/index/{indexName}/count", NewCountHandler(mgr)).Methods("POST")
 		r.Handle("/api/index/{indexName}/query", NewQueryHandler(mgr)).Methods("POST")
 	}
 
@@ -62,6 +63,12 @@ func NewManagerRESTRouter(mgr *Manager, staticDir, staticETag string, mr *MsgRin
 		r.Handle("/api/pindex/{pindexName}/count",
 			NewCountPIndexHandler(mgr)).Methods("GET")
 
+		r.Handle("/api/pindex/{pindexName}/stats",
+			NewStatsPIndexHandler(mgr)).Methods("GET")
+
+		r.Handle("/api/pindex/{pindexName}/flush",
+			NewFlushPIndexHandler(mgr)).Methods("POST")
+
 		docCountHandler := bleveHttp.NewDocCountHandler("")
 		docCountHandler.IndexNameLookup = pindexNameLookup
 		r.Handle("/api/pindex-bleve/{pindexName}/count",
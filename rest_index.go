@@ -10,6 +10,7 @@
 package cbft
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -135,12 +136,44 @@ func (h *CountHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	count, err := pindexImplType.Count(h.mgr, indexName, indexUUID)
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("rest.Count,"+
+			" could not read request body, indexName: %s", indexName), 400)
+		return
+	}
+
+	queryDone, err := h.mgr.QueryBegin(indexName)
 	if err != nil {
 		showError(w, req, fmt.Sprintf("rest.Count,"+
-			" indexName: %s, err: %v", indexName, err), 500)
+			" indexName: %s, err: %v", indexName, err), QueryErrorStatus(err))
 		return
 	}
+	defer queryDone()
+
+	var count uint64
+	if len(bytes.TrimSpace(requestBody)) > 0 {
+		if pindexImplType.CountQuery == nil {
+			showError(w, req, fmt.Sprintf("rest.Count,"+
+				" count by query unsupported, indexName: %s", indexName), 400)
+			return
+		}
+		count, err = pindexImplType.CountQuery(h.mgr,
+			indexName, indexUUID, requestBody)
+		if err != nil {
+			showError(w, req, fmt.Sprintf("rest.Count,"+
+				" indexName: %s, requestBody: %s, err: %v",
+				indexName, requestBody, err), QueryErrorStatus(err))
+			return
+		}
+	} else {
+		count, err = pindexImplType.Count(h.mgr, indexName, indexUUID)
+		if err != nil {
+			showError(w, req, fmt.Sprintf("rest.Count,"+
+				" indexName: %s, err: %v", indexName, err), 500)
+			return
+		}
+	}
 
 	rv := struct {
 		Status string `json:"status"`
@@ -187,11 +220,19 @@ func (h *QueryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	log.Printf("rest.Query indexName: %s, requestBody: %s", indexName, requestBody)
 
+	queryDone, err := h.mgr.QueryBegin(indexName)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("rest.Query,"+
+			" indexName: %s, err: %v", indexName, err), QueryErrorStatus(err))
+		return
+	}
+	defer queryDone()
+
 	err = pindexImplType.Query(h.mgr, indexName, indexUUID, requestBody, w)
 	if err != nil {
 		showError(w, req, fmt.Sprintf("rest.Query,"+
 			" indexName: %s, requestBody: %s, req: %#v, err: %v",
-			indexName, requestBody, req, err), 400)
+			indexName, requestBody, req, err), QueryErrorStatus(err))
 		return
 	}
 
@@ -258,15 +299,17 @@ func (h *CountPIndexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 
 // ---------------------------------------------------
 
-type QueryPIndexHandler struct {
+// StatsPIndexHandler responds with a pindex's status, and is used by
+// BleveClient.Health() to probe remote pindexes.
+type StatsPIndexHandler struct {
 	mgr *Manager
 }
 
-func NewQueryPIndexHandler(mgr *Manager) *QueryPIndexHandler {
-	return &QueryPIndexHandler{mgr: mgr}
+func NewStatsPIndexHandler(mgr *Manager) *StatsPIndexHandler {
+	return &StatsPIndexHandler{mgr: mgr}
 }
 
-func (h *QueryPIndexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (h *StatsPIndexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	pindexName := pindexNameLookup(req)
 	if pindexName == "" {
 		showError(w, req, "pindex name is required", 400)
@@ -275,41 +318,144 @@ func (h *QueryPIndexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 
 	pindex := h.mgr.GetPIndex(pindexName)
 	if pindex == nil {
-		showError(w, req, fmt.Sprintf("rest.QueryPIndex,"+
+		showError(w, req, fmt.Sprintf("rest.StatsPIndex,"+
 			" no pindex, pindexName: %s", pindexName), 400)
 		return
 	}
 	if pindex.Dest == nil {
-		showError(w, req, fmt.Sprintf("rest.QueryPIndex,"+
+		showError(w, req, fmt.Sprintf("rest.StatsPIndex,"+
 			" no pindex.Dest, pindexName: %s", pindexName), 400)
 		return
 	}
 
-	pindexUUID := req.FormValue("pindexUUID")
-	if pindexUUID != "" && pindex.UUID != pindexUUID {
-		showError(w, req, fmt.Sprintf("rest.QueryPIndex,"+
-			" wrong pindexUUID: %s, pindex.UUID: %s, pindexName: %s",
-			pindexUUID, pindex.UUID, pindexName), 400)
+	rv := struct {
+		Status     string `json:"status"`
+		PIndexName string `json:"pindexName"`
+		PIndexUUID string `json:"pindexUUID"`
+		IndexName  string `json:"indexName"`
+
+		// Keyed by partition, when the Dest supports it.
+		ConsistencyWaiters map[string]*PartitionConsistencyWaiters `json:"consistencyWaiters,omitempty"`
+
+		// When the Dest supports it.
+		IngestLag *LatencyHistogramStats `json:"ingestLag,omitempty"`
+
+		// When the Dest supports it.
+		NumDocsTooLarge *uint64 `json:"numDocsTooLarge,omitempty"`
+	}{
+		Status:     "ok",
+		PIndexName: pindex.Name,
+		PIndexUUID: pindex.UUID,
+		IndexName:  pindex.IndexName,
+	}
+	if dcw, ok := pindex.Dest.(DestConsistencyWaiters); ok {
+		rv.ConsistencyWaiters = dcw.ConsistencyWaiters()
+	}
+	if dil, ok := pindex.Dest.(DestIngestLag); ok {
+		rv.IngestLag = dil.IngestLag()
+	}
+	if ddtl, ok := pindex.Dest.(DestDocsTooLarge); ok {
+		n := ddtl.NumDocsTooLarge()
+		rv.NumDocsTooLarge = &n
+	}
+	mustEncode(w, rv)
+}
+
+// ---------------------------------------------------
+
+type FlushPIndexHandler struct {
+	mgr *Manager
+}
+
+func NewFlushPIndexHandler(mgr *Manager) *FlushPIndexHandler {
+	return &FlushPIndexHandler{mgr: mgr}
+}
+
+func (h *FlushPIndexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	pindexName := pindexNameLookup(req)
+	if pindexName == "" {
+		showError(w, req, "pindex name is required", 400)
 		return
 	}
 
-	requestBody, err := ioutil.ReadAll(req.Body)
+	err := h.mgr.FlushPIndex(pindexName)
 	if err != nil {
+		showError(w, req, fmt.Sprintf("rest.FlushPIndex,"+
+			" pindexName: %s, err: %v", pindexName, err), 400)
+		return
+	}
+
+	mustEncode(w, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// ---------------------------------------------------
+
+type QueryPIndexHandler struct {
+	mgr *Manager
+}
+
+func NewQueryPIndexHandler(mgr *Manager) *QueryPIndexHandler {
+	return &QueryPIndexHandler{mgr: mgr}
+}
+
+func (h *QueryPIndexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	pindexName := pindexNameLookup(req)
+	if pindexName == "" {
+		showError(w, req, "pindex name is required", 400)
+		return
+	}
+
+	pindexUUID := req.FormValue("pindexUUID")
+	if pindexUUID != "" {
+		pindex := h.mgr.GetPIndex(pindexName)
+		if pindex != nil && pindex.UUID != pindexUUID {
+			showError(w, req, fmt.Sprintf("rest.QueryPIndex,"+
+				" wrong pindexUUID: %s, pindex.UUID: %s, pindexName: %s",
+				pindexUUID, pindex.UUID, pindexName), 400)
+			return
+		}
+	}
+
+	requestBody, err := readRequestBody(req)
+	if err != nil {
+		code := 400
+		if _, ok := err.(*RequestEncodingError); ok {
+			code = 415
+		}
 		showError(w, req, fmt.Sprintf("rest.QueryPIndex,"+
-			" could not read request body, pindexName: %s", pindexName), 400)
+			" could not read request body, pindexName: %s, err: %v",
+			pindexName, err), code)
 		return
 	}
 
+	// A pindex query, such as from a remote node's scatter/gather,
+	// counts against the query admission of the pindex's index.
+	if pindex := h.mgr.GetPIndex(pindexName); pindex != nil {
+		queryDone, err := h.mgr.QueryBegin(pindex.IndexName)
+		if err != nil {
+			showError(w, req, fmt.Sprintf("rest.QueryPIndex,"+
+				" pindexName: %s, err: %v", pindexName, err),
+				QueryErrorStatus(err))
+			return
+		}
+		defer queryDone()
+	}
+
+	w, gzipDone := maybeGzipResponse(w, req)
+	defer gzipDone()
+
 	var cancelCh chan struct{} // TODO: Support request timeout and cancellation.
 
 	log.Printf("rest.QueryPIndex pindexName: %s, requestBody: %s",
 		pindexName, requestBody)
 
-	err = pindex.Dest.Query(pindex, requestBody, w, cancelCh)
+	err = h.mgr.QueryPIndex(pindexName, requestBody, w, cancelCh)
 	if err != nil {
 		showError(w, req, fmt.Sprintf("rest.QueryPIndex,"+
 			" pindexName: %s, requestBody: %s, req: %#v, err: %v",
-			pindexName, requestBody, req, err), 400)
+			pindexName, requestBody, req, err), QueryErrorStatus(err))
 		return
 	}
 
@@ -10,9 +10,7 @@
 package cbft
 
 import (
-	"fmt"
 	"net/http"
-	"sort"
 )
 
 type FeedStatsHandler struct {
@@ -24,24 +22,7 @@ func NewFeedStatsHandler(mgr *Manager) *FeedStatsHandler {
 }
 
 func (h *FeedStatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	feeds, _ := h.mgr.CurrentMaps()
-	w.Write([]byte("[\n"))
-	first := true
-	feedNames := make([]string, 0, len(feeds))
-	for feedName := range feeds {
-		feedNames = append(feedNames, feedName)
-	}
-	sort.Strings(feedNames)
-	for _, feedName := range feedNames {
-		if !first {
-			w.Write([]byte(",\n"))
-		}
-		first = false
-		w.Write([]byte(fmt.Sprintf("  {\"feedName\":\"%s\",\"stats\":", feedName)))
-		feeds[feedName].Stats(w)
-		w.Write([]byte("}\n"))
-	}
-	w.Write([]byte("]\n"))
+	w.Write(h.mgr.FeedStats())
 }
 
 // ---------------------------------------------------
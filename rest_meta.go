@@ -27,39 +27,11 @@ type MetaDesc struct {
 }
 
 func (h *ManagerMetaHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	startSamples := map[string]interface{}{
-		"planParams": &PlanParams{},
-	}
-
-	// Key is sourceType, value is description.
-	sourceTypes := map[string]*MetaDesc{}
-	for sourceType, f := range feedTypes {
-		if f.Public {
-			sourceTypes[sourceType] = &MetaDesc{
-				Description: f.Description,
-				StartSample: f.StartSample,
-			}
-		}
-	}
-
-	// Key is indexType, value is description.
-	indexTypes := map[string]*MetaDesc{}
-	for indexType, t := range pindexImplTypes {
-		indexTypes[indexType] = &MetaDesc{
-			Description: t.Description,
-			StartSample: t.StartSample,
-		}
-	}
-
 	mustEncode(w, struct {
-		Status       string                 `json:"status"`
-		StartSamples map[string]interface{} `json:"startSamples"`
-		SourceTypes  map[string]*MetaDesc   `json:"sourceTypes"`
-		IndexTypes   map[string]*MetaDesc   `json:"indexTypes"`
+		Status string `json:"status"`
+		*ManagerMeta
 	}{
-		Status:       "ok",
-		StartSamples: startSamples,
-		SourceTypes:  sourceTypes,
-		IndexTypes:   indexTypes,
+		Status:      "ok",
+		ManagerMeta: h.mgr.Meta(),
 	})
 }
@@ -926,6 +926,50 @@ func TestHandlersWithOnePartitionDestFeedIndex(t *testing.T) {
 				test.check(t, record)
 			},
 		},
+		{
+			Desc:   "direct pindex query on a saturated index",
+			Method: "NOOP",
+			After: func() {
+				var pindex *PIndex
+				_, pindexes := mgr.CurrentMaps()
+				for _, p := range pindexes {
+					pindex = p
+				}
+				if pindex == nil {
+					t.Errorf("expected to be a pindex")
+				}
+				// Limiters are sized on creation, so drop the unbounded
+				// one that the earlier index queries created.
+				mgr.options["queryConcurrencyMax"] = "1"
+				mgr.pruneQueryLimiters(nil)
+				queryDone, err := mgr.QueryBegin(pindex.IndexName)
+				if err != nil {
+					t.Errorf("expected QueryBegin to work, err: %v", err)
+				}
+				defer func() {
+					queryDone()
+					delete(mgr.options, "queryConcurrencyMax")
+					mgr.pruneQueryLimiters(nil)
+				}()
+				body := []byte(`{"query":{"size":10,"query":{"query":"wow"}}}`)
+				req := &http.Request{
+					Method: "POST",
+					URL:    &url.URL{Path: "/api/pindex/" + pindex.Name + "/query"},
+					Form:   url.Values(nil),
+					Body:   ioutil.NopCloser(bytes.NewBuffer(body)),
+				}
+				record := httptest.NewRecorder()
+				router.ServeHTTP(record, req)
+				test := &RESTHandlerTest{
+					Desc:   "direct pindex query on a saturated index check",
+					Status: 429,
+					ResponseMatch: map[string]bool{
+						`too many concurrent queries`: true,
+					},
+				}
+				test.check(t, record)
+			},
+		},
 
 		// ------------------------------------------------------
 		// Now let's test a consistency wait.
@@ -1432,7 +1476,7 @@ func TestHandlersWithOnePartitionDestFeedRollback(t *testing.T) {
 				}
 				test := &RESTHandlerTest{
 					Desc:   "test consistency wait got right result",
-					Status: 400,
+					Status: 503,
 					ResponseMatch: map[string]bool{
 						`err: bleveIndexAlias consistency wait`: true,
 					},
@@ -1506,7 +1550,7 @@ func TestCreateIndexTwoNodes(t *testing.T) {
 	httpGetPrev := httpGet
 	defer func() { httpGet = httpGetPrev }()
 
-	httpGet = func(urlStr string) (
+	httpGet = func(c *http.Client, urlStr string) (
 		resp *http.Response, err error) {
 		u, _ := url.Parse(urlStr)
 		req := &http.Request{
@@ -1525,8 +1569,8 @@ func TestCreateIndexTwoNodes(t *testing.T) {
 	httpPostPrev := httpPost
 	defer func() { httpPost = httpPostPrev }()
 
-	httpPost = func(urlStr string, bodyType string, body io.Reader) (
-		resp *http.Response, err error) {
+	httpPost = func(c *http.Client, urlStr string, bodyType string,
+		body io.Reader) (resp *http.Response, err error) {
 		u, _ := url.Parse(urlStr)
 		req := &http.Request{
 			Method: "POST",
@@ -11,6 +11,10 @@
 
 package cbft
 
+import (
+	"time"
+)
+
 const WORK_NOOP = ""
 const WORK_KICK = "kick"
 
@@ -26,3 +30,60 @@ func SyncWorkReq(ch chan *WorkReq, op, msg string, obj interface{}) error {
 	ch <- &WorkReq{op: op, msg: msg, obj: obj, resCh: resCh}
 	return <-resCh
 }
+
+// Responds to the sender of a WorkReq, if it's waiting for a response.
+func replyWorkReq(m *WorkReq, err error) {
+	if m.resCh != nil {
+		if err != nil {
+			m.resCh <- err
+		}
+		close(m.resCh)
+	}
+}
+
+// CoalesceWorkReqs collects the kick requests that follow an initial
+// kick request m on ch, so that they can all be served by a single
+// work cycle.  When waitMS is <= 0, only the kicks that are already
+// pending are collected; otherwise, kicks are collected for up to
+// waitMS millisecs.  Collection stops early at a non-kick request,
+// which is returned as next, to be handled after the cycle.  As only
+// kicks that arrive before a cycle are coalesced into it, a kick that
+// arrives during a cycle still triggers another cycle.
+func CoalesceWorkReqs(ch chan *WorkReq, m *WorkReq, waitMS int) (
+	kicks []*WorkReq, next *WorkReq) {
+	kicks = []*WorkReq{m}
+
+	var timeoutCh <-chan time.Time
+	if waitMS > 0 {
+		timer := time.NewTimer(time.Duration(waitMS) * time.Millisecond)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	for {
+		var r *WorkReq
+		var ok bool
+
+		if timeoutCh == nil {
+			select {
+			case r, ok = <-ch:
+			default:
+				return kicks, nil
+			}
+		} else {
+			select {
+			case r, ok = <-ch:
+			case <-timeoutCh:
+				return kicks, nil
+			}
+		}
+
+		if !ok || r == nil {
+			return kicks, nil
+		}
+		if r.op != WORK_KICK {
+			return kicks, r
+		}
+		kicks = append(kicks, r)
+	}
+}
@@ -13,6 +13,7 @@ package cbft
 
 import (
 	"testing"
+	"time"
 )
 
 func TestSyncWorkReq(t *testing.T) {
@@ -38,3 +39,37 @@ func TestSyncWorkReq(t *testing.T) {
 	}
 	close(ch)
 }
+
+func TestCoalesceWorkReqs(t *testing.T) {
+	ch := make(chan *WorkReq, 10)
+	for i := 0; i < 3; i++ {
+		ch <- &WorkReq{op: WORK_KICK}
+	}
+	ch <- &WorkReq{op: WORK_NOOP}
+	ch <- &WorkReq{op: WORK_KICK}
+
+	m := &WorkReq{op: WORK_KICK}
+	kicks, next := CoalesceWorkReqs(ch, m, 0)
+	if len(kicks) != 4 || kicks[0] != m {
+		t.Errorf("expected 4 coalesced kicks, got: %d", len(kicks))
+	}
+	if next == nil || next.op != WORK_NOOP {
+		t.Errorf("expected the noop as next, got: %#v", next)
+	}
+
+	// The kick after the noop is left for a later cycle.
+	kicks, next = CoalesceWorkReqs(ch, <-ch, 0)
+	if len(kicks) != 1 || next != nil {
+		t.Errorf("expected 1 kick and no next, got: %d, %#v", len(kicks), next)
+	}
+
+	// With a wait, kicks that arrive soon after are coalesced too.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ch <- &WorkReq{op: WORK_KICK}
+	}()
+	kicks, next = CoalesceWorkReqs(ch, m, 200)
+	if len(kicks) != 2 || next != nil {
+		t.Errorf("expected 2 kicks with wait, got: %d, %#v", len(kicks), next)
+	}
+}